@@ -1,190 +1,900 @@
 package main
 
-import "net"
 import "fmt"
+import "flag"
 import "bufio"
 import "strings"
-import "os"
 import "strconv"
-
-import "github.com/neilalexander/siren/sirenproto"
-import proto "github.com/golang/protobuf/proto"
+import "sort"
+import "sync"
+import "os"
+import "time"
+import "context"
+import "io/ioutil"
+import "path/filepath"
+import "encoding/hex"
+import "encoding/json"
 
 import "github.com/neilalexander/siren"
+import "github.com/neilalexander/siren/client"
 
-func main() {
-	var connectionState int
-	var remotePublicKey [32]byte
-	publicKey, privateKey := siren.NewCryptoKeys()
-	fmt.Println("public key:", *publicKey)
-	fmt.Println("private key:", *privateKey)
+// How long each command is allowed to take. Some commands may need to wait
+// for the server to talk to other servers, so this is fairly generous.
+const commandTimeout = 30 * time.Second
+
+// The number of sent messages that the status command shows.
+const statusMessages = 10
+
+// How long to wait for another device to link this one.
+const linkTimeout = 5 * time.Minute
+
+type cli struct {
+	client   *client.Client
+	keys     client.DeviceKeys
+	keystore *keystore
+	profile  profile
+
+	mutex    sync.Mutex
+	inbox    []*client.Message
+	contacts map[string]*client.DirectoryEntry
+	presence map[string]*client.Presence
+	history  []string
+	sent     []string
+}
+
+type command struct {
+	name  string
+	usage string
+	help  string
+	// The number of arguments that the command takes. If rest is set then
+	// the last argument is the rest of the line, i.e. a message
+	args int
+	rest bool
+	run  func(c *cli, ctx context.Context, args []string) error
+}
+
+var commands []*command
+
+func init() {
+	commands = []*command{
+		{name: "help", usage: "help [command]", help: "Show the available commands, or help for one command", args: 1, run: (*cli).help},
+		{name: "register", usage: "register [uid]", help: "Register a new user with this device and log in as it", args: 1, run: (*cli).register},
+		{name: "login", usage: "login [uid]", help: "Log in as a user whose keys are in the key directory", args: 1, run: (*cli).login},
+		{name: "send", usage: "send <uid> <message>", help: "Send a message to a user", args: 2, rest: true, run: (*cli).send},
+		{name: "inbox", usage: "inbox", help: "Show messages that haven't been read yet, and send read receipts for them", run: (*cli).showInbox},
+		{name: "status", usage: "status [message id]", help: "Show the receipts for the messages that we've sent", args: 1, run: (*cli).status},
+		{name: "lookup", usage: "lookup <uid>", help: "Look up the keys for a user in the directory", args: 1, run: (*cli).lookup},
+		{name: "contacts", usage: "contacts [add|remove <uid>]", help: "List, add or remove contacts", args: 2, run: (*cli).contactsCommand},
+		{name: "devices", usage: "devices [add|revoke <device key> | link <link code>]", help: "List, add, revoke or link the devices for our user", args: 2, run: (*cli).devices},
+		{name: "link", usage: "link [uid]", help: "Wait for another device to link this device to a user, by running \"devices link\" there", args: 1, run: (*cli).link},
+		{name: "group", usage: "group create|members|add|remove|admin|leave|send ...", help: "Create and manage groups, and send messages to them", args: 3, rest: true, run: (*cli).group},
+		{name: "presence", usage: "presence online|away|offline", help: "Share our presence with our contacts, or stop sharing it with offline", args: 1, run: (*cli).setPresence},
+		{name: "typing", usage: "typing <uid>", help: "Let a user know that we're typing a message to them", args: 1, run: (*cli).typing},
+		{name: "ping", usage: "ping", help: "Measure the round trip time to the server", run: (*cli).ping},
+		{name: "history", usage: "history", help: "Show previous commands, which can be repeated with !<number>", run: (*cli).showHistory},
+		{name: "exit", usage: "exit", help: "Close the connection and exit"},
+	}
+}
 
-	conn, err := net.Dial("tcp", "localhost:9989")
+func findCommand(name string) *command {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// Splits the arguments for a command. Arguments are separated by whitespace,
+// except for the last argument of commands that take the rest of the line.
+func splitArgs(line string, cmd *command) []string {
+	var args []string
+	line = strings.TrimSpace(line)
+	for line != "" {
+		if cmd.rest && len(args) == cmd.args-1 {
+			return append(args, line)
+		}
+		end := strings.IndexAny(line, " \t")
+		if end < 0 {
+			return append(args, line)
+		}
+		args = append(args, line[:end])
+		line = strings.TrimSpace(line[end:])
+	}
+	return args
+}
+
+// The profile holds the settings for the client. It can be loaded from a
+// JSON file with -profile, and any flags given on the command line override
+// the values in the profile.
+type profile struct {
+	Server       string
+	UID          string
+	KeyDirectory string
+	DNSServer    string
+}
+
+func loadProfile() profile {
+	var p profile
+	profilePath := flag.String("profile", "", "path to a JSON profile file containing Server, UID, KeyDirectory and DNSServer")
+	server := flag.String("server", "", "address of the server, i.e. \"host:port\" or \"tls://host:port\" (default: discovered from the user ID, or localhost:9989)")
+	uid := flag.String("uid", "", "user ID to log in as")
+	keys := flag.String("keys", "", "directory where keys and sessions are stored (default: ~/.siren)")
+	dns := flag.String("dns", "", "DNS server to use when discovering the server, i.e. \"127.0.0.1:53\"")
+	flag.Parse()
+
+	if *profilePath != "" {
+		data, err := ioutil.ReadFile(*profilePath)
+		if err != nil {
+			fmt.Println("Unable to read profile:", err)
+			os.Exit(1)
+		}
+		if err := json.Unmarshal(data, &p); err != nil {
+			fmt.Println("Unable to parse profile:", err)
+			os.Exit(1)
+		}
+	}
+	for _, f := range []struct {
+		flag  *string
+		value *string
+	}{{server, &p.Server}, {uid, &p.UID}, {keys, &p.KeyDirectory}, {dns, &p.DNSServer}} {
+		if *f.flag != "" {
+			*f.value = *f.flag
+		}
+	}
+	if p.KeyDirectory == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			fmt.Println("Unable to find home directory, use -keys instead:", err)
+			os.Exit(1)
+		}
+		p.KeyDirectory = filepath.Join(home, ".siren")
+	}
+	if p.UID != "" && !validUID(p.UID) {
+		fmt.Println("Invalid user ID", p.UID)
+		os.Exit(1)
+	}
+	return p
+}
+
+// Returns the addresses to try connecting to. If no server was given then we
+// look up the home server for the user's domain, in the same way that
+// servers find each other.
+func (p profile) addresses() []string {
+	if p.Server != "" {
+		return []string{p.Server}
+	}
+	if p.UID != "" {
+		var resolver siren.Resolver
+		if p.DNSServer != "" {
+			resolver = siren.NewDNSResolver(p.DNSServer)
+		}
+		domain := p.UID[strings.LastIndex(p.UID, "@")+1:]
+		addresses, err := client.Discover(domain, resolver)
+		if err == nil {
+			return addresses
+		}
+		fmt.Println("Unable to discover server for", domain+":", err)
+	}
+	return []string{"localhost:9989"}
+}
+
+func main() {
+	p := loadProfile()
+	if err := os.MkdirAll(p.KeyDirectory, 0700); err != nil {
+		fmt.Println("Unable to create key directory:", err)
+		os.Exit(1)
+	}
+	ks, err := openKeystore(p.KeyDirectory)
 	if err != nil {
-		panic(err)
-	}
-	defer conn.Close()
-
-	sendPacket(conn, &sirenproto.Payload{
-		Contents: &sirenproto.Payload_HelloIAm{
-			HelloIAm: &sirenproto.HelloIAm{
-				ConnectionType: sirenproto.HelloIAm_CLIENT_TO_SERVER,
-				PublicKey:      publicKey[:],
-			},
-		},
-	})
-
-	go func() {
-		for {
-			buf := make([]byte, 1024)
-			buflen, err := conn.Read(buf)
-
-			if err != nil {
-				fmt.Println("Error reading packet from server:", err)
-				return
-			}
+		fmt.Println("Unable to open keystore:", err)
+		os.Exit(1)
+	}
+	keys, err := ks.deviceKeys()
+	if err != nil {
+		fmt.Println("Unable to load device keys:", err)
+		os.Exit(1)
+	}
+	store, err := client.NewFileSessionStore(filepath.Join(p.KeyDirectory, "sessions"), keys)
+	if err != nil {
+		fmt.Println("Unable to open session store:", err)
+		os.Exit(1)
+	}
 
-			packetin := &sirenproto.Packet{}
-			if err := proto.Unmarshal(buf[:buflen], packetin); err != nil {
-				fmt.Println("Invalid packet received from server:", err)
-				continue
-			}
+	var cl *client.Client
+	for _, address := range p.addresses() {
+		ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+		cl, err = client.Dial(ctx, address, keys)
+		cancel()
+		if err == nil {
+			fmt.Println("Connected to", address)
+			break
+		}
+		fmt.Println("Unable to connect to", address+":", err)
+	}
+	if cl == nil {
+		os.Exit(1)
+	}
+	defer cl.Close()
+	cl.SetSessionStore(store)
+	fmt.Println("Device key:", hex.EncodeToString(keys.PublicKey[:]))
 
-			// Prepare our container!
-			var p *sirenproto.Payload
-
-			// If the packet is encrypted, attempt to decrypt it
-			switch obj := packetin.PayloadType.(type) {
-			case *sirenproto.Packet_EncryptedPayload:
-				p, err = siren.DecryptPayload(remotePublicKey, *privateKey, obj.EncryptedPayload)
-				if err != nil {
-					fmt.Println(err)
-					continue
-				}
-			case *sirenproto.Packet_Payload:
-				p = obj.Payload
-			}
+	c := &cli{
+		client:   cl,
+		keys:     keys,
+		keystore: ks,
+		profile:  p,
+		contacts: make(map[string]*client.DirectoryEntry),
+		presence: make(map[string]*client.Presence),
+	}
+	go c.receive()
+	go c.receiveDeviceChanges()
+	go c.receivePresence()
+	go c.receiveTyping()
 
-			switch obj := p.Contents.(type) {
-			case *sirenproto.Payload_HelloIAm:
-				if connectionState < siren.STATE_AUTHENTICATED {
-					copy(remotePublicKey[:32], obj.HelloIAm.PublicKey[:32])
-					fmt.Println("Authenticating session")
-				}
-			case *sirenproto.Payload_Ping:
-				fmt.Println("server->client: ping", obj.Ping.Sequence)
-				if connectionState < siren.STATE_AUTHENTICATED {
-					connectionState = siren.STATE_AUTHENTICATED
-					fmt.Println("Authenticated session successfully")
-				}
-				payloadout := &sirenproto.Payload{
-					Contents: &sirenproto.Payload_Pong{
-						Pong: &sirenproto.Pong{
-							Sequence: obj.Ping.Sequence,
-						},
-					},
-				}
-				enc, err := siren.EncryptPayload(remotePublicKey, *privateKey, payloadout)
-				if err == nil {
-					sendEncryptedPacket(conn, enc)
-				}
-				fmt.Println("client->server: pong", obj.Ping.Sequence)
-			default:
-				if connectionState < siren.STATE_AUTHENTICATED {
-					continue
-				}
-				fmt.Println("server->client:", p)
+	// Log in straight away if we were given a user ID that we have keys for
+	if p.UID != "" {
+		if _, err := ks.userKeys(p.UID); err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+			if err := c.login(ctx, nil); err != nil {
+				fmt.Println("Error:", err)
 			}
+			cancel()
+		} else {
+			fmt.Println("No user keys for", p.UID, "- use \"register\" to register it")
 		}
-	}()
+	}
+	fmt.Println("Type \"help\" for a list of commands")
 
-loop:
+	scanner := bufio.NewScanner(os.Stdin)
 	for {
-		reader := bufio.NewReader(os.Stdin)
-		input, _ := reader.ReadString('\n')
-		input = strings.Trim(input, " \r\n\t")
-		inputtokens := strings.Split(input, " ")
-
-		var payloadout *sirenproto.Payload
-
-		switch inputtokens[0] {
-		case "lookup":
-			{
-				payloadout = &sirenproto.Payload{
-					Contents: &sirenproto.Payload_DirectoryRequest{
-						DirectoryRequest: &sirenproto.DirectoryRequest{
-							UID: inputtokens[1],
-						},
-					},
-				}
-			}
-		case "ping":
-			{
-				var seq int64
-				if len(inputtokens) > 1 {
-					seq, _ = strconv.ParseInt(inputtokens[1], 10, 32)
-				}
-				payloadout = &sirenproto.Payload{
-					Contents: &sirenproto.Payload_Ping{
-						Ping: &sirenproto.Ping{
-							Sequence: seq,
-						},
-					},
-				}
-			}
+		fmt.Print("> ")
+		if !scanner.Scan() {
+			break
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
 
-		case "exit":
-			{
-				fmt.Println("Exiting")
-				break loop
+		// Lines starting with ! repeat a command from the history
+		if strings.HasPrefix(line, "!") {
+			n, err := strconv.Atoi(line[1:])
+			c.mutex.Lock()
+			if err != nil || n < 1 || n > len(c.history) {
+				c.mutex.Unlock()
+				fmt.Println("No such command in history:", line)
+				continue
 			}
+			line = c.history[n-1]
+			c.mutex.Unlock()
+			fmt.Println(line)
 		}
+		c.mutex.Lock()
+		c.history = append(c.history, line)
+		c.mutex.Unlock()
 
-		if connectionState < siren.STATE_AUTHENTICATED {
-			sendPacket(conn, payloadout)
-		} else {
-			enc, err := siren.EncryptPayload(remotePublicKey, *privateKey, payloadout)
-			if err == nil {
-				sendEncryptedPacket(conn, enc)
-			}
+		name := line
+		rest := ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			name, rest = line[:i], line[i+1:]
+		}
+		cmd := findCommand(name)
+		if cmd == nil {
+			fmt.Println("Unknown command:", name, "- type \"help\" for a list of commands")
+			continue
+		}
+		if cmd.name == "exit" {
+			break
+		}
+		args := splitArgs(rest, cmd)
+		if len(args) > cmd.args {
+			fmt.Println("Usage:", cmd.usage)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+		if err := cmd.run(c, ctx, args); err != nil {
+			fmt.Println("Error:", err)
+		}
+		cancel()
+
+		select {
+		case <-cl.Done():
+			fmt.Println("Disconnected from server:", cl.Err())
+			return
+		default:
+		}
+	}
+	fmt.Println("Exiting")
+}
+
+// Keys are kept in an encrypted keystore in the key directory, which is
+// created the first time that the key directory is used. The device keys and
+// the keys for each user are stored under their own names.
+const deviceKeyName = "device"
+
+func userKeyName(uid string) string {
+	return "user:" + uid
+}
+
+type keystore struct {
+	*siren.Keystore
+	path       string
+	passphrase []byte
+}
+
+func openKeystore(dir string) (*keystore, error) {
+	k := &keystore{
+		Keystore: &siren.Keystore{},
+		path:     filepath.Join(dir, "keystore.json"),
+	}
+	_, err := os.Stat(k.path)
+	exists := !os.IsNotExist(err)
+	prompt := "New keystore passphrase: "
+	if exists {
+		prompt = "Keystore passphrase: "
+	}
+	if k.passphrase, err = siren.ReadPassphrase(prompt); err != nil {
+		return nil, err
+	}
+	if exists {
+		if k.Keystore, err = siren.LoadKeystore(k.path, k.passphrase); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+func (k *keystore) save() error {
+	return k.Save(k.path, k.passphrase)
+}
+
+// Returns the keys for this device, generating them if this is the first
+// time that the keystore has been used.
+func (k *keystore) deviceKeys() (client.DeviceKeys, error) {
+	entry, err := k.Get(deviceKeyName)
+	if err == siren.ErrKeyNotFound {
+		if entry, err = k.Create(deviceKeyName); err == nil {
+			err = k.save()
+		}
+	}
+	if err != nil {
+		return client.DeviceKeys{}, err
+	}
+	return client.DeviceKeys{
+		PublicKey:  entry.CryptoPublicKey,
+		PrivateKey: entry.CryptoPrivateKey,
+	}, nil
+}
+
+func (k *keystore) userKeys(uid string) (client.UserKeys, error) {
+	entry, err := k.Get(userKeyName(uid))
+	if err != nil {
+		return client.UserKeys{}, err
+	}
+	return client.UserKeys{
+		PublicKey:  entry.SignaturePublicKey,
+		PrivateKey: entry.SignaturePrivateKey,
+	}, nil
+}
+
+// Receives messages in the background, keeping them in the inbox until they
+// are read.
+func (c *cli) receive() {
+	for message := range c.client.Messages() {
+		c.mutex.Lock()
+		c.inbox = append(c.inbox, message)
+		unread := len(c.inbox)
+		c.mutex.Unlock()
+		from := message.Source
+		if message.Group != "" {
+			from += " in group " + message.Group
+		}
+		fmt.Printf("\n* New message from %s (%d unread, type \"inbox\" to read)\n> ", from, unread)
+	}
+	fmt.Println("\nDisconnected from server:", c.client.Err())
+}
+
+// Lets the user know when the devices for one of their contacts change, as
+// they may want to check that the change was expected.
+func (c *cli) receiveDeviceChanges() {
+	for change := range c.client.DeviceChanges() {
+		action := "added"
+		if change.Revoked {
+			action = "revoked"
+		}
+		fmt.Printf("\n* %s %s device %s\n> ", change.UID, action, fingerprint(change.DeviceKey))
+	}
+}
+
+func (c *cli) receivePresence() {
+	for presence := range c.client.PresenceUpdates() {
+		c.mutex.Lock()
+		previous := c.presence[presence.UID]
+		c.presence[presence.UID] = presence
+		c.mutex.Unlock()
+		if previous == nil || previous.State != presence.State {
+			fmt.Printf("\n* %s is %s\n> ", presence.UID, renderPresence(presence))
+		}
+	}
+}
+
+func (c *cli) receiveTyping() {
+	for typing := range c.client.TypingUpdates() {
+		if typing.Typing {
+			fmt.Printf("\n* %s is typing...\n> ", typing.UID)
+		}
+	}
+}
+
+func renderPresence(presence *client.Presence) string {
+	switch {
+	case presence == nil:
+		return ""
+	case presence.State == client.PresenceOffline && !presence.LastSeen.IsZero():
+		return "offline, last seen " + presence.LastSeen.Format("2006-01-02 15:04:05")
+	default:
+		return presence.State.String()
+	}
+}
+
+func render(message *client.Message) string {
+	header := message.Source
+	if message.Group != "" {
+		header += " to group " + message.Group
+	} else if message.Destination != message.Source && message.Destination != "" {
+		header += " to " + message.Destination
+	}
+	return fmt.Sprintf("[%s] %s:\n    %s",
+		message.Received.Format("2006-01-02 15:04:05"), header,
+		strings.Replace(string(message.Contents), "\n", "\n    ", -1))
+}
+
+func fingerprint(key []byte) string {
+	if len(key) == 0 {
+		return "(none)"
+	}
+	return hex.EncodeToString(key)
+}
+
+func parseDeviceKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(s)
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("Device key must be 64 hexadecimal characters")
+	}
+	return key, nil
+}
+
+func validUID(uid string) bool {
+	parts := strings.Split(uid, "@")
+	return len(parts) == 2 && parts[0] != "" && parts[1] != ""
+}
+
+func usage(name string) error {
+	return fmt.Errorf("Usage: %s", findCommand(name).usage)
+}
+
+func (c *cli) help(ctx context.Context, args []string) error {
+	if len(args) == 1 {
+		cmd := findCommand(args[0])
+		if cmd == nil {
+			return fmt.Errorf("Unknown command %s", args[0])
 		}
+		fmt.Println(cmd.usage)
+		fmt.Println("   ", cmd.help)
+		return nil
+	}
+	for _, cmd := range commands {
+		fmt.Printf("  %-52s %s\n", cmd.usage, cmd.help)
+	}
+	return nil
+}
+
+// Returns the user ID given as an argument, or the one from the profile if
+// there wasn't one.
+func (c *cli) uidArgument(args []string) (string, bool) {
+	uid := c.profile.UID
+	if len(args) == 1 {
+		uid = args[0]
+	}
+	return uid, validUID(uid)
+}
+
+func (c *cli) register(ctx context.Context, args []string) error {
+	uid, ok := c.uidArgument(args)
+	if !ok {
+		return usage("register")
+	}
+	if c.client.UID() != "" {
+		return fmt.Errorf("Already logged in as %s", c.client.UID())
+	}
+	if _, err := c.keystore.userKeys(uid); err == nil {
+		return fmt.Errorf("We already have keys for %s, use \"login\" instead", uid)
+	}
+
+	// The new keys are only saved once the server has accepted them
+	if _, err := c.keystore.Create(userKeyName(uid)); err != nil {
+		return err
+	}
+	user, _ := c.keystore.userKeys(uid)
+	if err := c.client.Register(ctx, uid, user); err != nil {
+		c.keystore.Delete(userKeyName(uid))
+		return err
+	}
+	if err := c.keystore.save(); err != nil {
+		return err
+	}
+	fmt.Println("Registered", uid, "with user signing key", fingerprint(user.PublicKey[:]))
+	return c.login(ctx, []string{uid})
+}
+
+func (c *cli) login(ctx context.Context, args []string) error {
+	uid, ok := c.uidArgument(args)
+	if !ok {
+		return usage("login")
+	}
+	if c.client.UID() != "" {
+		return fmt.Errorf("Already logged in as %s", c.client.UID())
+	}
+	user, err := c.keystore.userKeys(uid)
+	if err == siren.ErrKeyNotFound {
+		return fmt.Errorf("No user keys for %s in %s", uid, c.keystore.path)
+	} else if err != nil {
+		return err
+	}
+	if err := c.client.Login(ctx, uid, user); err != nil {
+		return err
+	}
+	fmt.Println("Logged in as", uid)
+	return nil
+}
+
+func (c *cli) send(ctx context.Context, args []string) error {
+	if len(args) != 2 || !validUID(args[0]) {
+		return usage("send")
+	}
+	id, err := c.client.Send(ctx, args[0], []byte(args[1]))
+	if err != nil {
+		return err
+	}
+	c.addSent(id)
+	fmt.Println("Sent message", id, "to", args[0])
+	return nil
+}
+
+// Remembers the IDs of the messages that we've sent, so that the status
+// command can show their receipts.
+func (c *cli) addSent(id string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.sent = append(c.sent, id)
+	if len(c.sent) > statusMessages {
+		c.sent = c.sent[len(c.sent)-statusMessages:]
+	}
+}
+
+func (c *cli) status(ctx context.Context, args []string) error {
+	ids := args
+	if len(ids) == 0 {
+		c.mutex.Lock()
+		ids = append(ids, c.sent...)
+		c.mutex.Unlock()
+	}
+	if len(ids) == 0 {
+		fmt.Println("No sent messages")
+		return nil
+	}
+	for _, id := range ids {
+		status, ok := c.client.Status(id)
+		if !ok {
+			fmt.Println("  ", id, "unknown")
+			continue
+		}
+		state := "sending"
+		switch {
+		case len(status.Read) > 0:
+			state = fmt.Sprintf("read by %d", len(status.Read))
+		case len(status.Delivered) > 0:
+			state = fmt.Sprintf("delivered to %d devices", len(status.Delivered))
+		case !status.Accepted.IsZero():
+			state = "accepted by server"
+		}
+		fmt.Printf("   %s %s to %s: %s\n", id, status.Sent.Format("15:04:05"), status.Destination, state)
+	}
+	return nil
+}
+
+func (c *cli) showInbox(ctx context.Context, args []string) error {
+	c.mutex.Lock()
+	inbox := c.inbox
+	c.inbox = nil
+	c.mutex.Unlock()
+	if len(inbox) == 0 {
+		fmt.Println("No unread messages")
+		return nil
+	}
+	for _, message := range inbox {
+		fmt.Println(render(message))
+	}
+	// Now that the messages have been shown, let the senders know that
+	// they've been read
+	return c.client.MarkRead(ctx, inbox...)
+}
+
+func (c *cli) lookup(ctx context.Context, args []string) error {
+	if len(args) != 1 || !validUID(args[0]) {
+		return usage("lookup")
 	}
+	entry, err := c.client.Lookup(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if len(entry.UserSigningKey) == 0 {
+		return fmt.Errorf("%s was not found in the directory", args[0])
+	}
+	fmt.Println(entry.UID)
+	fmt.Println("    User signing key:", fingerprint(entry.UserSigningKey))
+	for _, k := range entry.DeviceEncryptionKeys {
+		fmt.Println("    Device:", fingerprint(k))
+	}
+	return nil
 }
 
-func sendPacket(conn net.Conn, payload *sirenproto.Payload) {
-	packetout := &sirenproto.Packet{
-		Version: 1,
-		PayloadType: &sirenproto.Packet_Payload{
-			Payload: payload,
-		},
+func (c *cli) contactsCommand(ctx context.Context, args []string) error {
+	switch {
+	case len(args) == 0:
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if len(c.contacts) == 0 {
+			fmt.Println("No contacts")
+			return nil
+		}
+		var uids []string
+		for uid := range c.contacts {
+			uids = append(uids, uid)
+		}
+		sort.Strings(uids)
+		for _, uid := range uids {
+			fmt.Printf("  %-32s %s %s\n", uid, fingerprint(c.contacts[uid].UserSigningKey), renderPresence(c.presence[uid]))
+		}
+		return nil
+	case len(args) == 2 && args[0] == "add" && validUID(args[1]):
+		// Remember the user signing key for the contact, so that the user can
+		// compare it with the contact out of band
+		entry, err := c.client.Lookup(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		if len(entry.UserSigningKey) == 0 {
+			return fmt.Errorf("%s was not found in the directory", args[1])
+		}
+		c.mutex.Lock()
+		c.contacts[args[1]] = entry
+		c.mutex.Unlock()
+		fmt.Println("Added contact", args[1], "with user signing key", fingerprint(entry.UserSigningKey))
+
+		// Watch the contact's presence, which we'll only see if they share it
+		return c.client.Subscribe(ctx, args[1])
+	case len(args) == 2 && args[0] == "remove":
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if _, ok := c.contacts[args[1]]; !ok {
+			return fmt.Errorf("%s is not a contact", args[1])
+		}
+		delete(c.contacts, args[1])
+		delete(c.presence, args[1])
+		fmt.Println("Removed contact", args[1])
+		return c.client.Unsubscribe(ctx, args[1])
+	default:
+		return usage("contacts")
 	}
+}
 
-	if packetout != nil {
-		out, err := proto.Marshal(packetout)
+func (c *cli) devices(ctx context.Context, args []string) error {
+	uid := c.client.UID()
+	if uid == "" {
+		return client.ErrNotLoggedIn
+	}
+	switch {
+	case len(args) == 0:
+		entry, err := c.client.Lookup(ctx, uid)
+		if err != nil {
+			return err
+		}
+		for _, k := range entry.DeviceEncryptionKeys {
+			if string(k) == string(c.keys.PublicKey[:]) {
+				fmt.Println("  ", fingerprint(k), "(this device)")
+			} else {
+				fmt.Println("  ", fingerprint(k))
+			}
+		}
+		return nil
+	case len(args) == 2 && args[0] == "add":
+		key, err := parseDeviceKey(args[1])
+		if err != nil {
+			return err
+		}
+		if err := c.client.AddDevice(ctx, key, c.contactUIDs()...); err != nil {
+			return err
+		}
+		fmt.Println("Added device", args[1])
+		return nil
+	case len(args) == 2 && args[0] == "revoke":
+		key, err := parseDeviceKey(args[1])
 		if err != nil {
-			fmt.Println("Failed to encode packet:", err)
+			return err
 		}
-		if _, err = conn.Write(out); err != nil {
-			fmt.Println("Failed to send packet:", err)
+		if err := c.client.RevokeDevice(ctx, key, c.contactUIDs()...); err != nil {
+			return err
 		}
+		fmt.Println("Revoked device", args[1])
+		return nil
+	case len(args) == 2 && args[0] == "link":
+		if err := c.client.LinkDevice(ctx, args[1], c.contactUIDs()...); err != nil {
+			return err
+		}
+		fmt.Println("Linked device", args[1])
+		return nil
+	default:
+		return usage("devices")
 	}
 }
 
-func sendEncryptedPacket(conn net.Conn, payload *sirenproto.EncryptedPayload) {
-	packetout := &sirenproto.Packet{
-		Version: 1,
-		PayloadType: &sirenproto.Packet_EncryptedPayload{
-			EncryptedPayload: payload,
-		},
+func (c *cli) setPresence(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return usage("presence")
+	}
+	states := map[string]client.PresenceState{
+		"online":  client.PresenceOnline,
+		"away":    client.PresenceAway,
+		"offline": client.PresenceOffline,
 	}
+	state, ok := states[args[0]]
+	if !ok {
+		return usage("presence")
+	}
+	if err := c.client.SetPresence(ctx, state); err != nil {
+		return err
+	}
+	fmt.Println("Presence set to", state)
+	return nil
+}
 
-	if packetout != nil {
-		out, err := proto.Marshal(packetout)
+func (c *cli) typing(ctx context.Context, args []string) error {
+	if len(args) != 1 || !validUID(args[0]) {
+		return usage("typing")
+	}
+	return c.client.SetTyping(args[0], true)
+}
+
+// Returns the user IDs of our contacts, who are told when our devices change.
+func (c *cli) contactUIDs() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	uids := make([]string, 0, len(c.contacts))
+	for uid := range c.contacts {
+		uids = append(uids, uid)
+	}
+	return uids
+}
+
+// Shows the link code for this device and waits for one of the user's other
+// devices to link it. This can take a while, as the code has to be passed
+// to the other device by hand, so it doesn't use the usual command timeout.
+func (c *cli) link(_ context.Context, args []string) error {
+	uid, ok := c.uidArgument(args)
+	if !ok {
+		return usage("link")
+	}
+	if c.client.UID() != "" {
+		return fmt.Errorf("Already logged in as %s", c.client.UID())
+	}
+	if _, err := c.keystore.userKeys(uid); err == nil {
+		return fmt.Errorf("We already have keys for %s, use \"login\" instead", uid)
+	}
+	fmt.Println("Run this command on one of the existing devices for", uid+":")
+	fmt.Println("    devices link", client.LinkCode(c.keys))
+	fmt.Println("Waiting for up to", linkTimeout, "for the device to be linked...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), linkTimeout)
+	defer cancel()
+	user, err := c.client.WaitForLink(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if err := c.keystore.Add(&siren.KeystoreEntry{
+		Name:                userKeyName(uid),
+		Created:             time.Now().UTC(),
+		SignaturePublicKey:  user.PublicKey,
+		SignaturePrivateKey: user.PrivateKey,
+	}); err != nil {
+		return err
+	}
+	if err := c.keystore.save(); err != nil {
+		return err
+	}
+	fmt.Println("Linked to", uid, "and logged in")
+	return nil
+}
+
+func (c *cli) group(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return usage("group")
+	}
+	switch {
+	case args[0] == "create" && len(args) == 1:
+		gid, err := c.client.CreateGroup(ctx)
 		if err != nil {
-			fmt.Println("Failed to encode packet:", err)
+			return err
 		}
-		if _, err = conn.Write(out); err != nil {
-			fmt.Println("Failed to send packet:", err)
+		fmt.Println("Created group", gid)
+	case args[0] == "members" && len(args) == 2:
+		group, err := c.client.Group(ctx, args[1])
+		if err != nil {
+			return err
 		}
+		for _, m := range group.Members {
+			if m.Admin {
+				fmt.Println("  ", m.UID, "(admin)")
+			} else {
+				fmt.Println("  ", m.UID)
+			}
+		}
+	case args[0] == "add" && len(args) == 3 && validUID(args[2]):
+		if err := c.client.AddGroupMember(ctx, args[1], args[2], false); err != nil {
+			return err
+		}
+		fmt.Println("Added", args[2], "to group", args[1])
+	case args[0] == "remove" && len(args) == 3:
+		if err := c.client.RemoveGroupMember(ctx, args[1], args[2]); err != nil {
+			return err
+		}
+		fmt.Println("Removed", args[2], "from group", args[1])
+	case args[0] == "admin" && len(args) == 3:
+		if err := c.client.SetGroupAdmin(ctx, args[1], args[2], true); err != nil {
+			return err
+		}
+		fmt.Println("Made", args[2], "an admin of group", args[1])
+	case args[0] == "leave" && len(args) == 2:
+		if err := c.client.LeaveGroup(ctx, args[1]); err != nil {
+			return err
+		}
+		fmt.Println("Left group", args[1])
+	case args[0] == "send" && len(args) == 3:
+		id, err := c.client.SendGroup(ctx, args[1], []byte(args[2]))
+		if err != nil {
+			return err
+		}
+		c.addSent(id)
+		fmt.Println("Sent message", id, "to group", args[1])
+	default:
+		fmt.Println("Usage:")
+		fmt.Println("  group create")
+		fmt.Println("  group members <gid>")
+		fmt.Println("  group add <gid> <uid>")
+		fmt.Println("  group remove <gid> <uid>")
+		fmt.Println("  group admin <gid> <uid>")
+		fmt.Println("  group leave <gid>")
+		fmt.Println("  group send <gid> <message>")
+	}
+	return nil
+}
+
+func (c *cli) ping(ctx context.Context, args []string) error {
+	rtt, err := c.client.Ping(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Pong from server in", rtt)
+	return nil
+}
+
+func (c *cli) showHistory(ctx context.Context, args []string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i, line := range c.history {
+		fmt.Printf("%5d  %s\n", i+1, line)
 	}
+	return nil
 }
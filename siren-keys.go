@@ -0,0 +1,168 @@
+package main
+
+import "fmt"
+import "flag"
+import "os"
+import "io/ioutil"
+import "path/filepath"
+import "encoding/hex"
+
+import "github.com/neilalexander/siren"
+
+const usageText = `Usage: siren-keys [-keystore path] <command> [arguments]
+
+Commands:
+  create <name>          Generate new keys with the given name
+  list                   List the keys in the keystore
+  rotate <name>          Replace the keys with the given name, keeping the old ones
+  delete <name>          Remove the keys with the given name, including old ones
+  export <name> <file>   Export the keys with the given name to a file
+  import <file>          Import keys that were exported with export
+
+The keystore passphrase is read from the terminal, or from the
+SIREN_PASSPHRASE environment variable if it is set. The keystore is
+created if it doesn't exist yet.
+`
+
+func main() {
+	path := flag.String("keystore", "", "path to the keystore (default: ~/.siren/keystore.json)")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usageText)
+		fmt.Fprintln(os.Stderr, "\nFlags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	arguments := map[string]int{"create": 1, "list": 0, "rotate": 1, "delete": 1, "export": 2, "import": 1}
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if n, ok := arguments[args[0]]; !ok || len(args)-1 != n {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if *path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			fail("Unable to find home directory, use -keystore instead:", err)
+		}
+		*path = filepath.Join(home, ".siren", "keystore.json")
+	}
+
+	// Only create and import make sense on a keystore that doesn't exist yet
+	_, err := os.Stat(*path)
+	exists := !os.IsNotExist(err)
+	if !exists && args[0] != "create" && args[0] != "import" {
+		fail("Keystore", *path, "does not exist")
+	}
+	prompt := "Keystore passphrase: "
+	if !exists {
+		prompt = "New keystore passphrase: "
+	}
+	passphrase, err := siren.ReadPassphrase(prompt)
+	if err != nil {
+		fail("Unable to read passphrase:", err)
+	}
+	keystore := &siren.Keystore{}
+	if exists {
+		if keystore, err = siren.LoadKeystore(*path, passphrase); err != nil {
+			fail("Unable to load keystore:", err)
+		}
+	}
+
+	switch args[0] {
+	case "create":
+		entry, err := keystore.Create(args[1])
+		if err != nil {
+			fail("Unable to create keys:", err)
+		}
+		save(keystore, *path, passphrase)
+		fmt.Println("Created keys", entry.Name)
+		show(entry)
+
+	case "list":
+		for _, entry := range keystore.List() {
+			show(entry)
+		}
+
+	case "rotate":
+		entry, err := keystore.Rotate(args[1])
+		if err != nil {
+			fail("Unable to rotate keys:", err)
+		}
+		save(keystore, *path, passphrase)
+		fmt.Println("Rotated keys", entry.Name)
+		show(entry)
+
+	case "delete":
+		if err := keystore.Delete(args[1]); err != nil {
+			fail("Unable to delete keys:", err)
+		}
+		save(keystore, *path, passphrase)
+		fmt.Println("Deleted keys", args[1])
+
+	case "export":
+		// Exported keys are protected with their own passphrase, so that the
+		// keystore passphrase doesn't need to be shared
+		exportPassphrase, err := siren.ReadPassphrase("Export passphrase: ")
+		if err != nil {
+			fail("Unable to read passphrase:", err)
+		}
+		data, err := keystore.Export(args[1], exportPassphrase)
+		if err != nil {
+			fail("Unable to export keys:", err)
+		}
+		if err := ioutil.WriteFile(args[2], data, 0600); err != nil {
+			fail("Unable to write export:", err)
+		}
+		fmt.Println("Exported keys", args[1], "to", args[2])
+
+	case "import":
+		data, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			fail("Unable to read export:", err)
+		}
+		importPassphrase, err := siren.ReadPassphrase("Export passphrase: ")
+		if err != nil {
+			fail("Unable to read passphrase:", err)
+		}
+		entries, err := keystore.Import(data, importPassphrase)
+		if err != nil {
+			fail("Unable to import keys:", err)
+		}
+		save(keystore, *path, passphrase)
+		for _, entry := range entries {
+			fmt.Println("Imported keys", entry.Name)
+			show(entry)
+		}
+	}
+}
+
+func save(keystore *siren.Keystore, path string, passphrase []byte) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		fail("Unable to create keystore directory:", err)
+	}
+	if err := keystore.Save(path, passphrase); err != nil {
+		fail("Unable to save keystore:", err)
+	}
+}
+
+// Shows the public keys for an entry. The private keys are never shown, the
+// only way to get them out of the keystore is with export.
+func show(entry *siren.KeystoreEntry) {
+	status := "current"
+	if entry.IsRetired() {
+		status = "retired " + entry.Retired.Format("2006-01-02 15:04:05")
+	}
+	fmt.Printf("%s (created %s, %s)\n", entry.Name, entry.Created.Format("2006-01-02 15:04:05"), status)
+	fmt.Println("  Curve25519 public key:", hex.EncodeToString(entry.CryptoPublicKey[:]))
+	fmt.Println("  Ed25519 public key:   ", hex.EncodeToString(entry.SignaturePublicKey[:]))
+}
+
+func fail(a ...interface{}) {
+	fmt.Fprintln(os.Stderr, a...)
+	os.Exit(1)
+}
@@ -1,8 +1,95 @@
 package main
 
+import "fmt"
+import "flag"
+import "os"
+import "os/signal"
+import "syscall"
+
 import "github.com/neilalexander/siren"
 
 func main() {
+	configFile := flag.String("config", "", "path to a JSON configuration file, which is reloaded on SIGHUP")
+	keystore := flag.String("keystore", "", "path to a keystore containing the server keys (default: generate new keys)")
+	keyName := flag.String("key", "server", "name of the server keys in the keystore")
+	logLevel := flag.String("loglevel", "info", "minimum level to log: debug, info, warning or error")
+	logJSON := flag.Bool("logjson", false, "log in JSON format instead of text")
+	admin := flag.String("admin", "", "address to serve the admin API on, i.e. 127.0.0.1:9991 or unix:///var/run/siren.sock (default: disabled)")
+	metrics := flag.String("metrics", "", "address to serve Prometheus metrics on, i.e. 127.0.0.1:9990 (default: disabled)")
+	flag.Parse()
+
+	config := siren.DefaultServerConfig()
+
+	level, err := siren.ParseLogLevel(*logLevel)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// The loggers log everything that they are given, and the server drops
+	// anything below the log level, so that the level can be reloaded
+	config.LogLevel = level
+	if *logJSON {
+		config.Logger = siren.NewJSONLogger(os.Stdout, siren.LogDebug)
+	} else {
+		config.Logger = siren.NewTextLogger(os.Stdout, siren.LogDebug)
+	}
+	config.MetricsAddress = *metrics
+	config.AdminAddress = *admin
+
+	// Use the keys from the keystore if we were given one, otherwise the
+	// server will have new keys every time it starts
+	if *keystore != "" {
+		passphrase, err := siren.ReadPassphrase("Keystore passphrase: ")
+		if err != nil {
+			fmt.Println("Unable to read passphrase:", err)
+			os.Exit(1)
+		}
+		ks, err := siren.LoadKeystore(*keystore, passphrase)
+		if err != nil {
+			fmt.Println("Unable to load keystore:", err)
+			os.Exit(1)
+		}
+		entry, err := ks.Get(*keyName)
+		if err != nil {
+			fmt.Println("Unable to find key", *keyName+":", err)
+			fmt.Println("Create it with: siren-keys -keystore", *keystore, "create", *keyName)
+			os.Exit(1)
+		}
+		config.PublicKey = entry.CryptoPublicKey
+		config.PrivateKey = entry.CryptoPrivateKey
+	}
+
+	// Settings in the configuration file override the flags. The file is
+	// loaded on top of the same base every time, so that removing a setting
+	// from the file puts it back to the default
+	if *configFile != "" {
+		base := config
+		base.ConfigLoader = func() (siren.ServerConfig, error) {
+			return siren.LoadServerConfig(*configFile, base)
+		}
+		if config, err = base.ConfigLoader(); err != nil {
+			fmt.Println("Unable to load configuration:", err)
+			os.Exit(1)
+		}
+	}
+
 	var server siren.Server
-	server.Start(siren.DefaultServerConfig())
+
+	// Reload the configuration file when we receive SIGHUP
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			changes, err := server.Reload()
+			if err != nil {
+				fmt.Println("Unable to reload configuration:", err)
+				continue
+			}
+			if len(changes.RestartRequired) > 0 {
+				fmt.Println("Restart the server to apply:", changes.RestartRequired)
+			}
+		}
+	}()
+
+	server.Start(config)
 }
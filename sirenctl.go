@@ -0,0 +1,177 @@
+package main
+
+import "fmt"
+import "flag"
+import "os"
+import "bufio"
+import "strconv"
+import "strings"
+
+import "github.com/neilalexander/siren"
+
+const usageText = `Usage: sirenctl [-admin address] <command> [arguments]
+
+Commands:
+  connections                          List open connections
+  disconnect <id|uid>                  Close a connection, or all sessions for a user
+  federations                          List federation connections
+  users add <uid> <usk> <device-key>   Add a local user with the given hex keys
+  users remove <uid>                   Remove a local user and close their sessions
+  devices add <uid> <device-key>       Add a device to a local user
+  devices revoke <uid> <device-key>    Revoke a device from a local user
+  flush                                Flush the external directory cache
+  reload                               Reload the server configuration file
+  lists <whitelist> <blacklist>        Replace the federation lists from files
+                                       containing one domain per line, or "-"
+                                       for an empty list
+
+The server must be started with the -admin flag set to the same address.
+`
+
+func main() {
+	address := flag.String("admin", "127.0.0.1:9991", "address of the server admin API, i.e. 127.0.0.1:9991 or unix:///var/run/siren.sock")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usageText)
+		fmt.Fprintln(os.Stderr, "\nFlags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	arguments := map[string]int{
+		"connections": 0, "disconnect": 1, "federations": 0, "flush": 0, "lists": 2, "reload": 0,
+		"users add": 3, "users remove": 1, "devices add": 2, "devices revoke": 2,
+	}
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	command := args[0]
+	if (command == "users" || command == "devices") && len(args) > 1 {
+		command += " " + args[1]
+		args = args[1:]
+	}
+	if n, ok := arguments[command]; !ok || len(args)-1 != n {
+		flag.Usage()
+		os.Exit(1)
+	}
+	args = args[1:]
+
+	admin := siren.NewAdminClient(*address)
+	var result *siren.AdminResult
+	var err error
+
+	switch command {
+	case "connections":
+		connections, err := admin.Connections()
+		if err != nil {
+			fail("Unable to list connections:", err)
+		}
+		for _, c := range connections {
+			fmt.Printf("%-6d %-7s %-15s %-22s opened %s", c.ID, c.Type, c.State, c.Remote, c.Opened.Format("2006-01-02 15:04:05"))
+			if c.UID != "" {
+				fmt.Print(" uid ", c.UID)
+			}
+			if len(c.Domains) > 0 {
+				fmt.Print(" domains ", strings.Join(c.Domains, ","))
+			}
+			fmt.Println()
+		}
+		return
+
+	case "federations":
+		federations, err := admin.Federations()
+		if err != nil {
+			fail("Unable to list federations:", err)
+		}
+		for _, f := range federations {
+			direction := "incoming"
+			if f.Outgoing {
+				direction = "outgoing"
+			}
+			fmt.Printf("%-30s %-8s connection %d from %s\n", strings.Join(f.Domains, ","), direction, f.Connection, f.Remote)
+		}
+		return
+
+	case "disconnect":
+		// Connections are given by their ID, anything else is a user
+		if id, perr := strconv.ParseUint(args[0], 10, 64); perr == nil {
+			result, err = admin.Disconnect(id)
+		} else {
+			result, err = admin.DisconnectUser(args[0])
+		}
+
+	case "flush":
+		result, err = admin.FlushDirectory()
+
+	case "reload":
+		changes, err := admin.Reload()
+		if err != nil {
+			fail("Unable to reload configuration:", err)
+		}
+		if len(changes.Applied) == 0 && len(changes.RestartRequired) == 0 {
+			fmt.Println("No changes")
+		}
+		if len(changes.Applied) > 0 {
+			fmt.Println("Applied:", strings.Join(changes.Applied, ", "))
+		}
+		if len(changes.RestartRequired) > 0 {
+			fmt.Println("Restart required:", strings.Join(changes.RestartRequired, ", "))
+		}
+		return
+
+	case "lists":
+		result, err = admin.SetFederationLists(readDomains(args[0]), readDomains(args[1]))
+
+	case "users add":
+		result, err = admin.AddUser(args[0], args[1], args[2])
+
+	case "users remove":
+		result, err = admin.RemoveUser(args[0])
+
+	case "devices add":
+		result, err = admin.Device(args[0], args[1], false)
+
+	case "devices revoke":
+		result, err = admin.Device(args[0], args[1], true)
+	}
+
+	if err != nil {
+		fail(err)
+	}
+	if result.Count > 0 {
+		fmt.Println(result.Text, "("+strconv.Itoa(result.Count)+")")
+	} else {
+		fmt.Println(result.Text)
+	}
+}
+
+// Reads a list of domains from a file, one per line. Blank lines and lines
+// starting with # are ignored. A path of "-" is an empty list.
+func readDomains(path string) []string {
+	domains := []string{}
+	if path == "-" {
+		return domains
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		fail("Unable to read domains:", err)
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			domains = append(domains, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fail("Unable to read domains:", err)
+	}
+	return domains
+}
+
+func fail(a ...interface{}) {
+	fmt.Fprintln(os.Stderr, a...)
+	os.Exit(1)
+}
@@ -0,0 +1,238 @@
+package siren
+
+import "time"
+import "bytes"
+import "encoding/binary"
+
+import "github.com/neilalexander/siren/sirenproto"
+import "golang.org/x/crypto/ed25519"
+import proto "github.com/golang/protobuf/proto"
+
+// How far the timestamp on a device update can be from our own clock.
+const deviceUpdateMaximumSkew = 5 * time.Minute
+
+// Builds the data that is covered by the signature on a registration. The
+// device key is the key that the registering connection was authenticated
+// with, which becomes the user's first device.
+func RegisterSignatureData(uid string, deviceKey []byte) []byte {
+	return signatureData(
+		[]byte("siren-register"),
+		[]byte(uid),
+		deviceKey,
+	)
+}
+
+// Builds the data that is covered by the signature on a device update.
+func DeviceUpdateSignatureData(update *sirenproto.DeviceUpdate) []byte {
+	var fields [9]byte
+	binary.BigEndian.PutUint64(fields[0:8], uint64(update.Timestamp))
+	if update.Revoke {
+		fields[8] = 1
+	}
+	return signatureData(
+		[]byte("siren-device-update"),
+		[]byte(update.UID),
+		update.DeviceKey,
+		fields[:],
+	)
+}
+
+func (r *router) handleRegister(c *connection, register *sirenproto.Register) {
+	// Only clients that aren't logged in can register, and only for users in
+	// one of our local domains. The registration must be signed by the new
+	// user signing key, which proves that the client holds the private key
+	_, domain, ok := splitUID(register.UID)
+	switch {
+	case !r.server.config().RegistrationEnabled:
+		r.sendAck(c, sirenproto.Ack_UNAUTHORIZED, "This server does not allow registration")
+		return
+	case c.connectionType != sirenproto.HelloIAm_CLIENT_TO_SERVER || c.uid != "":
+		r.sendAck(c, sirenproto.Ack_INVALID_PACKET, "Only clients that are not logged in can register")
+		return
+	case !ok || !r.isLocalDomain(domain):
+		r.sendAck(c, sirenproto.Ack_UNAUTHORIZED, "Cannot register "+register.UID+" on this server")
+		return
+	case len(register.UserSigningKey) != ed25519.PublicKeySize ||
+		!ed25519.Verify(register.UserSigningKey, RegisterSignatureData(register.UID, c.remotePublicKey[:]), register.Signature):
+		r.sendAck(c, sirenproto.Ack_UNAUTHORIZED, "Registration is not signed by the user signing key")
+		return
+	}
+
+	dek := append([]byte{}, c.remotePublicKey[:]...)
+	if !r.server.localdirectory.register(register.UID, register.UserSigningKey, dek) {
+		r.sendAck(c, sirenproto.Ack_INVALID_PACKET, register.UID+" is already registered")
+		return
+	}
+	c.logger().info("Registered user", LogField{"registered", register.UID})
+	r.sendAck(c, sirenproto.Ack_SUCCESS, "Registered "+register.UID)
+}
+
+func (r *router) handleDeviceUpdate(c *connection, update *sirenproto.DeviceUpdate) {
+	// Device updates can only be made by a logged in client for its own user,
+	// and must be signed by the user signing key
+	if c.connectionType != sirenproto.HelloIAm_CLIENT_TO_SERVER || c.uid == "" || update.UID != c.uid {
+		r.sendAck(c, sirenproto.Ack_UNAUTHORIZED, "Device updates must be made by the logged in user")
+		return
+	}
+	if len(update.DeviceKey) != cryptoPublicKeyLen {
+		r.sendAck(c, sirenproto.Ack_INVALID_PACKET, "Invalid device key")
+		return
+	}
+	usk := r.server.localdirectory.userSigningKey(c.uid)
+	if len(usk) != ed25519.PublicKeySize || !ed25519.Verify(usk, DeviceUpdateSignatureData(update), update.Signature) {
+		r.sendAck(c, sirenproto.Ack_UNAUTHORIZED, "Device update is not signed by the user signing key")
+		return
+	}
+	// The timestamp is in milliseconds since the Unix epoch
+	skew := time.Since(time.Unix(0, update.Timestamp*int64(time.Millisecond)))
+	if skew > deviceUpdateMaximumSkew || skew < -deviceUpdateMaximumSkew {
+		r.sendAck(c, sirenproto.Ack_INVALID_PACKET, "Device update timestamp is too far from the server time")
+		return
+	}
+	if !r.server.localdirectory.updateDevice(c.uid, update.DeviceKey, update.Revoke, update.Timestamp) {
+		r.sendAck(c, sirenproto.Ack_INVALID_PACKET, "Device update is older than the last device update")
+		return
+	}
+
+	if !update.Revoke {
+		c.logger().info("Added device", LogField{"device", hexKey(update.DeviceKey)})
+		r.sendAck(c, sirenproto.Ack_SUCCESS, "Device added")
+	} else {
+		// Any sessions using a revoked device are closed straight away
+		c.logger().info("Revoked device", LogField{"device", hexKey(update.DeviceKey)})
+		r.sendAck(c, sirenproto.Ack_SUCCESS, "Device revoked")
+		for _, s := range r.localSessions(c.uid) {
+			if bytes.Equal(s.remotePublicKey[:], update.DeviceKey) {
+				s.connection.close()
+			}
+		}
+	}
+	r.notifyDeviceUpdate(update)
+}
+
+// Lets the users that the client asked us to notify know that the devices
+// for its user have changed, so that they start encrypting messages for the
+// new set of devices. The notification contains the signed device update so
+// that the recipients can check it for themselves.
+func (r *router) notifyDeviceUpdate(update *sirenproto.DeviceUpdate) {
+	notify := update.Notify
+	signed := proto.Clone(update).(*sirenproto.DeviceUpdate)
+	signed.Notify = nil
+	for _, uid := range notify {
+		_, domain, ok := splitUID(uid)
+		if !ok || uid == update.UID {
+			continue
+		}
+		notification := &sirenproto.DeviceNotification{
+			Destination: uid,
+			Update:      signed,
+		}
+		if r.isLocalDomain(domain) {
+			r.deliverDeviceNotification(notification)
+			continue
+		}
+		if err := r.forward(domain, &sirenproto.Payload{
+			Contents: &sirenproto.Payload_DeviceNotification{
+				DeviceNotification: notification,
+			},
+		}); err != nil {
+			r.server.log.warning("Unable to send device notification", LogField{"uid", update.UID}, LogField{"destination", uid}, LogField{"error", err})
+		}
+	}
+}
+
+func (r *router) handleDeviceNotification(c *connection, notification *sirenproto.DeviceNotification) {
+	// Device notifications only arrive over federation, from the server of
+	// the user whose devices changed. We check the signature ourselves, and
+	// make sure that our cached copy of the user's directory entry is fetched
+	// again next time it is needed
+	update := notification.Update
+	if c.connectionType != sirenproto.HelloIAm_SERVER_TO_SERVER || update == nil {
+		return
+	}
+	_, source, ok := splitUID(update.UID)
+	_, destination, ok2 := splitUID(notification.Destination)
+	if !ok || !ok2 || r.isLocalDomain(source) || !r.isLocalDomain(destination) {
+		c.logger().warning("Dropping device notification with invalid user", LogField{"user", update.UID})
+		return
+	}
+	// Looking up the user's signing key usually means asking their server,
+	// so it is done separately rather than holding up the connection
+	go func() {
+		usk := r.userSigningKey(update.UID)
+		if len(usk) != ed25519.PublicKeySize || !ed25519.Verify(usk, DeviceUpdateSignatureData(update), update.Signature) {
+			c.logger().warning("Dropping device notification with invalid signature", LogField{"user", update.UID})
+			return
+		}
+		r.server.externaldirectory.expire(update.UID)
+		r.deliverDeviceNotification(notification)
+	}()
+}
+
+// Device notifications are only delivered to sessions which are online, as
+// clients that are offline will look up the directory again anyway once
+// their cached entries have expired.
+func (r *router) deliverDeviceNotification(notification *sirenproto.DeviceNotification) {
+	for _, s := range r.localSessions(notification.Destination) {
+		s.queueEncrypted(&sirenproto.Payload{
+			Contents: &sirenproto.Payload_DeviceNotification{
+				DeviceNotification: notification,
+			},
+		})
+	}
+}
+
+func (r *router) handleDeviceLink(c *connection, link *sirenproto.DeviceLink) {
+	if c.connectionType != sirenproto.HelloIAm_CLIENT_TO_SERVER {
+		r.sendAck(c, sirenproto.Ack_UNAUTHORIZED, "Only clients can link devices")
+		return
+	}
+
+	// A link without a grant comes from a new device which isn't logged in,
+	// and which is waiting for one of the user's existing devices to send it
+	// the user keys
+	if link.Grant == nil {
+		r.mutex.Lock()
+		if c.uid != "" {
+			r.mutex.Unlock()
+			r.sendAck(c, sirenproto.Ack_INVALID_PACKET, "Already logged in as "+c.uid)
+			return
+		}
+		key := string(c.remotePublicKey[:])
+		r.linking[key] = append(r.linking[key], c)
+		r.mutex.Unlock()
+		r.sendAck(c, sirenproto.Ack_SUCCESS, "Waiting for device to be linked")
+		return
+	}
+
+	// Otherwise a logged in device is passing the user keys onto the new
+	// device, which must already have been added to the user. The grant is
+	// encrypted to the new device, so we can't read it
+	if c.uid == "" || link.UID != c.uid {
+		r.sendAck(c, sirenproto.Ack_UNAUTHORIZED, "Devices must be linked by the logged in user")
+		return
+	}
+	if !r.server.localdirectory.hasDeviceKey(c.uid, link.DeviceKey) {
+		r.sendAck(c, sirenproto.Ack_INVALID_PACKET, "Device must be added before it can be linked")
+		return
+	}
+	link.SenderDeviceKey = append([]byte{}, c.remotePublicKey[:]...)
+
+	r.mutex.Lock()
+	targets := r.linking[string(link.DeviceKey)]
+	delete(r.linking, string(link.DeviceKey))
+	r.mutex.Unlock()
+	if len(targets) == 0 {
+		r.sendAck(c, sirenproto.Ack_NOT_FOUND, "Device to link is not waiting on this server")
+		return
+	}
+	for _, t := range targets {
+		t.queueEncrypted(&sirenproto.Payload{
+			Contents: &sirenproto.Payload_DeviceLink{
+				DeviceLink: link,
+			},
+		})
+	}
+	c.logger().info("Linked device", LogField{"device", hexKey(link.DeviceKey)})
+	r.sendAck(c, sirenproto.Ack_SUCCESS, "Device linked")
+}
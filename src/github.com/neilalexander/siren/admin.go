@@ -0,0 +1,524 @@
+package siren
+
+import "io"
+import "os"
+import "net"
+import "mime"
+import "sort"
+import "time"
+import "bytes"
+import "errors"
+import "context"
+import "strings"
+import "net/http"
+import "io/ioutil"
+import "encoding/hex"
+import "encoding/json"
+import "path/filepath"
+
+import "github.com/neilalexander/siren/sirenproto"
+import "golang.org/x/crypto/ed25519"
+
+// The admin API lets operators inspect and manage a running server. It is
+// served over HTTP on the AdminAddress from the ServerConfig, which is either
+// a loopback TCP address like "127.0.0.1:9991" or a Unix socket like
+// "unix:///var/run/siren.sock". There is no authentication, so it must never
+// be reachable from anywhere but the server itself. Unix sockets are only
+// accessible by the user that the server runs as. Requests that change
+// something must be JSON, and requests over TCP must be addressed to a
+// loopback host, so that web pages can't reach the API through a browser.
+
+// An AdminConnection describes one of the server's open connections.
+type AdminConnection struct {
+	ID       uint64
+	Type     string
+	State    string
+	Remote   string
+	UID      string   `json:",omitempty"`
+	Domains  []string `json:",omitempty"`
+	Version  int32    `json:",omitempty"`
+	Features []string `json:",omitempty"`
+	Opened   time.Time
+}
+
+// An AdminFederation describes a federation connection with another server.
+type AdminFederation struct {
+	Domains    []string
+	Outgoing   bool
+	Connection uint64
+	Remote     string
+}
+
+// An AdminUser is a local user to add to the directory. The keys are hex.
+type AdminUser struct {
+	UID            string
+	UserSigningKey string
+	DeviceKey      string
+}
+
+// An AdminDevice is a device to add to or revoke from a local user. The key
+// is hex.
+type AdminDevice struct {
+	UID       string
+	DeviceKey string
+	Revoke    bool
+}
+
+// AdminDisconnect closes the connection with the given ID, or all of the
+// sessions for the given UID.
+type AdminDisconnect struct {
+	ID  uint64 `json:",omitempty"`
+	UID string `json:",omitempty"`
+}
+
+// AdminFederationLists replaces the federation whitelist and blacklist.
+type AdminFederationLists struct {
+	Whitelist []string
+	Blacklist []string
+}
+
+// AdminResult is returned by the admin API for requests that change
+// something.
+type AdminResult struct {
+	Text  string
+	Count int `json:",omitempty"`
+}
+
+// Splits an admin address into the network and address to listen on or
+// dial.
+func adminNetwork(address string) (string, string) {
+	if strings.HasPrefix(address, "unix://") {
+		return "unix", strings.TrimPrefix(address, "unix://")
+	}
+	return "tcp", address
+}
+
+// Checks that an admin address is either a Unix socket or a TCP address on
+// a loopback interface.
+func checkAdminAddress(address string) error {
+	network, addr := adminNetwork(address)
+	if network == "unix" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if !isLoopbackHost(host) {
+		return errors.New("Admin address " + address + " is not a loopback address")
+	}
+	return nil
+}
+
+// Returns true if the host, which may have a port, is localhost or a
+// loopback IP address.
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Listens on a Unix socket that only the user that the server runs as can
+// access. The socket is created in a directory that only we can access and
+// then moved into place, so that it is never accessible by anyone else.
+func listenAdminSocket(addr string) (net.Listener, error) {
+	// Remove the socket left behind if the server didn't stop cleanly
+	os.Remove(addr)
+	dir, err := ioutil.TempDir(filepath.Dir(addr), ".siren-admin-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	private := filepath.Join(dir, "admin.sock")
+	listener, err := net.Listen("unix", private)
+	if err != nil {
+		return nil, err
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(private, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if err := os.Rename(private, addr); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func (s *Server) serveAdmin(address string) {
+	if err := checkAdminAddress(address); err != nil {
+		s.log.error("Not serving admin API", LogField{"address", address}, LogField{"error", err})
+		return
+	}
+	network, addr := adminNetwork(address)
+	var listener net.Listener
+	var err error
+	if network == "unix" {
+		listener, err = listenAdminSocket(addr)
+	} else {
+		listener, err = net.Listen(network, addr)
+	}
+	if err != nil {
+		s.log.error("Error listening for admin API", LogField{"address", address}, LogField{"error", err})
+		return
+	}
+	s.log.info("Serving admin API", LogField{"address", address})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connections", s.adminHandler(http.MethodGet, s.adminConnections))
+	mux.HandleFunc("/connections/disconnect", s.adminHandler(http.MethodPost, s.adminDisconnect))
+	mux.HandleFunc("/federations", s.adminHandler(http.MethodGet, s.adminFederations))
+	mux.HandleFunc("/federations/lists", s.adminHandler(http.MethodPost, s.adminFederationLists))
+	mux.HandleFunc("/users/add", s.adminHandler(http.MethodPost, s.adminAddUser))
+	mux.HandleFunc("/users/remove", s.adminHandler(http.MethodPost, s.adminRemoveUser))
+	mux.HandleFunc("/devices", s.adminHandler(http.MethodPost, s.adminDevice))
+	mux.HandleFunc("/directory/flush", s.adminHandler(http.MethodPost, s.adminFlushDirectory))
+	mux.HandleFunc("/config/reload", s.adminHandler(http.MethodPost, s.adminReload))
+	var handler http.Handler = mux
+	if network != "unix" {
+		handler = adminLoopbackOnly(mux)
+	}
+	go func() {
+		if err := http.Serve(listener, handler); err != nil {
+			s.log.error("Stopped serving admin API", LogField{"address", address}, LogField{"error", err})
+		}
+	}()
+}
+
+// Refuses requests over TCP that aren't addressed to a loopback host, i.e.
+// from a web page whose domain has been pointed at a loopback address.
+func adminLoopbackOnly(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !isLoopbackHost(req.Host) {
+			http.Error(w, "Host must be a loopback address", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, req)
+	})
+}
+
+// Wraps an admin API handler, which is given the request body and returns
+// a response to encode as JSON or an error to send back as text. Requests
+// that change something must be sent as JSON, which a web page can't do
+// without the API allowing it.
+func (s *Server) adminHandler(method string, handler func(body []byte) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != method {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if method == http.MethodPost {
+			if contentType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type")); err != nil || contentType != "application/json" {
+				http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(req.Body, 1048576))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		response, err := handler(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func (s *Server) adminConnections(body []byte) (interface{}, error) {
+	r := &s.router
+	r.mutex.RLock()
+	connections := make([]AdminConnection, 0, len(r.connections))
+	for c := range r.connections {
+		connection := AdminConnection{
+			ID:      c.id,
+			Type:    "unknown",
+			Remote:  c.connection.remoteAddr().String(),
+			UID:     c.uid,
+			Domains: c.remoteDomains(),
+			Opened:  c.opened,
+		}
+		state := c.getState()
+		connection.State = stateNames[state]
+		if state == STATE_AUTHENTICATED {
+			connection.Type = connectionTypeLabel(c.connectionType)
+			connection.Version = c.getVersion()
+			connection.Features = c.featureList()
+		}
+		connections = append(connections, connection)
+	}
+	r.mutex.RUnlock()
+	sort.Slice(connections, func(i, j int) bool {
+		return connections[i].ID < connections[j].ID
+	})
+	return connections, nil
+}
+
+func (s *Server) adminDisconnect(body []byte) (interface{}, error) {
+	var request AdminDisconnect
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, err
+	}
+	r := &s.router
+	var closing []*connection
+	r.mutex.RLock()
+	for c := range r.connections {
+		if (request.ID != 0 && c.id == request.ID) || (request.UID != "" && c.uid == request.UID) {
+			closing = append(closing, c)
+		}
+	}
+	r.mutex.RUnlock()
+	if len(closing) == 0 {
+		return nil, errors.New("No matching connections")
+	}
+	for _, c := range closing {
+		c.logger().info("Disconnecting by admin request")
+		c.connection.close()
+	}
+	return AdminResult{Text: "Disconnected", Count: len(closing)}, nil
+}
+
+func (s *Server) adminFederations(body []byte) (interface{}, error) {
+	r := &s.router
+	r.mutex.RLock()
+	federations := []AdminFederation{}
+	for c := range r.connections {
+		if c.connectionType != sirenproto.HelloIAm_SERVER_TO_SERVER || c.getState() != STATE_AUTHENTICATED {
+			continue
+		}
+		federations = append(federations, AdminFederation{
+			Domains:    c.remoteDomains(),
+			Outgoing:   c.federationDomain != "",
+			Connection: c.id,
+			Remote:     c.connection.remoteAddr().String(),
+		})
+	}
+	r.mutex.RUnlock()
+	sort.Slice(federations, func(i, j int) bool {
+		return federations[i].Connection < federations[j].Connection
+	})
+	return federations, nil
+}
+
+func (s *Server) adminFederationLists(body []byte) (interface{}, error) {
+	var request AdminFederationLists
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, err
+	}
+	s.router.setFederationLists(request.Whitelist, request.Blacklist)
+	s.log.info("Federation lists replaced by admin request",
+		LogField{"whitelist", len(request.Whitelist)}, LogField{"blacklist", len(request.Blacklist)})
+	return AdminResult{Text: "Federation lists replaced"}, nil
+}
+
+func (s *Server) adminAddUser(body []byte) (interface{}, error) {
+	var request AdminUser
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, err
+	}
+	if _, domain, ok := splitUID(request.UID); !ok || !s.router.isLocalDomain(domain) {
+		return nil, errors.New("Not a user in one of our domains: " + request.UID)
+	}
+	usk, err := hex.DecodeString(request.UserSigningKey)
+	if err != nil || len(usk) != ed25519.PublicKeySize {
+		return nil, errors.New("Invalid user signing key")
+	}
+	dek, err := hex.DecodeString(request.DeviceKey)
+	if err != nil || len(dek) != cryptoPublicKeyLen {
+		return nil, errors.New("Invalid device key")
+	}
+	if !s.localdirectory.register(request.UID, usk, dek) {
+		return nil, errors.New(request.UID + " is already registered")
+	}
+	s.log.info("User added by admin request", LogField{"uid", request.UID})
+	return AdminResult{Text: "Added " + request.UID}, nil
+}
+
+func (s *Server) adminRemoveUser(body []byte) (interface{}, error) {
+	var request AdminUser
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, err
+	}
+	if !s.localdirectory.removeUser(request.UID) {
+		return nil, errors.New("Unknown user " + request.UID)
+	}
+	// The user's sessions and any messages waiting for them go too
+	s.router.offline.clear(request.UID)
+	for _, c := range s.router.localSessions(request.UID) {
+		c.connection.close()
+	}
+	s.log.info("User removed by admin request", LogField{"uid", request.UID})
+	return AdminResult{Text: "Removed " + request.UID}, nil
+}
+
+func (s *Server) adminDevice(body []byte) (interface{}, error) {
+	var request AdminDevice
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(request.DeviceKey)
+	if err != nil || len(key) != cryptoPublicKeyLen {
+		return nil, errors.New("Invalid device key")
+	}
+	if !s.localdirectory.setDevice(request.UID, key, request.Revoke) {
+		return nil, errors.New("Unknown user " + request.UID)
+	}
+	if !request.Revoke {
+		s.log.info("Device added by admin request", LogField{"uid", request.UID}, LogField{"device", request.DeviceKey})
+		return AdminResult{Text: "Device added to " + request.UID}, nil
+	}
+	// Any sessions using a revoked device are closed straight away
+	for _, c := range s.router.localSessions(request.UID) {
+		if bytes.Equal(c.remotePublicKey[:], key) {
+			c.connection.close()
+		}
+	}
+	s.log.info("Device revoked by admin request", LogField{"uid", request.UID}, LogField{"device", request.DeviceKey})
+	return AdminResult{Text: "Device revoked from " + request.UID}, nil
+}
+
+func (s *Server) adminFlushDirectory(body []byte) (interface{}, error) {
+	flushed := s.externaldirectory.flush()
+	s.log.info("External directory flushed by admin request", LogField{"records", flushed})
+	return AdminResult{Text: "External directory flushed", Count: flushed}, nil
+}
+
+func (s *Server) adminReload(body []byte) (interface{}, error) {
+	changes, err := s.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// An AdminClient talks to the admin API of a running server.
+type AdminClient struct {
+	client *http.Client
+}
+
+// Returns an AdminClient for the admin API on the given address, which is
+// the AdminAddress from the server's ServerConfig.
+func NewAdminClient(address string) *AdminClient {
+	network, addr := adminNetwork(address)
+	return &AdminClient{
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, network, addr)
+				},
+			},
+		},
+	}
+}
+
+func (a *AdminClient) call(method, path string, request, response interface{}) error {
+	var body io.Reader
+	if request != nil {
+		encoded, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(encoded)
+	}
+	// The host is ignored as we always dial the admin address, but the
+	// server only accepts loopback hosts
+	req, err := http.NewRequest(method, "http://localhost"+path, body)
+	if err != nil {
+		return err
+	}
+	if method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		text, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return errors.New(strings.TrimSpace(string(text)))
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// Lists the server's open connections.
+func (a *AdminClient) Connections() ([]AdminConnection, error) {
+	var connections []AdminConnection
+	err := a.call(http.MethodGet, "/connections", nil, &connections)
+	return connections, err
+}
+
+// Closes the connection with the given ID.
+func (a *AdminClient) Disconnect(id uint64) (*AdminResult, error) {
+	var result AdminResult
+	err := a.call(http.MethodPost, "/connections/disconnect", AdminDisconnect{ID: id}, &result)
+	return &result, err
+}
+
+// Closes all of the sessions for the given user.
+func (a *AdminClient) DisconnectUser(uid string) (*AdminResult, error) {
+	var result AdminResult
+	err := a.call(http.MethodPost, "/connections/disconnect", AdminDisconnect{UID: uid}, &result)
+	return &result, err
+}
+
+// Lists the server's federation connections.
+func (a *AdminClient) Federations() ([]AdminFederation, error) {
+	var federations []AdminFederation
+	err := a.call(http.MethodGet, "/federations", nil, &federations)
+	return federations, err
+}
+
+// Replaces the federation whitelist and blacklist, closing any federation
+// connections that are no longer allowed.
+func (a *AdminClient) SetFederationLists(whitelist, blacklist []string) (*AdminResult, error) {
+	var result AdminResult
+	err := a.call(http.MethodPost, "/federations/lists", AdminFederationLists{whitelist, blacklist}, &result)
+	return &result, err
+}
+
+// Adds a user to the local directory with the given hex keys.
+func (a *AdminClient) AddUser(uid, userSigningKey, deviceKey string) (*AdminResult, error) {
+	var result AdminResult
+	err := a.call(http.MethodPost, "/users/add", AdminUser{uid, userSigningKey, deviceKey}, &result)
+	return &result, err
+}
+
+// Removes a user from the local directory and closes their sessions.
+func (a *AdminClient) RemoveUser(uid string) (*AdminResult, error) {
+	var result AdminResult
+	err := a.call(http.MethodPost, "/users/remove", AdminUser{UID: uid}, &result)
+	return &result, err
+}
+
+// Adds a device to a local user, or revokes it, given its hex key.
+func (a *AdminClient) Device(uid, deviceKey string, revoke bool) (*AdminResult, error) {
+	var result AdminResult
+	err := a.call(http.MethodPost, "/devices", AdminDevice{uid, deviceKey, revoke}, &result)
+	return &result, err
+}
+
+// Asks the server to reload its configuration, and returns what changed.
+func (a *AdminClient) Reload() (*ConfigChanges, error) {
+	var changes ConfigChanges
+	err := a.call(http.MethodPost, "/config/reload", nil, &changes)
+	return &changes, err
+}
+
+// Drops every record from the external directory cache.
+func (a *AdminClient) FlushDirectory() (*AdminResult, error) {
+	var result AdminResult
+	err := a.call(http.MethodPost, "/directory/flush", nil, &result)
+	return &result, err
+}
@@ -0,0 +1,90 @@
+package siren
+
+import "os"
+import "net"
+import "strings"
+import "testing"
+import "net/http"
+import "net/http/httptest"
+import "path/filepath"
+
+func TestCheckAdminAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		ok      bool
+	}{
+		{"127.0.0.1:9991", true},
+		{"[::1]:9991", true},
+		{"localhost:9991", true},
+		{"unix:///var/run/siren.sock", true},
+		{"0.0.0.0:9991", false},
+		{":9991", false},
+		{"[::]:9991", false},
+		{"192.0.2.1:9991", false},
+		{"siren.example.com:9991", false},
+		{"127.0.0.1", false},
+	}
+	for _, test := range tests {
+		if err := checkAdminAddress(test.address); (err == nil) != test.ok {
+			t.Errorf("%s: got error %v, want ok %v", test.address, err, test.ok)
+		}
+	}
+}
+
+func TestAdminRequests(t *testing.T) {
+	s := &Server{}
+	handler := adminLoopbackOnly(s.adminHandler(http.MethodPost, func(body []byte) (interface{}, error) {
+		return AdminResult{Text: "OK"}, nil
+	}))
+	tests := []struct {
+		name        string
+		host        string
+		contentType string
+		status      int
+	}{
+		{"json", "localhost:9991", "application/json", http.StatusOK},
+		{"json with charset", "127.0.0.1:9991", "application/json; charset=utf-8", http.StatusOK},
+		{"text", "localhost:9991", "text/plain", http.StatusUnsupportedMediaType},
+		{"form", "localhost:9991", "application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"no content type", "localhost:9991", "", http.StatusUnsupportedMediaType},
+		{"rebound host", "attacker.example:9991", "application/json", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "http://"+test.host+"/users/add", strings.NewReader("{}"))
+		if test.contentType != "" {
+			req.Header.Set("Content-Type", test.contentType)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("%s: got status %d, want %d", test.name, w.Code, test.status)
+		}
+	}
+}
+
+func TestAdminSocketPermissions(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "admin.sock")
+	listener, err := listenAdminSocket(path)
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer listener.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Socket wasn't created: %v", err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Fatalf("Socket has mode %o, want 600", mode)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Could not connect to the socket: %v", err)
+	}
+	conn.Close()
+	// The private directory that the socket was created in is removed
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Got %d entries next to the socket, want just the socket", len(entries))
+	}
+}
@@ -0,0 +1,127 @@
+package siren
+
+import "errors"
+import "sync/atomic"
+
+import "github.com/neilalexander/siren/sirenproto"
+
+// The range of protocol versions that the server and client speak. Each side
+// gives its range in its HelloIAm and both sides pick the highest version
+// that they have in common, so no further round trip is needed.
+const ProtocolMinVersion = 1
+const ProtocolMaxVersion = 1
+
+var ErrVersionUnsupported = errors.New("No protocol version in common")
+
+// The optional features of the protocol. Each side lists the features that
+// it supports in its HelloIAm, and a feature is only used on a connection if
+// both sides listed it.
+const (
+	FEATURE_OFFLINE_QUEUE = "offline_queue"
+	FEATURE_GROUPS        = "groups"
+	FEATURE_RECEIPTS      = "receipts"
+	FEATURE_PRESENCE      = "presence"
+)
+
+var serverFeatures = []string{
+	FEATURE_OFFLINE_QUEUE,
+	FEATURE_GROUPS,
+	FEATURE_RECEIPTS,
+	FEATURE_PRESENCE,
+}
+
+// Returns the HelloIAm that introduces us to the remote side.
+func (c *connection) helloIAm(r *router, connectionType sirenproto.HelloIAm_ConnectionTypes) *sirenproto.HelloIAm {
+	hello := &sirenproto.HelloIAm{
+		ConnectionType: connectionType,
+		PublicKey:      r.server.config().PublicKey[:],
+		Challenge:      c.challenge[:],
+		MinVersion:     ProtocolMinVersion,
+		MaxVersion:     ProtocolMaxVersion,
+		Features:       serverFeatures,
+	}
+	if connectionType == sirenproto.HelloIAm_SERVER_TO_SERVER {
+		hello.Domains = r.server.config().LocalDomains
+	}
+	return hello
+}
+
+// Picks the highest protocol version that both sides speak, and the
+// features that both sides support, from the remote side's HelloIAm and the
+// features that we support. This is used by both servers and clients, so
+// that both sides of a connection always agree on what was negotiated.
+func Negotiate(hello *sirenproto.HelloIAm, supported []string) (int32, map[string]struct{}, error) {
+	min, max := hello.MinVersion, hello.MaxVersion
+	if min < ProtocolMinVersion {
+		min = ProtocolMinVersion
+	}
+	if max > ProtocolMaxVersion {
+		max = ProtocolMaxVersion
+	}
+	if min > max {
+		return 0, nil, ErrVersionUnsupported
+	}
+	negotiated := make(map[string]struct{})
+	for _, remote := range hello.Features {
+		for _, local := range supported {
+			if remote == local {
+				negotiated[local] = struct{}{}
+			}
+		}
+	}
+	return max, negotiated, nil
+}
+
+// Returns the feature that a payload belongs to, or an empty string if the
+// payload is part of the core protocol and can always be sent.
+func payloadFeature(payload *sirenproto.Payload) string {
+	switch payload.Contents.(type) {
+	case *sirenproto.Payload_GroupUpdate, *sirenproto.Payload_GroupRequest, *sirenproto.Payload_GroupState:
+		return FEATURE_GROUPS
+	case *sirenproto.Payload_Receipt:
+		return FEATURE_RECEIPTS
+	case *sirenproto.Payload_Presence, *sirenproto.Payload_PresenceSubscribe, *sirenproto.Payload_Typing:
+		return FEATURE_PRESENCE
+	default:
+		return ""
+	}
+}
+
+// Returns true if the feature was negotiated on this connection. The
+// features are only known once the remote side's HelloIAm has been
+// accepted, so this must only be called after that.
+func (c *connection) supports(feature string) bool {
+	if feature == "" {
+		return true
+	}
+	_, ok := c.features[feature]
+	return ok
+}
+
+// Returns the negotiated features in the order that this server lists them.
+func (c *connection) featureList() []string {
+	var features []string
+	for _, feature := range serverFeatures {
+		if c.supports(feature) {
+			features = append(features, feature)
+		}
+	}
+	return features
+}
+
+// Returns the negotiated protocol version, or 0 if it hasn't been
+// negotiated yet. The version is set by the read thread and used by the
+// write thread, so it is accessed atomically.
+func (c *connection) getVersion() int32 {
+	return atomic.LoadInt32(&c.version)
+}
+
+// Returns the version to put in the packets that we send. Until the version
+// has been negotiated we use the lowest version that we speak, which only
+// the HelloIAm is sent with.
+func (c *connection) packetVersion() int32 {
+	if version := c.getVersion(); version != 0 {
+		return version
+	}
+	return ProtocolMinVersion
+}
@@ -0,0 +1,87 @@
+package client
+
+import "time"
+import "errors"
+import "context"
+
+import "github.com/neilalexander/siren"
+import "github.com/neilalexander/siren/sirenproto"
+import "golang.org/x/crypto/ed25519"
+
+// Registers a new user on the server, using the given user keys as the user
+// signing key (USK) and the device keys that the client was dialled with as
+// the user's first device. The server must host the domain of the user ID.
+// Once registered, the client still needs to Login.
+func (c *Client) Register(ctx context.Context, uid string, user UserKeys) error {
+	ack, err := c.request(ctx, &sirenproto.Payload{
+		Contents: &sirenproto.Payload_Register{
+			Register: &sirenproto.Register{
+				UID:            uid,
+				UserSigningKey: user.PublicKey[:],
+				Signature:      ed25519.Sign(user.PrivateKey[:], siren.RegisterSignatureData(uid, c.keys.PublicKey[:])),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := ackError(ack); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Adds another device to our user, so that it can log in and receive
+// messages. Any users given in notify are told about the new device. The
+// client must be logged in. See LinkDevice for passing the user keys to the
+// new device as well.
+func (c *Client) AddDevice(ctx context.Context, deviceKey []byte, notify ...string) error {
+	return c.updateDevice(ctx, deviceKey, false, notify)
+}
+
+// Revokes one of our user's devices. The device will no longer be able to
+// log in, and other users will stop encrypting messages for it once their
+// directory caches expire, or straight away for any users given in notify.
+// The client must be logged in.
+func (c *Client) RevokeDevice(ctx context.Context, deviceKey []byte, notify ...string) error {
+	return c.updateDevice(ctx, deviceKey, true, notify)
+}
+
+func (c *Client) updateDevice(ctx context.Context, deviceKey []byte, revoke bool, notify []string) error {
+	c.mutex.Lock()
+	uid, user := c.uid, c.user
+	c.mutex.Unlock()
+	if uid == "" {
+		return ErrNotLoggedIn
+	}
+	if len(deviceKey) != len(c.keys.PublicKey) {
+		return errors.New("Invalid device key")
+	}
+
+	update := &sirenproto.DeviceUpdate{
+		UID:       uid,
+		DeviceKey: deviceKey,
+		Revoke:    revoke,
+		Timestamp: time.Now().UnixNano() / int64(time.Millisecond),
+		Notify:    notify,
+	}
+	update.Signature = ed25519.Sign(user.PrivateKey[:], siren.DeviceUpdateSignatureData(update))
+	ack, err := c.request(ctx, &sirenproto.Payload{
+		Contents: &sirenproto.Payload_DeviceUpdate{
+			DeviceUpdate: update,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := ackError(ack); err != nil {
+		return err
+	}
+
+	// Our own directory entry has changed, so make sure that we look it up
+	// again next time
+	c.mutex.Lock()
+	delete(c.directory, uid)
+	c.mutex.Unlock()
+	return nil
+}
@@ -0,0 +1,45 @@
+package client
+
+import "github.com/neilalexander/siren"
+import "github.com/neilalexander/siren/sirenproto"
+
+// The optional features that the client supports, which are offered to the
+// server in the HelloIAm.
+var clientFeatures = []string{
+	siren.FEATURE_OFFLINE_QUEUE,
+	siren.FEATURE_GROUPS,
+	siren.FEATURE_RECEIPTS,
+	siren.FEATURE_PRESENCE,
+}
+
+// Returns true if the server agreed to use the given feature, which is one
+// of the siren.FEATURE_* constants.
+func (c *Client) Supports(feature string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, ok := c.features[feature]
+	return ok
+}
+
+// Returns an error matching ErrNotImplemented if the server didn't agree to
+// use the given feature.
+func (c *Client) require(feature string) error {
+	if !c.Supports(feature) {
+		return &AckError{
+			Condition: sirenproto.Ack_NOT_IMPLEMENTED,
+			Text:      "Server does not support " + feature,
+		}
+	}
+	return nil
+}
+
+// Returns the version to put in the packets that we send, which is the
+// lowest version that we speak until the version has been negotiated.
+func (c *Client) packetVersion() int32 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.version != 0 {
+		return c.version
+	}
+	return siren.ProtocolMinVersion
+}
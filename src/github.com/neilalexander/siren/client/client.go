@@ -0,0 +1,912 @@
+// Package client implements a Siren client, which can be used to connect to
+// a Siren server, log in as a user and exchange messages with other users.
+package client
+
+import "io"
+import "fmt"
+import "net"
+import "bytes"
+import "sync"
+import "time"
+import "errors"
+import "context"
+import "strings"
+import "crypto/tls"
+import "crypto/rand"
+import "encoding/binary"
+
+import "github.com/neilalexander/siren"
+import "github.com/neilalexander/siren/sirenproto"
+import proto "github.com/golang/protobuf/proto"
+
+// The largest packet that the client will accept from the server.
+const maximumPacketSize = 1048576
+
+var ErrClosed = errors.New("Connection closed")
+var ErrNotLoggedIn = errors.New("Not logged in")
+
+// The DeviceKeys are the Curve25519 keys that identify this device to the
+// server. The public key must be registered as one of the user's device
+// encryption keys (DEK) in order to log in.
+type DeviceKeys struct {
+	PublicKey  [32]byte
+	PrivateKey [32]byte
+}
+
+// Generates a new set of DeviceKeys.
+func NewDeviceKeys() DeviceKeys {
+	publicKey, privateKey := siren.NewCryptoKeys()
+	return DeviceKeys{
+		PublicKey:  *publicKey,
+		PrivateKey: *privateKey,
+	}
+}
+
+// How long directory entries are cached by the client.
+const directoryCacheLifetime = time.Minute
+
+// A Message which was received from another user, or which was sent by
+// another one of our own devices. The contents have already been decrypted
+// and the signature verified. If the message was sent to a group then Group
+// contains the group ID. The ID can be passed to MarkRead to let the sender
+// know that the message has been read.
+type Message struct {
+	ID           string
+	Source       string
+	SourceDevice []byte
+	Destination  string
+	Group        string
+	Contents     []byte
+	Received     time.Time
+}
+
+// A DirectoryEntry contains the user signing key (USK) and the device
+// encryption keys (DEK) for a user, as returned by Lookup, along with the
+// prekey bundles for any devices that have published them.
+type DirectoryEntry struct {
+	UID                  string
+	UserSigningKey       []byte
+	DeviceEncryptionKeys [][]byte
+	PreKeyBundles        []*PreKeyBundle
+}
+
+// A PreKeyBundle is used to start a Double Ratchet session with a device. The
+// one-time prekey is handed out by the server to only one requester, and may
+// be missing if the device has run out.
+type PreKeyBundle struct {
+	DeviceKey             []byte
+	SignedPreKey          []byte
+	SignedPreKeySignature []byte
+	OneTimePreKey         []byte
+}
+
+// The Client is a connection to a Siren server. All of the methods on the
+// Client are safe to call from multiple goroutines.
+type Client struct {
+	conn            net.Conn
+	keys            DeviceKeys
+	remotePublicKey [32]byte
+	challenge       [32]byte
+	sendNonces      *siren.NonceSequence
+	receiveNonces   *siren.NonceSequence
+	writeMutex      sync.Mutex
+
+	mutex         sync.Mutex
+	uid           string
+	user          UserKeys
+	directory     map[string]*DirectoryEntry
+	fetched       map[string]time.Time
+	authenticated bool
+	version       int32
+	features      map[string]struct{}
+	pingSequence  int64
+	pings         map[int64][]chan time.Time
+	lookups       map[string][]chan *DirectoryEntry
+	groupQueries  map[string][]chan *Group
+	links         []chan *sirenproto.DeviceLink
+	sent          map[string]*MessageStatus
+	sentOrder     []string
+	acks          map[string]chan *sirenproto.Ack
+
+	sessionMutex sync.Mutex
+	store        SessionStore
+	preKeys      *preKeys
+	allowStatic  bool
+
+	ready         chan struct{}
+	readyOnce     sync.Once
+	inbound       chan *sirenproto.Message
+	messages      chan *Message
+	deviceChanges chan *DeviceChange
+	receipts      chan *Receipt
+	presence      chan *Presence
+	typing        chan *Typing
+	closed        chan struct{}
+	closeOnce     sync.Once
+	err           error
+}
+
+// Connects to the Siren server at the given address and performs the
+// handshake using the given device keys. The address can be "host:port", or
+// a URI such as "tcp://host:port", "tls://host:port" or "unix:///path". Dial
+// returns once the session is authenticated, or when the context expires.
+func Dial(ctx context.Context, address string, keys DeviceKeys) (*Client, error) {
+	conn, err := dial(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		conn:          conn,
+		keys:          keys,
+		pings:         make(map[int64][]chan time.Time),
+		lookups:       make(map[string][]chan *DirectoryEntry),
+		groupQueries:  make(map[string][]chan *Group),
+		directory:     make(map[string]*DirectoryEntry),
+		fetched:       make(map[string]time.Time),
+		ready:         make(chan struct{}),
+		inbound:       make(chan *sirenproto.Message, 100),
+		messages:      make(chan *Message, 100),
+		deviceChanges: make(chan *DeviceChange, 16),
+		receipts:      make(chan *Receipt, 100),
+		presence:      make(chan *Presence, 100),
+		typing:        make(chan *Typing, 100),
+		sent:          make(map[string]*MessageStatus),
+		acks:          make(map[string]chan *sirenproto.Ack),
+		closed:        make(chan struct{}),
+	}
+	if _, err := rand.Read(c.challenge[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go c.readLoop()
+	go c.messageLoop()
+
+	// Introduce ourselves to the server. The server will respond with its
+	// own public key and challenge, after which we can exchange encrypted
+	// packets. Our challenge is sent back to us by the server, encrypted, to
+	// prove that it holds the private key for the public key it gave. We
+	// also tell the server which protocol versions and features we support
+	if err := c.writePacket(&sirenproto.Packet{
+		Version: siren.ProtocolMinVersion,
+		PayloadType: &sirenproto.Packet_Payload{
+			Payload: &sirenproto.Payload{
+				Contents: &sirenproto.Payload_HelloIAm{
+					HelloIAm: &sirenproto.HelloIAm{
+						ConnectionType: sirenproto.HelloIAm_CLIENT_TO_SERVER,
+						PublicKey:      keys.PublicKey[:],
+						Challenge:      c.challenge[:],
+						MinVersion:     siren.ProtocolMinVersion,
+						MaxVersion:     siren.ProtocolMaxVersion,
+						Features:       clientFeatures,
+					},
+				},
+			},
+		},
+	}); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	// Wait for the session to be authenticated
+	select {
+	case <-c.ready:
+		return c, nil
+	case <-c.closed:
+		return nil, c.Err()
+	case <-ctx.Done():
+		c.Close()
+		return nil, ctx.Err()
+	}
+}
+
+func dial(ctx context.Context, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	parts := strings.SplitN(address, "://", 2)
+	if len(parts) == 1 {
+		return dialer.DialContext(ctx, "tcp", address)
+	}
+	switch parts[0] {
+	case "tcp", "tcp4", "tcp6", "unix":
+		return dialer.DialContext(ctx, parts[0], parts[1])
+	case "tls":
+		host, _, err := net.SplitHostPort(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		tlsDialer := tls.Dialer{
+			NetDialer: &dialer,
+			Config:    &tls.Config{ServerName: host},
+		}
+		return tlsDialer.DialContext(ctx, "tcp", parts[1])
+	default:
+		return nil, errors.New("Unsupported scheme " + parts[0])
+	}
+}
+
+// Returns the channel on which messages from other users are delivered. The
+// channel is closed when the connection to the server is closed.
+func (c *Client) Messages() <-chan *Message {
+	return c.messages
+}
+
+// Returns the user ID that the client is logged in as, if any.
+func (c *Client) UID() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.uid
+}
+
+// Returns a channel which is closed when the connection to the server has
+// been closed.
+func (c *Client) Done() <-chan struct{} {
+	return c.closed
+}
+
+// Returns the reason that the connection to the server was closed, or nil
+// if it is still open.
+func (c *Client) Err() error {
+	select {
+	case <-c.closed:
+		if c.err != nil {
+			return c.err
+		}
+		return ErrClosed
+	default:
+		return nil
+	}
+}
+
+// Closes the connection to the server.
+func (c *Client) Close() error {
+	c.shutdown(nil)
+	return nil
+}
+
+func (c *Client) shutdown(err error) {
+	c.closeOnce.Do(func() {
+		c.err = err
+		c.conn.Close()
+		close(c.closed)
+	})
+}
+
+// Logs in as the given user ID. The device keys that the client was dialled
+// with must be registered to the user on the server, and the user keys must
+// match the user signing key (USK) in the directory, as they are used to sign
+// outgoing messages.
+func (c *Client) Login(ctx context.Context, uid string, user UserKeys) error {
+	ack, err := c.request(ctx, &sirenproto.Payload{
+		Contents: &sirenproto.Payload_Login{
+			Login: &sirenproto.Login{
+				UID: uid,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := ackError(ack); err != nil {
+		return err
+	}
+	entry, err := c.Lookup(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(entry.UserSigningKey, user.PublicKey[:]) {
+		return errors.New("User signing key does not match the directory")
+	}
+	// Publish our prekeys so that other devices can start Double Ratchet
+	// sessions with this one
+	if err := c.publishPreKeys(ctx, user); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	c.uid = uid
+	c.user = user
+	c.mutex.Unlock()
+	return nil
+}
+
+// Looks up the user signing key and device encryption keys for the given
+// user ID in the directory.
+func (c *Client) Lookup(ctx context.Context, uid string) (*DirectoryEntry, error) {
+	// The server answers with the entry, or with an Ack if it refuses the
+	// request, i.e. because the UID is invalid
+	rc := make(chan *DirectoryEntry, 1)
+	ac := make(chan *sirenproto.Ack, 1)
+	requestID := siren.NewMessageID()
+	c.mutex.Lock()
+	c.lookups[uid] = append(c.lookups[uid], rc)
+	c.acks[requestID] = ac
+	c.mutex.Unlock()
+	defer c.cancelLookup(uid, rc)
+	defer func() {
+		c.mutex.Lock()
+		delete(c.acks, requestID)
+		c.mutex.Unlock()
+	}()
+
+	if err := c.writePayload(&sirenproto.Payload{
+		Contents: &sirenproto.Payload_DirectoryRequest{
+			DirectoryRequest: &sirenproto.DirectoryRequest{
+				UID: uid,
+			},
+		},
+		RequestID: requestID,
+	}); err != nil {
+		return nil, err
+	}
+
+	for {
+		select {
+		case ack := <-ac:
+			if err := ackError(ack); err != nil {
+				return nil, err
+			}
+		case entry := <-rc:
+			// Only cache entries which actually contain keys, as the server may
+			// not have been able to reach the user's home server yet
+			if len(entry.UserSigningKey) > 0 {
+				c.mutex.Lock()
+				c.directory[uid] = entry
+				c.fetched[uid] = time.Now()
+				c.mutex.Unlock()
+			}
+			return entry, nil
+		case <-c.closed:
+			return nil, c.Err()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Returns the directory entry for the given user ID from the cache if it is
+// recent enough, otherwise looks it up again.
+func (c *Client) lookupCached(ctx context.Context, uid string) (*DirectoryEntry, error) {
+	c.mutex.Lock()
+	entry, ok := c.directory[uid]
+	if ok && time.Since(c.fetched[uid]) < directoryCacheLifetime {
+		c.mutex.Unlock()
+		return entry, nil
+	}
+	c.mutex.Unlock()
+	return c.Lookup(ctx, uid)
+}
+
+func (c *Client) cancelLookup(uid string, rc chan *DirectoryEntry) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	waiting := c.lookups[uid][:0]
+	for _, w := range c.lookups[uid] {
+		if w != rc {
+			waiting = append(waiting, w)
+		}
+	}
+	if len(waiting) > 0 {
+		c.lookups[uid] = waiting
+	} else {
+		delete(c.lookups, uid)
+	}
+}
+
+// Sends a ping to the server and waits for the pong, returning the round
+// trip time.
+func (c *Client) Ping(ctx context.Context) (time.Duration, error) {
+	rc := make(chan time.Time, 1)
+	c.mutex.Lock()
+	sequence := c.pingSequence
+	c.pingSequence++
+	c.pings[sequence] = append(c.pings[sequence], rc)
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		delete(c.pings, sequence)
+		c.mutex.Unlock()
+	}()
+
+	sent := time.Now()
+	if err := c.writePayload(&sirenproto.Payload{
+		Contents: &sirenproto.Payload_Ping{
+			Ping: &sirenproto.Ping{
+				Sequence: sequence,
+			},
+		},
+	}); err != nil {
+		return 0, err
+	}
+
+	select {
+	case received := <-rc:
+		return received.Sub(sent), nil
+	case <-c.closed:
+		return 0, c.Err()
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// Sends a message to the given user ID, returning the ID of the message
+// which receipts for the message will refer to. The client must be logged
+// in. The message is encrypted separately to each of the recipient's
+// devices, and to each of our own other devices so that they also see the
+// message, and then signed with our user signing key.
+func (c *Client) Send(ctx context.Context, uid string, plaintext []byte) (string, error) {
+	id := siren.NewMessageID()
+	c.trackMessage(id, uid)
+	if err := c.send(ctx, uid, id, sirenproto.Message_CONTENT, plaintext); err != nil {
+		c.untrackMessage(id)
+		return "", err
+	}
+	return id, nil
+}
+
+func (c *Client) send(ctx context.Context, uid, id string, messageType sirenproto.Message_MessageTypes, plaintext []byte) error {
+	c.mutex.Lock()
+	source, user := c.uid, c.user
+	c.mutex.Unlock()
+	if source == "" {
+		return ErrNotLoggedIn
+	}
+
+	recipient, err := c.lookupCached(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if len(recipient.DeviceEncryptionKeys) == 0 {
+		return ErrNoDevices
+	}
+
+	// Encrypt the message for each of the recipient's devices, and then for
+	// each of our own other devices, unless we're sending to ourselves in
+	// which case we already have them
+	var ciphertexts []*sirenproto.DeviceCiphertext
+	for _, k := range recipient.DeviceEncryptionKeys {
+		var ciphertext *sirenproto.DeviceCiphertext
+		var err error
+		if bytes.Equal(k, c.keys.PublicKey[:]) {
+			// We can't have a session with ourselves, so encrypt messages that
+			// we send to ourselves directly to our own device key
+			ciphertext, err = staticSeal(c.keys, k, plaintext)
+		} else {
+			ciphertext, err = c.encryptForDevice(recipient, k, plaintext)
+		}
+		if err != nil {
+			return err
+		}
+		ciphertexts = append(ciphertexts, ciphertext)
+	}
+	others := false
+	if uid != source {
+		self, err := c.lookupCached(ctx, source)
+		if err != nil {
+			return err
+		}
+		for _, k := range self.DeviceEncryptionKeys {
+			if bytes.Equal(k, c.keys.PublicKey[:]) {
+				continue
+			}
+			ciphertext, err := c.encryptForDevice(self, k, plaintext)
+			if err != nil {
+				return err
+			}
+			ciphertexts = append(ciphertexts, ciphertext)
+			others = true
+		}
+	}
+
+	envelope, err := sealEnvelope(source, uid, id, messageType, c.keys, user, ciphertexts)
+	if err != nil {
+		return err
+	}
+	encrypted, err := proto.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+
+	// The request ID is the message ID, so that if the server can't deliver
+	// the message then we know which message it is talking about
+	if err := c.writePayload(&sirenproto.Payload{
+		Contents: &sirenproto.Payload_Message{
+			Message: &sirenproto.Message{
+				Destination:      uid,
+				EncryptedMessage: encrypted,
+				MessageID:        id,
+				Type:             messageType,
+			},
+		},
+		RequestID: id,
+	}); err != nil {
+		return err
+	}
+
+	// Send a copy of the same envelope to ourselves, so that the server will
+	// deliver it to our other devices
+	if others {
+		return c.writePayload(&sirenproto.Payload{
+			Contents: &sirenproto.Payload_Message{
+				Message: &sirenproto.Message{
+					Destination:      source,
+					EncryptedMessage: encrypted,
+					MessageID:        id,
+					Type:             messageType,
+				},
+			},
+		})
+	}
+	return nil
+}
+
+// Sends a payload and waits for the server to respond with an Ack for it.
+func (c *Client) request(ctx context.Context, payload *sirenproto.Payload) (*sirenproto.Ack, error) {
+	rc := make(chan *sirenproto.Ack, 1)
+	payload.RequestID = siren.NewMessageID()
+	c.mutex.Lock()
+	c.acks[payload.RequestID] = rc
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		delete(c.acks, payload.RequestID)
+		c.mutex.Unlock()
+	}()
+
+	if err := c.writePayload(payload); err != nil {
+		return nil, err
+	}
+
+	select {
+	case ack := <-rc:
+		return ack, nil
+	case <-c.closed:
+		return nil, c.Err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Returns the server's public key and the nonces for each direction, which
+// are known once the server has sent its HelloIAm.
+func (c *Client) serverKeys() ([32]byte, *siren.NonceSequence, *siren.NonceSequence) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.remotePublicKey, c.sendNonces, c.receiveNonces
+}
+
+// Writes a payload to the server. Every payload carries a request ID, so
+// that any Ack that the server sends for it can be matched up with it.
+func (c *Client) writePayload(payload *sirenproto.Payload) error {
+	if payload.RequestID == "" {
+		payload.RequestID = siren.NewMessageID()
+	}
+	// Payloads have to be written in the order that they were encrypted in,
+	// as the server refuses any nonce counter that goes backwards
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	key, nonces, _ := c.serverKeys()
+	enc, err := siren.EncryptPayload(key, c.keys.PrivateKey, nonces, payload)
+	if err != nil {
+		return err
+	}
+	return c.writePacketLocked(&sirenproto.Packet{
+		Version: c.packetVersion(),
+		PayloadType: &sirenproto.Packet_EncryptedPayload{
+			EncryptedPayload: enc,
+		},
+	})
+}
+
+func (c *Client) writePacket(packet *sirenproto.Packet) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.writePacketLocked(packet)
+}
+
+func (c *Client) writePacketLocked(packet *sirenproto.Packet) error {
+	out, err := proto.Marshal(packet)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-c.closed:
+		return c.Err()
+	default:
+	}
+	// Each packet is prefixed with its length, as the stream itself has no
+	// packet boundaries
+	framed := make([]byte, 4+len(out))
+	binary.BigEndian.PutUint32(framed[:4], uint32(len(out)))
+	copy(framed[4:], out)
+	if _, err := c.conn.Write(framed); err != nil {
+		c.shutdown(err)
+		return err
+	}
+	return nil
+}
+
+func (c *Client) readLoop() {
+	defer close(c.inbound)
+	var header [4]byte
+
+	for {
+		if _, err := io.ReadFull(c.conn, header[:]); err != nil {
+			c.shutdown(err)
+			return
+		}
+		length := binary.BigEndian.Uint32(header[:])
+		if length > maximumPacketSize {
+			c.shutdown(errors.New("Packet from server is too large"))
+			return
+		}
+		buf := make([]byte, length)
+		if _, err := io.ReadFull(c.conn, buf); err != nil {
+			c.shutdown(err)
+			return
+		}
+
+		packet := &sirenproto.Packet{}
+		if err := proto.Unmarshal(buf, packet); err != nil {
+			continue
+		}
+
+		switch received := packet.PayloadType.(type) {
+		case *sirenproto.Packet_Payload:
+			c.handleUnencrypted(received.Payload)
+		case *sirenproto.Packet_EncryptedPayload:
+			// Before we know the server's public key we won't be able to decrypt
+			// anything, so just drop those packets - the server will retry
+			key, _, nonces := c.serverKeys()
+			payload, err := siren.DecryptPayload(key, c.keys.PrivateKey, nonces, received.EncryptedPayload)
+			if err != nil {
+				continue
+			}
+			// Until the server has proved its key by sending back our
+			// challenge, nothing else that it sends can be trusted. Once it
+			// has, the session is authenticated
+			c.mutex.Lock()
+			authenticated := c.authenticated
+			c.mutex.Unlock()
+			if proof, ok := payload.Contents.(*sirenproto.Payload_HelloProof); ok {
+				if !authenticated && bytes.Equal(proof.HelloProof.GetChallenge(), c.challenge[:]) {
+					c.readyOnce.Do(func() {
+						c.mutex.Lock()
+						c.authenticated = true
+						c.mutex.Unlock()
+						close(c.ready)
+					})
+				}
+				continue
+			}
+			if !authenticated {
+				continue
+			}
+			if err := c.handleEncrypted(payload); err != nil {
+				c.shutdown(err)
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) handleUnencrypted(payload *sirenproto.Payload) {
+	switch received := payload.Contents.(type) {
+	case *sirenproto.Payload_HelloIAm:
+		// The server has told us its public key and which protocol versions
+		// and features it supports, so store them and then prove that we hold
+		// our own private key by sending the server's challenge back,
+		// encrypted, which completes the handshake
+		c.mutex.Lock()
+		if c.authenticated || len(received.HelloIAm.PublicKey) != len(c.remotePublicKey) ||
+			len(received.HelloIAm.Challenge) != len(c.challenge) {
+			c.mutex.Unlock()
+			return
+		}
+		version, features, err := siren.Negotiate(received.HelloIAm, clientFeatures)
+		if err != nil {
+			c.mutex.Unlock()
+			c.shutdown(&AckError{
+				Condition: sirenproto.Ack_VERSION_UNSUPPORTED,
+				Text:      fmt.Sprintf("Server speaks protocol versions %d to %d", received.HelloIAm.MinVersion, received.HelloIAm.MaxVersion),
+			})
+			return
+		}
+		copy(c.remotePublicKey[:], received.HelloIAm.PublicKey)
+		c.sendNonces = siren.NewNonceSequence(c.challenge[:], received.HelloIAm.Challenge)
+		c.receiveNonces = siren.NewNonceSequence(received.HelloIAm.Challenge, c.challenge[:])
+		c.version, c.features = version, features
+		c.mutex.Unlock()
+		c.writePayload(&sirenproto.Payload{
+			Contents: &sirenproto.Payload_HelloProof{
+				HelloProof: &sirenproto.HelloProof{
+					Challenge: received.HelloIAm.Challenge,
+				},
+			},
+		})
+	case *sirenproto.Payload_Ack:
+		// The server sends unencrypted Acks when it refuses the handshake,
+		// i.e. because we have no protocol version in common, in which case
+		// there's no point in waiting any longer
+		c.handleAck(received.Ack)
+		c.mutex.Lock()
+		authenticated := c.authenticated
+		c.mutex.Unlock()
+		switch received.Ack.Condition {
+		case sirenproto.Ack_TERMINATE, sirenproto.Ack_VERSION_UNSUPPORTED:
+			if !authenticated {
+				c.shutdown(ackError(received.Ack))
+			}
+		}
+	}
+}
+
+func (c *Client) handleEncrypted(payload *sirenproto.Payload) error {
+	switch received := payload.Contents.(type) {
+	case *sirenproto.Payload_Ping:
+		// Respond to pings from the server so that it knows we're still here
+		return c.writePayload(&sirenproto.Payload{
+			Contents: &sirenproto.Payload_Pong{
+				Pong: &sirenproto.Pong{
+					Sequence: received.Ping.Sequence,
+				},
+			},
+		})
+	case *sirenproto.Payload_Pong:
+		now := time.Now()
+		c.mutex.Lock()
+		for _, rc := range c.pings[received.Pong.Sequence] {
+			rc <- now
+		}
+		delete(c.pings, received.Pong.Sequence)
+		c.mutex.Unlock()
+	case *sirenproto.Payload_DirectoryResponse:
+		response := received.DirectoryResponse
+		entry := &DirectoryEntry{
+			UID:                  response.UID,
+			UserSigningKey:       response.UserSigningKey,
+			DeviceEncryptionKeys: response.DeviceEncryptionKey,
+		}
+		for _, b := range response.PreKeyBundles {
+			bundle := &PreKeyBundle{
+				DeviceKey:             b.DeviceKey,
+				SignedPreKey:          b.SignedPreKey,
+				SignedPreKeySignature: b.SignedPreKeySignature,
+			}
+			if len(b.OneTimePreKeys) > 0 {
+				bundle.OneTimePreKey = b.OneTimePreKeys[0]
+			}
+			entry.PreKeyBundles = append(entry.PreKeyBundles, bundle)
+		}
+		c.mutex.Lock()
+		for _, rc := range c.lookups[response.UID] {
+			rc <- entry
+		}
+		delete(c.lookups, response.UID)
+		c.mutex.Unlock()
+	case *sirenproto.Payload_GroupState:
+		c.handleGroupState(received.GroupState)
+	case *sirenproto.Payload_Receipt:
+		c.handleReceipt(received.Receipt)
+	case *sirenproto.Payload_Presence:
+		c.handlePresence(received.Presence)
+	case *sirenproto.Payload_Typing:
+		c.handleTyping(received.Typing)
+	case *sirenproto.Payload_DeviceLink:
+		c.handleDeviceLink(received.DeviceLink)
+	case *sirenproto.Payload_DeviceNotification:
+		// Checking the notification may involve looking up the contact in
+		// the directory, which we can't wait for here
+		go c.handleDeviceNotification(received.DeviceNotification)
+	case *sirenproto.Payload_Ack:
+		c.handleAck(received.Ack)
+		if received.Ack.Condition == sirenproto.Ack_TERMINATE {
+			return ackError(received.Ack)
+		}
+	case *sirenproto.Payload_Message:
+		// Decrypting the message may involve looking up the sender in the
+		// directory, which we can't wait for here, so pass the message to
+		// the message loop instead
+		select {
+		case c.inbound <- received.Message:
+		case <-c.closed:
+		}
+	}
+	return nil
+}
+
+func (c *Client) handleAck(ack *sirenproto.Ack) {
+	// Acks are delivered to the request that is waiting for them. Nothing
+	// waits for Acks for messages, so if the server couldn't deliver one of
+	// our messages then it is reported as a failed receipt instead
+	c.mutex.Lock()
+	rc, waiting := c.acks[ack.RequestID]
+	delete(c.acks, ack.RequestID)
+	_, sent := c.sent[ack.RequestID]
+	c.mutex.Unlock()
+	switch {
+	case waiting:
+		rc <- ack
+	case sent && ack.Condition != sirenproto.Ack_SUCCESS:
+		c.receipt(&Receipt{
+			MessageID: ack.RequestID,
+			Type:      ReceiptFailed,
+			Err:       ackError(ack),
+			Time:      time.Now(),
+		})
+	}
+}
+
+func (c *Client) messageLoop() {
+	defer close(c.messages)
+
+	for received := range c.inbound {
+		message, err := c.openMessage(received)
+		if err != nil {
+			// Messages which can't be decrypted or verified are dropped. This
+			// includes our own messages which were sent from this device
+			continue
+		}
+		if received.Type == sirenproto.Message_READ_RECEIPT {
+			c.handleReadReceipt(message)
+			continue
+		} else if received.Type != sirenproto.Message_CONTENT {
+			continue
+		}
+		select {
+		case c.messages <- message:
+		case <-c.closed:
+		}
+	}
+}
+
+func (c *Client) openMessage(received *sirenproto.Message) (*Message, error) {
+	envelope := &sirenproto.MessageEnvelope{}
+	if err := proto.Unmarshal(received.EncryptedMessage, envelope); err != nil {
+		return nil, err
+	}
+	// The envelope is addressed to the group for group messages, otherwise
+	// to the destination of the message, unless it's a copy of a message
+	// sent by one of our other devices
+	if received.GroupID != "" {
+		if envelope.Destination != received.GroupID {
+			return nil, errors.New("Message group does not match envelope")
+		}
+	} else if envelope.Destination != received.Destination && received.Source != received.Destination {
+		return nil, errors.New("Message destination does not match envelope")
+	}
+	if envelope.MessageID != received.MessageID || envelope.Type != received.Type {
+		return nil, errors.New("Message ID does not match envelope")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	sender, err := c.lookupCached(ctx, received.Source)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := openEnvelope(received.Source, c.keys, sender, envelope)
+	if err == ErrBadSignature || err == ErrUnknownDevice {
+		// The sender may have changed their keys since we cached them, so
+		// look them up again and retry
+		if sender, err = c.Lookup(ctx, received.Source); err != nil {
+			return nil, err
+		}
+		ciphertext, err = openEnvelope(received.Source, c.keys, sender, envelope)
+	}
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := c.decryptFromDevice(envelope.SenderDeviceKey, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		ID:           envelope.MessageID,
+		Source:       received.Source,
+		SourceDevice: envelope.SenderDeviceKey,
+		Destination:  envelope.Destination,
+		Group:        received.GroupID,
+		Contents:     plaintext,
+		Received:     time.Now(),
+	}, nil
+}
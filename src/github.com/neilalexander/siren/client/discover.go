@@ -0,0 +1,32 @@
+package client
+
+import "net"
+import "errors"
+import "strconv"
+import "strings"
+
+import "github.com/neilalexander/siren"
+
+// Finds the addresses of the Siren server for a domain by looking up the
+// _siren._tcp SRV record, in the same way that servers find each other for
+// federation. The addresses are returned in order of preference, in the
+// "host:port" form that Dial accepts. If the resolver is nil then the system
+// DNS resolver is used.
+func Discover(domain string, resolver siren.Resolver) ([]string, error) {
+	if resolver == nil {
+		resolver = siren.NewSystemResolver()
+	}
+	_, records, err := resolver.LookupSRV("siren", "tcp", domain)
+	if err != nil {
+		return nil, err
+	}
+	var addresses []string
+	for _, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+		addresses = append(addresses, net.JoinHostPort(target, strconv.Itoa(int(record.Port))))
+	}
+	if len(addresses) == 0 {
+		return nil, errors.New("No Siren server found for " + domain)
+	}
+	return addresses, nil
+}
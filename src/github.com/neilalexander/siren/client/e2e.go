@@ -0,0 +1,155 @@
+package client
+
+import "bytes"
+import "errors"
+import "crypto/rand"
+import "encoding/binary"
+
+import "github.com/neilalexander/siren"
+import "github.com/neilalexander/siren/sirenproto"
+import "golang.org/x/crypto/nacl/box"
+import "golang.org/x/crypto/ed25519"
+
+var ErrNoDevices = errors.New("User has no registered devices")
+var ErrNotForThisDevice = errors.New("Message was not encrypted for this device")
+var ErrUnknownDevice = errors.New("Message was sent from an unknown device")
+var ErrBadSignature = errors.New("Message signature is not valid")
+var ErrNoPreKeys = errors.New("Device has not published any prekeys")
+var ErrStaticAfterRatchet = errors.New("Message was not encrypted with our session with the device")
+
+// The UserKeys are the Ed25519 keys for the user signing key (USK). Every
+// device belonging to a user shares the same USK, and every message that a
+// user sends is signed with it.
+type UserKeys struct {
+	PublicKey  [32]byte
+	PrivateKey [64]byte
+}
+
+// Generates a new set of UserKeys.
+func NewUserKeys() UserKeys {
+	publicKey, privateKey := siren.NewSignatureKeys()
+	return UserKeys{
+		PublicKey:  *publicKey,
+		PrivateKey: *privateKey,
+	}
+}
+
+// Signs the envelope containing the ciphertexts for each recipient device
+// with the sender's USK. The source and destination are included in the
+// signature so that the envelope can't be replayed from a different user or
+// to a different user, and the message ID and type so that receipts can't
+// be pointed at a different message.
+func sealEnvelope(source, destination, id string, messageType sirenproto.Message_MessageTypes, device DeviceKeys, user UserKeys, ciphertexts []*sirenproto.DeviceCiphertext) (*sirenproto.MessageEnvelope, error) {
+	if len(ciphertexts) == 0 {
+		return nil, ErrNoDevices
+	}
+	envelope := &sirenproto.MessageEnvelope{
+		SenderDeviceKey: device.PublicKey[:],
+		Destination:     destination,
+		Ciphertexts:     ciphertexts,
+		MessageID:       id,
+		Type:            messageType,
+	}
+	envelope.Signature = ed25519.Sign(user.PrivateKey[:], envelopeSignatureData(source, envelope))
+	return envelope, nil
+}
+
+// Verifies the signature on the envelope using the sender's USK, checks that
+// it was sent from one of the sender's registered devices and then returns
+// the ciphertext that was encrypted for this device.
+func openEnvelope(source string, device DeviceKeys, sender *DirectoryEntry, envelope *sirenproto.MessageEnvelope) (*sirenproto.DeviceCiphertext, error) {
+	if len(sender.UserSigningKey) != ed25519.PublicKeySize ||
+		!ed25519.Verify(sender.UserSigningKey, envelopeSignatureData(source, envelope), envelope.Signature) {
+		return nil, ErrBadSignature
+	}
+
+	known := false
+	for _, k := range sender.DeviceEncryptionKeys {
+		if bytes.Equal(k, envelope.SenderDeviceKey) && len(k) == 32 {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return nil, ErrUnknownDevice
+	}
+
+	for _, c := range envelope.Ciphertexts {
+		if bytes.Equal(c.DeviceKey, device.PublicKey[:]) {
+			return c, nil
+		}
+	}
+	return nil, ErrNotForThisDevice
+}
+
+// Encrypts the plaintext directly to the long-term key of a device. This
+// gives no forward secrecy, so it is only used for devices which haven't
+// published any prekeys if AllowStaticEncryption has been called.
+func staticSeal(device DeviceKeys, recipient []byte, plaintext []byte) (*sirenproto.DeviceCiphertext, error) {
+	if len(recipient) != 32 {
+		return nil, errors.New("Invalid device key")
+	}
+	var recipientKey [32]byte
+	var nonce [24]byte
+	copy(recipientKey[:], recipient)
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	return &sirenproto.DeviceCiphertext{
+		DeviceKey:  recipientKey[:],
+		Nonce:      nonce[:],
+		Ciphertext: box.Seal(nil, plaintext, &nonce, &recipientKey, &device.PrivateKey),
+	}, nil
+}
+
+func staticOpen(device DeviceKeys, sender []byte, c *sirenproto.DeviceCiphertext) ([]byte, error) {
+	if len(sender) != 32 || len(c.Nonce) != 24 {
+		return nil, errors.New("Failed to decrypt message")
+	}
+	var senderKey [32]byte
+	var nonce [24]byte
+	copy(senderKey[:], sender)
+	copy(nonce[:], c.Nonce)
+	plaintext, ok := box.Open(nil, c.Ciphertext, &nonce, &senderKey, &device.PrivateKey)
+	if !ok {
+		return nil, errors.New("Failed to decrypt message")
+	}
+	return plaintext, nil
+}
+
+// Builds the data that is covered by the envelope signature. Each field is
+// prefixed with its length so that the boundaries between fields can't be
+// moved around.
+func envelopeSignatureData(source string, envelope *sirenproto.MessageEnvelope) []byte {
+	var buf bytes.Buffer
+	write := func(b []byte) {
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(b)))
+		buf.Write(length[:])
+		buf.Write(b)
+	}
+	write([]byte("siren-message-envelope"))
+	write([]byte(source))
+	write([]byte(envelope.Destination))
+	write(envelope.SenderDeviceKey)
+	var messageType [4]byte
+	binary.BigEndian.PutUint32(messageType[:], uint32(envelope.Type))
+	write([]byte(envelope.MessageID))
+	write(messageType[:])
+	for _, c := range envelope.Ciphertexts {
+		write(c.DeviceKey)
+		write(c.Nonce)
+		write(c.Ciphertext)
+		if h := c.Ratchet; h != nil {
+			var counters [8]byte
+			binary.BigEndian.PutUint32(counters[0:4], h.PreviousCounter)
+			binary.BigEndian.PutUint32(counters[4:8], h.Counter)
+			write(h.RatchetKey)
+			write(counters[:])
+			write(h.EphemeralKey)
+			write(h.SignedPreKey)
+			write(h.OneTimePreKey)
+		}
+	}
+	return buf.Bytes()
+}
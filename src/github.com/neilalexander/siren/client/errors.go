@@ -0,0 +1,43 @@
+package client
+
+import "github.com/neilalexander/siren/sirenproto"
+
+// An AckError is returned when the server refuses a request, or reports that
+// a message couldn't be delivered. Condition is the condition from the
+// server's Ack and Text is the server's explanation. Use errors.Is with the
+// errors below to check for a particular condition, i.e.
+// errors.Is(err, ErrNotFound).
+type AckError struct {
+	Condition sirenproto.Ack_Conditions
+	Text      string
+}
+
+func (e *AckError) Error() string {
+	return e.Text
+}
+
+// Matches any AckError with the same condition.
+func (e *AckError) Is(target error) bool {
+	t, ok := target.(*AckError)
+	return ok && t.Condition == e.Condition
+}
+
+var ErrTerminated = &AckError{Condition: sirenproto.Ack_TERMINATE, Text: "Connection terminated by the server"}
+var ErrInvalidRequest = &AckError{Condition: sirenproto.Ack_INVALID_PACKET, Text: "Invalid request"}
+var ErrNotImplemented = &AckError{Condition: sirenproto.Ack_NOT_IMPLEMENTED, Text: "Not implemented by the server"}
+var ErrRequiresEncryption = &AckError{Condition: sirenproto.Ack_REQUIRES_ENCRYPTION, Text: "Request must be encrypted"}
+var ErrRateLimited = &AckError{Condition: sirenproto.Ack_RATE_LIMITED, Text: "Rate limited by the server"}
+var ErrRemoteUnavailable = &AckError{Condition: sirenproto.Ack_REMOTE_UNAVAILABLE, Text: "Remote server is unavailable"}
+var ErrNotFound = &AckError{Condition: sirenproto.Ack_NOT_FOUND, Text: "Not found"}
+var ErrUnauthorized = &AckError{Condition: sirenproto.Ack_UNAUTHORIZED, Text: "Not authorized"}
+var ErrQuotaExceeded = &AckError{Condition: sirenproto.Ack_QUOTA_EXCEEDED, Text: "Quota exceeded"}
+var ErrVersionUnsupported = &AckError{Condition: sirenproto.Ack_VERSION_UNSUPPORTED, Text: "Version not supported by the server"}
+
+// Returns the error for an Ack from the server, or nil if the Ack was
+// successful.
+func ackError(ack *sirenproto.Ack) error {
+	if ack.Condition == sirenproto.Ack_SUCCESS {
+		return nil
+	}
+	return &AckError{Condition: ack.Condition, Text: ack.Text}
+}
@@ -0,0 +1,278 @@
+package client
+
+import "bytes"
+import "errors"
+import "context"
+import "strings"
+import "crypto/rand"
+import "encoding/hex"
+
+import "github.com/neilalexander/siren"
+import "github.com/neilalexander/siren/sirenproto"
+import "golang.org/x/crypto/ed25519"
+import proto "github.com/golang/protobuf/proto"
+
+var ErrUnknownGroup = errors.New("Group does not exist or we are not a member of it")
+
+// A Group is a conversation between a number of users, which is hosted by
+// the server for the domain in the group ID. Messages sent to the group are
+// fanned out to every member by that server.
+type Group struct {
+	ID      string
+	Version uint64
+	Members []GroupMember
+}
+
+type GroupMember struct {
+	UID   string
+	Admin bool
+}
+
+// Returns true if the given user is a member of the group.
+func (g *Group) IsMember(uid string) bool {
+	for _, m := range g.Members {
+		if m.UID == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the given user is an admin of the group.
+func (g *Group) IsAdmin(uid string) bool {
+	for _, m := range g.Members {
+		if m.UID == uid {
+			return m.Admin
+		}
+	}
+	return false
+}
+
+// Creates a new group, hosted by our own server, with ourselves as the only
+// member and admin. Returns the ID of the new group.
+func (c *Client) CreateGroup(ctx context.Context) (string, error) {
+	uid := c.UID()
+	if uid == "" {
+		return "", ErrNotLoggedIn
+	}
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	gid := hex.EncodeToString(id[:]) + uid[strings.LastIndex(uid, "@"):]
+	if err := c.updateGroup(ctx, &sirenproto.GroupUpdate{
+		GroupID: gid,
+		Type:    sirenproto.GroupUpdate_CREATE,
+	}); err != nil {
+		return "", err
+	}
+	return gid, nil
+}
+
+// Adds a user to a group. Only admins can add members.
+func (c *Client) AddGroupMember(ctx context.Context, gid, uid string, admin bool) error {
+	return c.changeGroup(ctx, gid, sirenproto.GroupUpdate_ADD_MEMBER, uid, admin)
+}
+
+// Removes a user from a group. Only admins can remove other members.
+func (c *Client) RemoveGroupMember(ctx context.Context, gid, uid string) error {
+	return c.changeGroup(ctx, gid, sirenproto.GroupUpdate_REMOVE_MEMBER, uid, false)
+}
+
+// Makes a member of a group an admin, or stops them from being one. Only
+// admins can change admins.
+func (c *Client) SetGroupAdmin(ctx context.Context, gid, uid string, admin bool) error {
+	return c.changeGroup(ctx, gid, sirenproto.GroupUpdate_SET_ADMIN, uid, admin)
+}
+
+// Leaves a group.
+func (c *Client) LeaveGroup(ctx context.Context, gid string) error {
+	return c.changeGroup(ctx, gid, sirenproto.GroupUpdate_REMOVE_MEMBER, c.UID(), false)
+}
+
+func (c *Client) changeGroup(ctx context.Context, gid string, updateType sirenproto.GroupUpdate_UpdateTypes, uid string, admin bool) error {
+	// Updates are made against the current version of the group, so fetch
+	// that first
+	group, err := c.Group(ctx, gid)
+	if err != nil {
+		return err
+	}
+	return c.updateGroup(ctx, &sirenproto.GroupUpdate{
+		GroupID: gid,
+		Type:    updateType,
+		Member:  uid,
+		Admin:   admin,
+		Version: group.Version,
+	})
+}
+
+// Signs a group update with our user signing key and sends it to our server.
+// If the group is hosted by another server then the update is passed on to
+// it, and the new state of the group will arrive once it has been applied.
+func (c *Client) updateGroup(ctx context.Context, update *sirenproto.GroupUpdate) error {
+	if err := c.require(siren.FEATURE_GROUPS); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	uid, user := c.uid, c.user
+	c.mutex.Unlock()
+	if uid == "" {
+		return ErrNotLoggedIn
+	}
+	update.Author = uid
+	update.Signature = ed25519.Sign(user.PrivateKey[:], siren.GroupUpdateSignatureData(update))
+
+	ack, err := c.request(ctx, &sirenproto.Payload{
+		Contents: &sirenproto.Payload_GroupUpdate{
+			GroupUpdate: update,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := ackError(ack); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Asks the server that hosts the group for the current state of the group.
+// Only members of a group can see its state.
+func (c *Client) Group(ctx context.Context, gid string) (*Group, error) {
+	if c.UID() == "" {
+		return nil, ErrNotLoggedIn
+	}
+	if err := c.require(siren.FEATURE_GROUPS); err != nil {
+		return nil, err
+	}
+	rc := make(chan *Group, 1)
+	c.mutex.Lock()
+	c.groupQueries[gid] = append(c.groupQueries[gid], rc)
+	c.mutex.Unlock()
+	defer c.cancelGroupQuery(gid, rc)
+
+	if err := c.writePayload(&sirenproto.Payload{
+		Contents: &sirenproto.Payload_GroupRequest{
+			GroupRequest: &sirenproto.GroupRequest{
+				GroupID: gid,
+			},
+		},
+	}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case group := <-rc:
+		if len(group.Members) == 0 {
+			return nil, ErrUnknownGroup
+		}
+		return group, nil
+	case <-c.closed:
+		return nil, c.Err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) cancelGroupQuery(gid string, rc chan *Group) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	waiting := c.groupQueries[gid][:0]
+	for _, w := range c.groupQueries[gid] {
+		if w != rc {
+			waiting = append(waiting, w)
+		}
+	}
+	if len(waiting) > 0 {
+		c.groupQueries[gid] = waiting
+	} else {
+		delete(c.groupQueries, gid)
+	}
+}
+
+// Handles the state of a group arriving from the server, either because we
+// asked for it or because the group has changed.
+func (c *Client) handleGroupState(state *sirenproto.GroupState) {
+	group := &Group{
+		ID:      state.GroupID,
+		Version: state.Version,
+	}
+	for _, m := range state.Members {
+		group.Members = append(group.Members, GroupMember{
+			UID:   m.UID,
+			Admin: m.Admin,
+		})
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, rc := range c.groupQueries[state.GroupID] {
+		rc <- group
+	}
+	delete(c.groupQueries, state.GroupID)
+}
+
+// Sends a message to every member of a group. The message is encrypted for
+// every device of every member, other than this one, and uploaded once. The
+// server that hosts the group sends a copy to each member. Returns the ID of
+// the message, which receipts for the message will refer to.
+func (c *Client) SendGroup(ctx context.Context, gid string, plaintext []byte) (string, error) {
+	id := siren.NewMessageID()
+	c.trackMessage(id, gid)
+	if err := c.sendGroup(ctx, gid, id, plaintext); err != nil {
+		c.untrackMessage(id)
+		return "", err
+	}
+	return id, nil
+}
+
+func (c *Client) sendGroup(ctx context.Context, gid, id string, plaintext []byte) error {
+	if err := c.require(siren.FEATURE_GROUPS); err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	source, user := c.uid, c.user
+	c.mutex.Unlock()
+	if source == "" {
+		return ErrNotLoggedIn
+	}
+	group, err := c.Group(ctx, gid)
+	if err != nil {
+		return err
+	}
+
+	var ciphertexts []*sirenproto.DeviceCiphertext
+	for _, member := range group.Members {
+		entry, err := c.lookupCached(ctx, member.UID)
+		if err != nil {
+			return err
+		}
+		for _, k := range entry.DeviceEncryptionKeys {
+			if member.UID == source && bytes.Equal(k, c.keys.PublicKey[:]) {
+				continue
+			}
+			ciphertext, err := c.encryptForDevice(entry, k, plaintext)
+			if err != nil {
+				return err
+			}
+			ciphertexts = append(ciphertexts, ciphertext)
+		}
+	}
+
+	envelope, err := sealEnvelope(source, gid, id, sirenproto.Message_CONTENT, c.keys, user, ciphertexts)
+	if err != nil {
+		return err
+	}
+	encrypted, err := proto.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	return c.writePayload(&sirenproto.Payload{
+		Contents: &sirenproto.Payload_Message{
+			Message: &sirenproto.Message{
+				GroupID:          gid,
+				EncryptedMessage: encrypted,
+				MessageID:        id,
+			},
+		},
+	})
+}
@@ -0,0 +1,241 @@
+package client
+
+import "time"
+import "bytes"
+import "errors"
+import "context"
+import "strings"
+import "crypto/sha256"
+import "encoding/base32"
+
+import "github.com/neilalexander/siren"
+import "github.com/neilalexander/siren/sirenproto"
+import proto "github.com/golang/protobuf/proto"
+import "golang.org/x/crypto/ed25519"
+
+// The number of bytes of checksum on the end of a link code, which catches
+// mistakes when the code is typed in by hand.
+const linkCodeChecksumLen = 2
+
+var ErrInvalidLinkCode = errors.New("Invalid link code")
+var ErrInvalidLinkGrant = errors.New("Link grant is not valid for this user")
+
+// A DeviceChange is delivered on the DeviceChanges channel when one of our
+// contacts adds or revokes a device. The contact's directory entry has
+// already been dropped from the cache by the time that it is delivered, so
+// the next message to them will be encrypted for the new set of devices.
+type DeviceChange struct {
+	UID       string
+	DeviceKey []byte
+	Revoked   bool
+}
+
+var linkCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Returns the link code for a new device, which should be shown to the user
+// so that they can pass it to one of their existing devices out of band,
+// i.e. by typing it in or scanning it as a QR code. The code contains the
+// device key and a short checksum, split into groups to make it easier to
+// read.
+func LinkCode(keys DeviceKeys) string {
+	sum := sha256.Sum256(keys.PublicKey[:])
+	code := linkCodeEncoding.EncodeToString(append(keys.PublicKey[:], sum[:linkCodeChecksumLen]...))
+	var groups []string
+	for len(code) > 5 {
+		groups = append(groups, code[:5])
+		code = code[5:]
+	}
+	return strings.Join(append(groups, code), "-")
+}
+
+// Returns the device key from a link code created by LinkCode. Dashes,
+// spaces and the case of the code are ignored.
+func ParseLinkCode(code string) ([]byte, error) {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	decoded, err := linkCodeEncoding.DecodeString(code)
+	if err != nil || len(decoded) != 32+linkCodeChecksumLen {
+		return nil, ErrInvalidLinkCode
+	}
+	key, checksum := decoded[:32], decoded[32:]
+	sum := sha256.Sum256(key)
+	if !bytes.Equal(checksum, sum[:linkCodeChecksumLen]) {
+		return nil, ErrInvalidLinkCode
+	}
+	return key, nil
+}
+
+// Links a new device, given its link code, to our user. The device is added
+// to the user in the directory with an update signed by the user signing key
+// (USK), and then the user keys are sent to the new device, encrypted so that
+// only it can read them. The new device must be waiting in WaitForLink on
+// the same server. Any users given in notify are told about the new device,
+// which would normally be our contacts. The client must be logged in.
+func (c *Client) LinkDevice(ctx context.Context, code string, notify ...string) error {
+	deviceKey, err := ParseLinkCode(code)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	uid, user := c.uid, c.user
+	c.mutex.Unlock()
+	if uid == "" {
+		return ErrNotLoggedIn
+	}
+	if err := c.AddDevice(ctx, deviceKey, notify...); err != nil {
+		return err
+	}
+
+	grant, err := proto.Marshal(&sirenproto.LinkGrant{
+		UID:            uid,
+		UserSigningKey: user.PublicKey[:],
+		UserPrivateKey: user.PrivateKey[:],
+	})
+	if err != nil {
+		return err
+	}
+	sealed, err := staticSeal(c.keys, deviceKey, grant)
+	if err != nil {
+		return err
+	}
+	ack, err := c.request(ctx, &sirenproto.Payload{
+		Contents: &sirenproto.Payload_DeviceLink{
+			DeviceLink: &sirenproto.DeviceLink{
+				UID:       uid,
+				DeviceKey: deviceKey,
+				Grant:     sealed,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := ackError(ack); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Waits for one of the user's existing devices to link this device using
+// LinkDevice, and then logs in as the user. The link code for this device
+// should be shown to the user while waiting. The user ID is the user that
+// we expect to be linked to, so that a link from anyone else is refused.
+// Returns the user keys, which should be stored so that the device can log
+// in again later.
+func (c *Client) WaitForLink(ctx context.Context, uid string) (UserKeys, error) {
+	rc := make(chan *sirenproto.DeviceLink, 1)
+	c.mutex.Lock()
+	c.links = append(c.links, rc)
+	c.mutex.Unlock()
+	defer c.cancelLink(rc)
+
+	ack, err := c.request(ctx, &sirenproto.Payload{
+		Contents: &sirenproto.Payload_DeviceLink{
+			DeviceLink: &sirenproto.DeviceLink{
+				DeviceKey: c.keys.PublicKey[:],
+			},
+		},
+	})
+	if err != nil {
+		return UserKeys{}, err
+	}
+	if err := ackError(ack); err != nil {
+		return UserKeys{}, err
+	}
+
+	var link *sirenproto.DeviceLink
+	select {
+	case link = <-rc:
+	case <-c.closed:
+		return UserKeys{}, c.Err()
+	case <-ctx.Done():
+		return UserKeys{}, ctx.Err()
+	}
+
+	// The server only passes on grants from devices which are logged in as
+	// the user in the link, but we check that it's the user we expected and
+	// that the keys in the grant belong together. Login checks that the USK
+	// matches the directory
+	if link.UID != uid || link.Grant == nil {
+		return UserKeys{}, ErrInvalidLinkGrant
+	}
+	plaintext, err := staticOpen(c.keys, link.SenderDeviceKey, link.Grant)
+	if err != nil {
+		return UserKeys{}, err
+	}
+	grant := &sirenproto.LinkGrant{}
+	if err := proto.Unmarshal(plaintext, grant); err != nil {
+		return UserKeys{}, err
+	}
+	var user UserKeys
+	if grant.UID != uid || len(grant.UserSigningKey) != len(user.PublicKey) || len(grant.UserPrivateKey) != len(user.PrivateKey) {
+		return UserKeys{}, ErrInvalidLinkGrant
+	}
+	copy(user.PublicKey[:], grant.UserSigningKey)
+	copy(user.PrivateKey[:], grant.UserPrivateKey)
+	if !bytes.Equal(ed25519.PrivateKey(user.PrivateKey[:]).Public().(ed25519.PublicKey), user.PublicKey[:]) {
+		return UserKeys{}, ErrInvalidLinkGrant
+	}
+
+	if err := c.Login(ctx, uid, user); err != nil {
+		return UserKeys{}, err
+	}
+	return user, nil
+}
+
+func (c *Client) cancelLink(rc chan *sirenproto.DeviceLink) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	links := c.links[:0]
+	for _, l := range c.links {
+		if l != rc {
+			links = append(links, l)
+		}
+	}
+	c.links = links
+}
+
+func (c *Client) handleDeviceLink(link *sirenproto.DeviceLink) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, rc := range c.links {
+		select {
+		case rc <- link:
+		default:
+		}
+	}
+}
+
+// Returns the channel on which changes to the devices of our contacts are
+// delivered. Changes are dropped if nothing is reading from the channel.
+func (c *Client) DeviceChanges() <-chan *DeviceChange {
+	return c.deviceChanges
+}
+
+func (c *Client) handleDeviceNotification(notification *sirenproto.DeviceNotification) {
+	// Check that the update was signed by the contact's user signing key
+	// before believing it, as it passed through their server and ours
+	update := notification.Update
+	if update == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	entry, err := c.lookupCached(ctx, update.UID)
+	if err != nil || len(entry.UserSigningKey) != ed25519.PublicKeySize ||
+		!ed25519.Verify(entry.UserSigningKey, siren.DeviceUpdateSignatureData(update), update.Signature) {
+		return
+	}
+
+	c.mutex.Lock()
+	delete(c.directory, update.UID)
+	c.mutex.Unlock()
+
+	select {
+	case c.deviceChanges <- &DeviceChange{
+		UID:       update.UID,
+		DeviceKey: update.DeviceKey,
+		Revoked:   update.Revoke,
+	}:
+	default:
+	}
+}
@@ -0,0 +1,173 @@
+package client
+
+import "time"
+import "context"
+
+import "github.com/neilalexander/siren"
+import "github.com/neilalexander/siren/sirenproto"
+
+type PresenceState int
+
+const (
+	PresenceOffline PresenceState = iota
+	PresenceOnline
+	PresenceAway
+)
+
+func (s PresenceState) String() string {
+	switch s {
+	case PresenceOnline:
+		return "online"
+	case PresenceAway:
+		return "away"
+	default:
+		return "offline"
+	}
+}
+
+// A Presence is delivered on the PresenceUpdates channel when the presence of
+// a user that we subscribed to changes. LastSeen is the last time that one
+// of the user's devices was online, and may be zero if the user is hiding it.
+type Presence struct {
+	UID      string
+	State    PresenceState
+	LastSeen time.Time
+}
+
+// A Typing notification is delivered on the TypingUpdates channel when a
+// user starts or stops typing a message to us.
+type Typing struct {
+	UID    string
+	Typing bool
+	Time   time.Time
+}
+
+// Sets the presence of this device, and starts sharing our presence with the
+// users that have subscribed to it. Our presence is online if any of our
+// devices are online, and away if all of them are away. Setting our
+// presence to offline stops it from being shared at all, until it is set to
+// online or away again. The client must be logged in.
+func (c *Client) SetPresence(ctx context.Context, state PresenceState) error {
+	if err := c.require(siren.FEATURE_PRESENCE); err != nil {
+		return err
+	}
+	var protoState sirenproto.Presence_States
+	switch state {
+	case PresenceOnline:
+		protoState = sirenproto.Presence_ONLINE
+	case PresenceAway:
+		protoState = sirenproto.Presence_AWAY
+	default:
+		protoState = sirenproto.Presence_OFFLINE
+	}
+	ack, err := c.request(ctx, &sirenproto.Payload{
+		Contents: &sirenproto.Payload_Presence{
+			Presence: &sirenproto.Presence{
+				State: protoState,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := ackError(ack); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Subscribes to the presence of a user. The current presence is delivered
+// on the PresenceUpdates channel straight away, followed by any changes,
+// for as long as we are online and the user is sharing their presence.
+// Subscriptions don't last across logins. The client must be logged in.
+func (c *Client) Subscribe(ctx context.Context, uid string) error {
+	return c.subscribe(ctx, uid, false)
+}
+
+// Stops receiving the presence of a user.
+func (c *Client) Unsubscribe(ctx context.Context, uid string) error {
+	return c.subscribe(ctx, uid, true)
+}
+
+func (c *Client) subscribe(ctx context.Context, uid string, unsubscribe bool) error {
+	if err := c.require(siren.FEATURE_PRESENCE); err != nil {
+		return err
+	}
+	ack, err := c.request(ctx, &sirenproto.Payload{
+		Contents: &sirenproto.Payload_PresenceSubscribe{
+			PresenceSubscribe: &sirenproto.PresenceSubscribe{
+				UID:         uid,
+				Unsubscribe: unsubscribe,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := ackError(ack); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Lets a user know that we have started or stopped typing a message to them.
+// Typing notifications are only delivered if the user is online.
+func (c *Client) SetTyping(uid string, typing bool) error {
+	if c.UID() == "" {
+		return ErrNotLoggedIn
+	}
+	if err := c.require(siren.FEATURE_PRESENCE); err != nil {
+		return err
+	}
+	return c.writePayload(&sirenproto.Payload{
+		Contents: &sirenproto.Payload_Typing{
+			Typing: &sirenproto.Typing{
+				Destination: uid,
+				Typing:      typing,
+			},
+		},
+	})
+}
+
+// Returns the channel on which the presence of users that we subscribed to
+// is delivered. Updates are dropped if nothing is reading from the channel.
+func (c *Client) PresenceUpdates() <-chan *Presence {
+	return c.presence
+}
+
+// Returns the channel on which typing notifications are delivered. Updates
+// are dropped if nothing is reading from the channel.
+func (c *Client) TypingUpdates() <-chan *Typing {
+	return c.typing
+}
+
+func (c *Client) handlePresence(received *sirenproto.Presence) {
+	presence := &Presence{
+		UID:   received.UID,
+		State: PresenceOffline,
+	}
+	switch received.State {
+	case sirenproto.Presence_ONLINE:
+		presence.State = PresenceOnline
+	case sirenproto.Presence_AWAY:
+		presence.State = PresenceAway
+	}
+	if received.LastSeen > 0 {
+		presence.LastSeen = time.Unix(0, received.LastSeen*int64(time.Millisecond))
+	}
+	select {
+	case c.presence <- presence:
+	default:
+	}
+}
+
+func (c *Client) handleTyping(received *sirenproto.Typing) {
+	select {
+	case c.typing <- &Typing{
+		UID:    received.Source,
+		Typing: received.Typing,
+		Time:   time.Now(),
+	}:
+	default:
+	}
+}
@@ -0,0 +1,261 @@
+package client
+
+import "io"
+import "bytes"
+import "errors"
+import "strconv"
+import "crypto/hmac"
+import "crypto/rand"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/binary"
+
+import "github.com/neilalexander/siren/sirenproto"
+import "golang.org/x/crypto/chacha20poly1305"
+import "golang.org/x/crypto/curve25519"
+import "golang.org/x/crypto/hkdf"
+
+// The maximum number of message keys that we will skip over in a single
+// chain, i.e. because messages were lost or arrived out of order.
+const maximumSkippedKeys = 1000
+
+var ErrRatchetDecrypt = errors.New("Failed to decrypt ratchet message")
+
+// The keys that the initiator of a session used for X3DH, which the
+// responder needs in order to work out the same shared secret.
+type x3dhKeys struct {
+	EphemeralKey  []byte
+	SignedPreKey  []byte
+	OneTimePreKey []byte
+}
+
+// The state of a Double Ratchet session with a single remote device. The
+// fields are exported so that the state can be serialised into the
+// SessionStore.
+type ratchetState struct {
+	DHs        keyPair
+	DHr        []byte
+	RootKey    []byte
+	SendChain  []byte
+	RecvChain  []byte
+	Ns         uint32
+	Nr         uint32
+	PN         uint32
+	Skipped    map[string][]byte
+	AD         []byte
+	Initiating *x3dhKeys `json:",omitempty"`
+	// For sessions that were started by the remote side, the ephemeral key
+	// that they started it with, so that we can recognise their header
+	RemoteEphemeral []byte `json:",omitempty"`
+}
+
+// Starts a session as the initiator, after performing X3DH against the
+// remote device's prekey bundle. The header contains the X3DH keys, and is
+// sent with every message until the remote side replies.
+func newInitiatorRatchet(secret []byte, remoteSignedPreKey []byte, ad []byte, initiating *x3dhKeys) (*ratchetState, error) {
+	dhs, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	dh, err := curve25519.X25519(dhs.Private, remoteSignedPreKey)
+	if err != nil {
+		return nil, err
+	}
+	rootKey, sendChain, err := kdfRootKey(secret, dh)
+	if err != nil {
+		return nil, err
+	}
+	return &ratchetState{
+		DHs:        dhs,
+		DHr:        remoteSignedPreKey,
+		RootKey:    rootKey,
+		SendChain:  sendChain,
+		Skipped:    make(map[string][]byte),
+		AD:         ad,
+		Initiating: initiating,
+	}, nil
+}
+
+// Starts a session as the responder, after performing X3DH using the keys
+// in the header of the initiator's first message.
+func newResponderRatchet(secret []byte, signedPreKey keyPair, ad []byte, remoteEphemeral []byte) *ratchetState {
+	return &ratchetState{
+		DHs:             signedPreKey,
+		RootKey:         secret,
+		Skipped:         make(map[string][]byte),
+		AD:              ad,
+		RemoteEphemeral: remoteEphemeral,
+	}
+}
+
+func (s *ratchetState) clone() *ratchetState {
+	c := *s
+	c.Skipped = make(map[string][]byte, len(s.Skipped))
+	for k, v := range s.Skipped {
+		c.Skipped[k] = v
+	}
+	return &c
+}
+
+// Encrypts the plaintext with the next message key from the sending chain.
+func (s *ratchetState) encrypt(plaintext []byte) (*sirenproto.RatchetHeader, []byte, []byte, error) {
+	if s.SendChain == nil {
+		return nil, nil, nil, errors.New("Session has no sending chain")
+	}
+	var messageKey []byte
+	s.SendChain, messageKey = kdfChainKey(s.SendChain)
+	header := &sirenproto.RatchetHeader{
+		RatchetKey:      s.DHs.Public,
+		PreviousCounter: s.PN,
+		Counter:         s.Ns,
+	}
+	if s.Initiating != nil {
+		header.EphemeralKey = s.Initiating.EphemeralKey
+		header.SignedPreKey = s.Initiating.SignedPreKey
+		header.OneTimePreKey = s.Initiating.OneTimePreKey
+	}
+	s.Ns++
+	nonce, ciphertext, err := ratchetSeal(messageKey, plaintext, s.associatedData(header))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return header, nonce, ciphertext, nil
+}
+
+// Decrypts a message using the session. The state is only changed if the
+// message was decrypted successfully, so callers should try a clone first.
+func (s *ratchetState) decrypt(header *sirenproto.RatchetHeader, nonce, ciphertext []byte) ([]byte, error) {
+	// The message key may have been skipped over already
+	skippedKey := skippedKeyName(header.RatchetKey, header.Counter)
+	if messageKey, ok := s.Skipped[skippedKey]; ok {
+		plaintext, err := ratchetOpen(messageKey, nonce, ciphertext, s.associatedData(header))
+		if err != nil {
+			return nil, err
+		}
+		delete(s.Skipped, skippedKey)
+		return plaintext, nil
+	}
+
+	// If the remote side has moved onto a new ratchet key then skip over any
+	// remaining messages in the current receiving chain and step the ratchet
+	if !bytes.Equal(header.RatchetKey, s.DHr) {
+		if err := s.skip(header.PreviousCounter); err != nil {
+			return nil, err
+		}
+		if err := s.step(header.RatchetKey); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.skip(header.Counter); err != nil {
+		return nil, err
+	}
+
+	var messageKey []byte
+	s.RecvChain, messageKey = kdfChainKey(s.RecvChain)
+	s.Nr++
+	plaintext, err := ratchetOpen(messageKey, nonce, ciphertext, s.associatedData(header))
+	if err != nil {
+		return nil, err
+	}
+	// The remote side has clearly got our first message, so we no longer
+	// need to send the X3DH keys
+	s.Initiating = nil
+	return plaintext, nil
+}
+
+func (s *ratchetState) skip(until uint32) error {
+	if s.RecvChain == nil {
+		return nil
+	}
+	if until > s.Nr+maximumSkippedKeys || len(s.Skipped) > maximumSkippedKeys {
+		return errors.New("Too many skipped messages")
+	}
+	for s.Nr < until {
+		var messageKey []byte
+		s.RecvChain, messageKey = kdfChainKey(s.RecvChain)
+		s.Skipped[skippedKeyName(s.DHr, s.Nr)] = messageKey
+		s.Nr++
+	}
+	return nil
+}
+
+func (s *ratchetState) step(remoteRatchetKey []byte) error {
+	s.PN = s.Ns
+	s.Ns = 0
+	s.Nr = 0
+	s.DHr = remoteRatchetKey
+
+	dh, err := curve25519.X25519(s.DHs.Private, s.DHr)
+	if err != nil {
+		return err
+	}
+	if s.RootKey, s.RecvChain, err = kdfRootKey(s.RootKey, dh); err != nil {
+		return err
+	}
+	if s.DHs, err = newKeyPair(); err != nil {
+		return err
+	}
+	if dh, err = curve25519.X25519(s.DHs.Private, s.DHr); err != nil {
+		return err
+	}
+	s.RootKey, s.SendChain, err = kdfRootKey(s.RootKey, dh)
+	return err
+}
+
+func (s *ratchetState) associatedData(header *sirenproto.RatchetHeader) []byte {
+	var counters [8]byte
+	binary.BigEndian.PutUint32(counters[0:4], header.PreviousCounter)
+	binary.BigEndian.PutUint32(counters[4:8], header.Counter)
+	ad := append([]byte{}, s.AD...)
+	ad = append(ad, header.RatchetKey...)
+	return append(ad, counters[:]...)
+}
+
+func skippedKeyName(ratchetKey []byte, counter uint32) string {
+	return hex.EncodeToString(ratchetKey) + ":" + strconv.FormatUint(uint64(counter), 10)
+}
+
+func kdfRootKey(rootKey, dh []byte) ([]byte, []byte, error) {
+	out := make([]byte, 64)
+	reader := hkdf.New(sha256.New, dh, rootKey, []byte("siren-ratchet"))
+	if _, err := io.ReadFull(reader, out); err != nil {
+		return nil, nil, err
+	}
+	return out[:32], out[32:], nil
+}
+
+func kdfChainKey(chainKey []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{0x02})
+	next := mac.Sum(nil)
+	mac = hmac.New(sha256.New, chainKey)
+	mac.Write([]byte{0x01})
+	return next, mac.Sum(nil)
+}
+
+func ratchetSeal(messageKey, plaintext, ad []byte) ([]byte, []byte, error) {
+	aead, err := chacha20poly1305.NewX(messageKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return nonce, aead.Seal(nil, nonce, plaintext, ad), nil
+}
+
+func ratchetOpen(messageKey, nonce, ciphertext, ad []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(messageKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, ErrRatchetDecrypt
+	}
+	plaintext, err := aead.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return nil, ErrRatchetDecrypt
+	}
+	return plaintext, nil
+}
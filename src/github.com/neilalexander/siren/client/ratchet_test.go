@@ -0,0 +1,148 @@
+package client
+
+import "fmt"
+import "testing"
+
+import "github.com/neilalexander/siren/sirenproto"
+
+type testRatchetMessage struct {
+	header     *sirenproto.RatchetHeader
+	nonce      []byte
+	ciphertext []byte
+	plaintext  string
+}
+
+// Returns the initiator and responder sides of a new session, after X3DH.
+func newTestRatchets(t *testing.T) (*ratchetState, *ratchetState) {
+	alice, bob := newTestDevice(t), newTestDevice(t)
+	secret, ephemeral, ad, err := x3dhInitiate(alice.device, bob.userKeys.PublicKey[:], bob.preKeyBundle(nil))
+	if err != nil {
+		t.Fatalf("Initiate failed: %v", err)
+	}
+	initiator, err := newInitiatorRatchet(secret, bob.bundle.SignedPreKey, ad, &x3dhKeys{
+		EphemeralKey: ephemeral.Public,
+		SignedPreKey: bob.bundle.SignedPreKey,
+	})
+	if err != nil {
+		t.Fatalf("Could not start initiator ratchet: %v", err)
+	}
+	header := &sirenproto.RatchetHeader{
+		EphemeralKey: ephemeral.Public,
+		SignedPreKey: bob.bundle.SignedPreKey,
+	}
+	responderSecret, responderAD, err := x3dhRespond(bob.device, bob.pre, alice.device.PublicKey[:], header)
+	if err != nil {
+		t.Fatalf("Respond failed: %v", err)
+	}
+	return initiator, newResponderRatchet(responderSecret, bob.pre.SignedPreKey, responderAD, ephemeral.Public)
+}
+
+func ratchetSend(t *testing.T, s *ratchetState, plaintext string) testRatchetMessage {
+	header, nonce, ciphertext, err := s.encrypt([]byte(plaintext))
+	if err != nil {
+		t.Fatalf("Could not encrypt %q: %v", plaintext, err)
+	}
+	return testRatchetMessage{header, nonce, ciphertext, plaintext}
+}
+
+// Decrypts the message with a clone of the session, as the client does, and
+// only keeps the new state if it decrypted.
+func ratchetReceive(t *testing.T, s *ratchetState, m testRatchetMessage) error {
+	attempt := s.clone()
+	plaintext, err := attempt.decrypt(m.header, m.nonce, m.ciphertext)
+	if err != nil {
+		return err
+	}
+	if string(plaintext) != m.plaintext {
+		t.Fatalf("Decrypted %q, want %q", plaintext, m.plaintext)
+	}
+	*s = *attempt
+	return nil
+}
+
+func TestRatchetConversation(t *testing.T) {
+	alice, bob := newTestRatchets(t)
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 3; i++ {
+			m := ratchetSend(t, alice, fmt.Sprintf("alice %d.%d", round, i))
+			if err := ratchetReceive(t, bob, m); err != nil {
+				t.Fatalf("Bob couldn't decrypt %q: %v", m.plaintext, err)
+			}
+		}
+		m := ratchetSend(t, bob, fmt.Sprintf("bob %d", round))
+		if err := ratchetReceive(t, alice, m); err != nil {
+			t.Fatalf("Alice couldn't decrypt %q: %v", m.plaintext, err)
+		}
+	}
+	if alice.Initiating != nil {
+		t.Errorf("Initiator still sends X3DH keys after getting a reply")
+	}
+}
+
+func TestRatchetOutOfOrder(t *testing.T) {
+	alice, bob := newTestRatchets(t)
+	var messages []testRatchetMessage
+	for i := 0; i < 5; i++ {
+		messages = append(messages, ratchetSend(t, alice, fmt.Sprintf("message %d", i)))
+	}
+	for _, i := range []int{3, 0, 4, 2, 1} {
+		if err := ratchetReceive(t, bob, messages[i]); err != nil {
+			t.Fatalf("Couldn't decrypt message %d out of order: %v", i, err)
+		}
+	}
+	if len(bob.Skipped) != 0 {
+		t.Errorf("%d skipped message keys left over, want none", len(bob.Skipped))
+	}
+
+	// Each message key can only be used once
+	if err := ratchetReceive(t, bob, messages[2]); err == nil {
+		t.Errorf("Message was decrypted twice")
+	}
+}
+
+func TestRatchetSkippedAcrossSteps(t *testing.T) {
+	alice, bob := newTestRatchets(t)
+	first := ratchetSend(t, alice, "first")
+	late := ratchetSend(t, alice, "late")
+	if err := ratchetReceive(t, bob, first); err != nil {
+		t.Fatalf("Couldn't decrypt first message: %v", err)
+	}
+
+	// Bob's reply moves Alice onto a new sending chain, so the late message
+	// is from the previous one and has to be found using PreviousCounter
+	if err := ratchetReceive(t, alice, ratchetSend(t, bob, "reply")); err != nil {
+		t.Fatalf("Couldn't decrypt reply: %v", err)
+	}
+	next := ratchetSend(t, alice, "next")
+	if err := ratchetReceive(t, bob, next); err != nil {
+		t.Fatalf("Couldn't decrypt message from the new chain: %v", err)
+	}
+	if err := ratchetReceive(t, bob, late); err != nil {
+		t.Fatalf("Couldn't decrypt message from the previous chain: %v", err)
+	}
+}
+
+func TestRatchetSkipLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		skipped int
+		ok      bool
+	}{
+		{"at the limit", maximumSkippedKeys, true},
+		{"over the limit", maximumSkippedKeys + 1, false},
+	}
+	for _, test := range tests {
+		alice, bob := newTestRatchets(t)
+		var m testRatchetMessage
+		for i := 0; i <= test.skipped; i++ {
+			m = ratchetSend(t, alice, fmt.Sprintf("message %d", i))
+		}
+		err := ratchetReceive(t, bob, m)
+		if test.ok && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: skipped %d message keys", test.name, test.skipped)
+		}
+	}
+}
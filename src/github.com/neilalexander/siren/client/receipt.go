@@ -0,0 +1,222 @@
+package client
+
+import "time"
+import "context"
+import "encoding/hex"
+
+import "github.com/neilalexander/siren"
+import "github.com/neilalexander/siren/sirenproto"
+import proto "github.com/golang/protobuf/proto"
+
+// The number of sent messages that we keep the receipt status for. Receipts
+// for older messages are still delivered on the Receipts channel.
+const maximumTrackedMessages = 1000
+
+type ReceiptType int
+
+const (
+	// The server has accepted the message and will try to deliver it
+	ReceiptAccepted ReceiptType = iota
+	// The message has been delivered to one of the recipient's devices
+	ReceiptDelivered
+	// The recipient has read the message
+	ReceiptRead
+	// The server couldn't deliver the message
+	ReceiptFailed
+)
+
+func (t ReceiptType) String() string {
+	switch t {
+	case ReceiptAccepted:
+		return "accepted"
+	case ReceiptDelivered:
+		return "delivered"
+	case ReceiptRead:
+		return "read"
+	case ReceiptFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// A Receipt is delivered on the Receipts channel when something happens to a
+// message that we sent. Accepted and delivered receipts come from the
+// servers, whereas read receipts are sent end-to-end encrypted by the
+// recipient. UID is the user that the receipt is about, or the group for
+// accepted receipts for group messages, and DeviceKey is the recipient's
+// device for delivered and read receipts. Err is set for failed receipts,
+// and is an AckError saying why the message couldn't be delivered.
+type Receipt struct {
+	MessageID string
+	Type      ReceiptType
+	UID       string
+	DeviceKey []byte
+	Time      time.Time
+	Err       error
+}
+
+// The MessageStatus holds the receipts that have been received for a message
+// that we sent. Delivered is keyed by the hex device key of each device that
+// the message was delivered to, and Read by the user ID of each user that has
+// read it. Failed is set if the server couldn't deliver the message.
+type MessageStatus struct {
+	ID          string
+	Destination string
+	Sent        time.Time
+	Accepted    time.Time
+	Delivered   map[string]time.Time
+	Read        map[string]time.Time
+	Failed      error
+}
+
+// Returns the channel on which receipts for the messages that we sent are
+// delivered. Receipts are dropped if nothing is reading from the channel,
+// but they are still reflected in Status.
+func (c *Client) Receipts() <-chan *Receipt {
+	return c.receipts
+}
+
+// Returns the receipt status of a message that we sent, if it is one of the
+// most recent messages.
+func (c *Client) Status(id string) (*MessageStatus, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	status, ok := c.sent[id]
+	if !ok {
+		return nil, false
+	}
+	copied := *status
+	copied.Delivered = make(map[string]time.Time, len(status.Delivered))
+	for k, v := range status.Delivered {
+		copied.Delivered[k] = v
+	}
+	copied.Read = make(map[string]time.Time, len(status.Read))
+	for k, v := range status.Read {
+		copied.Read[k] = v
+	}
+	return &copied, true
+}
+
+// Lets the senders of the given messages know that we have read them. The
+// receipts are end-to-end encrypted, and are also sent to our own other
+// devices so that they know that the messages have been read.
+func (c *Client) MarkRead(ctx context.Context, messages ...*Message) error {
+	uid := c.UID()
+	if uid == "" {
+		return ErrNotLoggedIn
+	}
+	if err := c.require(siren.FEATURE_RECEIPTS); err != nil {
+		return err
+	}
+	ids := make(map[string][]string)
+	for _, message := range messages {
+		if message.ID != "" && message.Source != uid {
+			ids[message.Source] = append(ids[message.Source], message.ID)
+		}
+	}
+	for source, messageIDs := range ids {
+		receipt, err := proto.Marshal(&sirenproto.ReadReceipt{
+			MessageIDs: messageIDs,
+			Timestamp:  time.Now().UnixNano() / int64(time.Millisecond),
+		})
+		if err != nil {
+			return err
+		}
+		if err := c.send(ctx, source, siren.NewMessageID(), sirenproto.Message_READ_RECEIPT, receipt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) trackMessage(id, destination string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.sent[id] = &MessageStatus{
+		ID:          id,
+		Destination: destination,
+		Sent:        time.Now(),
+		Delivered:   make(map[string]time.Time),
+		Read:        make(map[string]time.Time),
+	}
+	c.sentOrder = append(c.sentOrder, id)
+	for len(c.sentOrder) > maximumTrackedMessages {
+		delete(c.sent, c.sentOrder[0])
+		c.sentOrder = c.sentOrder[1:]
+	}
+}
+
+func (c *Client) untrackMessage(id string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.sent, id)
+	for i, sent := range c.sentOrder {
+		if sent == id {
+			c.sentOrder = append(c.sentOrder[:i], c.sentOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+func (c *Client) handleReceipt(received *sirenproto.Receipt) {
+	var receiptType ReceiptType
+	switch received.Type {
+	case sirenproto.Receipt_ACCEPTED:
+		receiptType = ReceiptAccepted
+	case sirenproto.Receipt_DELIVERED:
+		receiptType = ReceiptDelivered
+	default:
+		// Read receipts only count if they come from the recipient
+		return
+	}
+	c.receipt(&Receipt{
+		MessageID: received.MessageID,
+		Type:      receiptType,
+		UID:       received.UID,
+		DeviceKey: received.DeviceKey,
+		Time:      time.Unix(0, received.Timestamp*int64(time.Millisecond)),
+	})
+}
+
+func (c *Client) handleReadReceipt(message *Message) {
+	receipt := &sirenproto.ReadReceipt{}
+	if err := proto.Unmarshal(message.Contents, receipt); err != nil {
+		return
+	}
+	for _, id := range receipt.MessageIDs {
+		c.receipt(&Receipt{
+			MessageID: id,
+			Type:      ReceiptRead,
+			UID:       message.Source,
+			DeviceKey: message.SourceDevice,
+			Time:      time.Unix(0, receipt.Timestamp*int64(time.Millisecond)),
+		})
+	}
+}
+
+// Updates the status of the message that the receipt is for, if we are
+// keeping track of it, and then passes the receipt on.
+func (c *Client) receipt(receipt *Receipt) {
+	c.mutex.Lock()
+	if status, ok := c.sent[receipt.MessageID]; ok {
+		switch receipt.Type {
+		case ReceiptAccepted:
+			if status.Accepted.IsZero() {
+				status.Accepted = receipt.Time
+			}
+		case ReceiptDelivered:
+			status.Delivered[hex.EncodeToString(receipt.DeviceKey)] = receipt.Time
+		case ReceiptRead:
+			status.Read[receipt.UID] = receipt.Time
+		case ReceiptFailed:
+			status.Failed = receipt.Err
+		}
+	}
+	c.mutex.Unlock()
+
+	select {
+	case c.receipts <- receipt:
+	default:
+	}
+}
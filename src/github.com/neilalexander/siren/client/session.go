@@ -0,0 +1,305 @@
+package client
+
+import "bytes"
+import "errors"
+import "context"
+import "encoding/hex"
+import "encoding/json"
+
+import "github.com/neilalexander/siren/sirenproto"
+import "golang.org/x/crypto/ed25519"
+
+// The number of sessions that we keep with each remote device. There can be
+// more than one if both devices started a session at the same time, or if
+// the remote device has started a new session since.
+const maximumSessionsPerDevice = 3
+
+// Sets the SessionStore that is used to persist Double Ratchet sessions and
+// our own prekeys. This must be called before Login, otherwise the sessions
+// are only kept in memory.
+func (c *Client) SetSessionStore(store SessionStore) {
+	c.sessionMutex.Lock()
+	defer c.sessionMutex.Unlock()
+	c.store = store
+	c.preKeys = nil
+}
+
+// Sets whether messages to devices that haven't published any prekeys are
+// encrypted directly to their device key, which gives no forward secrecy. By
+// default they aren't, and sending to such a device fails with ErrNoPreKeys.
+func (c *Client) AllowStaticEncryption(allow bool) {
+	c.sessionMutex.Lock()
+	defer c.sessionMutex.Unlock()
+	c.allowStatic = allow
+}
+
+// Loads our prekeys from the session store, or generates new ones if there
+// are none or if they were signed by a different user, and then publishes
+// them to the server.
+func (c *Client) publishPreKeys(ctx context.Context, user UserKeys) error {
+	c.sessionMutex.Lock()
+	pre, err := c.loadPreKeys()
+	if err != nil {
+		c.sessionMutex.Unlock()
+		return err
+	}
+	if pre == nil || !verifySignedPreKey(user.PublicKey[:], pre) {
+		if pre, err = newPreKeys(user); err != nil {
+			c.sessionMutex.Unlock()
+			return err
+		}
+	}
+	bundle, err := pre.refresh(c.keys)
+	if err == nil {
+		err = c.storePreKeys(pre)
+	}
+	c.sessionMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.sendPreKeys(ctx, bundle)
+}
+
+// Publishes a new batch of one-time prekeys if enough of the last batch have
+// been used up. If this fails then we'll try again after the next one is used.
+// The session mutex must be held.
+func (c *Client) refreshPreKeys() {
+	if c.preKeys == nil || !c.preKeys.needsRefresh() {
+		return
+	}
+	bundle, err := c.preKeys.refresh(c.keys)
+	if err != nil {
+		return
+	}
+	if err := c.storePreKeys(c.preKeys); err != nil {
+		return
+	}
+	// We're called from the message loop, so don't wait for the server to
+	// acknowledge the new prekeys
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), directoryCacheLifetime)
+		defer cancel()
+		c.sendPreKeys(ctx, bundle)
+	}()
+}
+
+func (c *Client) sendPreKeys(ctx context.Context, bundle *sirenproto.PreKeyBundle) error {
+	ack, err := c.request(ctx, &sirenproto.Payload{
+		Contents: &sirenproto.Payload_PublishPreKeys{
+			PublishPreKeys: &sirenproto.PublishPreKeys{
+				Bundle: bundle,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := ackError(ack); err != nil {
+		return err
+	}
+	return nil
+}
+
+func verifySignedPreKey(usk []byte, pre *preKeys) bool {
+	return len(usk) == ed25519.PublicKeySize && ed25519.Verify(usk, pre.SignedPreKey.Public, pre.SignedPreKeySignature)
+}
+
+// Encrypts the plaintext for a single device belonging to the given user. We
+// use an existing session with the device if we have one, otherwise start a
+// new one using the device's prekey bundle. Devices that haven't published
+// any prekeys only get the plaintext encrypted directly to their device key
+// if AllowStaticEncryption has been called.
+func (c *Client) encryptForDevice(entry *DirectoryEntry, device []byte, plaintext []byte) (*sirenproto.DeviceCiphertext, error) {
+	c.sessionMutex.Lock()
+	defer c.sessionMutex.Unlock()
+
+	sessions, err := c.loadSessions(device)
+	if err != nil {
+		return nil, err
+	}
+	if len(sessions) == 0 {
+		bundle := c.takePreKeyBundle(entry, device)
+		if bundle == nil {
+			if !c.allowStatic {
+				return nil, ErrNoPreKeys
+			}
+			return staticSeal(c.keys, device, plaintext)
+		}
+		secret, ephemeral, ad, err := x3dhInitiate(c.keys, entry.UserSigningKey, bundle)
+		if err != nil {
+			return nil, err
+		}
+		session, err := newInitiatorRatchet(secret, bundle.SignedPreKey, ad, &x3dhKeys{
+			EphemeralKey:  ephemeral.Public,
+			SignedPreKey:  bundle.SignedPreKey,
+			OneTimePreKey: bundle.OneTimePreKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+		sessions = []*ratchetState{session}
+	}
+
+	header, nonce, ciphertext, err := sessions[0].encrypt(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.storeSessions(device, sessions); err != nil {
+		return nil, err
+	}
+	return &sirenproto.DeviceCiphertext{
+		DeviceKey:  device,
+		Nonce:      nonce,
+		Ciphertext: ciphertext,
+		Ratchet:    header,
+	}, nil
+}
+
+// Decrypts a ciphertext that was sent to us by the given device. Messages
+// that carry X3DH keys start a new session unless we already have one for
+// them, otherwise we try each of our sessions with the device in turn.
+// Messages encrypted directly to our device key are refused once we have a
+// session with the device, so that they can't be used to get around it.
+func (c *Client) decryptFromDevice(device []byte, ciphertext *sirenproto.DeviceCiphertext) ([]byte, error) {
+	c.sessionMutex.Lock()
+	defer c.sessionMutex.Unlock()
+
+	sessions, err := c.loadSessions(device)
+	if err != nil {
+		return nil, err
+	}
+	if ciphertext.Ratchet == nil {
+		if len(sessions) > 0 {
+			return nil, ErrStaticAfterRatchet
+		}
+		return staticOpen(c.keys, device, ciphertext)
+	}
+	header := ciphertext.Ratchet
+
+	// Try the sessions that we already have. The state is only updated if
+	// the message decrypts successfully, so a bad message can't break them
+	for i, session := range sessions {
+		if len(header.EphemeralKey) > 0 && !bytes.Equal(session.RemoteEphemeral, header.EphemeralKey) {
+			continue
+		}
+		attempt := session.clone()
+		plaintext, err := attempt.decrypt(header, ciphertext.Nonce, ciphertext.Ciphertext)
+		if err != nil {
+			continue
+		}
+		sessions = append(sessions[:i:i], sessions[i+1:]...)
+		if err := c.storeSessions(device, append([]*ratchetState{attempt}, sessions...)); err != nil {
+			return nil, err
+		}
+		return plaintext, nil
+	}
+	if len(header.EphemeralKey) == 0 {
+		return nil, ErrRatchetDecrypt
+	}
+
+	// Otherwise this is the first message of a new session that the remote
+	// device has started with us. Work on a copy of our prekeys so that the
+	// one-time prekey isn't used up unless the message decrypts successfully
+	pre, err := c.loadPreKeys()
+	if err != nil {
+		return nil, err
+	}
+	if pre == nil {
+		return nil, errors.New("No prekeys have been published for this device")
+	}
+	attempt := *pre
+	attempt.OneTimePreKeys = append([]keyPair{}, pre.OneTimePreKeys...)
+	secret, ad, err := x3dhRespond(c.keys, &attempt, device, header)
+	if err != nil {
+		return nil, err
+	}
+	session := newResponderRatchet(secret, attempt.SignedPreKey, ad, header.EphemeralKey)
+	plaintext, err := session.decrypt(header, ciphertext.Nonce, ciphertext.Ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	*pre = attempt
+	if err := c.storePreKeys(pre); err != nil {
+		return nil, err
+	}
+	if err := c.storeSessions(device, append([]*ratchetState{session}, sessions...)); err != nil {
+		return nil, err
+	}
+	c.refreshPreKeys()
+	return plaintext, nil
+}
+
+// Returns the prekey bundle for the given device from the directory entry.
+// The one-time prekey is removed from the entry, as it can only be used once.
+func (c *Client) takePreKeyBundle(entry *DirectoryEntry, device []byte) *PreKeyBundle {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, bundle := range entry.PreKeyBundles {
+		if bytes.Equal(bundle.DeviceKey, device) {
+			taken := *bundle
+			bundle.OneTimePreKey = nil
+			return &taken
+		}
+	}
+	return nil
+}
+
+// The session mutex must be held for the functions below.
+
+func (c *Client) sessionStore() SessionStore {
+	if c.store == nil {
+		c.store = NewMemorySessionStore()
+	}
+	return c.store
+}
+
+func (c *Client) loadSessions(device []byte) ([]*ratchetState, error) {
+	data, err := c.sessionStore().Load("session-" + hex.EncodeToString(device))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	var sessions []*ratchetState
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (c *Client) storeSessions(device []byte, sessions []*ratchetState) error {
+	if len(sessions) > maximumSessionsPerDevice {
+		sessions = sessions[:maximumSessionsPerDevice]
+	}
+	data, err := json.Marshal(sessions)
+	if err != nil {
+		return err
+	}
+	return c.sessionStore().Store("session-"+hex.EncodeToString(device), data)
+}
+
+func (c *Client) loadPreKeys() (*preKeys, error) {
+	if c.preKeys != nil {
+		return c.preKeys, nil
+	}
+	data, err := c.sessionStore().Load("prekeys-" + hex.EncodeToString(c.keys.PublicKey[:]))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	pre := &preKeys{}
+	if err := json.Unmarshal(data, pre); err != nil {
+		return nil, err
+	}
+	c.preKeys = pre
+	return pre, nil
+}
+
+func (c *Client) storePreKeys(pre *preKeys) error {
+	data, err := json.Marshal(pre)
+	if err != nil {
+		return err
+	}
+	if err := c.sessionStore().Store("prekeys-"+hex.EncodeToString(c.keys.PublicKey[:]), data); err != nil {
+		return err
+	}
+	c.preKeys = pre
+	return nil
+}
@@ -0,0 +1,178 @@
+package client
+
+import "testing"
+
+import "github.com/neilalexander/siren/sirenproto"
+
+// A client with published prekeys, which can encrypt and decrypt for other
+// test clients without a server.
+type testClient struct {
+	*Client
+	*testDevice
+}
+
+func newTestClient(t *testing.T, store SessionStore) *testClient {
+	d := newTestDevice(t)
+	c := &Client{keys: d.device, user: d.userKeys, store: store}
+	c.sessionMutex.Lock()
+	err := c.storePreKeys(d.pre)
+	c.sessionMutex.Unlock()
+	if err != nil {
+		t.Fatalf("Could not store prekeys: %v", err)
+	}
+	return &testClient{c, d}
+}
+
+// Returns the directory entry that the server would hand out for the
+// client's user, with one of its one-time prekeys.
+func (c *testClient) entry() *DirectoryEntry {
+	return &DirectoryEntry{
+		UserSigningKey:       c.userKeys.PublicKey[:],
+		DeviceEncryptionKeys: [][]byte{c.device.PublicKey[:]},
+		PreKeyBundles:        []*PreKeyBundle{c.preKeyBundle(c.bundle.OneTimePreKeys[0])},
+	}
+}
+
+func sessionSend(t *testing.T, from *testClient, entry *DirectoryEntry, to *testClient, plaintext string) *sirenproto.DeviceCiphertext {
+	ciphertext, err := from.encryptForDevice(entry, to.device.PublicKey[:], []byte(plaintext))
+	if err != nil {
+		t.Fatalf("Could not encrypt %q: %v", plaintext, err)
+	}
+	return ciphertext
+}
+
+func sessionReceive(t *testing.T, to *testClient, from *testClient, ciphertext *sirenproto.DeviceCiphertext, want string) {
+	plaintext, err := to.decryptFromDevice(from.device.PublicKey[:], ciphertext)
+	if err != nil {
+		t.Fatalf("Could not decrypt %q: %v", want, err)
+	}
+	if string(plaintext) != want {
+		t.Fatalf("Decrypted %q, want %q", plaintext, want)
+	}
+}
+
+func TestSessionConversation(t *testing.T) {
+	alice, bob := newTestClient(t, nil), newTestClient(t, nil)
+	aliceEntry, bobEntry := alice.entry(), bob.entry()
+	sessionReceive(t, bob, alice, sessionSend(t, alice, bobEntry, bob, "hello"), "hello")
+	sessionReceive(t, alice, bob, sessionSend(t, bob, aliceEntry, alice, "hi"), "hi")
+	sessionReceive(t, bob, alice, sessionSend(t, alice, bobEntry, bob, "how are you?"), "how are you?")
+
+	// Only the first message starts a session, after that both sides keep
+	// using it
+	for _, pair := range [][2]*testClient{{alice, bob}, {bob, alice}} {
+		c, remote := pair[0], pair[1]
+		c.sessionMutex.Lock()
+		sessions, err := c.loadSessions(remote.device.PublicKey[:])
+		c.sessionMutex.Unlock()
+		if err != nil || len(sessions) != 1 {
+			t.Errorf("Got %d sessions, want 1 (error %v)", len(sessions), err)
+		}
+	}
+}
+
+func TestSessionSimultaneousInitiation(t *testing.T) {
+	alice, bob := newTestClient(t, nil), newTestClient(t, nil)
+	aliceEntry, bobEntry := alice.entry(), bob.entry()
+
+	// Both sides start a session before either has heard from the other
+	fromAlice := sessionSend(t, alice, bobEntry, bob, "hello from alice")
+	fromBob := sessionSend(t, bob, aliceEntry, alice, "hello from bob")
+	sessionReceive(t, bob, alice, fromAlice, "hello from alice")
+	sessionReceive(t, alice, bob, fromBob, "hello from bob")
+
+	// Whichever sessions they each end up using, they can still talk
+	for i := 0; i < 3; i++ {
+		sessionReceive(t, bob, alice, sessionSend(t, alice, bobEntry, bob, "alice again"), "alice again")
+		sessionReceive(t, alice, bob, sessionSend(t, bob, aliceEntry, alice, "bob again"), "bob again")
+	}
+}
+
+func TestSessionOneTimePreKeyConsumed(t *testing.T) {
+	alice, bob, carol := newTestClient(t, nil), newTestClient(t, nil), newTestClient(t, nil)
+	bobEntry := bob.entry()
+	otpk := bobEntry.PreKeyBundles[0].OneTimePreKey
+	remaining := len(bob.pre.OneTimePreKeys)
+
+	sessionReceive(t, bob, alice, sessionSend(t, alice, bobEntry, bob, "hello"), "hello")
+	if len(bob.pre.OneTimePreKeys) != remaining-1 {
+		t.Fatalf("Got %d one-time prekeys, want %d", len(bob.pre.OneTimePreKeys), remaining-1)
+	}
+	// The one-time prekey is taken from the directory entry when it is used
+	if bobEntry.PreKeyBundles[0].OneTimePreKey != nil {
+		t.Fatalf("One-time prekey was left in the directory entry")
+	}
+
+	// If the server hands the same one-time prekey out again then the
+	// session can't be started with it
+	reused := bob.entry()
+	reused.PreKeyBundles[0].OneTimePreKey = otpk
+	ciphertext := sessionSend(t, carol, reused, bob, "hello again")
+	if _, err := bob.decryptFromDevice(carol.device.PublicKey[:], ciphertext); err == nil {
+		t.Fatalf("Session was started with a one-time prekey that was already used")
+	}
+}
+
+func TestSessionStaticMessages(t *testing.T) {
+	alice, bob := newTestClient(t, nil), newTestClient(t, nil)
+	noPreKeys := &DirectoryEntry{
+		UserSigningKey:       bob.userKeys.PublicKey[:],
+		DeviceEncryptionKeys: [][]byte{bob.device.PublicKey[:]},
+	}
+
+	// Devices without prekeys only get static messages if we allow it
+	if _, err := alice.encryptForDevice(noPreKeys, bob.device.PublicKey[:], []byte("hello")); err != ErrNoPreKeys {
+		t.Fatalf("Got error %v, want ErrNoPreKeys", err)
+	}
+	alice.AllowStaticEncryption(true)
+	static := sessionSend(t, alice, noPreKeys, bob, "hello")
+	if static.Ratchet != nil {
+		t.Fatalf("Message to a device without prekeys used a ratchet")
+	}
+	sessionReceive(t, bob, alice, static, "hello")
+
+	// Once there is a session with the device, static messages from it are
+	// refused
+	sessionReceive(t, bob, alice, sessionSend(t, alice, bob.entry(), bob, "ratchet"), "ratchet")
+	if _, err := bob.decryptFromDevice(alice.device.PublicKey[:], static); err != ErrStaticAfterRatchet {
+		t.Fatalf("Got error %v, want ErrStaticAfterRatchet", err)
+	}
+}
+
+func TestSessionPersistence(t *testing.T) {
+	alice, bob := newTestClient(t, nil), newTestClient(t, nil)
+	dir := t.TempDir()
+	store, err := NewFileSessionStore(dir, bob.device)
+	if err != nil {
+		t.Fatalf("Could not create session store: %v", err)
+	}
+	bob.SetSessionStore(store)
+	bob.sessionMutex.Lock()
+	err = bob.storePreKeys(bob.pre)
+	bob.sessionMutex.Unlock()
+	if err != nil {
+		t.Fatalf("Could not store prekeys: %v", err)
+	}
+	aliceEntry, bobEntry := alice.entry(), bob.entry()
+	sessionReceive(t, bob, alice, sessionSend(t, alice, bobEntry, bob, "hello"), "hello")
+
+	// A new client with the same keys and store picks up where the old one
+	// left off, including the one-time prekeys that have been used
+	if store, err = NewFileSessionStore(dir, bob.device); err != nil {
+		t.Fatalf("Could not reopen session store: %v", err)
+	}
+	restarted := &testClient{&Client{keys: bob.device, user: bob.userKeys}, bob.testDevice}
+	restarted.SetSessionStore(store)
+	sessionReceive(t, restarted, alice, sessionSend(t, alice, bobEntry, bob, "still there?"), "still there?")
+	sessionReceive(t, alice, restarted, sessionSend(t, restarted, aliceEntry, alice, "yes"), "yes")
+
+	restarted.sessionMutex.Lock()
+	pre, err := restarted.loadPreKeys()
+	restarted.sessionMutex.Unlock()
+	if err != nil || pre == nil {
+		t.Fatalf("Could not load prekeys: %v", err)
+	}
+	if len(pre.OneTimePreKeys) != len(bob.pre.OneTimePreKeys) {
+		t.Fatalf("Loaded %d one-time prekeys, want %d", len(pre.OneTimePreKeys), len(bob.pre.OneTimePreKeys))
+	}
+}
@@ -0,0 +1,197 @@
+package client
+
+import "io"
+import "os"
+import "sync"
+import "errors"
+import "strings"
+import "io/ioutil"
+import "crypto/rand"
+import "crypto/sha256"
+import "encoding/json"
+import "path/filepath"
+
+import "golang.org/x/crypto/hkdf"
+import "golang.org/x/crypto/nacl/secretbox"
+
+var ErrSessionStoreDecrypt = errors.New("Failed to decrypt session store")
+
+// A SessionStore persists the state that the client needs to keep between
+// runs, such as the Double Ratchet session with each remote device and the
+// private halves of our own prekeys. Load returns nil and no error if
+// nothing has been stored under the given name.
+type SessionStore interface {
+	Load(name string) ([]byte, error)
+	Store(name string, data []byte) error
+	Delete(name string) error
+}
+
+// Returns a SessionStore which only keeps state in memory, so sessions will
+// be lost when the process exits. This is the default.
+func NewMemorySessionStore() SessionStore {
+	return &memorySessionStore{
+		data: make(map[string][]byte),
+	}
+}
+
+type memorySessionStore struct {
+	mutex sync.Mutex
+	data  map[string][]byte
+}
+
+func (m *memorySessionStore) Load(name string) ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.data[name], nil
+}
+
+func (m *memorySessionStore) Store(name string, data []byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.data[name] = append([]byte{}, data...)
+	return nil
+}
+
+func (m *memorySessionStore) Delete(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.data, name)
+	return nil
+}
+
+// Returns a SessionStore which keeps each item of state in its own file in
+// the given directory, which is created if it doesn't exist. The files are
+// only readable by the current user, and are encrypted with a key derived
+// from the device's private key, so they are only as exposed as the keystore
+// that the device key is kept in. Files written in plaintext by older
+// versions are encrypted when the store is opened.
+func NewFileSessionStore(path string, device DeviceKeys) (SessionStore, error) {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+	f := &fileSessionStore{path: path}
+	reader := hkdf.New(sha256.New, device.PrivateKey[:], nil, []byte("siren-session-store"))
+	if _, err := io.ReadFull(reader, f.key[:]); err != nil {
+		return nil, err
+	}
+	if err := f.migrate(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+type fileSessionStore struct {
+	mutex sync.Mutex
+	path  string
+	key   [32]byte
+}
+
+// Each file is the nonce followed by the secretbox of the state.
+func (f *fileSessionStore) seal(data []byte) ([]byte, error) {
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	return secretbox.Seal(nonce[:], data, &nonce, &f.key), nil
+}
+
+func (f *fileSessionStore) open(sealed []byte) ([]byte, error) {
+	if len(sealed) < 24 {
+		return nil, ErrSessionStoreDecrypt
+	}
+	var nonce [24]byte
+	copy(nonce[:], sealed)
+	data, ok := secretbox.Open(nil, sealed[24:], &nonce, &f.key)
+	if !ok {
+		return nil, ErrSessionStoreDecrypt
+	}
+	return data, nil
+}
+
+func (f *fileSessionStore) write(filename string, data []byte) error {
+	sealed, err := f.seal(data)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first and then rename it over the top, so
+	// that we never leave a half-written session behind
+	temp := filename + ".tmp"
+	if err := ioutil.WriteFile(temp, sealed, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temp, filename)
+}
+
+// Encrypts any files that were left in plaintext by older versions. All of
+// the state that the client stores is JSON, which can't be mistaken for
+// something that we have encrypted.
+func (f *fileSessionStore) migrate() error {
+	files, err := ioutil.ReadDir(f.path)
+	if err != nil {
+		return err
+	}
+	for _, info := range files {
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") || strings.HasSuffix(info.Name(), ".tmp") {
+			continue
+		}
+		filename := filepath.Join(f.path, info.Name())
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		if _, err := f.open(data); err == nil || !json.Valid(data) {
+			continue
+		}
+		if err := f.write(filename, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fileSessionStore) filename(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, ".") {
+		return "", errors.New("Invalid session store name " + name)
+	}
+	return filepath.Join(f.path, name), nil
+}
+
+func (f *fileSessionStore) Load(name string) ([]byte, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	filename, err := f.filename(name)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f.open(sealed)
+}
+
+func (f *fileSessionStore) Store(name string, data []byte) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	filename, err := f.filename(name)
+	if err != nil {
+		return err
+	}
+	return f.write(filename, data)
+}
+
+func (f *fileSessionStore) Delete(name string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	filename, err := f.filename(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
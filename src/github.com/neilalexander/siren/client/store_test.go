@@ -0,0 +1,98 @@
+package client
+
+import "bytes"
+import "testing"
+import "io/ioutil"
+import "path/filepath"
+
+func TestSessionStores(t *testing.T) {
+	file, err := NewFileSessionStore(t.TempDir(), NewDeviceKeys())
+	if err != nil {
+		t.Fatalf("Could not create file session store: %v", err)
+	}
+	stores := map[string]SessionStore{
+		"memory": NewMemorySessionStore(),
+		"file":   file,
+	}
+	for name, store := range stores {
+		if data, err := store.Load("session-abc"); err != nil || data != nil {
+			t.Errorf("%s: loading something that wasn't stored gave %q, %v", name, data, err)
+		}
+		if err := store.Store("session-abc", []byte("state")); err != nil {
+			t.Errorf("%s: could not store: %v", name, err)
+		}
+		if data, err := store.Load("session-abc"); err != nil || !bytes.Equal(data, []byte("state")) {
+			t.Errorf("%s: loaded %q, %v, want \"state\"", name, data, err)
+		}
+		if err := store.Delete("session-abc"); err != nil {
+			t.Errorf("%s: could not delete: %v", name, err)
+		}
+		if data, err := store.Load("session-abc"); err != nil || data != nil {
+			t.Errorf("%s: loaded %q, %v after deleting", name, data, err)
+		}
+		if err := store.Delete("session-abc"); err != nil {
+			t.Errorf("%s: deleting twice failed: %v", name, err)
+		}
+	}
+
+	// Names can't be used to reach outside of the directory
+	for _, name := range []string{"", "../session", "a/b", ".hidden"} {
+		if err := file.Store(name, []byte("state")); err == nil {
+			t.Errorf("Stored state under invalid name %q", name)
+		}
+	}
+}
+
+func TestFileSessionStoreEncrypted(t *testing.T) {
+	dir, device := t.TempDir(), NewDeviceKeys()
+	store, err := NewFileSessionStore(dir, device)
+	if err != nil {
+		t.Fatalf("Could not create session store: %v", err)
+	}
+	state := []byte(`{"RootKey":"secret"}`)
+	if err := store.Store("session-abc", state); err != nil {
+		t.Fatalf("Could not store: %v", err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "session-abc"))
+	if err != nil {
+		t.Fatalf("Could not read stored file: %v", err)
+	}
+	if bytes.Contains(data, []byte("secret")) {
+		t.Fatalf("Session state was stored in plaintext")
+	}
+
+	// Another device key can't read it
+	other, err := NewFileSessionStore(dir, NewDeviceKeys())
+	if err != nil {
+		t.Fatalf("Could not open session store with another key: %v", err)
+	}
+	if _, err := other.Load("session-abc"); err != ErrSessionStoreDecrypt {
+		t.Fatalf("Got error %v, want ErrSessionStoreDecrypt", err)
+	}
+	if loaded, err := store.Load("session-abc"); err != nil || !bytes.Equal(loaded, state) {
+		t.Fatalf("Loaded %q, %v, want %q", loaded, err, state)
+	}
+}
+
+func TestFileSessionStoreMigration(t *testing.T) {
+	dir, device := t.TempDir(), NewDeviceKeys()
+	state := []byte(`{"RootKey":"secret"}`)
+	filename := filepath.Join(dir, "session-abc")
+	if err := ioutil.WriteFile(filename, state, 0600); err != nil {
+		t.Fatalf("Could not write plaintext state: %v", err)
+	}
+	store, err := NewFileSessionStore(dir, device)
+	if err != nil {
+		t.Fatalf("Could not open session store: %v", err)
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Could not read stored file: %v", err)
+	}
+	if bytes.Contains(data, []byte("secret")) {
+		t.Fatalf("Plaintext state was not encrypted when the store was opened")
+	}
+	if loaded, err := store.Load("session-abc"); err != nil || !bytes.Equal(loaded, state) {
+		t.Fatalf("Loaded %q, %v, want %q", loaded, err, state)
+	}
+}
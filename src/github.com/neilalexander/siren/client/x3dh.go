@@ -0,0 +1,180 @@
+package client
+
+import "io"
+import "bytes"
+import "errors"
+import "crypto/rand"
+import "crypto/sha256"
+
+import "github.com/neilalexander/siren/sirenproto"
+import "golang.org/x/crypto/curve25519"
+import "golang.org/x/crypto/ed25519"
+import "golang.org/x/crypto/hkdf"
+
+// How many one-time prekeys we publish at a time, how few we believe the
+// server still holds before we publish some more, and how many private keys
+// we keep for one-time prekeys that have been published but not yet used.
+const oneTimePreKeyCount = 20
+const oneTimePreKeyMinimum = 5
+const oneTimePreKeyRetained = 100
+
+var ErrBadPreKeySignature = errors.New("Signed prekey is not signed by the user signing key")
+
+// A Curve25519 key pair, used for prekeys and ratchet keys.
+type keyPair struct {
+	Public  []byte
+	Private []byte
+}
+
+func newKeyPair() (keyPair, error) {
+	private := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(private); err != nil {
+		return keyPair{}, err
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return keyPair{}, err
+	}
+	return keyPair{Public: public, Private: private}, nil
+}
+
+// Our own prekeys. The signed prekey is signed by the user signing key, and
+// each one-time prekey is deleted once a remote device has used it. We can't
+// know which one-time prekeys the server has handed out, so we count how many
+// have been used since we last published instead.
+type preKeys struct {
+	SignedPreKey          keyPair
+	SignedPreKeySignature []byte
+	OneTimePreKeys        []keyPair
+	Used                  int
+}
+
+func newPreKeys(user UserKeys) (*preKeys, error) {
+	spk, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	return &preKeys{
+		SignedPreKey:          spk,
+		SignedPreKeySignature: ed25519.Sign(user.PrivateKey[:], spk.Public),
+	}, nil
+}
+
+// Generates a new batch of one-time prekeys and returns the bundle that
+// should be published for them. Publishing replaces whatever the server still
+// holds, so we keep the private keys for older batches for a while in case
+// they were handed out but haven't been used yet.
+func (p *preKeys) refresh(device DeviceKeys) (*sirenproto.PreKeyBundle, error) {
+	bundle := &sirenproto.PreKeyBundle{
+		DeviceKey:             device.PublicKey[:],
+		SignedPreKey:          p.SignedPreKey.Public,
+		SignedPreKeySignature: p.SignedPreKeySignature,
+	}
+	for i := 0; i < oneTimePreKeyCount; i++ {
+		otpk, err := newKeyPair()
+		if err != nil {
+			return nil, err
+		}
+		p.OneTimePreKeys = append(p.OneTimePreKeys, otpk)
+		bundle.OneTimePreKeys = append(bundle.OneTimePreKeys, otpk.Public)
+	}
+	if excess := len(p.OneTimePreKeys) - oneTimePreKeyRetained; excess > 0 {
+		p.OneTimePreKeys = p.OneTimePreKeys[excess:]
+	}
+	p.Used = 0
+	return bundle, nil
+}
+
+// Returns true if enough of the last batch of one-time prekeys have been used
+// that we should publish some more.
+func (p *preKeys) needsRefresh() bool {
+	return p.Used >= oneTimePreKeyCount-oneTimePreKeyMinimum
+}
+
+// Finds and removes the one-time prekey with the given public key.
+func (p *preKeys) takeOneTimePreKey(public []byte) (keyPair, bool) {
+	for i, k := range p.OneTimePreKeys {
+		if bytes.Equal(k.Public, public) {
+			p.OneTimePreKeys = append(p.OneTimePreKeys[:i:i], p.OneTimePreKeys[i+1:]...)
+			p.Used++
+			return k, true
+		}
+	}
+	return keyPair{}, false
+}
+
+// Performs the initiator side of X3DH against a remote device's prekey
+// bundle. Our device encryption key acts as the identity key. Returns the
+// shared secret, the ephemeral key pair that the responder needs to know
+// about and the associated data for the session.
+func x3dhInitiate(device DeviceKeys, remoteUSK []byte, bundle *PreKeyBundle) ([]byte, keyPair, []byte, error) {
+	if len(remoteUSK) != ed25519.PublicKeySize || !ed25519.Verify(remoteUSK, bundle.SignedPreKey, bundle.SignedPreKeySignature) {
+		return nil, keyPair{}, nil, ErrBadPreKeySignature
+	}
+	ephemeral, err := newKeyPair()
+	if err != nil {
+		return nil, keyPair{}, nil, err
+	}
+	dhs := [][2][]byte{
+		{device.PrivateKey[:], bundle.SignedPreKey},
+		{ephemeral.Private, bundle.DeviceKey},
+		{ephemeral.Private, bundle.SignedPreKey},
+	}
+	if len(bundle.OneTimePreKey) > 0 {
+		dhs = append(dhs, [2][]byte{ephemeral.Private, bundle.OneTimePreKey})
+	}
+	secret, err := x3dhSecret(dhs)
+	if err != nil {
+		return nil, keyPair{}, nil, err
+	}
+	ad := append(append([]byte{}, device.PublicKey[:]...), bundle.DeviceKey...)
+	return secret, ephemeral, ad, nil
+}
+
+// Performs the responder side of X3DH, using the keys that the initiator
+// sent in the header of its first message.
+func x3dhRespond(device DeviceKeys, pre *preKeys, remoteDevice []byte, header *sirenproto.RatchetHeader) ([]byte, []byte, error) {
+	if !bytes.Equal(header.SignedPreKey, pre.SignedPreKey.Public) {
+		return nil, nil, errors.New("Message uses an unknown signed prekey")
+	}
+	dhs := [][2][]byte{
+		{pre.SignedPreKey.Private, remoteDevice},
+		{device.PrivateKey[:], header.EphemeralKey},
+		{pre.SignedPreKey.Private, header.EphemeralKey},
+	}
+	if len(header.OneTimePreKey) > 0 {
+		otpk, ok := pre.takeOneTimePreKey(header.OneTimePreKey)
+		if !ok {
+			return nil, nil, errors.New("Message uses an unknown one-time prekey")
+		}
+		dhs = append(dhs, [2][]byte{otpk.Private, header.EphemeralKey})
+	}
+	secret, err := x3dhSecret(dhs)
+	if err != nil {
+		return nil, nil, err
+	}
+	ad := append(append([]byte{}, remoteDevice...), device.PublicKey[:]...)
+	return secret, ad, nil
+}
+
+func x3dhSecret(dhs [][2][]byte) ([]byte, error) {
+	// As per the X3DH specification, the input to the KDF is prefixed with
+	// 32 0xFF bytes for Curve25519
+	input := make([]byte, 32)
+	for i := range input {
+		input[i] = 0xFF
+	}
+	for _, dh := range dhs {
+		out, err := curve25519.X25519(dh[0], dh[1])
+		if err != nil {
+			return nil, err
+		}
+		input = append(input, out...)
+	}
+	secret := make([]byte, 32)
+	reader := hkdf.New(sha256.New, input, make([]byte, 32), []byte("siren-x3dh"))
+	if _, err := io.ReadFull(reader, secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
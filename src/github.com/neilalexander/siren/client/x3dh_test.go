@@ -0,0 +1,119 @@
+package client
+
+import "bytes"
+import "testing"
+
+import "github.com/neilalexander/siren/sirenproto"
+
+// A device with its user keys and published prekeys, for testing sessions
+// without a server.
+type testDevice struct {
+	device   DeviceKeys
+	userKeys UserKeys
+	pre      *preKeys
+	bundle   *sirenproto.PreKeyBundle
+}
+
+func newTestDevice(t *testing.T) *testDevice {
+	d := &testDevice{
+		device:   NewDeviceKeys(),
+		userKeys: NewUserKeys(),
+	}
+	var err error
+	if d.pre, err = newPreKeys(d.userKeys); err != nil {
+		t.Fatalf("Could not generate prekeys: %v", err)
+	}
+	if d.bundle, err = d.pre.refresh(d.device); err != nil {
+		t.Fatalf("Could not generate one-time prekeys: %v", err)
+	}
+	return d
+}
+
+// Returns the prekey bundle that the server would hand out for the device,
+// with the given one-time prekey if there is one.
+func (d *testDevice) preKeyBundle(oneTimePreKey []byte) *PreKeyBundle {
+	return &PreKeyBundle{
+		DeviceKey:             d.device.PublicKey[:],
+		SignedPreKey:          d.bundle.SignedPreKey,
+		SignedPreKeySignature: d.bundle.SignedPreKeySignature,
+		OneTimePreKey:         oneTimePreKey,
+	}
+}
+
+func TestX3DHAgreement(t *testing.T) {
+	tests := []struct {
+		name          string
+		oneTimePreKey bool
+	}{
+		{"with one-time prekey", true},
+		{"without one-time prekey", false},
+	}
+	for _, test := range tests {
+		alice, bob := newTestDevice(t), newTestDevice(t)
+		var otpk []byte
+		if test.oneTimePreKey {
+			otpk = bob.bundle.OneTimePreKeys[0]
+		}
+		secret, ephemeral, ad, err := x3dhInitiate(alice.device, bob.userKeys.PublicKey[:], bob.preKeyBundle(otpk))
+		if err != nil {
+			t.Fatalf("%s: initiate failed: %v", test.name, err)
+		}
+		remaining := len(bob.pre.OneTimePreKeys)
+		header := &sirenproto.RatchetHeader{
+			EphemeralKey:  ephemeral.Public,
+			SignedPreKey:  bob.bundle.SignedPreKey,
+			OneTimePreKey: otpk,
+		}
+		responderSecret, responderAD, err := x3dhRespond(bob.device, bob.pre, alice.device.PublicKey[:], header)
+		if err != nil {
+			t.Fatalf("%s: respond failed: %v", test.name, err)
+		}
+		if !bytes.Equal(secret, responderSecret) {
+			t.Errorf("%s: initiator and responder have different secrets", test.name)
+		}
+		if !bytes.Equal(ad, responderAD) {
+			t.Errorf("%s: initiator and responder have different associated data", test.name)
+		}
+		used := remaining - len(bob.pre.OneTimePreKeys)
+		if test.oneTimePreKey && used != 1 {
+			t.Errorf("%s: used %d one-time prekeys, want 1", test.name, used)
+		}
+		if !test.oneTimePreKey && used != 0 {
+			t.Errorf("%s: used %d one-time prekeys, want none", test.name, used)
+		}
+	}
+}
+
+func TestX3DHBadPreKeySignature(t *testing.T) {
+	alice, bob, mallory := newTestDevice(t), newTestDevice(t), newTestDevice(t)
+	if _, _, _, err := x3dhInitiate(alice.device, mallory.userKeys.PublicKey[:], bob.preKeyBundle(nil)); err != ErrBadPreKeySignature {
+		t.Fatalf("Got error %v, want ErrBadPreKeySignature", err)
+	}
+}
+
+func TestX3DHOneTimePreKeyReuse(t *testing.T) {
+	alice, bob := newTestDevice(t), newTestDevice(t)
+	otpk := bob.bundle.OneTimePreKeys[0]
+	_, ephemeral, _, err := x3dhInitiate(alice.device, bob.userKeys.PublicKey[:], bob.preKeyBundle(otpk))
+	if err != nil {
+		t.Fatalf("Initiate failed: %v", err)
+	}
+	header := &sirenproto.RatchetHeader{
+		EphemeralKey:  ephemeral.Public,
+		SignedPreKey:  bob.bundle.SignedPreKey,
+		OneTimePreKey: otpk,
+	}
+	if _, _, err := x3dhRespond(bob.device, bob.pre, alice.device.PublicKey[:], header); err != nil {
+		t.Fatalf("Respond failed: %v", err)
+	}
+	if _, _, err := x3dhRespond(bob.device, bob.pre, alice.device.PublicKey[:], header); err == nil {
+		t.Fatalf("One-time prekey was accepted twice")
+	}
+
+	// Nor can a message use a signed prekey that isn't ours
+	header.OneTimePreKey = nil
+	header.SignedPreKey = alice.bundle.SignedPreKey
+	if _, _, err := x3dhRespond(bob.device, bob.pre, alice.device.PublicKey[:], header); err == nil {
+		t.Fatalf("Unknown signed prekey was accepted")
+	}
+}
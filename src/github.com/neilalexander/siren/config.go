@@ -0,0 +1,155 @@
+package siren
+
+import "errors"
+import "reflect"
+import "io/ioutil"
+import "encoding/json"
+
+// The ConfigChanges describe what happened when the server was given a new
+// configuration. Applied lists the settings that were changed while the
+// server is running, and RestartRequired lists the settings that were
+// changed but will only take effect when the server is restarted.
+type ConfigChanges struct {
+	Applied         []string
+	RestartRequired []string
+}
+
+// Loads a server configuration from a JSON file. The settings in the file
+// are applied on top of the given base configuration, i.e. the one from
+// DefaultServerConfig, so that settings missing from the file keep their
+// values from the base. The keys, Resolver, Logger and ConfigLoader always
+// come from the base.
+func LoadServerConfig(path string, base ServerConfig) (ServerConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ServerConfig{}, err
+	}
+	// The base is copied through JSON first, so that the slices in the new
+	// configuration don't share memory with the base or with each other
+	copied, err := json.Marshal(base)
+	if err != nil {
+		return ServerConfig{}, err
+	}
+	var config ServerConfig
+	if err := json.Unmarshal(copied, &config); err != nil {
+		return ServerConfig{}, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return ServerConfig{}, errors.New("Invalid configuration in " + path + ": " + err.Error())
+	}
+	if _, err := config.listeners(); err != nil {
+		return ServerConfig{}, errors.New("Invalid configuration in " + path + ": " + err.Error())
+	}
+	if config.AdminAddress != "" {
+		if err := checkAdminAddress(config.AdminAddress); err != nil {
+			return ServerConfig{}, errors.New("Invalid configuration in " + path + ": " + err.Error())
+		}
+	}
+	config.PrivateKey = base.PrivateKey
+	config.PublicKey = base.PublicKey
+	config.Resolver = base.Resolver
+	config.Logger = base.Logger
+	config.ConfigLoader = base.ConfigLoader
+	return config, nil
+}
+
+// Returns the current configuration. The configuration is never changed in
+// place, so callers can keep hold of it, but they should call config again
+// to see any changes made by a reload.
+func (s *Server) config() *ServerConfig {
+	return s.current.Load().(*ServerConfig)
+}
+
+// Loads the configuration again using the ConfigLoader from the current
+// configuration, and applies it with Reconfigure.
+func (s *Server) Reload() (ConfigChanges, error) {
+	current, ok := s.current.Load().(*ServerConfig)
+	if !ok {
+		return ConfigChanges{}, errors.New("The server is not running")
+	}
+	if current.ConfigLoader == nil {
+		return ConfigChanges{}, errors.New("The server has no configuration to reload")
+	}
+	config, err := current.ConfigLoader()
+	if err != nil {
+		s.log.error("Unable to reload configuration", LogField{"error", err})
+		return ConfigChanges{}, err
+	}
+	return s.Reconfigure(config), nil
+}
+
+// Applies a new configuration to the running server. The local domains,
+// federation settings and lists, registration, limits, rate limits and log
+// level are changed straight away, although the write queue sizes only apply
+// to new connections. Any other settings that are different are kept as they
+// are until the server is restarted, and are listed in the result.
+func (s *Server) Reconfigure(c ServerConfig) ConfigChanges {
+	s.reloadMutex.Lock()
+	defer s.reloadMutex.Unlock()
+
+	current := s.config()
+	var changes ConfigChanges
+	applied := func(name string, before, after interface{}) {
+		if !reflect.DeepEqual(before, after) {
+			changes.Applied = append(changes.Applied, name)
+		}
+	}
+	restart := func(name string, before, after interface{}) {
+		if !reflect.DeepEqual(before, after) {
+			changes.RestartRequired = append(changes.RestartRequired, name)
+		}
+	}
+
+	// Settings which can safely be changed while the server is running are
+	// copied into the updated configuration
+	applied("LocalDomains", current.LocalDomains, c.LocalDomains)
+	applied("FederationEnabled", current.FederationEnabled, c.FederationEnabled)
+	applied("FederationWhitelist", current.FederationWhitelist, c.FederationWhitelist)
+	applied("FederationBlacklist", current.FederationBlacklist, c.FederationBlacklist)
+	applied("RegistrationEnabled", current.RegistrationEnabled, c.RegistrationEnabled)
+	applied("MaximumMessageSize", current.MaximumMessageSize, c.MaximumMessageSize)
+	applied("MaximumS2SConnections", current.MaximumS2SConnections, c.MaximumS2SConnections)
+	applied("MaximumOfflineMessages", current.MaximumOfflineMessages, c.MaximumOfflineMessages)
+	applied("MaximumControlQueue", current.MaximumControlQueue, c.MaximumControlQueue)
+	applied("MaximumMessageQueue", current.MaximumMessageQueue, c.MaximumMessageQueue)
+	applied("RateLimits", current.RateLimits, c.RateLimits)
+	applied("LogLevel", current.LogLevel, c.LogLevel)
+	updated := *current
+	updated.LocalDomains = c.LocalDomains
+	updated.FederationEnabled = c.FederationEnabled
+	updated.FederationWhitelist = c.FederationWhitelist
+	updated.FederationBlacklist = c.FederationBlacklist
+	updated.RegistrationEnabled = c.RegistrationEnabled
+	updated.MaximumMessageSize = c.MaximumMessageSize
+	updated.MaximumS2SConnections = c.MaximumS2SConnections
+	updated.MaximumOfflineMessages = c.MaximumOfflineMessages
+	updated.MaximumControlQueue = c.MaximumControlQueue
+	updated.MaximumMessageQueue = c.MaximumMessageQueue
+	updated.RateLimits = c.RateLimits
+	updated.LogLevel = c.LogLevel
+	if c.ConfigLoader != nil {
+		updated.ConfigLoader = c.ConfigLoader
+	}
+
+	// Everything else needs a restart. Go values like the Resolver and
+	// Logger can't be compared, so they are never reported
+	before, _ := current.listeners()
+	after, _ := c.listeners()
+	restart("Listeners", before, after)
+	restart("PrivateKey", current.PrivateKey, c.PrivateKey)
+	restart("PublicKey", current.PublicKey, c.PublicKey)
+	restart("MetricsAddress", current.MetricsAddress, c.MetricsAddress)
+	restart("AdminAddress", current.AdminAddress, c.AdminAddress)
+	restart("TLS", current.TLS, c.TLS)
+
+	s.current.Store(&updated)
+	s.log.setLevel(updated.LogLevel)
+	s.router.offline.setLimit(updated.MaximumOfflineMessages)
+	s.localdirectory.setLocalDomains(updated.LocalDomains)
+	s.router.lists.set(updated.FederationWhitelist, updated.FederationBlacklist)
+	s.router.closeDisallowedFederations()
+
+	s.log.info("Configuration reloaded",
+		LogField{"applied", changes.Applied}, LogField{"restart_required", changes.RestartRequired})
+	return changes
+}
@@ -4,157 +4,392 @@ import "fmt"
 import "net"
 import "time"
 import "reflect"
-import "strings"
 import "bytes"
+import "sync/atomic"
 
 import "github.com/neilalexander/siren/sirenproto"
 import proto "github.com/golang/protobuf/proto"
 
-const (
-	STATE_INITIAL        = iota
-	STATE_AUTHENTICATING = iota
-	STATE_AUTHENTICATED  = iota
-)
+// How long the remote side has to prove its key before the connection is
+// dropped, which is also how long payloads are held for while waiting for a
+// connection to be authenticated. This is a variable so that tests can
+// shorten it.
+var authenticationTimeout = 5 * time.Second
 
 type connection struct {
-	state            int
+	id               uint64
+	log              logger
+	state            int32
+	challenge        [challengeLen]byte
+	sendNonces       *NonceSequence
+	receiveNonces    *NonceSequence
+	version          int32
+	features         map[string]struct{}
 	remotePublicKey  [cryptoPublicKeyLen]byte
 	pingSequence     int64
 	pingLastResponse time.Time
-	connection       net.Conn
+	connection       packetConn
 	connectionType   sirenproto.HelloIAm_ConnectionTypes
-	writeEncrypted   chan *sirenproto.Payload
-	writeUnencrypted chan *sirenproto.Payload
+	queue            *writeQueue
+	metrics          *metrics
 	terminateWrite   chan bool
+	writeFinished    chan struct{}
 	writeTicker      *time.Ticker
+	pending          []queuedPayload
+	pendingExpired   bool
 	federationDomain string
+	policy           ListenerPolicy
+	uid              string
+	domains          atomic.Value // []string
+	claimedDomains   []string
+	domainsVerified  chan struct{}
+	opened           time.Time
+	buckets          map[string]*tokenBucket
+	requestID        string
+}
+
+// Returns the domains served by the remote server on a federation
+// connection. For connections that we initiated this is the domain that we
+// connected to, otherwise it is the domains that the remote server gave in
+// its HelloIAm, once they have been verified.
+func (c *connection) remoteDomains() []string {
+	if c.federationDomain != "" {
+		return []string{c.federationDomain}
+	}
+	domains, _ := c.domains.Load().([]string)
+	return domains
+}
+
+// Waits for the domains that the remote server claims to serve to be
+// verified. Returns false if the connection closes or verification doesn't
+// finish in time.
+func (c *connection) waitForDomains() bool {
+	if c.domainsVerified == nil {
+		return true
+	}
+	timer := time.NewTimer(domainVerificationTimeout)
+	defer timer.Stop()
+	select {
+	case <-c.domainsVerified:
+		return true
+	case <-c.writeFinished:
+		return false
+	case <-timer.C:
+		return false
+	}
+}
+
+// Returns true if the remote server on a federation connection serves the
+// given domain, so that it can speak for users in that domain.
+func (c *connection) servesDomain(domain string) bool {
+	for _, d := range c.remoteDomains() {
+		if d == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns a logger with the connection ID and remote address, along with
+// the federation domain and UID once they are known.
+func (c *connection) logger() logger {
+	var fields []LogField
+	if c.federationDomain != "" {
+		fields = append(fields, LogField{"domain", c.federationDomain})
+	}
+	if c.uid != "" {
+		fields = append(fields, LogField{"uid", c.uid})
+	}
+	return c.log.with(fields...)
 }
 
 func (c *connection) writeThread(r *router, initiator bool) {
-	c.terminateWrite = make(chan bool)
+	defer close(c.writeFinished)
 	c.writeTicker = time.NewTicker(time.Second)
 	defer c.writeTicker.Stop()
-	if len(c.federationDomain) > 0 {
-		defer delete(r.server.router.federations, c.federationDomain)
-	}
+	authenticationTimer := time.NewTimer(authenticationTimeout)
+	defer authenticationTimer.Stop()
+	slowed := false
 
 	// If we are the initiator of the connection then the first thing we
 	// need to do is introduce ourself to the remote side - this includes
 	// sending our public key and requesting an S2S-type connection
 	if initiator {
-		c.state = STATE_AUTHENTICATING
-		c.writeUnencrypted <- &sirenproto.Payload{
+		c.queueUnencrypted(&sirenproto.Payload{
 			Contents: &sirenproto.Payload_HelloIAm{
-				HelloIAm: &sirenproto.HelloIAm{
-					ConnectionType: sirenproto.HelloIAm_SERVER_TO_SERVER,
-					PublicKey:      r.server.config.PublicKey[:],
-				},
+				HelloIAm: c.helloIAm(r, sirenproto.HelloIAm_SERVER_TO_SERVER),
 			},
-		}
+		})
 	}
 
-	// Start listening for packets to send to the connection. Each message
-	// arrives through either the encrypted or the unencrypted channel
+	// Start listening for packets to send to the connection. Payloads are
+	// taken from the write queue, control traffic first, whenever the queue
+	// signals that something is waiting
 	for {
 		select {
 		case _ = <-c.terminateWrite:
-			// The read thread asked the write thread to stop processing
+			// The read thread asked the write thread to stop processing, so
+			// send the control traffic that is still queued, throw away the
+			// rest and fail anything that was waiting for the connection to
+			// be authenticated
+			for _, p := range c.queue.close() {
+				c.write(r, p)
+			}
+			c.failPending("Connection closed before it was authenticated")
 			return
-		case payload := <-c.writeUnencrypted:
-			// We received a payload to be sent unencrypted - wrap it in the
-			// packet format and send it to the remote side
-			packet := sirenproto.Packet{
-				Version: 1,
-				PayloadType: &sirenproto.Packet_Payload{
-					Payload: payload,
-				},
+		case <-authenticationTimer.C:
+			// If the connection still isn't authenticated then give up on
+			// anything waiting for it and drop the connection. For connections
+			// that we initiated this means that the next payload for the
+			// domain dials again rather than waiting on this connection
+			if c.getState() < STATE_AUTHENTICATED {
+				c.logger().warning("Remote side didn't authenticate in time")
+				r.server.metrics.handshakeFailures.inc("timeout")
+				c.pendingExpired = true
+				c.failPending("Connection wasn't authenticated in time")
+				c.write(r, queuedPayload{
+					payload: &sirenproto.Payload{
+						Contents: &sirenproto.Payload_Ack{
+							Ack: &sirenproto.Ack{
+								Condition: sirenproto.Ack_TERMINATE,
+								Text:      "Connection wasn't authenticated in time",
+							},
+						},
+					},
+				})
+				c.connection.close()
 			}
-			c.send(&packet)
-		case payload := <-c.writeEncrypted:
-			// We received a payload to be sent encrypted, so first of all we
-			// need to check if the connection is authenticated. If not then we
-			// can't do anything
-			// TODO: Can we queue these packets for later dispatch?
-			switch payload.Contents.(type) {
-			case *sirenproto.Payload_Ping:
-				// As long as we know the public key, we are happy to send pings
-				// on unauthenticated sessions because a successful ping-pong
-				// exchange is part of the handshake
-				break
-			default:
-				// If it's not a ping then we musn't try to send it over an
-				// unauthenticated session
-				if c.state < STATE_AUTHENTICATED {
-					continue
+		case <-c.queue.ready:
+			// Anything held back while the connection was being authenticated
+			// is sent before anything newer, but only after whatever is still
+			// queued for the handshake, i.e. our proof
+			for {
+				p, ok := c.queue.pop()
+				if !ok {
+					break
 				}
+				c.write(r, p)
 			}
-			// Encrypt the payload and then wrap it in the packet format, send
-			// it to the remote side
-			enc, err := c.EncryptPayload(r.server.config.PrivateKey, payload)
-			if err == nil {
-				packet := sirenproto.Packet{
-					Version: 1,
-					PayloadType: &sirenproto.Packet_EncryptedPayload{
-						EncryptedPayload: enc,
-					},
+			if c.getState() == STATE_AUTHENTICATED {
+				c.flushPending(r)
+				// Once the connection is authenticated the pings are only
+				// needed to keep it alive, so they can be sent less often
+				if !slowed {
+					c.writeTicker.Reset(time.Minute)
+					slowed = true
 				}
-				c.send(&packet)
-			} else {
-				fmt.Println(err)
 			}
 		case <-c.writeTicker.C:
 			// The ticker fires on an interval, and is used to send pings to the
-			// remote side
-			c.writeEncrypted <- &sirenproto.Payload{
-				Contents: &sirenproto.Payload_Ping{
-					Ping: &sirenproto.Ping{
-						Sequence: c.pingSequence,
+			// remote side. The ping is written straight away rather than being
+			// queued, so that it is never held up behind queued traffic
+			c.write(r, queuedPayload{
+				encrypted: true,
+				payload: &sirenproto.Payload{
+					Contents: &sirenproto.Payload_Ping{
+						Ping: &sirenproto.Ping{
+							Sequence: c.pingSequence,
+						},
 					},
 				},
-			}
+			})
 			c.pingSequence++
-			// Have we failed to authenticate with the remote side after a
-			// given number of pings? If so, decrease the interval and stop
-			// spamming the remote side so much
-			if c.pingSequence == 30 {
-				if c.state < STATE_AUTHENTICATED {
-					fmt.Println("Remote side hasn't authenticated in 30 seconds")
-					c.writeTicker.Stop()
-					c.writeTicker = time.NewTicker(time.Minute)
-				}
+		}
+	}
+}
+
+// Writes a payload from the write queue to the remote side.
+func (c *connection) write(r *router, p queuedPayload) {
+	if !p.encrypted {
+		// The payload is to be sent unencrypted - wrap it in the packet
+		// format and send it to the remote side
+		packet := sirenproto.Packet{
+			Version: c.packetVersion(),
+			PayloadType: &sirenproto.Packet_Payload{
+				Payload: p.payload,
+			},
+		}
+		c.send(&packet)
+		r.server.metrics.countSent(p.payload)
+		return
+	}
+
+	// The payload is to be sent encrypted, so first of all we need to check
+	// if the connection is authenticated
+	switch p.payload.Contents.(type) {
+	case *sirenproto.Payload_Ping, *sirenproto.Payload_HelloProof:
+		// As long as we know the public key, we are happy to send pings
+		// and our proof on unauthenticated sessions, because the proof is
+		// part of the handshake. Until the remote side has sent its HelloIAm
+		// we don't know who to encrypt them for, so they are dropped
+		if c.getState() == STATE_INITIAL {
+			return
+		}
+	default:
+		// If it's not a ping then we musn't try to send it over an
+		// unauthenticated session, so hold onto it until the connection
+		// is authenticated. Anything held from before has to go first
+		if c.getState() < STATE_AUTHENTICATED {
+			c.pending = append(c.pending, p)
+			if c.pendingExpired {
+				c.failPending("Connection wasn't authenticated in time")
 			}
+			return
 		}
+		c.flushPending(r)
+		c.writeNegotiated(r, p)
+		return
 	}
+	c.writeEncrypted(r, p.payload)
 }
 
-func (c *connection) readThread(r *router, initiator bool) {
-	fmt.Println("Opened connection with", c.connection.RemoteAddr())
-	defer c.connection.Close()
+// Sends the payloads that were held while the connection was being
+// authenticated, in the order that they were queued.
+func (c *connection) flushPending(r *router) {
+	if len(c.pending) == 0 {
+		return
+	}
+	c.logger().debug("Sending payloads held during authentication", LogField{"count", len(c.pending)})
+	pending := c.pending
+	c.pending = nil
+	for _, p := range pending {
+		c.writeNegotiated(r, p)
+	}
+}
 
-	buf := make([]byte, r.server.config.MaximumMessageSize)
+// Sends a queued payload, unless it belongs to a feature that wasn't
+// negotiated with the remote side, in which case it is dropped and whoever
+// asked for it is told.
+func (c *connection) writeNegotiated(r *router, p queuedPayload) {
+	if feature := payloadFeature(p.payload); !c.supports(feature) {
+		c.logger().debug("Dropping payload for feature that wasn't negotiated",
+			LogField{"type", payloadType(p.payload)}, LogField{"feature", feature})
+		if p.failed != nil {
+			p.failed()
+		}
+		return
+	}
+	c.writeEncrypted(r, p.payload)
+}
+
+// Gives up on the payloads that were held while the connection was being
+// authenticated, telling whoever asked for them where possible.
+func (c *connection) failPending(reason string) {
+	if len(c.pending) == 0 {
+		return
+	}
+	c.logger().warning("Failing payloads held during authentication", LogField{"count", len(c.pending)}, LogField{"reason", reason})
+	c.metrics.writeQueueDrops.add("pending", uint64(len(c.pending)))
+	pending := c.pending
+	c.pending = nil
+	for _, p := range pending {
+		if p.failed != nil {
+			p.failed()
+		}
+	}
+}
+
+func (c *connection) writeEncrypted(r *router, payload *sirenproto.Payload) {
+	// Encrypt the payload and then wrap it in the packet format, send
+	// it to the remote side
+	enc, err := c.EncryptPayload(r.server.config().PrivateKey, payload)
+	if err != nil {
+		c.logger().warning("Failed to encrypt payload", LogField{"error", err})
+		return
+	}
+	packet := sirenproto.Packet{
+		Version: c.packetVersion(),
+		PayloadType: &sirenproto.Packet_EncryptedPayload{
+			EncryptedPayload: enc,
+		},
+	}
+	if !c.send(&packet) {
+		return
+	}
+	r.server.metrics.countSent(payload)
+	// A message that has been written to one of the recipient's devices has
+	// been delivered, so let the sender know. The receipt may have to be
+	// forwarded to another server, which we can't wait for here
+	if message, ok := payload.Contents.(*sirenproto.Payload_Message); ok &&
+		c.connectionType == sirenproto.HelloIAm_CLIENT_TO_SERVER {
+		go r.sendDeliveredReceipt(message.Message, c.remotePublicKey[:])
+	}
+}
+
+// Tells the remote side why the connection is being dropped. Until the
+// remote side has proved its key it might not be able to decrypt anything we
+// send it, so the reason is only encrypted once it has.
+func (c *connection) queueTerminate(text string) {
+	terminate := &sirenproto.Payload{
+		Contents: &sirenproto.Payload_Ack{
+			Ack: &sirenproto.Ack{
+				Condition: sirenproto.Ack_TERMINATE,
+				Text:      text,
+			},
+		},
+	}
+	if c.getState() == STATE_AUTHENTICATED {
+		c.queueEncrypted(terminate)
+	} else {
+		c.queueUnencrypted(terminate)
+	}
+}
+
+func (c *connection) readThread(r *router, initiator bool) {
+	c.logger().info("Opened connection")
+	defer c.connection.close()
+	defer r.removeConnection(c)
 
 loop:
 	for {
-		buflen, err := c.connection.Read(buf)
+		packet, err := c.connection.readPacket()
+		if err == errPacketTooLarge {
+			c.logger().warning("Packet too large")
+			c.queueTerminate("Packet exceeds maximum packet size")
+			break loop
+		}
 		if err != nil {
 			break loop
 		}
 
+		// Clients are held to the maximum message size from the config, but
+		// other servers forward packets that were built by servers, i.e.
+		// directory responses, so they can send anything that the transport
+		// accepts
+		if maximum := int(r.server.config().MaximumMessageSize); c.connectionType != sirenproto.HelloIAm_SERVER_TO_SERVER && len(packet) > maximum {
+			c.logger().warning("Packet too large", LogField{"length", len(packet)})
+			c.queueTerminate(fmt.Sprintf("Packet exceeds maximum message size of %d bytes", maximum))
+			break loop
+		}
+
 		// Attempt to decode the protobuf packet we received. If it isn't
 		// possible to decode the packet then send back a warning and drop
 		// the connection.
 		packetin := &sirenproto.Packet{}
-		if err := proto.Unmarshal(buf[:buflen], packetin); err != nil {
-			c.writeEncrypted <- &sirenproto.Payload{
+		if err := proto.Unmarshal(packet, packetin); err != nil {
+			c.queueTerminate("Failed to decode packet")
+			c.logger().warning("Could not decode packet", LogField{"length", len(packet)}, LogField{"error", err})
+			if c.getState() < STATE_AUTHENTICATED {
+				r.server.metrics.handshakeFailures.inc("decode")
+			}
+			break loop
+		}
+
+		// Once the protocol version has been negotiated, every packet must
+		// use it, so anything else is dropped, letting the remote side know
+		// why. Before then the only packet allowed is the HelloIAm, which is
+		// where the remote side tells us which versions it speaks
+		if version := c.getVersion(); version != 0 && packetin.Version != version {
+			c.logger().debug("Unsupported packet version", LogField{"version", packetin.Version})
+			c.queueUnencrypted(&sirenproto.Payload{
 				Contents: &sirenproto.Payload_Ack{
 					Ack: &sirenproto.Ack{
-						Condition: sirenproto.Ack_TERMINATE,
-						Text:      "Failed to decode packet",
+						Condition: sirenproto.Ack_VERSION_UNSUPPORTED,
+						Text:      fmt.Sprintf("Packet version %d is not supported", packetin.Version),
 					},
 				},
-			}
-			fmt.Printf("Could not decode packet:\n----\n\x1b[31m%s\x1b[39m\n----\n", buf[:buflen])
-			break loop
+			})
+			continue
 		}
 
 		var payload *sirenproto.Payload
@@ -165,9 +400,12 @@ loop:
 		switch received := packetin.PayloadType.(type) {
 		case *sirenproto.Packet_EncryptedPayload:
 			// The received packet was encrypted, therefore decrypt it
-			payload, err = c.DecryptPayload(r.server.config.PrivateKey, received.EncryptedPayload)
+			payload, err = c.DecryptPayload(r.server.config().PrivateKey, received.EncryptedPayload)
 			if err != nil {
-				fmt.Println(err)
+				c.logger().warning("Failed to decrypt payload", LogField{"error", err})
+				if c.getState() < STATE_AUTHENTICATED {
+					r.server.metrics.handshakeFailures.inc("decrypt")
+				}
 				continue
 			}
 			wasEncrypted = true
@@ -177,13 +415,44 @@ loop:
 			wasEncrypted = false
 		default:
 			// The payload type isn't known - send a warning back
-			c.writeEncrypted <- &sirenproto.Payload{
+			c.queueEncrypted(&sirenproto.Payload{
 				Contents: &sirenproto.Payload_Ack{
 					Ack: &sirenproto.Ack{
-						Condition: sirenproto.Ack_INVALID_PACKET,
+						Condition: sirenproto.Ack_NOT_IMPLEMENTED,
 						Text:      "Unknown payload type",
 					},
 				},
+			})
+		}
+
+		if payload == nil {
+			continue
+		}
+		r.server.metrics.countReceived(payload)
+
+		// Check that the payload is allowed in the state that the connection
+		// is in, i.e. that the remote side isn't sending a second HelloIAm or
+		// sending encrypted payloads before it has proved its key. If it is
+		// then the remote side isn't following the protocol, so drop it
+		next := c.getState()
+		if event, ok := payloadEvent(payload, wasEncrypted); ok {
+			if next, err = c.nextState(event); err != nil {
+				c.logger().warning("Illegal payload", LogField{"type", payloadType(payload)}, LogField{"error", err})
+				terminate := &sirenproto.Payload{
+					Contents: &sirenproto.Payload_Ack{
+						Ack: &sirenproto.Ack{
+							Condition: sirenproto.Ack_TERMINATE,
+							Text:      err.Error(),
+						},
+					},
+				}
+				if c.getState() == STATE_AUTHENTICATED {
+					c.queueEncrypted(terminate)
+				} else {
+					r.server.metrics.handshakeFailures.inc("illegal_state")
+					c.queueUnencrypted(terminate)
+				}
+				break loop
 			}
 		}
 
@@ -194,79 +463,278 @@ loop:
 			// We received an unencrypted packet
 			switch received := payload.Contents.(type) {
 			case *sirenproto.Payload_HelloIAm:
+				// The HelloIAm must have a public key and a challenge that we
+				// can use to check that the remote side holds the private key
+				if received.HelloIAm == nil ||
+					len(received.HelloIAm.PublicKey) != cryptoPublicKeyLen ||
+					len(received.HelloIAm.Challenge) != challengeLen {
+					r.server.metrics.handshakeFailures.inc("invalid_hello")
+					c.queueUnencrypted(&sirenproto.Payload{
+						Contents: &sirenproto.Payload_Ack{
+							Ack: &sirenproto.Ack{
+								Condition: sirenproto.Ack_TERMINATE,
+								Text:      "HelloIAm must contain a public key and a challenge",
+							},
+						},
+					})
+					break loop
+				}
+				// Pick the protocol version and features to use. If we have no
+				// version in common then there's no way to talk to each other
+				version, features, err := Negotiate(received.HelloIAm, serverFeatures)
+				if err != nil {
+					c.logger().warning("No protocol version in common",
+						LogField{"min", received.HelloIAm.MinVersion}, LogField{"max", received.HelloIAm.MaxVersion})
+					r.server.metrics.handshakeFailures.inc("version")
+					c.queueUnencrypted(&sirenproto.Payload{
+						Contents: &sirenproto.Payload_Ack{
+							Ack: &sirenproto.Ack{
+								Condition: sirenproto.Ack_VERSION_UNSUPPORTED,
+								Text:      fmt.Sprintf("This server only speaks protocol versions %d to %d", ProtocolMinVersion, ProtocolMaxVersion),
+							},
+						},
+					})
+					break loop
+				}
+				// Make sure that the listener that accepted this connection is
+				// willing to accept this type of connection
+				if !initiator && !c.policy.allows(received.HelloIAm.ConnectionType) {
+					r.server.metrics.handshakeFailures.inc("listener_policy")
+					c.queueUnencrypted(&sirenproto.Payload{
+						Contents: &sirenproto.Payload_Ack{
+							Ack: &sirenproto.Ack{
+								Condition: sirenproto.Ack_TERMINATE,
+								Text:      "This listener does not accept this connection type",
+							},
+						},
+					})
+					break loop
+				}
 				// Only accept federation connections from other servers if
 				// federation is enabled in the server config
 				if received.HelloIAm.ConnectionType == sirenproto.HelloIAm_SERVER_TO_SERVER {
-					if !r.server.config.FederationEnabled {
+					if !r.server.config().FederationEnabled {
+						r.server.metrics.handshakeFailures.inc("federation_disabled")
 						// Federation is not enabled. Goodbye!
-						c.writeEncrypted <- &sirenproto.Payload{
+						c.queueUnencrypted(&sirenproto.Payload{
 							Contents: &sirenproto.Payload_Ack{
 								Ack: &sirenproto.Ack{
 									Condition: sirenproto.Ack_TERMINATE,
 									Text:      "This server does not accept federation",
 								},
 							},
-						}
+						})
+						break loop
+					}
+					// Don't let other servers open more federation connections
+					// than the server config allows
+					if !initiator && r.federationsFull() {
+						r.server.metrics.handshakeFailures.inc("federation_limit")
+						c.queueUnencrypted(&sirenproto.Payload{
+							Contents: &sirenproto.Payload_Ack{
+								Ack: &sirenproto.Ack{
+									Condition: sirenproto.Ack_TERMINATE,
+									Text:      "This server has too many federation connections",
+								},
+							},
+						})
 						break loop
 					}
+					// If TLS client certificates are required for federation then
+					// make sure that the remote server presented a valid one
+					if r.server.config().TLS.RequireS2SClientCertificate && !initiator && !hasVerifiedPeerCertificate(c.connection) {
+						r.server.metrics.handshakeFailures.inc("client_certificate")
+						c.queueUnencrypted(&sirenproto.Payload{
+							Contents: &sirenproto.Payload_Ack{
+								Ack: &sirenproto.Ack{
+									Condition: sirenproto.Ack_TERMINATE,
+									Text:      "This server requires a TLS client certificate for federation",
+								},
+							},
+						})
+						break loop
+					}
+					// The remote server tells us which domains it serves, and we
+					// won't federate with it if any of them aren't allowed. A server
+					// that doesn't tell us is only allowed if there's no whitelist
+					if !initiator && !r.federationAllowed(received.HelloIAm.Domains) {
+						r.server.metrics.handshakeFailures.inc("federation_not_allowed")
+						c.queueUnencrypted(&sirenproto.Payload{
+							Contents: &sirenproto.Payload_Ack{
+								Ack: &sirenproto.Ack{
+									Condition: sirenproto.Ack_TERMINATE,
+									Text:      "This server does not federate with your domain",
+								},
+							},
+						})
+						break loop
+					}
+					// If the remote server presented a certificate then it has to
+					// be valid for all of the domains that it claims to serve
+					if !initiator && hasVerifiedPeerCertificate(c.connection) {
+						if err := verifyPeerDomains(c.connection, received.HelloIAm.Domains); err != nil {
+							r.server.metrics.handshakeFailures.inc("domain_unverified")
+							c.queueUnencrypted(&sirenproto.Payload{
+								Contents: &sirenproto.Payload_Ack{
+									Ack: &sirenproto.Ack{
+										Condition: sirenproto.Ack_TERMINATE,
+										Text:      err.Error(),
+									},
+								},
+							})
+							break loop
+						}
+					}
 				}
 				// Make sure that we aren't connecting to ourselves. This shouldn't
 				// ever really happen, but stranger things happen at sea
-				if bytes.Equal(received.HelloIAm.PublicKey[:32], r.server.config.PublicKey[:32]) {
-					fmt.Println("Rejecting connection from same public key")
-					c.writeEncrypted <- &sirenproto.Payload{
+				if bytes.Equal(received.HelloIAm.PublicKey[:32], r.server.config().PublicKey[:32]) {
+					c.logger().warning("Rejecting connection from same public key")
+					r.server.metrics.handshakeFailures.inc("same_public_key")
+					c.queueUnencrypted(&sirenproto.Payload{
 						Contents: &sirenproto.Payload_Ack{
 							Ack: &sirenproto.Ack{
 								Condition: sirenproto.Ack_TERMINATE,
 								Text:      "Rejecting connection from same public key",
 							},
 						},
-					}
-					// break loop
+					})
+					break loop
 				}
-				// If the connection wasn't authenticated before this point then
-				// store the public key and connection type and mark the connection
-				// as authenticated. This allows encrypted traffic to be sent and
-				// received from this point forward
-				if c.state < STATE_AUTHENTICATED {
-					copy(c.remotePublicKey[:32], received.HelloIAm.PublicKey[:32])
-					c.connectionType = received.HelloIAm.ConnectionType
+				// Store the public key, connection type and what was negotiated,
+				// and move on to authenticating. This allows encrypted traffic to
+				// be sent and received from this point forward, although only
+				// pings and the proofs are accepted until the remote side has
+				// proved its key
+				copy(c.remotePublicKey[:], received.HelloIAm.PublicKey)
+				c.sendNonces = NewNonceSequence(c.challenge[:], received.HelloIAm.Challenge)
+				c.receiveNonces = NewNonceSequence(received.HelloIAm.Challenge, c.challenge[:])
+				c.connectionType = received.HelloIAm.ConnectionType
+				// The domains that the remote server claims to serve can only be
+				// trusted once they have been checked. That has already happened
+				// if it presented a certificate, otherwise it happens when the
+				// connection is authenticated
+				if received.HelloIAm.ConnectionType == sirenproto.HelloIAm_SERVER_TO_SERVER && !initiator {
+					if hasVerifiedPeerCertificate(c.connection) || len(received.HelloIAm.Domains) == 0 {
+						c.domains.Store(received.HelloIAm.Domains)
+					} else {
+						c.claimedDomains = received.HelloIAm.Domains
+						c.domainsVerified = make(chan struct{})
+					}
 				}
+				c.features = features
+				atomic.StoreInt32(&c.version, version)
+				c.setState(next)
 				// If we were the initiator of the connection then we have already
 				// sent our "HelloIAm" packet already in the write thread, so only
 				// send a response "HelloIAm" if we are not the initiator
 				if !initiator {
-					c.writeUnencrypted <- &sirenproto.Payload{
+					c.queueUnencrypted(&sirenproto.Payload{
 						Contents: &sirenproto.Payload_HelloIAm{
-							HelloIAm: &sirenproto.HelloIAm{
-								ConnectionType: received.HelloIAm.ConnectionType,
-								PublicKey:      r.server.config.PublicKey[:],
-							},
+							HelloIAm: c.helloIAm(r, received.HelloIAm.ConnectionType),
 						},
-					}
+					})
 				}
+				// Prove that we hold the private key for our public key by
+				// sending the remote side's challenge back, encrypted
+				c.queueEncrypted(&sirenproto.Payload{
+					Contents: &sirenproto.Payload_HelloProof{
+						HelloProof: &sirenproto.HelloProof{
+							Challenge: received.HelloIAm.Challenge,
+						},
+					},
+				})
 			default:
 				// This case happens if we've received an unencrypted packet that
 				// isn't defined above. If that happens then send an error back
 				// to the sender telling them that encryption is required for
 				// that payload type
-				c.writeUnencrypted <- &sirenproto.Payload{
+				c.queueUnencrypted(&sirenproto.Payload{
 					Contents: &sirenproto.Payload_Ack{
 						Ack: &sirenproto.Ack{
 							Condition: sirenproto.Ack_REQUIRES_ENCRYPTION,
-							Text:      fmt.Sprintf("%v", reflect.TypeOf(received)),
+							Text:      payloadType(payload) + " must be encrypted",
+							RequestID: payload.RequestID,
 						},
 					},
-				}
+				})
 			}
 		} else {
-			// We received an encrypted packet. If our session is not already
-			// marked as authenticated then now we can safely do that
-			if c.state < STATE_AUTHENTICATED {
-				fmt.Println("Connection authenticated")
-				c.state = STATE_AUTHENTICATED
-				c.writeTicker.Stop()
-				c.writeTicker = time.NewTicker(time.Minute)
+			// We received an encrypted packet. If it is the remote side's
+			// proof then it must contain the challenge that we sent, which
+			// only the holder of the private key for the public key in its
+			// HelloIAm could have encrypted, and then the connection is
+			// authenticated. Challenges are never reused, so an old proof
+			// can't be replayed
+			if proof, ok := payload.Contents.(*sirenproto.Payload_HelloProof); ok {
+				// The write thread drops connections that haven't authenticated
+				// in time, but a proof might still be read before it does
+				if time.Since(c.opened) > authenticationTimeout {
+					c.logger().warning("Remote side proved its key too late")
+					r.server.metrics.handshakeFailures.inc("timeout")
+					c.queueUnencrypted(&sirenproto.Payload{
+						Contents: &sirenproto.Payload_Ack{
+							Ack: &sirenproto.Ack{
+								Condition: sirenproto.Ack_TERMINATE,
+								Text:      "Connection wasn't authenticated in time",
+							},
+						},
+					})
+					break loop
+				}
+				if !bytes.Equal(proof.HelloProof.GetChallenge(), c.challenge[:]) {
+					c.logger().warning("Remote side failed to prove its key")
+					r.server.metrics.handshakeFailures.inc("proof")
+					c.queueUnencrypted(&sirenproto.Payload{
+						Contents: &sirenproto.Payload_Ack{
+							Ack: &sirenproto.Ack{
+								Condition: sirenproto.Ack_TERMINATE,
+								Text:      "Invalid proof of key possession",
+							},
+						},
+					})
+					break loop
+				}
+				c.logger().info("Connection authenticated", LogField{"type", c.connectionType},
+					LogField{"version", c.getVersion()}, LogField{"features", c.featureList()})
+				c.setState(next)
+				r.server.metrics.connections.add("unauthenticated", -1)
+				r.server.metrics.connections.add(connectionTypeLabel(c.connectionType), 1)
+				// Wake up the write thread to send anything it was holding
+				// until now, and to slow down the pings
+				c.queue.wake()
+				if c.domainsVerified != nil {
+					go r.verifyDomains(c)
+				}
+				continue
+			}
+
+			// Nothing from a federation connection can be trusted until we
+			// know which domains the remote server serves, so wait until they
+			// have been verified. Verification only starts once the proof has
+			// been accepted, so keepalives, which can arrive before then, are
+			// handled without waiting
+			if event, _ := payloadEvent(payload, wasEncrypted); event == EVENT_PAYLOAD && !c.waitForDomains() {
+				c.logger().warning("Federation domains weren't verified in time")
+				c.queueTerminate("Could not verify your domains in time")
+				break loop
+			}
+
+			// Remember which request this is so that any Acks sent while it is
+			// processed refer to it
+			c.requestID = payload.RequestID
+
+			// Drop the packet if the remote side is sending too many messages
+			// or directory lookups
+			if !r.allowPayload(c, payload) {
+				continue
+			}
+
+			// Refuse payloads for features that the remote side didn't ask
+			// for, as we won't send it anything for them in return
+			if feature := payloadFeature(payload); !c.supports(feature) {
+				r.sendAck(c, sirenproto.Ack_NOT_IMPLEMENTED, "The "+feature+" feature wasn't negotiated")
+				continue
 			}
 
 			// Process the packet
@@ -275,92 +743,135 @@ loop:
 				// If we receive a ping from the remote side then we should respond
 				// with a pong. The connection must have been authenticated for
 				// pings and pongs to be exchanged
-				fmt.Println("Received ping from", c.connection.RemoteAddr())
-				c.writeEncrypted <- &sirenproto.Payload{
+				c.logger().debug("Received ping", LogField{"sequence", received.Ping.Sequence})
+				c.queueEncrypted(&sirenproto.Payload{
 					Contents: &sirenproto.Payload_Pong{
 						Pong: &sirenproto.Pong{
 							Sequence: received.Ping.Sequence,
 						},
 					},
-				}
+				})
 			case *sirenproto.Payload_Pong:
 				// The write thread also sends periodic pings to open connections.
 				// If we receive a pong then we should do nothing but store the
 				// last time we received a pong. This acts as a bit of a keep-alive
 				// for peer connections and lets us identify dead connections
 				c.pingLastResponse = time.Now()
-				fmt.Println("Last pong response:", c.pingLastResponse)
+				c.logger().debug("Received pong", LogField{"sequence", received.Pong.Sequence})
 				continue
 			case *sirenproto.Payload_DirectoryRequest:
-				// A directory request happens when a client wants to look up the
-				// user signing keys (USK) or device encryption keys (DEK) for a
-				// given user ID. First of all determine if the UID is one that
-				// we serve locally, or we need to go externally for
-				fmt.Println("Directory request for " + received.DirectoryRequest.UID)
-				parts := strings.Split(strings.Trim(received.DirectoryRequest.UID, " \t\r\n"), "@")
-				if len(parts) != 2 {
-					fmt.Println("Invalid UID")
+				// Answering a directory request might mean asking another server,
+				// so it is done separately rather than holding up everything
+				// else that the remote side sends. Clients must be logged in to
+				// be given one-time prekeys, and other servers are rate limited
+				// per domain
+				oneTimePreKeys := c.connectionType == sirenproto.HelloIAm_SERVER_TO_SERVER || c.uid != ""
+				go r.handleDirectoryRequest(c, received.DirectoryRequest, payload.RequestID, oneTimePreKeys)
+			case *sirenproto.Payload_DirectoryResponse:
+				// A federated server has responded to a directory request that we
+				// sent to it. Only accept records for users in that server's own
+				// domain, otherwise it could poison our cache for other domains
+				response := received.DirectoryResponse
+				if _, domain, ok := splitUID(response.UID); !ok || domain != c.federationDomain {
+					c.logger().warning("Ignoring directory response", LogField{"response", response.UID})
 					break
 				}
-				// Check if we have a local directory for this domain, otherwise
-				// use the "external" directory which caches records from outside servers
-				directory := r.server.externaldirectory
-				for _, domain := range r.server.config.LocalDomains {
-					if domain == parts[1] {
-						directory = r.server.localdirectory
-					}
-				}
-				// Create the request and create a channel to wait for the response.
-				// This thread will wait for the response before sending it to the
-				// remote side
-				rc := make(chan sirenproto.DirectoryResponse)
-				go directory.directoryRequest(*received.DirectoryRequest, rc)
-				// Wait for a response from the directory and send it back to the
-				// remote requestor
-				response := <-rc
-				c.writeEncrypted <- &sirenproto.Payload{
-					Contents: &sirenproto.Payload_DirectoryResponse{
-						DirectoryResponse: &response,
-					},
+				r.server.externaldirectory.directoryResponseExternal(*response)
+			case *sirenproto.Payload_Ack:
+				// The remote side has acknowledged something that we sent. We must
+				// never respond to an Ack with another Ack, otherwise the two sides
+				// could end up sending Acks back and forth forever
+				if received.Ack.Condition != sirenproto.Ack_SUCCESS {
+					c.logger().debug("Received ack", LogField{"condition", received.Ack.Condition}, LogField{"text", received.Ack.Text})
 				}
+			case *sirenproto.Payload_Login:
+				// A client wants to log in as a given user ID. The device key that
+				// the client authenticated the connection with must be registered
+				// to the user in our local directory
+				r.handleLogin(c, received.Login)
+			case *sirenproto.Payload_Register:
+				// A client wants to register a new user in one of our domains,
+				// with the device that it's connected from as the first device
+				r.handleRegister(c, received.Register)
+			case *sirenproto.Payload_DeviceUpdate:
+				// A logged in client is adding or revoking a device for its user
+				r.handleDeviceUpdate(c, received.DeviceUpdate)
+			case *sirenproto.Payload_DeviceLink:
+				// A logged in client is passing its user keys to a new device
+				r.handleDeviceLink(c, received.DeviceLink)
+			case *sirenproto.Payload_DeviceNotification:
+				// A federated server is letting one of our users know that the
+				// devices for one of their contacts have changed
+				r.handleDeviceNotification(c, received.DeviceNotification)
+			case *sirenproto.Payload_Receipt:
+				// A federated server is letting one of our users know that their
+				// message was delivered
+				r.handleReceipt(c, received.Receipt)
+			case *sirenproto.Payload_Presence:
+				// A client is setting its presence, or a federated server is
+				// sending the presence of one of its users to one of ours
+				r.handlePresence(c, received.Presence)
+			case *sirenproto.Payload_PresenceSubscribe:
+				// A user wants to be told about the presence of another user
+				r.handlePresenceSubscribe(c, received.PresenceSubscribe)
+			case *sirenproto.Payload_Typing:
+				// A user is typing a message to another user
+				r.handleTyping(c, received.Typing)
+			case *sirenproto.Payload_PublishPreKeys:
+				// A logged in client is publishing the prekeys for its device, so
+				// that other devices can start Double Ratchet sessions with it
+				r.handlePublishPreKeys(c, received.PublishPreKeys)
+			case *sirenproto.Payload_GroupUpdate:
+				// A group member is changing the membership of a group, which is
+				// applied here if we host the group or passed on if we don't
+				r.handleGroupUpdate(c, received.GroupUpdate)
+			case *sirenproto.Payload_GroupRequest:
+				// A group member wants to know the current state of a group
+				r.handleGroupRequest(c, received.GroupRequest)
+			case *sirenproto.Payload_GroupState:
+				// The server hosting a group has sent the state of the group for
+				// one of our users
+				r.handleGroupState(c, received.GroupState)
+			case *sirenproto.Payload_Message:
+				// A message has arrived from a client or from a federated server,
+				// so route it towards the destination user
+				r.routeMessage(c, received.Message)
 			default:
 				// We received an authenticated but unrecognised packet - this isn't
 				// necessarily catastrophic as it might just be a new packet type
 				// so the connection isn't terminated when this happens
-				fmt.Println("Unknown packet type")
-				c.writeEncrypted <- &sirenproto.Payload{
-					Contents: &sirenproto.Payload_Ack{
-						Ack: &sirenproto.Ack{
-							Condition: sirenproto.Ack_INVALID_PACKET,
-							Text:      "Unknown packet type",
-						},
-					},
-				}
+				c.logger().debug("Unknown packet type", LogField{"type", reflect.TypeOf(received)})
+				r.sendAck(c, sirenproto.Ack_NOT_IMPLEMENTED, "Unknown packet type "+payloadType(payload))
 			}
 		}
 	}
 
-	// If we reach this point then we want the connection to be dropped
+	// If we reach this point then we want the connection to be dropped. Wait
+	// for the write thread to send anything that it still has to say, i.e.
+	// the reason why, before the connection is closed
 	c.terminateWrite <- true
-	fmt.Println("Closed connection with", c.connection.RemoteAddr())
+	<-c.writeFinished
+	c.logger().info("Closed connection")
 }
 
-func (c *connection) send(packet *sirenproto.Packet) {
+// Returns true if the packet was written to the socket.
+func (c *connection) send(packet *sirenproto.Packet) bool {
 	// Marshalling turns the packet from the Protobuf struct into binary
 	// format to write out onto the wire. If there is an error marshalling
 	// then just drop the packet
 	out, err := proto.Marshal(packet)
 	if err != nil {
-		fmt.Println("Failed to encode packet:", err)
-		return
+		c.logger().warning("Failed to encode packet", LogField{"error", err})
+		return false
 	}
-	if _, err = c.connection.Write(out); err != nil {
+	if err = c.connection.writePacket(out); err != nil {
 		// Check for actual connection errors on the socket
 		switch err.(type) {
 		case *net.OpError:
-			return
 		default:
-			fmt.Println("Failed to send packet:", err)
+			c.logger().warning("Failed to send packet", LogField{"error", err})
 		}
+		return false
 	}
+	return true
 }
@@ -0,0 +1,495 @@
+package siren
+
+import "io"
+import "net"
+import "time"
+import "bytes"
+import "testing"
+
+import "github.com/neilalexander/siren/sirenproto"
+import proto "github.com/golang/protobuf/proto"
+
+// A testPeer drives the client side of a handshake by hand over the pipe
+// transport, so that it can send things that a real client never would.
+type testPeer struct {
+	t               *testing.T
+	conn            *streamConn
+	connectionType  sirenproto.HelloIAm_ConnectionTypes
+	domains         []string
+	packets         chan *sirenproto.Packet
+	publicKey       *cryptoPublicKey
+	privateKey      *cryptoPrivateKey
+	challenge       [challengeLen]byte
+	serverPublicKey cryptoPublicKey
+	serverChallenge []byte
+	sendNonces      *NonceSequence
+	receiveNonces   *NonceSequence
+}
+
+// Starts a server which listens on the given pipe address.
+func startTestServer(t *testing.T, address string) *Server {
+	config := DefaultServerConfig()
+	config.Listeners = []ListenerConfig{{Address: "pipe://" + address}}
+	config.Logger = NewTextLogger(io.Discard, LogError)
+	s := &Server{}
+	go s.Start(config)
+	return s
+}
+
+// Returns a server that is set up enough to route payloads but which isn't
+// listening, so that the router can be tested without real connections.
+func newTestServer(t *testing.T, domains ...string) *Server {
+	config := DefaultServerConfig()
+	config.Listeners = nil
+	config.LocalDomains = domains
+	config.Logger = NewTextLogger(io.Discard, LogError)
+	s := &Server{}
+	s.current.Store(&config)
+	s.log = newLogger(config.Logger, config.LogLevel)
+	s.groups.start()
+	s.presence.start()
+	s.router.start(s)
+	s.externaldirectory.start(s)
+	s.localdirectory.start(s, domains...)
+	return s
+}
+
+// Adds a logged in session for a local user to a server from newTestServer,
+// with room for the given number of messages in its write queue. Nothing
+// reads from the queue, so whatever is delivered to it stays there.
+func newTestSession(s *Server, uid string, messages int) *connection {
+	c := &connection{
+		log:     s.log,
+		queue:   newWriteQueue(0, messages),
+		metrics: &s.metrics,
+		state:   STATE_AUTHENTICATED,
+		uid:     uid,
+	}
+	s.router.mutex.Lock()
+	s.router.sessions[uid] = append(s.router.sessions[uid], c)
+	s.router.mutex.Unlock()
+	return c
+}
+
+// Returns the number of connections that the server knows about. The server
+// must be listening, i.e. newTestPeer must have returned.
+func connectionCount(s *Server) int {
+	s.router.mutex.RLock()
+	defer s.router.mutex.RUnlock()
+	return len(s.router.connections)
+}
+
+// Connects to a server started with startTestServer, waiting for it to
+// start listening if it hasn't yet.
+func newTestPeer(t *testing.T, address string) *testPeer {
+	transportsMutex.RLock()
+	pipes := transports["pipe"].(*pipeTransport)
+	transportsMutex.RUnlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pipes.mutex.Lock()
+		listener, ok := pipes.listeners[address]
+		pipes.mutex.Unlock()
+		if ok {
+			local, remote := net.Pipe()
+			listener.incoming <- remote
+			publicKey, privateKey := NewCryptoKeys()
+			p := &testPeer{
+				t:          t,
+				conn:       &streamConn{conn: local},
+				packets:    make(chan *sirenproto.Packet, 16),
+				publicKey:  publicKey,
+				privateKey: privateKey,
+				challenge:  newChallenge(),
+			}
+			go p.readLoop()
+			t.Cleanup(func() { p.conn.close() })
+			return p
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Nothing is listening on pipe %s", address)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Reads packets from the server until the connection is closed. The pipe
+// has no buffer, so the server can't write anything unless this is running.
+func (p *testPeer) readLoop() {
+	defer close(p.packets)
+	for {
+		packet, err := p.conn.readPacket()
+		if err != nil {
+			return
+		}
+		packetin := &sirenproto.Packet{}
+		if err := proto.Unmarshal(packet, packetin); err != nil {
+			p.t.Errorf("Could not decode packet from server: %v", err)
+			return
+		}
+		p.packets <- packetin
+	}
+}
+
+func (p *testPeer) write(payload *sirenproto.Packet) error {
+	packet, err := proto.Marshal(payload)
+	if err != nil {
+		p.t.Fatalf("Could not encode packet: %v", err)
+	}
+	return p.conn.writePacket(packet)
+}
+
+func (p *testPeer) sendHello(challenge []byte) {
+	err := p.write(&sirenproto.Packet{
+		Version: ProtocolMaxVersion,
+		PayloadType: &sirenproto.Packet_Payload{
+			Payload: &sirenproto.Payload{
+				Contents: &sirenproto.Payload_HelloIAm{
+					HelloIAm: &sirenproto.HelloIAm{
+						ConnectionType: p.connectionType,
+						Domains:        p.domains,
+						PublicKey:      p.publicKey[:],
+						Challenge:      challenge,
+						MinVersion:     ProtocolMinVersion,
+						MaxVersion:     ProtocolMaxVersion,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		p.t.Fatalf("Could not send HelloIAm: %v", err)
+	}
+}
+
+func (p *testPeer) sendEncrypted(payload *sirenproto.Payload) error {
+	enc, err := EncryptPayload(p.serverPublicKey, *p.privateKey, p.sendNonces, payload)
+	if err != nil {
+		p.t.Fatalf("Could not encrypt payload: %v", err)
+	}
+	return p.write(&sirenproto.Packet{
+		Version: ProtocolMaxVersion,
+		PayloadType: &sirenproto.Packet_EncryptedPayload{
+			EncryptedPayload: enc,
+		},
+	})
+}
+
+// Returns the next payload from the server and whether it was encrypted.
+// Encrypted payloads that can't be decrypted yet, i.e. pings sent before the
+// server's HelloIAm, are skipped. Returns nil if the connection is closed.
+func (p *testPeer) next() (*sirenproto.Payload, bool) {
+	for {
+		select {
+		case packet, ok := <-p.packets:
+			if !ok {
+				return nil, false
+			}
+			switch received := packet.PayloadType.(type) {
+			case *sirenproto.Packet_Payload:
+				return received.Payload, false
+			case *sirenproto.Packet_EncryptedPayload:
+				payload, err := DecryptPayload(p.serverPublicKey, *p.privateKey, p.receiveNonces, received.EncryptedPayload)
+				if err != nil {
+					continue
+				}
+				return payload, true
+			}
+		case <-time.After(5 * time.Second):
+			p.t.Fatalf("Timed out waiting for the server")
+		}
+	}
+}
+
+// Waits for the server's HelloIAm and its proof of our challenge.
+func (p *testPeer) expectHandshake() {
+	for {
+		payload, encrypted := p.next()
+		if payload == nil {
+			p.t.Fatalf("Connection closed during handshake")
+		}
+		switch received := payload.Contents.(type) {
+		case *sirenproto.Payload_HelloIAm:
+			if encrypted {
+				p.t.Fatalf("HelloIAm from server was encrypted")
+			}
+			copy(p.serverPublicKey[:], received.HelloIAm.PublicKey)
+			p.serverChallenge = received.HelloIAm.Challenge
+			p.sendNonces = NewNonceSequence(p.challenge[:], p.serverChallenge)
+			p.receiveNonces = NewNonceSequence(p.serverChallenge, p.challenge[:])
+		case *sirenproto.Payload_HelloProof:
+			if !encrypted {
+				p.t.Fatalf("HelloProof from server wasn't encrypted")
+			}
+			if !bytes.Equal(received.HelloProof.Challenge, p.challenge[:]) {
+				p.t.Fatalf("Server sent back the wrong challenge")
+			}
+			return
+		case *sirenproto.Payload_Ack:
+			p.t.Fatalf("Server refused the handshake: %s", received.Ack.Text)
+		}
+	}
+}
+
+// Waits for the server to send an unencrypted TERMINATE with the given text
+// and then close the connection, failing if the connection is authenticated
+// in the meantime.
+func (p *testPeer) expectTerminate(text string) {
+	terminated := false
+	for {
+		payload, encrypted := p.next()
+		if payload == nil {
+			break
+		}
+		switch received := payload.Contents.(type) {
+		case *sirenproto.Payload_Pong:
+			p.t.Fatalf("Server answered a ping on an unauthenticated connection")
+		case *sirenproto.Payload_Ack:
+			if received.Ack.Condition != sirenproto.Ack_TERMINATE {
+				continue
+			}
+			if encrypted {
+				p.t.Errorf("TERMINATE was encrypted before the connection was authenticated")
+			}
+			if received.Ack.Text != text {
+				p.t.Errorf("Got TERMINATE %q, want %q", received.Ack.Text, text)
+			}
+			terminated = true
+		}
+	}
+	if !terminated {
+		p.t.Fatalf("Connection closed without a TERMINATE")
+	}
+}
+
+func (p *testPeer) sendPing(sequence int64) error {
+	return p.sendEncrypted(&sirenproto.Payload{
+		Contents: &sirenproto.Payload_Ping{
+			Ping: &sirenproto.Ping{
+				Sequence: sequence,
+			},
+		},
+	})
+}
+
+func (p *testPeer) sendProof(challenge []byte) error {
+	return p.sendEncrypted(&sirenproto.Payload{
+		Contents: &sirenproto.Payload_HelloProof{
+			HelloProof: &sirenproto.HelloProof{
+				Challenge: challenge,
+			},
+		},
+	})
+}
+
+func TestHandshakeGoodProof(t *testing.T) {
+	startTestServer(t, "handshake-good")
+	p := newTestPeer(t, "handshake-good")
+	p.sendHello(p.challenge[:])
+	p.expectHandshake()
+	if err := p.sendProof(p.serverChallenge); err != nil {
+		t.Fatalf("Could not send proof: %v", err)
+	}
+
+	// Pings are only answered once the connection is authenticated
+	if err := p.sendPing(42); err != nil {
+		t.Fatalf("Could not send ping: %v", err)
+	}
+	for {
+		payload, encrypted := p.next()
+		if payload == nil {
+			t.Fatalf("Connection closed after a good proof")
+		}
+		switch received := payload.Contents.(type) {
+		case *sirenproto.Payload_Pong:
+			if !encrypted {
+				t.Fatalf("Pong wasn't encrypted")
+			}
+			if received.Pong.Sequence != 42 {
+				t.Fatalf("Got pong %d, want 42", received.Pong.Sequence)
+			}
+			return
+		case *sirenproto.Payload_Ack:
+			t.Fatalf("Server refused a good proof: %s", received.Ack.Text)
+		}
+	}
+}
+
+func TestHandshakeBadProof(t *testing.T) {
+	startTestServer(t, "handshake-bad")
+	tests := []struct {
+		name      string
+		challenge func(p *testPeer) []byte
+	}{
+		{"own challenge", func(p *testPeer) []byte { return p.challenge[:] }},
+		{"modified challenge", func(p *testPeer) []byte {
+			challenge := append([]byte{}, p.serverChallenge...)
+			challenge[0] ^= 1
+			return challenge
+		}},
+		{"missing challenge", func(p *testPeer) []byte { return nil }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestPeer(t, "handshake-bad")
+			p.sendHello(p.challenge[:])
+			p.expectHandshake()
+			p.sendProof(test.challenge(p))
+			p.sendPing(1)
+			p.expectTerminate("Invalid proof of key possession")
+		})
+	}
+}
+
+func TestHandshakeMissingChallenge(t *testing.T) {
+	startTestServer(t, "handshake-missing")
+	tests := []struct {
+		name      string
+		challenge []byte
+	}{
+		{"missing", nil},
+		{"short", make([]byte, challengeLen-1)},
+		{"long", make([]byte, challengeLen+1)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestPeer(t, "handshake-missing")
+			p.sendHello(test.challenge)
+			p.expectTerminate("HelloIAm must contain a public key and a challenge")
+		})
+	}
+}
+
+func TestHandshakeLateProof(t *testing.T) {
+	timeout := authenticationTimeout
+	authenticationTimeout = 200 * time.Millisecond
+	defer func() { authenticationTimeout = timeout }()
+
+	startTestServer(t, "handshake-late")
+	p := newTestPeer(t, "handshake-late")
+	p.sendHello(p.challenge[:])
+	p.expectHandshake()
+	time.Sleep(2 * authenticationTimeout)
+	// The server might have closed the connection already, in which case
+	// the proof can't be sent at all
+	p.sendProof(p.serverChallenge)
+	p.sendPing(1)
+	p.expectTerminate("Connection wasn't authenticated in time")
+}
+
+func TestOversizedPacket(t *testing.T) {
+	startTestServer(t, "oversized")
+	p := newTestPeer(t, "oversized")
+	p.sendHello(p.challenge[:])
+	p.expectHandshake()
+	// The server reads the whole packet before refusing it, so it can still
+	// say why it is dropping the connection
+	p.conn.writePacket(make([]byte, 4097))
+	p.expectTerminate("Packet exceeds maximum message size of 4096 bytes")
+}
+
+func TestDirectoryRequestInvalidUID(t *testing.T) {
+	startTestServer(t, "directory-invalid")
+	p := newTestPeer(t, "directory-invalid")
+	p.sendHello(p.challenge[:])
+	p.expectHandshake()
+	p.sendProof(p.serverChallenge)
+	p.sendEncrypted(&sirenproto.Payload{
+		Contents: &sirenproto.Payload_DirectoryRequest{
+			DirectoryRequest: &sirenproto.DirectoryRequest{
+				UID: "nobody",
+			},
+		},
+		RequestID: "lookup",
+	})
+	for {
+		payload, _ := p.next()
+		if payload == nil {
+			t.Fatalf("Connection closed without an answer")
+		}
+		if received, ok := payload.Contents.(*sirenproto.Payload_Ack); ok {
+			if received.Ack.Condition != sirenproto.Ack_INVALID_PACKET || received.Ack.RequestID != "lookup" {
+				t.Fatalf("Got %s for request %q, want INVALID_PACKET for \"lookup\"", received.Ack.Condition, received.Ack.RequestID)
+			}
+			return
+		}
+	}
+}
+
+func TestFederationPingBeforeProof(t *testing.T) {
+	timeout := authenticationTimeout
+	authenticationTimeout = 200 * time.Millisecond
+	defer func() { authenticationTimeout = timeout }()
+
+	s := startTestServer(t, "federation-ping")
+	newFederationPeer := func(t *testing.T) *testPeer {
+		p := newTestPeer(t, "federation-ping")
+		p.connectionType = sirenproto.HelloIAm_SERVER_TO_SERVER
+		p.domains = []string{"unverifiable.invalid"}
+		p.sendHello(p.challenge[:])
+		p.expectHandshake()
+		// The domains can't be verified until the proof has been accepted,
+		// so the ping mustn't wait for that to happen
+		if err := p.sendPing(7); err != nil {
+			t.Fatalf("Could not send ping: %v", err)
+		}
+		return p
+	}
+
+	t.Run("without proof", func(t *testing.T) {
+		p := newFederationPeer(t)
+		p.expectTerminate("Connection wasn't authenticated in time")
+		deadline := time.Now().Add(time.Second)
+		for connectionCount(s) != 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("Connection is still registered after it timed out")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	t.Run("with proof", func(t *testing.T) {
+		p := newFederationPeer(t)
+		p.sendProof(p.serverChallenge)
+		for {
+			payload, _ := p.next()
+			if payload == nil {
+				t.Fatalf("Connection closed without answering the ping")
+			}
+			if received, ok := payload.Contents.(*sirenproto.Payload_Pong); ok {
+				if received.Pong.Sequence != 7 {
+					t.Fatalf("Got pong %d, want 7", received.Pong.Sequence)
+				}
+				return
+			}
+		}
+	})
+}
+
+func TestFederationLimit(t *testing.T) {
+	s := startTestServer(t, "federation-limit")
+	first := newTestPeer(t, "federation-limit")
+	config := *s.config()
+	config.MaximumS2SConnections = 1
+	s.Reconfigure(config)
+
+	first.connectionType = sirenproto.HelloIAm_SERVER_TO_SERVER
+	first.sendHello(first.challenge[:])
+	first.expectHandshake()
+
+	// The first federation connection takes up the only space, so another
+	// server is turned away, but clients aren't
+	second := newTestPeer(t, "federation-limit")
+	second.connectionType = sirenproto.HelloIAm_SERVER_TO_SERVER
+	second.sendHello(second.challenge[:])
+	second.expectTerminate("This server has too many federation connections")
+
+	client := newTestPeer(t, "federation-limit")
+	client.sendHello(client.challenge[:])
+	client.expectHandshake()
+
+	// Nor do we open federation connections of our own
+	if err := s.router.initiateOutgoingConnection("remote.example"); err == nil || err.Error() != "Too many federation connections" {
+		t.Fatalf("Got error %v, want too many federation connections", err)
+	}
+}
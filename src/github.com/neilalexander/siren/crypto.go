@@ -2,6 +2,10 @@ package siren
 
 import "crypto/rand"
 import "errors"
+import "bytes"
+import "encoding/binary"
+import "crypto/sha256"
+import "math"
 
 import "github.com/neilalexander/siren/sirenproto"
 import proto "github.com/golang/protobuf/proto"
@@ -35,27 +39,70 @@ func NewCryptoKeys() (*cryptoPublicKey, *cryptoPrivateKey) {
 	return (*cryptoPublicKey)(pubBytes), (*cryptoPrivateKey)(privBytes)
 }
 
-func EncryptPayload(remotePublicKey cryptoPublicKey, localPrivateKey cryptoPrivateKey, p *sirenproto.Payload) (*sirenproto.EncryptedPayload, error) {
+// A NonceSequence hands out the nonces for one direction of an encrypted
+// connection. Each nonce is made from the challenges that both sides sent in
+// their HelloIAm, the sender's first, followed by a counter. That way no nonce
+// is used twice with the same keys, and packets can't be replayed from another
+// connection, from the other direction or from earlier in the same connection.
+type NonceSequence struct {
+	prefix  [cryptoNonceLen - 8]byte
+	counter uint64
+}
+
+func NewNonceSequence(senderChallenge, receiverChallenge []byte) *NonceSequence {
+	hash := sha256.Sum256(signatureData(senderChallenge, receiverChallenge))
+	n := &NonceSequence{}
+	copy(n.prefix[:], hash[:])
+	return n
+}
+
+func (n *NonceSequence) nonce(counter uint64) *[cryptoNonceLen]byte {
 	var nonce [cryptoNonceLen]byte
+	copy(nonce[:], n.prefix[:])
+	binary.BigEndian.PutUint64(nonce[len(n.prefix):], counter)
+	return &nonce
+}
+
+// Encrypts a payload with the next nonce from the sequence. Payloads must be
+// sent in the order that they were encrypted in, as the remote side refuses
+// any counter that isn't higher than the last one it accepted.
+func EncryptPayload(remotePublicKey cryptoPublicKey, localPrivateKey cryptoPrivateKey, nonces *NonceSequence, p *sirenproto.Payload) (*sirenproto.EncryptedPayload, error) {
+	if nonces == nil {
+		return nil, errors.New("Handshake not complete")
+	}
+	if nonces.counter == math.MaxUint64 {
+		return nil, errors.New("Nonces exhausted")
+	}
 	message, err := proto.Marshal(p)
 	if err != nil {
 		return nil, errors.New("Failed to encode packet")
 	}
 
+	counter := nonces.counter
+	nonces.counter++
 	crypted := make([]byte, 0, len(message)+cryptoOverhead)
-	boxed := box.Seal(crypted, message, &nonce,
+	boxed := box.Seal(crypted, message, nonces.nonce(counter),
 		(*[32]byte)(&remotePublicKey),
 		(*[32]byte)(&localPrivateKey))
 
 	return &sirenproto.EncryptedPayload{
 		Ciphertext: boxed,
+		Counter:    counter,
 	}, nil
 }
 
-func DecryptPayload(remotePublicKey cryptoPublicKey, localPrivateKey cryptoPrivateKey, p *sirenproto.EncryptedPayload) (*sirenproto.Payload, error) {
-	var nonce [cryptoNonceLen]byte
+// Decrypts a payload using the nonce from the sequence for the counter in the
+// payload. Counters can be skipped, i.e. if the sender encrypted packets that
+// were never read, but never go backwards.
+func DecryptPayload(remotePublicKey cryptoPublicKey, localPrivateKey cryptoPrivateKey, nonces *NonceSequence, p *sirenproto.EncryptedPayload) (*sirenproto.Payload, error) {
+	if nonces == nil {
+		return nil, errors.New("Handshake not complete")
+	}
+	if p.Counter < nonces.counter {
+		return nil, errors.New("Replayed packet")
+	}
 	decrypted := make([]byte, 0, len(p.Ciphertext))
-	unboxed, success := box.Open(decrypted, p.Ciphertext, &nonce,
+	unboxed, success := box.Open(decrypted, p.Ciphertext, nonces.nonce(p.Counter),
 		(*[32]byte)(&remotePublicKey),
 		(*[32]byte)(&localPrivateKey))
 	if !success {
@@ -68,15 +115,18 @@ func DecryptPayload(remotePublicKey cryptoPublicKey, localPrivateKey cryptoPriva
 		return nil, errors.New("Failed to decode packet")
 	}
 
+	// Only move the sequence on once the packet is known to be genuine, so
+	// that garbage can't be used to skip over the packets that follow it
+	nonces.counter = p.Counter + 1
 	return payloadout, nil
 }
 
 func (c *connection) EncryptPayload(localPrivateKey cryptoPrivateKey, payload *sirenproto.Payload) (*sirenproto.EncryptedPayload, error) {
-	return EncryptPayload(c.remotePublicKey, localPrivateKey, payload)
+	return EncryptPayload(c.remotePublicKey, localPrivateKey, c.sendNonces, payload)
 }
 
 func (c *connection) DecryptPayload(localPrivateKey cryptoPrivateKey, payload *sirenproto.EncryptedPayload) (*sirenproto.Payload, error) {
-	return DecryptPayload(c.remotePublicKey, localPrivateKey, payload)
+	return DecryptPayload(c.remotePublicKey, localPrivateKey, c.receiveNonces, payload)
 }
 
 func NewSignatureKeys() (*signaturePublicKey, *signaturePrivateKey) {
@@ -114,3 +164,17 @@ func VerifyPayload(public *signaturePublicKey, msg []byte, signature *signature)
 	// It's fixed size, but
 	return ed25519.Verify(public[:], msg, signature[:])
 }
+
+// Builds the data that is covered by a signature from the given fields. Each
+// field is prefixed with its length so that the boundaries between fields
+// can't be moved around.
+func signatureData(fields ...[]byte) []byte {
+	var buf bytes.Buffer
+	for _, field := range fields {
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(field)))
+		buf.Write(length[:])
+		buf.Write(field)
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,390 @@
+package siren
+
+import "sync"
+import "bytes"
+import "errors"
+import "strings"
+
+import "github.com/neilalexander/siren/sirenproto"
+import "golang.org/x/crypto/ed25519"
+
+var errUnknownUser = errors.New("Unknown user")
+var errOfflineQueueFull = errors.New("Offline queue is full")
+
+// The offlineQueue holds messages for local users who have no devices
+// online. The messages are delivered when one of the user's devices next
+// logs in. It also holds the latest group state that couldn't be delivered
+// because the write queues of all of the user's sessions were full. Newer
+// state replaces older state with the same key, so only the latest is ever
+// delivered.
+type offlineQueue struct {
+	mutex    sync.Mutex
+	messages map[string][]*sirenproto.Message
+	latest   map[string]map[string]*sirenproto.Payload
+	limit    int32
+}
+
+func (q *offlineQueue) start(limit int32) {
+	q.messages = make(map[string][]*sirenproto.Message)
+	q.latest = make(map[string]map[string]*sirenproto.Payload)
+	q.limit = limit
+}
+
+func (q *offlineQueue) setLimit(limit int32) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.limit = limit
+}
+
+func (q *offlineQueue) push(uid string, message *sirenproto.Message) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if int32(len(q.messages[uid])) >= q.limit {
+		return false
+	}
+	q.messages[uid] = append(q.messages[uid], message)
+	return true
+}
+
+// Returns the number of users with messages in the queue, and the total
+// number of messages.
+func (q *offlineQueue) depth() (int, int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	var messages int
+	for _, queued := range q.messages {
+		messages += len(queued)
+	}
+	return len(q.messages), messages
+}
+
+func (q *offlineQueue) pop(uid string) []*sirenproto.Message {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	messages := q.messages[uid]
+	delete(q.messages, uid)
+	return messages
+}
+
+func (q *offlineQueue) pushLatest(uid, key string, payload *sirenproto.Payload) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.latest[uid] == nil {
+		q.latest[uid] = make(map[string]*sirenproto.Payload)
+	}
+	q.latest[uid][key] = payload
+}
+
+func (q *offlineQueue) popLatest(uid string) map[string]*sirenproto.Payload {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	latest := q.latest[uid]
+	delete(q.latest, uid)
+	return latest
+}
+
+// Throws away everything held for a user.
+func (q *offlineQueue) clear(uid string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	delete(q.messages, uid)
+	delete(q.latest, uid)
+}
+
+func splitUID(uid string) (string, string, bool) {
+	parts := strings.Split(strings.Trim(uid, " \t\r\n"), "@")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func (r *router) handleLogin(c *connection, login *sirenproto.Login) {
+	// Only clients can log in, and only to users in one of our local
+	// domains. The device key that the connection was authenticated with
+	// must also be registered to the user in our local directory
+	_, domain, ok := splitUID(login.UID)
+	if c.connectionType != sirenproto.HelloIAm_CLIENT_TO_SERVER || !ok ||
+		!r.isLocalDomain(domain) ||
+		!r.server.localdirectory.hasDeviceKey(login.UID, c.remotePublicKey[:]) {
+		c.logger().warning("Rejecting login", LogField{"login", login.UID})
+		r.sendAck(c, sirenproto.Ack_UNAUTHORIZED, "Device key is not registered to "+login.UID)
+		return
+	}
+
+	// Users who have been banned for going over the rate limits can't log
+	// in again until the ban is over
+	if r.limiter.banned("uid:" + login.UID) {
+		r.sendAck(c, sirenproto.Ack_RATE_LIMITED, login.UID+" is temporarily banned")
+		return
+	}
+
+	// Register the session so that messages can be routed to it
+	r.mutex.Lock()
+	if c.uid != "" {
+		r.mutex.Unlock()
+		r.sendAck(c, sirenproto.Ack_INVALID_PACKET, "Already logged in as "+c.uid)
+		return
+	}
+	c.uid = login.UID
+	r.sessions[c.uid] = append(r.sessions[c.uid], c)
+	r.mutex.Unlock()
+	r.server.localdirectory.touch(c.uid)
+
+	c.logger().info("Logged in")
+	r.sendAck(c, sirenproto.Ack_SUCCESS, "Logged in as "+c.uid)
+
+	// Deliver anything that arrived whilst the user was offline, as long as
+	// the client supports the offline queue. Otherwise the messages are left
+	// for another one of the user's devices that does
+	if c.supports(FEATURE_OFFLINE_QUEUE) {
+		r.deliverOffline(c)
+	}
+	r.notifyPresence(c.uid)
+}
+
+// Delivers the messages that arrived for a user whilst they were offline to
+// a session that has just logged in, along with any state that couldn't be
+// delivered before.
+func (r *router) deliverOffline(c *connection) {
+	for key, payload := range r.offline.popLatest(c.uid) {
+		if !c.queueEncrypted(payload) {
+			r.offline.pushLatest(c.uid, key, payload)
+		}
+	}
+	for _, message := range r.offline.pop(c.uid) {
+		if !c.queueEncrypted(&sirenproto.Payload{
+			Contents: &sirenproto.Payload_Message{
+				Message: message,
+			},
+		}) {
+			// The write queue is full, so put the message back for later
+			r.offline.push(c.uid, message)
+		}
+	}
+}
+
+func (r *router) handlePublishPreKeys(c *connection, publish *sirenproto.PublishPreKeys) {
+	// Clients can only publish prekeys for the device that they logged in
+	// with, and the signed prekey must be signed by the user signing key
+	bundle := publish.Bundle
+	if c.uid == "" || bundle == nil || !bytes.Equal(bundle.DeviceKey, c.remotePublicKey[:]) {
+		r.sendAck(c, sirenproto.Ack_UNAUTHORIZED, "Prekeys can only be published for the logged in device")
+		return
+	}
+	usk := r.server.localdirectory.userSigningKey(c.uid)
+	if len(usk) != ed25519.PublicKeySize || !ed25519.Verify(usk, bundle.SignedPreKey, bundle.SignedPreKeySignature) {
+		r.sendAck(c, sirenproto.Ack_UNAUTHORIZED, "Signed prekey is not signed by the user signing key")
+		return
+	}
+	r.server.localdirectory.publishPreKeys(c.uid, bundle)
+	r.sendAck(c, sirenproto.Ack_SUCCESS, "Published prekeys")
+}
+
+func (r *router) routeMessage(c *connection, message *sirenproto.Message) {
+	// Messages from clients must come from a logged in session, in which case
+	// we fill in the source ourselves so that it can't be forged. Messages
+	// from federated servers can never come from our own users, and must come
+	// from one of that server's own users, unless they are group messages,
+	// which are fanned out by the server that hosts the group and are checked
+	// in routeGroupMessage
+	switch c.connectionType {
+	case sirenproto.HelloIAm_CLIENT_TO_SERVER:
+		if c.uid == "" {
+			r.sendAck(c, sirenproto.Ack_UNAUTHORIZED, "Must be logged in to send messages")
+			return
+		}
+		message.Source = c.uid
+		if message.MessageID == "" {
+			message.MessageID = NewMessageID()
+		}
+	case sirenproto.HelloIAm_SERVER_TO_SERVER:
+		_, domain, ok := splitUID(message.Source)
+		if !ok || r.isLocalDomain(domain) || (message.GroupID == "" && !c.servesDomain(domain)) {
+			c.logger().warning("Dropping federated message with invalid source", LogField{"source", message.Source})
+			return
+		}
+	}
+
+	if message.GroupID != "" {
+		if r.routeGroupMessage(c, message) && c.connectionType == sirenproto.HelloIAm_CLIENT_TO_SERVER {
+			r.sendAcceptedReceipt(c, message)
+		}
+		return
+	}
+
+	_, domain, ok := splitUID(message.Destination)
+	if !ok {
+		r.sendAck(c, sirenproto.Ack_INVALID_PACKET, "Invalid destination "+message.Destination)
+		return
+	}
+
+	// If the destination isn't one of our users then send the message onto
+	// the destination server, as long as it didn't come from federation in
+	// the first place
+	if !r.isLocalDomain(domain) {
+		if c.connectionType != sirenproto.HelloIAm_CLIENT_TO_SERVER {
+			return
+		}
+		// If the connection to the destination server doesn't authenticate
+		// in time then the message is never sent, so tell the sender
+		failed := r.remoteUnavailable(c, domain)
+		if err := r.forwardRequest(domain, &sirenproto.Payload{
+			Contents: &sirenproto.Payload_Message{
+				Message: message,
+			},
+		}, failed); err != nil {
+			r.server.log.warning("Unable to route message", LogField{"destination", message.Destination}, LogField{"error", err})
+			r.sendAck(c, sirenproto.Ack_REMOTE_UNAVAILABLE, err.Error())
+			return
+		}
+		r.sendAcceptedReceipt(c, message)
+		return
+	}
+
+	switch r.deliverLocal(message) {
+	case errUnknownUser:
+		r.sendAck(c, sirenproto.Ack_NOT_FOUND, "Unknown user "+message.Destination)
+		return
+	case errOfflineQueueFull:
+		r.sendAck(c, sirenproto.Ack_QUOTA_EXCEEDED, "Offline queue is full for "+message.Destination)
+		return
+	}
+	if c.connectionType == sirenproto.HelloIAm_CLIENT_TO_SERVER {
+		r.sendAcceptedReceipt(c, message)
+	}
+}
+
+// Delivers a message to all of the destination user's devices that are
+// online, or queues it if none of them are. Returns errUnknownUser if the
+// destination isn't one of our users, or errOfflineQueueFull if the message
+// had to be queued but there was no room for it.
+func (r *router) deliverLocal(message *sirenproto.Message) error {
+	if !r.server.localdirectory.hasUser(message.Destination) {
+		return errUnknownUser
+	}
+	sessions := r.localSessions(message.Destination)
+	if len(sessions) == 0 {
+		if !r.offline.push(message.Destination, message) {
+			r.server.log.warning("Offline queue is full", LogField{"destination", message.Destination})
+			return errOfflineQueueFull
+		}
+		return nil
+	}
+	// If none of the sessions could take the message because their write
+	// queues are full then keep it in the offline queue instead, so that it
+	// isn't lost
+	delivered := false
+	for _, s := range sessions {
+		if s.queueEncrypted(&sirenproto.Payload{
+			Contents: &sirenproto.Payload_Message{
+				Message: message,
+			},
+		}) {
+			delivered = true
+		}
+	}
+	if !delivered && !r.offline.push(message.Destination, message) {
+		r.server.log.warning("Offline queue is full", LogField{"destination", message.Destination})
+		return errOfflineQueueFull
+	}
+	return nil
+}
+
+// Queues state for all of a local user's sessions. If none of them have
+// room for it then it is kept in the offline queue under the given key, so
+// that it is delivered when one of the user's devices next logs in.
+func (r *router) deliverLatest(uid, key string, sessions []*connection, payload *sirenproto.Payload) {
+	delivered := false
+	for _, s := range sessions {
+		if s.queueEncrypted(payload) {
+			delivered = true
+		}
+	}
+	if !delivered {
+		r.offline.pushLatest(uid, key, payload)
+	}
+}
+
+func (r *router) localSessions(uid string) []*connection {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return append([]*connection{}, r.sessions[uid]...)
+}
+
+// Sends a payload to the server for the given domain over federation,
+// connecting to it first if needed.
+func (r *router) forward(domain string, payload *sirenproto.Payload) error {
+	return r.forwardRequest(domain, payload, nil)
+}
+
+// Returns a function which tells the client on the given connection that
+// the payload it is processing couldn't be forwarded to the server for the
+// given domain, for use with forwardRequest. Only clients are told, since
+// federated servers don't wait for Acks.
+func (r *router) remoteUnavailable(c *connection, domain string) func() {
+	if c.connectionType != sirenproto.HelloIAm_CLIENT_TO_SERVER {
+		return nil
+	}
+	requestID := c.requestID
+	return func() {
+		r.sendAckFor(c, requestID, sirenproto.Ack_REMOTE_UNAVAILABLE, "Unable to reach "+domain)
+	}
+}
+
+// Sends a payload to the server for the given domain like forward, but
+// calls failed if the connection to that server isn't authenticated in time
+// for the payload to be sent.
+func (r *router) forwardRequest(domain string, payload *sirenproto.Payload, failed func()) error {
+	if !r.server.config().FederationEnabled {
+		return errors.New("Federation is not enabled")
+	}
+	if err := r.initiateOutgoingConnection(domain); err != nil {
+		return err
+	}
+	federation, ok := r.federation(domain)
+	if !ok {
+		return errors.New("No federation connection to " + domain)
+	}
+	if !federation.queueRequest(payload, failed) {
+		return errors.New("Federation connection to " + domain + " is congested")
+	}
+	return nil
+}
+
+// Looks up the user signing key for a user, either from our local directory
+// or from the user's own server.
+func (r *router) userSigningKey(uid string) []byte {
+	_, domain, ok := splitUID(uid)
+	if !ok {
+		return nil
+	}
+	directory := &r.server.externaldirectory
+	if r.isLocalDomain(domain) {
+		directory = &r.server.localdirectory
+	}
+	rc := make(chan sirenproto.DirectoryResponse)
+	go directory.directoryRequest(sirenproto.DirectoryRequest{UID: uid}, false, rc)
+	response := <-rc
+	return response.UserSigningKey
+}
+
+// Sends an Ack for the payload that the connection is processing, which is
+// identified by its request ID.
+func (r *router) sendAck(c *connection, condition sirenproto.Ack_Conditions, text string) {
+	r.sendAckFor(c, c.requestID, condition, text)
+}
+
+// Sends an Ack for a particular request. This is used for Acks which are
+// sent after the read thread has moved on to other payloads.
+func (r *router) sendAckFor(c *connection, requestID string, condition sirenproto.Ack_Conditions, text string) {
+	c.queueEncrypted(&sirenproto.Payload{
+		Contents: &sirenproto.Payload_Ack{
+			Ack: &sirenproto.Ack{
+				Condition: condition,
+				Text:      text,
+				RequestID: requestID,
+			},
+		},
+	})
+}
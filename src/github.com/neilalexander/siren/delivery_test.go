@@ -0,0 +1,42 @@
+package siren
+
+import "testing"
+
+import "github.com/neilalexander/siren/sirenproto"
+
+func TestDeliverLocalOnline(t *testing.T) {
+	s := newTestServer(t, "test.com")
+	limit := int(s.config().MaximumOfflineMessages)
+	session := newTestSession(s, "test@test.com", limit+1)
+
+	// Messages that were queued to a session must not also be kept for the
+	// next login, otherwise they would be delivered twice and the offline
+	// queue would fill up
+	for i := 0; i <= limit; i++ {
+		if err := s.router.deliverLocal(&sirenproto.Message{Destination: "test@test.com"}); err != nil {
+			t.Fatalf("Message %d: unexpected error: %v", i, err)
+		}
+	}
+	if users, messages := s.router.offline.depth(); users != 0 || messages != 0 {
+		t.Fatalf("Offline queue has %d messages for %d users, want none", messages, users)
+	}
+	if depth := session.queue.depth(); depth[PRIORITY_MESSAGE] != limit+1 {
+		t.Fatalf("Session has %d messages queued, want %d", depth[PRIORITY_MESSAGE], limit+1)
+	}
+}
+
+func TestDeliverLocalSessionFull(t *testing.T) {
+	s := newTestServer(t, "test.com")
+	newTestSession(s, "test@test.com", 1)
+
+	// The second message doesn't fit in the session's write queue, so it is
+	// kept until the user next logs in
+	for i := 0; i < 2; i++ {
+		if err := s.router.deliverLocal(&sirenproto.Message{Destination: "test@test.com"}); err != nil {
+			t.Fatalf("Message %d: unexpected error: %v", i, err)
+		}
+	}
+	if _, messages := s.router.offline.depth(); messages != 1 {
+		t.Fatalf("Offline queue has %d messages, want 1", messages)
+	}
+}
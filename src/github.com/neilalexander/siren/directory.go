@@ -1,11 +1,20 @@
 package siren
 
-import "fmt"
 import "time"
+import "sync"
+import "bytes"
 import "strings"
 
 import "github.com/neilalexander/siren/sirenproto"
 
+// How long records from external servers are cached for, and how long we
+// will wait for an external server to respond to a directory request.
+const directoryCacheLifetime = 5 * time.Minute
+const directoryRequestTimeout = 10 * time.Second
+
+// The maximum number of one-time prekeys that we will store for a device.
+const maximumOneTimePreKeys = 100
+
 type userSigningKey struct {
 	publicKey []byte
 }
@@ -17,6 +26,7 @@ type deviceEncryptionKey struct {
 
 type directory struct {
 	server *Server
+	mutex  sync.RWMutex
 
 	isLocalDirectory bool
 	localDomains     []string
@@ -24,6 +34,19 @@ type directory struct {
 	// TODO: It would be better to map UID->USK and then USK->DEK
 	mapUIDtoUSK map[string]userSigningKey
 	mapUIDtoDEK map[string]deviceEncryptionKey
+
+	// The prekey bundles for each of a user's devices, keyed by the device
+	// encryption key, which are used to start Double Ratchet sessions
+	mapUIDtoPreKeys map[string]map[string]*sirenproto.PreKeyBundle
+
+	// The time of the last device update for each user, so that old updates
+	// can't be replayed
+	deviceUpdated map[string]int64
+
+	// External directories keep track of when each record was fetched, and
+	// which requests are waiting for a response from an external server
+	fetched map[string]time.Time
+	pending map[string][]chan sirenproto.DirectoryResponse
 }
 
 func (d *directory) start(s *Server, domains ...string) {
@@ -33,10 +56,14 @@ func (d *directory) start(s *Server, domains ...string) {
 	// TODO: It would be better to map UID->USK and then USK->DEK
 	d.mapUIDtoUSK = make(map[string]userSigningKey)
 	d.mapUIDtoDEK = make(map[string]deviceEncryptionKey)
+	d.mapUIDtoPreKeys = make(map[string]map[string]*sirenproto.PreKeyBundle)
+	d.deviceUpdated = make(map[string]int64)
+	d.fetched = make(map[string]time.Time)
+	d.pending = make(map[string][]chan sirenproto.DirectoryResponse)
 
 	// Determine if we have been given any local domains to serve
 	if len(domains) > 0 {
-		fmt.Println("Starting directory for domains", domains)
+		d.server.log.info("Starting directory", LogField{"domains", strings.Join(domains, ",")})
 		d.isLocalDirectory = true
 		d.localDomains = domains
 
@@ -53,57 +80,396 @@ func (d *directory) start(s *Server, domains ...string) {
 			publicKeys: [][]byte{(*pk2)[:], (*pk3)[:]},
 		}
 	} else {
-		fmt.Println("Starting directory for external caching")
+		d.server.log.debug("Starting directory for external caching")
 		d.isLocalDirectory = false
 	}
 }
 
-func (d *directory) directoryRequest(r sirenproto.DirectoryRequest, c chan sirenproto.DirectoryResponse) {
+// Answers a directory request from a connection. A directory request happens
+// when a client wants to look up the user signing keys (USK) or device
+// encryption keys (DEK) for a given user ID. The request ID is passed in as
+// the connection may have moved on to another request by the time that the
+// response is ready. One-time prekeys are only handed out if oneTimePreKeys
+// is set, as anyone who can ask for them can use them all up.
+func (r *router) handleDirectoryRequest(c *connection, request *sirenproto.DirectoryRequest, requestID string, oneTimePreKeys bool) {
+	c.logger().debug("Directory request", LogField{"request", request.UID})
+	_, domain, ok := splitUID(request.UID)
+	if !ok {
+		c.logger().debug("Invalid UID in directory request", LogField{"request", request.UID})
+		r.sendAckFor(c, requestID, sirenproto.Ack_INVALID_PACKET, "Invalid UID in directory request")
+		return
+	}
+	// Check if we have a local directory for this domain, otherwise use the
+	// "external" directory which caches records from outside servers
+	directory := &r.server.externaldirectory
+	if r.isLocalDomain(domain) {
+		directory = &r.server.localdirectory
+	}
+	rc := make(chan sirenproto.DirectoryResponse)
+	go directory.directoryRequest(*request, oneTimePreKeys, rc)
+	response := <-rc
+	c.queueEncrypted(&sirenproto.Payload{
+		Contents: &sirenproto.Payload_DirectoryResponse{
+			DirectoryResponse: &response,
+		},
+		RequestID: requestID,
+	})
+}
+
+func (d *directory) directoryRequest(r sirenproto.DirectoryRequest, oneTimePreKeys bool, c chan sirenproto.DirectoryResponse) {
 	// Look up the appropriate function for the type of directory
 	if d.isLocalDirectory {
-		c <- d.directoryRequestInternal(r)
-	} else {
-		c <- d.directoryRequestExternal(r)
+		c <- d.directoryRequestInternal(r, oneTimePreKeys)
+		return
+	}
+	response := d.directoryRequestExternal(r)
+	if !oneTimePreKeys {
+		// The remote server has already handed them out, but there's no need
+		// to pass them on to someone who isn't allowed them
+		bundles := make([]*sirenproto.PreKeyBundle, 0, len(response.PreKeyBundles))
+		for _, bundle := range response.PreKeyBundles {
+			bundles = append(bundles, &sirenproto.PreKeyBundle{
+				DeviceKey:             bundle.DeviceKey,
+				SignedPreKey:          bundle.SignedPreKey,
+				SignedPreKeySignature: bundle.SignedPreKeySignature,
+			})
+		}
+		response.PreKeyBundles = bundles
 	}
+	c <- response
 }
 
-func (d *directory) directoryRequestInternal(r sirenproto.DirectoryRequest) sirenproto.DirectoryResponse {
+func (d *directory) directoryRequestInternal(r sirenproto.DirectoryRequest, oneTimePreKeys bool) sirenproto.DirectoryResponse {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// Include the prekey bundle for each device. Each one-time prekey must
+	// only ever be handed out once, so remove it from the bundle as we go
+	// if the requester is allowed one
+	var bundles []*sirenproto.PreKeyBundle
+	for _, dek := range d.mapUIDtoDEK[r.UID].publicKeys {
+		bundle, ok := d.mapUIDtoPreKeys[r.UID][string(dek)]
+		if !ok {
+			continue
+		}
+		response := &sirenproto.PreKeyBundle{
+			DeviceKey:             bundle.DeviceKey,
+			SignedPreKey:          bundle.SignedPreKey,
+			SignedPreKeySignature: bundle.SignedPreKeySignature,
+		}
+		if oneTimePreKeys && len(bundle.OneTimePreKeys) > 0 {
+			response.OneTimePreKeys = bundle.OneTimePreKeys[:1]
+			bundle.OneTimePreKeys = bundle.OneTimePreKeys[1:]
+		}
+		bundles = append(bundles, response)
+	}
+
 	// Create the directory response object based on the USK and DEK maps
 	return sirenproto.DirectoryResponse{
 		UID:                 r.UID,
 		UserSigningKey:      d.mapUIDtoUSK[r.UID].publicKey,
 		DeviceEncryptionKey: d.mapUIDtoDEK[r.UID].publicKeys,
+		PreKeyBundles:       bundles,
 	}
 }
 
+func (d *directory) publishPreKeys(uid string, bundle *sirenproto.PreKeyBundle) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// Replace any existing bundle for the device. The device always sends
+	// all of the one-time prekeys that it still holds
+	if len(bundle.OneTimePreKeys) > maximumOneTimePreKeys {
+		bundle.OneTimePreKeys = bundle.OneTimePreKeys[:maximumOneTimePreKeys]
+	}
+	if _, ok := d.mapUIDtoPreKeys[uid]; !ok {
+		d.mapUIDtoPreKeys[uid] = make(map[string]*sirenproto.PreKeyBundle)
+	}
+	d.mapUIDtoPreKeys[uid][string(bundle.DeviceKey)] = bundle
+}
+
+func (d *directory) userSigningKey(uid string) []byte {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.mapUIDtoUSK[uid].publicKey
+}
+
 func (d *directory) directoryRequestExternal(r sirenproto.DirectoryRequest) sirenproto.DirectoryResponse {
 	// Extract the domain part
-	parts := strings.Split(strings.Trim(r.UID, " \t\r\n"), "@")
-	if len(parts) != 2 {
-		fmt.Println("Invalid UID")
+	_, domain, ok := splitUID(r.UID)
+	if !ok {
+		d.server.log.debug("Invalid UID in directory request", LogField{"request", r.UID})
 		return sirenproto.DirectoryResponse{}
 	}
 
+	// If we have a recent copy of the record in the cache then we don't need
+	// to ask the remote server again
+	d.mutex.Lock()
+	if fetched, ok := d.fetched[r.UID]; ok && time.Since(fetched) < directoryCacheLifetime {
+		d.mutex.Unlock()
+		d.server.metrics.directoryLookups.inc("hit")
+		return d.cachedResponse(r.UID)
+	}
+	d.server.metrics.directoryLookups.inc("miss")
+	rc := make(chan sirenproto.DirectoryResponse, 1)
+	d.pending[r.UID] = append(d.pending[r.UID], rc)
+	d.mutex.Unlock()
+	defer d.cancelPending(r.UID, rc)
+
 	// Create a connection if needed to the remote server
-	err := d.server.router.initiateOutgoingConnection(parts[1])
+	err := d.server.router.initiateOutgoingConnection(domain)
 	if err != nil {
-		fmt.Println("Initiating outgoing connection failed")
+		d.server.log.warning("Initiating outgoing connection failed", LogField{"domain", domain}, LogField{"error", err})
 		return sirenproto.DirectoryResponse{
 			UID: r.UID,
 		}
 	}
 
-	// Send the request onto the remote server
-	d.server.router.federations[parts[1]].writeEncrypted <- &sirenproto.Payload{
-		Contents: &sirenproto.Payload_DirectoryRequest{
-			DirectoryRequest: &r,
-		},
+	// Send the request onto the remote server. If the connection isn't
+	// authenticated in time for the request to be sent then stop waiting
+	failed := make(chan struct{}, 1)
+	if federation, ok := d.server.router.federation(domain); ok {
+		federation.queueRequest(&sirenproto.Payload{
+			Contents: &sirenproto.Payload_DirectoryRequest{
+				DirectoryRequest: &r,
+			},
+		}, func() {
+			failed <- struct{}{}
+		})
+	}
+
+	// Wait for the remote server to respond. If it doesn't respond in time
+	// then return whatever we have in the cache, even if it is stale
+	select {
+	case response := <-rc:
+		return response
+	case <-failed:
+		d.server.log.warning("Directory request failed", LogField{"domain", domain}, LogField{"request", r.UID})
+		return d.cachedResponse(r.UID)
+	case <-time.After(directoryRequestTimeout):
+		d.server.log.warning("Timed out waiting for directory response", LogField{"domain", domain}, LogField{"request", r.UID})
+		return d.cachedResponse(r.UID)
+	}
+}
+
+func (d *directory) directoryResponseExternal(r sirenproto.DirectoryResponse) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// Store the record from the remote server in the cache and then pass it
+	// to any requests that are waiting for it
+	d.mapUIDtoUSK[r.UID] = userSigningKey{
+		publicKey: r.UserSigningKey,
+	}
+	d.mapUIDtoDEK[r.UID] = deviceEncryptionKey{
+		publicKeys: r.DeviceEncryptionKey,
+		lastSeen:   d.mapUIDtoDEK[r.UID].lastSeen,
+	}
+	// Cache the prekey bundles without their one-time prekeys, as those can
+	// only be used once by whoever asked for them
+	bundles := make(map[string]*sirenproto.PreKeyBundle)
+	for _, bundle := range r.PreKeyBundles {
+		bundles[string(bundle.DeviceKey)] = &sirenproto.PreKeyBundle{
+			DeviceKey:             bundle.DeviceKey,
+			SignedPreKey:          bundle.SignedPreKey,
+			SignedPreKeySignature: bundle.SignedPreKeySignature,
+		}
+	}
+	d.mapUIDtoPreKeys[r.UID] = bundles
+	d.fetched[r.UID] = time.Now()
+	for _, rc := range d.pending[r.UID] {
+		rc <- r
+	}
+	delete(d.pending, r.UID)
+}
+
+// Marks the cached record for a user as stale, so that it is fetched from
+// the remote server again the next time that it is needed.
+func (d *directory) expire(uid string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.fetched, uid)
+}
+
+func (d *directory) setLocalDomains(domains []string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.localDomains = domains
+}
+
+// Returns the number of requests waiting for a response from an external
+// server.
+func (d *directory) pendingRequests() int {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	var pending int
+	for _, waiting := range d.pending {
+		pending += len(waiting)
+	}
+	return pending
+}
+
+func (d *directory) cancelPending(uid string, rc chan sirenproto.DirectoryResponse) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	pending := d.pending[uid][:0]
+	for _, p := range d.pending[uid] {
+		if p != rc {
+			pending = append(pending, p)
+		}
+	}
+	if len(pending) > 0 {
+		d.pending[uid] = pending
+	} else {
+		delete(d.pending, uid)
+	}
+}
+
+func (d *directory) cachedResponse(uid string) sirenproto.DirectoryResponse {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	var bundles []*sirenproto.PreKeyBundle
+	for _, bundle := range d.mapUIDtoPreKeys[uid] {
+		bundles = append(bundles, bundle)
 	}
 
 	// Create the directory response object based on the USK and DEK maps
 	return sirenproto.DirectoryResponse{
-		UID:                 r.UID,
-		UserSigningKey:      d.mapUIDtoUSK[r.UID].publicKey,
-		DeviceEncryptionKey: d.mapUIDtoDEK[r.UID].publicKeys,
+		UID:                 uid,
+		UserSigningKey:      d.mapUIDtoUSK[uid].publicKey,
+		DeviceEncryptionKey: d.mapUIDtoDEK[uid].publicKeys,
+		PreKeyBundles:       bundles,
 	}
 }
+
+func (d *directory) hasUser(uid string) bool {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	_, ok := d.mapUIDtoUSK[uid]
+	return ok
+}
+
+func (d *directory) hasDeviceKey(uid string, key []byte) bool {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	// Check if the given key is one of the device encryption keys which are
+	// registered to the user
+	for _, k := range d.mapUIDtoDEK[uid].publicKeys {
+		if bytes.Equal(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *directory) touch(uid string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// Update the time that we last saw one of the user's devices
+	if dek, ok := d.mapUIDtoDEK[uid]; ok {
+		dek.lastSeen = time.Now()
+		d.mapUIDtoDEK[uid] = dek
+	}
+}
+
+// Returns the last time that one of the user's devices was online.
+func (d *directory) lastSeen(uid string) time.Time {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	return d.mapUIDtoDEK[uid].lastSeen
+}
+
+func (d *directory) register(uid string, usk []byte, dek []byte) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// Users can only be registered once, after which their keys can only be
+	// changed using device updates signed by the user signing key
+	if _, ok := d.mapUIDtoUSK[uid]; ok {
+		return false
+	}
+	d.mapUIDtoUSK[uid] = userSigningKey{
+		publicKey: usk,
+	}
+	d.mapUIDtoDEK[uid] = deviceEncryptionKey{
+		publicKeys: [][]byte{dek},
+		lastSeen:   time.Now(),
+	}
+	return true
+}
+
+func (d *directory) updateDevice(uid string, key []byte, revoke bool, timestamp int64) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	// Updates must be newer than the last update for the user
+	if timestamp <= d.deviceUpdated[uid] {
+		return false
+	}
+	d.applyDeviceUpdate(uid, key, revoke)
+	d.deviceUpdated[uid] = timestamp
+	return true
+}
+
+// Adds or revokes a device for a local user without a signed device update,
+// which is only used by the admin API. Returns false if the user doesn't
+// exist.
+func (d *directory) setDevice(uid string, key []byte, revoke bool) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if _, ok := d.mapUIDtoUSK[uid]; !ok {
+		return false
+	}
+	d.applyDeviceUpdate(uid, key, revoke)
+	return true
+}
+
+// Must be called with the directory mutex held.
+func (d *directory) applyDeviceUpdate(uid string, key []byte, revoke bool) {
+	dek := d.mapUIDtoDEK[uid]
+	keys := make([][]byte, 0, len(dek.publicKeys)+1)
+	for _, k := range dek.publicKeys {
+		if !bytes.Equal(k, key) {
+			keys = append(keys, k)
+		}
+	}
+	if revoke {
+		delete(d.mapUIDtoPreKeys[uid], string(key))
+	} else {
+		keys = append(keys, key)
+	}
+	dek.publicKeys = keys
+	d.mapUIDtoDEK[uid] = dek
+}
+
+// Removes a user and all of their devices and prekeys. Returns false if the
+// user doesn't exist.
+func (d *directory) removeUser(uid string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if _, ok := d.mapUIDtoUSK[uid]; !ok {
+		return false
+	}
+	delete(d.mapUIDtoUSK, uid)
+	delete(d.mapUIDtoDEK, uid)
+	delete(d.mapUIDtoPreKeys, uid)
+	delete(d.deviceUpdated, uid)
+	return true
+}
+
+// Drops every record from the external directory cache, so that they are
+// fetched from the remote servers again the next time that they are needed.
+// Returns the number of records that were dropped.
+func (d *directory) flush() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	flushed := len(d.mapUIDtoUSK)
+	d.mapUIDtoUSK = make(map[string]userSigningKey)
+	d.mapUIDtoDEK = make(map[string]deviceEncryptionKey)
+	d.mapUIDtoPreKeys = make(map[string]map[string]*sirenproto.PreKeyBundle)
+	d.fetched = make(map[string]time.Time)
+	return flushed
+}
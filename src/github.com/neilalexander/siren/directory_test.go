@@ -0,0 +1,47 @@
+package siren
+
+import "testing"
+
+import "github.com/neilalexander/siren/sirenproto"
+
+func TestDirectoryOneTimePreKeys(t *testing.T) {
+	device, _ := NewCryptoKeys()
+	d := &directory{
+		isLocalDirectory: true,
+		mapUIDtoUSK:      map[string]userSigningKey{},
+		mapUIDtoDEK: map[string]deviceEncryptionKey{
+			"alice@test.com": {publicKeys: [][]byte{device[:]}},
+		},
+		mapUIDtoPreKeys: map[string]map[string]*sirenproto.PreKeyBundle{},
+	}
+	d.publishPreKeys("alice@test.com", &sirenproto.PreKeyBundle{
+		DeviceKey:      device[:],
+		SignedPreKey:   []byte("signed"),
+		OneTimePreKeys: [][]byte{[]byte("one"), []byte("two")},
+	})
+	request := sirenproto.DirectoryRequest{UID: "alice@test.com"}
+
+	// Requests that aren't allowed one-time prekeys still get the rest of
+	// the bundle, and don't use any of them up
+	for i := 0; i < 3; i++ {
+		response := d.directoryRequestInternal(request, false)
+		if len(response.PreKeyBundles) != 1 || string(response.PreKeyBundles[0].SignedPreKey) != "signed" {
+			t.Fatalf("Got bundles %v, want the signed prekey", response.PreKeyBundles)
+		}
+		if len(response.PreKeyBundles[0].OneTimePreKeys) != 0 {
+			t.Fatalf("Handed out a one-time prekey to a request that isn't allowed one")
+		}
+	}
+
+	// Each one-time prekey is only handed out once
+	for _, want := range []string{"one", "two", ""} {
+		response := d.directoryRequestInternal(request, true)
+		var got string
+		if keys := response.PreKeyBundles[0].OneTimePreKeys; len(keys) > 0 {
+			got = string(keys[0])
+		}
+		if got != want {
+			t.Fatalf("Got one-time prekey %q, want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,470 @@
+package siren
+
+import "sync"
+import "errors"
+import "encoding/binary"
+
+import "github.com/neilalexander/siren/sirenproto"
+import "golang.org/x/crypto/ed25519"
+import proto "github.com/golang/protobuf/proto"
+
+// A group is hosted by the server for the domain in its group ID, which holds
+// the member list and fans out messages sent to the group to every member.
+type group struct {
+	id      string
+	version uint64
+	members map[string]bool // UID -> admin
+}
+
+// As well as the groups that we host, the groupStore remembers the latest
+// state of groups hosted elsewhere that has been sent to our users, so that
+// we can deliver messages sent to those groups by our users to the other
+// members in our own domains.
+type groupStore struct {
+	mutex  sync.RWMutex
+	groups map[string]*group
+	remote map[string]*sirenproto.GroupState
+}
+
+func (g *groupStore) start() {
+	g.groups = make(map[string]*group)
+	g.remote = make(map[string]*sirenproto.GroupState)
+}
+
+// Remembers the state of a group hosted by another server. Empty states,
+// which are sent to users that aren't members, and older states are ignored.
+func (g *groupStore) cacheRemote(state *sirenproto.GroupState) {
+	if state.Version == 0 {
+		return
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if cached, ok := g.remote[state.GroupID]; ok && cached.Version > state.Version {
+		return
+	}
+	g.remote[state.GroupID] = state
+}
+
+// Returns the UIDs of the members of a group hosted by another server if the
+// given user is one of them, as far as we know.
+func (g *groupStore) remoteMembersFor(id, uid string) ([]string, bool) {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	state, ok := g.remote[id]
+	if !ok {
+		return nil, false
+	}
+	var members []string
+	member := false
+	for _, m := range state.Members {
+		members = append(members, m.UID)
+		member = member || m.UID == uid
+	}
+	return members, member
+}
+
+// Returns a copy of the state of the group, or nil if the group doesn't exist.
+func (g *groupStore) state(id string) *sirenproto.GroupState {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	gr, ok := g.groups[id]
+	if !ok {
+		return nil
+	}
+	state := &sirenproto.GroupState{
+		GroupID: gr.id,
+		Version: gr.version,
+	}
+	for uid, admin := range gr.members {
+		state.Members = append(state.Members, &sirenproto.GroupMember{
+			UID:   uid,
+			Admin: admin,
+		})
+	}
+	return state
+}
+
+// Returns the UIDs of the members of the group if the given user is one of
+// them, checked under the same lock so that the group can't be deleted in
+// between.
+func (g *groupStore) membersFor(id, uid string) ([]string, bool) {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	gr, ok := g.groups[id]
+	if !ok {
+		return nil, false
+	}
+	if _, ok := gr.members[uid]; !ok {
+		return nil, false
+	}
+	members := make([]string, 0, len(gr.members))
+	for member := range gr.members {
+		members = append(members, member)
+	}
+	return members, true
+}
+
+func (g *groupStore) isMember(id, uid string) bool {
+	g.mutex.RLock()
+	defer g.mutex.RUnlock()
+	gr, ok := g.groups[id]
+	if !ok {
+		return false
+	}
+	_, ok = gr.members[uid]
+	return ok
+}
+
+// Applies a membership change to a group. The signature on the update must
+// already have been checked. Returns the members who should be told about
+// the change, which includes anyone who was removed.
+func (g *groupStore) apply(update *sirenproto.GroupUpdate) ([]string, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	gr, ok := g.groups[update.GroupID]
+	if update.Type == sirenproto.GroupUpdate_CREATE {
+		if ok {
+			return nil, errors.New("Group already exists")
+		}
+		g.groups[update.GroupID] = &group{
+			id:      update.GroupID,
+			version: 1,
+			members: map[string]bool{update.Author: true},
+		}
+		return []string{update.Author}, nil
+	}
+	if !ok {
+		return nil, errors.New("Unknown group " + update.GroupID)
+	}
+
+	// Updates are made against a specific version of the group, so that an
+	// update can't be replayed and two admins can't make conflicting changes
+	if update.Version != gr.version {
+		return nil, errors.New("Group has changed since this update was made")
+	}
+	admin := gr.members[update.Author]
+	if _, _, ok := splitUID(update.Member); !ok {
+		return nil, errors.New("Invalid member " + update.Member)
+	}
+	_, member := gr.members[update.Member]
+
+	notify := make([]string, 0, len(gr.members)+1)
+	for uid := range gr.members {
+		notify = append(notify, uid)
+	}
+	members := make(map[string]bool, len(gr.members)+1)
+	for uid, a := range gr.members {
+		members[uid] = a
+	}
+
+	switch update.Type {
+	case sirenproto.GroupUpdate_ADD_MEMBER:
+		if !admin {
+			return nil, errors.New("Only admins can add members")
+		}
+		if member {
+			return nil, errors.New(update.Member + " is already a member")
+		}
+		members[update.Member] = update.Admin
+		notify = append(notify, update.Member)
+	case sirenproto.GroupUpdate_REMOVE_MEMBER:
+		// Members can always remove themselves, i.e. leave the group
+		if !admin && update.Member != update.Author {
+			return nil, errors.New("Only admins can remove members")
+		}
+		if !member {
+			return nil, errors.New(update.Member + " is not a member")
+		}
+		delete(members, update.Member)
+	case sirenproto.GroupUpdate_SET_ADMIN:
+		if !admin {
+			return nil, errors.New("Only admins can change admins")
+		}
+		if !member {
+			return nil, errors.New(update.Member + " is not a member")
+		}
+		members[update.Member] = update.Admin
+	default:
+		return nil, errors.New("Unknown group update type")
+	}
+
+	// The group must always have an admin, unless it's now empty, in which
+	// case it's removed entirely
+	if len(members) == 0 {
+		delete(g.groups, update.GroupID)
+		return notify, nil
+	}
+	hasAdmin := false
+	for _, a := range members {
+		hasAdmin = hasAdmin || a
+	}
+	if !hasAdmin {
+		return nil, errors.New("Group must have at least one admin")
+	}
+	gr.members = members
+	gr.version++
+	return notify, nil
+}
+
+// Builds the data that is covered by the signature on a group update.
+func GroupUpdateSignatureData(update *sirenproto.GroupUpdate) []byte {
+	var fields [13]byte
+	binary.BigEndian.PutUint32(fields[0:4], uint32(update.Type))
+	binary.BigEndian.PutUint64(fields[4:12], update.Version)
+	if update.Admin {
+		fields[12] = 1
+	}
+	return signatureData(
+		[]byte("siren-group-update"),
+		[]byte(update.GroupID),
+		[]byte(update.Member),
+		[]byte(update.Author),
+		fields[:],
+	)
+}
+
+func (r *router) handleGroupUpdate(c *connection, update *sirenproto.GroupUpdate) {
+	// Clients can only make updates as the user that they're logged in as.
+	// Updates from federated servers are checked against the signature only
+	if c.connectionType == sirenproto.HelloIAm_CLIENT_TO_SERVER && (c.uid == "" || update.Author != c.uid) {
+		r.sendAck(c, sirenproto.Ack_UNAUTHORIZED, "Group updates must be made by the logged in user")
+		return
+	}
+	_, domain, ok := splitUID(update.GroupID)
+	if !ok {
+		r.sendAck(c, sirenproto.Ack_INVALID_PACKET, "Invalid group ID "+update.GroupID)
+		return
+	}
+
+	// If the group is hosted elsewhere then pass the update on to the server
+	// that hosts it, which will tell the members about the change
+	if !r.isLocalDomain(domain) {
+		if c.connectionType != sirenproto.HelloIAm_CLIENT_TO_SERVER {
+			return
+		}
+		failed := r.remoteUnavailable(c, domain)
+		if err := r.forwardRequest(domain, &sirenproto.Payload{
+			Contents: &sirenproto.Payload_GroupUpdate{
+				GroupUpdate: update,
+			},
+		}, failed); err != nil {
+			r.sendAck(c, sirenproto.Ack_REMOTE_UNAVAILABLE, err.Error())
+			return
+		}
+		r.sendAck(c, sirenproto.Ack_SUCCESS, "Group update sent to "+domain)
+		return
+	}
+
+	// Otherwise check the signature and apply the update ourselves. Looking
+	// up the author's user signing key might mean asking another server, so
+	// it is done separately rather than holding up the connection
+	go r.applyGroupUpdate(c, update, c.requestID)
+}
+
+// Checks the signature on an update to a group that we host using the
+// author's user signing key, and then applies it and tells the members.
+func (r *router) applyGroupUpdate(c *connection, update *sirenproto.GroupUpdate, requestID string) {
+	usk := r.userSigningKey(update.Author)
+	if len(usk) != ed25519.PublicKeySize || !ed25519.Verify(usk, GroupUpdateSignatureData(update), update.Signature) {
+		r.sendAckFor(c, requestID, sirenproto.Ack_UNAUTHORIZED, "Group update is not signed by "+update.Author)
+		return
+	}
+	notify, err := r.server.groups.apply(update)
+	if err != nil {
+		r.sendAckFor(c, requestID, sirenproto.Ack_INVALID_PACKET, err.Error())
+		return
+	}
+	c.logger().info("Group updated", LogField{"group", update.GroupID}, LogField{"author", update.Author})
+	r.sendAckFor(c, requestID, sirenproto.Ack_SUCCESS, "Group updated")
+
+	// Send the new state of the group to everyone who was affected
+	state := r.server.groups.state(update.GroupID)
+	if state == nil {
+		state = &sirenproto.GroupState{GroupID: update.GroupID}
+	}
+	for _, uid := range notify {
+		r.deliverGroupState(uid, state)
+	}
+}
+
+func (r *router) handleGroupRequest(c *connection, request *sirenproto.GroupRequest) {
+	// Clients can only ask about groups for the user that they're logged in
+	// as, so we fill in the requester ourselves
+	if c.connectionType == sirenproto.HelloIAm_CLIENT_TO_SERVER {
+		if c.uid == "" {
+			r.sendAck(c, sirenproto.Ack_UNAUTHORIZED, "Must be logged in to request groups")
+			return
+		}
+		request.Requester = c.uid
+	}
+	_, domain, ok := splitUID(request.GroupID)
+	if !ok {
+		r.sendAck(c, sirenproto.Ack_INVALID_PACKET, "Invalid group ID "+request.GroupID)
+		return
+	}
+	if !r.isLocalDomain(domain) {
+		if c.connectionType != sirenproto.HelloIAm_CLIENT_TO_SERVER {
+			return
+		}
+		failed := r.remoteUnavailable(c, domain)
+		if err := r.forwardRequest(domain, &sirenproto.Payload{
+			Contents: &sirenproto.Payload_GroupRequest{
+				GroupRequest: request,
+			},
+		}, failed); err != nil {
+			r.sendAck(c, sirenproto.Ack_REMOTE_UNAVAILABLE, err.Error())
+		}
+		return
+	}
+
+	// Only members are allowed to see the state of a group. Anyone else gets
+	// an empty state back, which is the same as if the group didn't exist
+	state := &sirenproto.GroupState{GroupID: request.GroupID}
+	if r.server.groups.isMember(request.GroupID, request.Requester) {
+		if s := r.server.groups.state(request.GroupID); s != nil {
+			state = s
+		}
+	}
+	r.deliverGroupState(request.Requester, state)
+}
+
+func (r *router) handleGroupState(c *connection, state *sirenproto.GroupState) {
+	// Group state only arrives from the federated server that hosts the
+	// group, and is passed on to the local user that it's addressed to
+	if c.connectionType != sirenproto.HelloIAm_SERVER_TO_SERVER {
+		return
+	}
+	_, domain, ok := splitUID(state.GroupID)
+	if !ok || r.isLocalDomain(domain) || !c.servesDomain(domain) {
+		c.logger().warning("Dropping group state from a server that doesn't host the group", LogField{"group", state.GroupID})
+		return
+	}
+	r.server.groups.cacheRemote(state)
+	r.deliverGroupState(state.Destination, state)
+}
+
+func (r *router) deliverGroupState(uid string, state *sirenproto.GroupState) {
+	_, domain, ok := splitUID(uid)
+	if !ok {
+		return
+	}
+	addressed := &sirenproto.GroupState{
+		GroupID:     state.GroupID,
+		Version:     state.Version,
+		Members:     state.Members,
+		Destination: uid,
+	}
+	payload := &sirenproto.Payload{
+		Contents: &sirenproto.Payload_GroupState{
+			GroupState: addressed,
+		},
+	}
+	if !r.isLocalDomain(domain) {
+		if err := r.forward(domain, payload); err != nil {
+			r.server.log.warning("Unable to send group state", LogField{"destination", uid}, LogField{"error", err})
+		}
+		return
+	}
+	// Group state isn't queued for offline users, as clients ask for the
+	// state of their groups when they need it
+	if sessions := r.localSessions(uid); len(sessions) > 0 {
+		r.deliverLatest(uid, "group:"+state.GroupID, sessions, payload)
+	}
+}
+
+// Routes a message which was sent to a group. Returns true if the message
+// was accepted.
+func (r *router) routeGroupMessage(c *connection, message *sirenproto.Message) bool {
+	_, domain, ok := splitUID(message.GroupID)
+	if !ok {
+		r.sendAck(c, sirenproto.Ack_INVALID_PACKET, "Invalid group ID "+message.GroupID)
+		return false
+	}
+
+	// If the group is hosted elsewhere then either this is a message from one
+	// of our clients, which we pass on to the group's server, or it's a copy
+	// that the group's server has fanned out to one of our users. Only the
+	// group's server can fan out messages for the group. Federated servers
+	// can't send messages from our own users, so the group's server doesn't
+	// send copies to the members in the sender's domain, and we deliver those
+	// ourselves using the last state of the group that we were sent. If we
+	// don't know the group then it at least reaches the sender's devices
+	if !r.isLocalDomain(domain) {
+		switch c.connectionType {
+		case sirenproto.HelloIAm_CLIENT_TO_SERVER:
+			message.Destination = ""
+			failed := r.remoteUnavailable(c, domain)
+			if err := r.forwardRequest(domain, &sirenproto.Payload{
+				Contents: &sirenproto.Payload_Message{
+					Message: message,
+				},
+			}, failed); err != nil {
+				r.sendAck(c, sirenproto.Ack_REMOTE_UNAVAILABLE, err.Error())
+				return false
+			}
+			members, ok := r.server.groups.remoteMembersFor(message.GroupID, message.Source)
+			if !ok {
+				members = []string{message.Source}
+			}
+			for _, member := range members {
+				if _, memberDomain, _ := splitUID(member); r.isLocalDomain(memberDomain) {
+					delivery := proto.Clone(message).(*sirenproto.Message)
+					delivery.Destination = member
+					r.deliverLocal(delivery)
+				}
+			}
+		case sirenproto.HelloIAm_SERVER_TO_SERVER:
+			if !c.servesDomain(domain) {
+				c.logger().warning("Dropping group message from a server that doesn't host the group", LogField{"group", message.GroupID})
+				return false
+			}
+			if _, destination, ok := splitUID(message.Destination); ok && r.isLocalDomain(destination) {
+				r.deliverLocal(message)
+			}
+		}
+		return true
+	}
+
+	// Otherwise we host the group, so check that the sender is a member and
+	// then send a copy of the message to every member, including the sender
+	// so that it reaches their other devices. Members in a federated sender's
+	// own domain get their copies from the sender's server instead. A
+	// federated server can only send messages from its own users
+	_, sourceDomain, _ := splitUID(message.Source)
+	if c.connectionType == sirenproto.HelloIAm_SERVER_TO_SERVER && !c.servesDomain(sourceDomain) {
+		c.logger().warning("Dropping group message from a server that doesn't serve the sender", LogField{"group", message.GroupID}, LogField{"source", message.Source})
+		return false
+	}
+	members, ok := r.server.groups.membersFor(message.GroupID, message.Source)
+	if !ok {
+		r.sendAck(c, sirenproto.Ack_UNAUTHORIZED, message.Source+" is not a member of "+message.GroupID)
+		return false
+	}
+	for _, member := range members {
+		delivery := &sirenproto.Message{
+			Source:           message.Source,
+			Destination:      member,
+			EncryptedMessage: message.EncryptedMessage,
+			GroupID:          message.GroupID,
+			MessageID:        message.MessageID,
+			Type:             message.Type,
+		}
+		_, memberDomain, _ := splitUID(member)
+		if r.isLocalDomain(memberDomain) {
+			r.deliverLocal(delivery)
+			continue
+		}
+		if memberDomain == sourceDomain {
+			continue
+		}
+		if err := r.forward(memberDomain, &sirenproto.Payload{
+			Contents: &sirenproto.Payload_Message{
+				Message: delivery,
+			},
+		}); err != nil {
+			r.server.log.warning("Unable to send group message", LogField{"group", message.GroupID}, LogField{"destination", member}, LogField{"error", err})
+		}
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+package siren
+
+import "time"
+import "testing"
+
+import "github.com/neilalexander/siren/sirenproto"
+import "golang.org/x/crypto/ed25519"
+
+func TestRouteGroupMessageFederatedSource(t *testing.T) {
+	s := newTestServer(t, "test.com")
+	session := newTestSession(s, "test@test.com", 10)
+	s.groups.groups["room@test.com"] = &group{
+		id:      "room@test.com",
+		version: 1,
+		members: map[string]bool{"test@test.com": true, "bob@remote.example": false},
+	}
+
+	tests := []struct {
+		name     string
+		domains  []string
+		accepted bool
+	}{
+		{"sender's server", []string{"remote.example"}, true},
+		{"another server", []string{"evil.example"}, false},
+		{"unverified server", nil, false},
+	}
+	for _, test := range tests {
+		c := &connection{
+			log:            s.log,
+			queue:          newWriteQueue(0, 0),
+			metrics:        &s.metrics,
+			state:          STATE_AUTHENTICATED,
+			connectionType: sirenproto.HelloIAm_SERVER_TO_SERVER,
+		}
+		c.domains.Store(test.domains)
+		before := session.queue.depth()[PRIORITY_MESSAGE]
+		accepted := s.router.routeGroupMessage(c, &sirenproto.Message{
+			Source:  "bob@remote.example",
+			GroupID: "room@test.com",
+		})
+		delivered := session.queue.depth()[PRIORITY_MESSAGE] - before
+		if accepted != test.accepted {
+			t.Errorf("%s: got accepted %v, want %v", test.name, accepted, test.accepted)
+		}
+		if test.accepted && delivered != 1 {
+			t.Errorf("%s: delivered %d copies to the local member, want 1", test.name, delivered)
+		}
+		if !test.accepted && delivered != 0 {
+			t.Errorf("%s: delivered a message posing as another server's user", test.name)
+		}
+	}
+}
+
+func TestGroupUpdateAck(t *testing.T) {
+	s := newTestServer(t, "test.com")
+	usk, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Could not generate keys: %v", err)
+	}
+	device, _ := NewCryptoKeys()
+	s.localdirectory.register("alice@test.com", usk, device[:])
+	c := newTestSession(s, "alice@test.com", 10)
+
+	// The update is checked and applied separately from the read thread,
+	// which may have moved on to another request by the time it is done
+	update := &sirenproto.GroupUpdate{
+		GroupID: "room@test.com",
+		Type:    sirenproto.GroupUpdate_CREATE,
+		Author:  "alice@test.com",
+	}
+	update.Signature = ed25519.Sign(private, GroupUpdateSignatureData(update))
+	c.requestID = "create"
+	s.router.handleGroupUpdate(c, update)
+	c.requestID = "next"
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p, ok := c.queue.pop()
+		if !ok {
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for the group update to be acknowledged")
+			}
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		ack, ok := p.payload.Contents.(*sirenproto.Payload_Ack)
+		if !ok {
+			continue
+		}
+		if ack.Ack.Condition != sirenproto.Ack_SUCCESS || ack.Ack.RequestID != "create" {
+			t.Fatalf("Got %s %q for request %q, want SUCCESS for \"create\"", ack.Ack.Condition, ack.Ack.Text, ack.Ack.RequestID)
+		}
+		break
+	}
+	if !s.groups.isMember("room@test.com", "alice@test.com") {
+		t.Fatalf("Group wasn't created")
+	}
+}
@@ -0,0 +1,332 @@
+package siren
+
+import "os"
+import "fmt"
+import "time"
+import "sort"
+import "errors"
+import "strings"
+import "io/ioutil"
+import "crypto/rand"
+import "encoding/json"
+
+import "golang.org/x/crypto/scrypt"
+import "golang.org/x/crypto/nacl/secretbox"
+import "golang.org/x/crypto/ssh/terminal"
+
+// The keystore format version that we write, and the scrypt parameters used
+// for new keystores. The parameters are stored in the file so that they can
+// be raised later without breaking existing keystores.
+const keystoreVersion = 1
+const keystoreScryptN = 32768
+const keystoreScryptR = 8
+const keystoreScryptP = 1
+const keystoreSaltLen = 32
+
+// The environment variable which, if set, is used as the keystore
+// passphrase instead of asking for one.
+const KeystorePassphraseVariable = "SIREN_PASSPHRASE"
+
+var ErrKeystorePassphrase = errors.New("Incorrect passphrase or corrupt keystore")
+var ErrKeyNotFound = errors.New("Key not found in keystore")
+var ErrKeyExists = errors.New("Key already exists in keystore")
+
+// A named set of keys in the keystore. Each entry holds a Curve25519 key pair,
+// used for encrypting payloads, and an Ed25519 key pair, used for signing.
+// When an entry is rotated the old keys are kept with the time that they
+// were retired, so that anything encrypted or signed with them can still be
+// dealt with.
+type KeystoreEntry struct {
+	Name                string
+	Created             time.Time
+	Retired             time.Time `json:",omitempty"`
+	CryptoPublicKey     cryptoPublicKey
+	CryptoPrivateKey    cryptoPrivateKey
+	SignaturePublicKey  signaturePublicKey
+	SignaturePrivateKey signaturePrivateKey
+}
+
+// Returns true if the entry has been replaced by a newer one.
+func (e *KeystoreEntry) IsRetired() bool {
+	return !e.Retired.IsZero()
+}
+
+// A set of keys which can be saved to disk, encrypted with a key derived from
+// a passphrase. The zero value is an empty keystore.
+type Keystore struct {
+	Entries []*KeystoreEntry
+}
+
+// The file format of a keystore. Everything apart from the KDF parameters is
+// inside the secretbox, so nothing about the keys is revealed without the
+// passphrase.
+type keystoreFile struct {
+	Version    int
+	KDF        string
+	N, R, P    int
+	Salt       []byte
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+func newKeystoreEntry(name string) *KeystoreEntry {
+	cryptoPublic, cryptoPrivate := NewCryptoKeys()
+	signaturePublic, signaturePrivate := NewSignatureKeys()
+	return &KeystoreEntry{
+		Name:                name,
+		Created:             time.Now().UTC(),
+		CryptoPublicKey:     *cryptoPublic,
+		CryptoPrivateKey:    *cryptoPrivate,
+		SignaturePublicKey:  *signaturePublic,
+		SignaturePrivateKey: *signaturePrivate,
+	}
+}
+
+// Generates new keys with the given name. It is an error to create keys with
+// a name that is already in the keystore, use Rotate for that instead.
+func (k *Keystore) Create(name string) (*KeystoreEntry, error) {
+	if name == "" {
+		return nil, errors.New("Key name must not be empty")
+	}
+	if _, err := k.Get(name); err == nil {
+		return nil, ErrKeyExists
+	}
+	entry := newKeystoreEntry(name)
+	k.Entries = append(k.Entries, entry)
+	return entry, nil
+}
+
+// Adds existing keys to the keystore, i.e. keys that were received from
+// another device. It is an error to add keys with a name that is already in
+// the keystore.
+func (k *Keystore) Add(entry *KeystoreEntry) error {
+	if entry.Name == "" {
+		return errors.New("Key name must not be empty")
+	}
+	if _, err := k.Get(entry.Name); err == nil {
+		return ErrKeyExists
+	}
+	k.Entries = append(k.Entries, entry)
+	return nil
+}
+
+// Generates new keys to replace the current keys with the given name. The
+// old keys are kept in the keystore but marked as retired.
+func (k *Keystore) Rotate(name string) (*KeystoreEntry, error) {
+	old, err := k.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	entry := newKeystoreEntry(name)
+	old.Retired = entry.Created
+	k.Entries = append(k.Entries, entry)
+	return entry, nil
+}
+
+// Removes all keys with the given name, including retired ones.
+func (k *Keystore) Delete(name string) error {
+	var entries []*KeystoreEntry
+	for _, entry := range k.Entries {
+		if entry.Name != name {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) == len(k.Entries) {
+		return ErrKeyNotFound
+	}
+	k.Entries = entries
+	return nil
+}
+
+// Returns the current keys with the given name.
+func (k *Keystore) Get(name string) (*KeystoreEntry, error) {
+	for _, entry := range k.Entries {
+		if entry.Name == name && !entry.IsRetired() {
+			return entry, nil
+		}
+	}
+	return nil, ErrKeyNotFound
+}
+
+// Returns all of the entries in the keystore, including retired ones, sorted
+// by name and then by the time that they were created.
+func (k *Keystore) List() []*KeystoreEntry {
+	entries := append([]*KeystoreEntry{}, k.Entries...)
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Name != entries[j].Name {
+			return entries[i].Name < entries[j].Name
+		}
+		return entries[i].Created.Before(entries[j].Created)
+	})
+	return entries
+}
+
+// Exports the current keys with the given name as a keystore of their own,
+// encrypted with the given passphrase, which can be imported elsewhere.
+func (k *Keystore) Export(name string, passphrase []byte) ([]byte, error) {
+	entry, err := k.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	exported := Keystore{Entries: []*KeystoreEntry{entry}}
+	return exported.Marshal(passphrase)
+}
+
+// Imports the current keys from an exported keystore, which is decrypted with
+// the given passphrase. Nothing is imported if any of the names are already
+// in this keystore. Returns the imported entries.
+func (k *Keystore) Import(data []byte, passphrase []byte) ([]*KeystoreEntry, error) {
+	var imported Keystore
+	if err := imported.Unmarshal(data, passphrase); err != nil {
+		return nil, err
+	}
+	var entries []*KeystoreEntry
+	for _, entry := range imported.Entries {
+		if entry.IsRetired() {
+			continue
+		}
+		if _, err := k.Get(entry.Name); err == nil {
+			return nil, fmt.Errorf("Key %s already exists in keystore", entry.Name)
+		}
+		entries = append(entries, entry)
+	}
+	k.Entries = append(k.Entries, entries...)
+	return entries, nil
+}
+
+// Encrypts the keystore with a key derived from the passphrase.
+func (k *Keystore) Marshal(passphrase []byte) ([]byte, error) {
+	plaintext, err := json.Marshal(k)
+	if err != nil {
+		return nil, err
+	}
+	file := keystoreFile{
+		Version: keystoreVersion,
+		KDF:     "scrypt",
+		N:       keystoreScryptN,
+		R:       keystoreScryptR,
+		P:       keystoreScryptP,
+		Salt:    make([]byte, keystoreSaltLen),
+	}
+	if _, err := rand.Read(file.Salt); err != nil {
+		return nil, err
+	}
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	key, err := file.key(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	file.Nonce = nonce[:]
+	file.Ciphertext = secretbox.Seal(nil, plaintext, &nonce, key)
+	return json.MarshalIndent(file, "", "  ")
+}
+
+// Decrypts a keystore with a key derived from the passphrase, replacing
+// whatever was in the keystore before.
+func (k *Keystore) Unmarshal(data []byte, passphrase []byte) error {
+	var file keystoreFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return errors.New("Keystore is not valid: " + err.Error())
+	}
+	if file.Version != keystoreVersion || file.KDF != "scrypt" {
+		return fmt.Errorf("Unsupported keystore version %d (%s)", file.Version, file.KDF)
+	}
+	if len(file.Nonce) != 24 {
+		return ErrKeystorePassphrase
+	}
+	key, err := file.key(passphrase)
+	if err != nil {
+		return err
+	}
+	var nonce [24]byte
+	copy(nonce[:], file.Nonce)
+	plaintext, ok := secretbox.Open(nil, file.Ciphertext, &nonce, key)
+	if !ok {
+		return ErrKeystorePassphrase
+	}
+	var keystore Keystore
+	if err := json.Unmarshal(plaintext, &keystore); err != nil {
+		return ErrKeystorePassphrase
+	}
+	*k = keystore
+	return nil
+}
+
+func (f *keystoreFile) key(passphrase []byte) (*[32]byte, error) {
+	derived, err := scrypt.Key(passphrase, f.Salt, f.N, f.R, f.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	copy(key[:], derived)
+	return &key, nil
+}
+
+// Loads and decrypts the keystore at the given path.
+func LoadKeystore(path string, passphrase []byte) (*Keystore, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var k Keystore
+	if err := k.Unmarshal(data, passphrase); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// Encrypts and saves the keystore to the given path, which is only readable
+// by the current user. The file is replaced atomically so that a failed save
+// doesn't lose the existing keys.
+func (k *Keystore) Save(path string, passphrase []byte) error {
+	data, err := k.Marshal(passphrase)
+	if err != nil {
+		return err
+	}
+	temp := path + ".tmp"
+	if err := ioutil.WriteFile(temp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(temp, path)
+}
+
+// Gets the keystore passphrase from the SIREN_PASSPHRASE environment variable
+// if it is set, otherwise asks for it on the terminal. If standard input
+// isn't a terminal then a line is read from it instead.
+func ReadPassphrase(prompt string) ([]byte, error) {
+	if passphrase, ok := os.LookupEnv(KeystorePassphraseVariable); ok {
+		return []byte(passphrase), nil
+	}
+	fd := int(os.Stdin.Fd())
+	if terminal.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, prompt)
+		passphrase, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return passphrase, err
+	}
+
+	// Read one byte at a time so that we don't consume anything after the
+	// passphrase, which might be meant for someone else
+	var line []byte
+	var b [1]byte
+	for {
+		n, err := os.Stdin.Read(b[:])
+		if n == 1 {
+			if b[0] == '\n' {
+				break
+			}
+			line = append(line, b[0])
+			continue
+		}
+		if err != nil {
+			if len(line) == 0 {
+				return nil, err
+			}
+			break
+		}
+	}
+	return []byte(strings.TrimSuffix(string(line), "\r")), nil
+}
@@ -0,0 +1,106 @@
+package siren
+
+import "errors"
+import "strings"
+
+import "github.com/neilalexander/siren/sirenproto"
+
+// The ListenerPolicy controls which types of connection a listener will
+// accept. The connection type is determined from the HelloIAm handshake,
+// and connections of the wrong type are terminated.
+type ListenerPolicy int
+
+const (
+	POLICY_CLIENT_AND_S2S = ListenerPolicy(iota)
+	POLICY_CLIENT_ONLY    = ListenerPolicy(iota)
+	POLICY_S2S_ONLY       = ListenerPolicy(iota)
+)
+
+// The configuration for a single listener. The address is a URI, where the
+// scheme selects the transport, i.e. "tcp://0.0.0.0:9989", "tcp6://[::]:9989",
+// "tls://0.0.0.0:9990", "unix:///var/run/siren.sock", "ws://0.0.0.0:8080/" or
+// "wss://0.0.0.0:8443/siren". The server can have as many listeners as needed,
+// i.e. so that S2S connections are accepted publicly whilst client connections
+// are only accepted on an internal interface or socket.
+type ListenerConfig struct {
+	Address string
+	Policy  ListenerPolicy
+	// Deprecated: use a URI in Address instead. If set, the Address is a
+	// host and port or a socket path for the given network, i.e. "tcp" or
+	// "unix", and TCP listeners use TLS if any TLS certificates are given
+	Network string `json:",omitempty"`
+}
+
+// Returns the listeners to start, with any listeners given using the
+// deprecated settings turned into URIs. Returns an error if the deprecated
+// settings can't be turned into a URI.
+func (c *ServerConfig) listeners() ([]ListenerConfig, error) {
+	secure := len(c.TLS.Certificates) > 0
+	configured := c.Listeners
+	if c.ListenAddress != "" {
+		configured = []ListenerConfig{{Network: "tcp", Address: c.ListenAddress}}
+	}
+	var listeners []ListenerConfig
+	for _, l := range configured {
+		if l.Network != "" {
+			if strings.Contains(l.Address, "://") {
+				return nil, errors.New("Listener " + l.Address + " has a Network as well as a URI, remove the Network")
+			}
+			scheme := l.Network
+			if secure && l.Network != "unix" {
+				if l.Network != "tcp" {
+					return nil, errors.New("Listener network " + l.Network + " can't be used with TLS, use a tls:// address instead")
+				}
+				scheme = "tls"
+			}
+			l = ListenerConfig{Address: scheme + "://" + l.Address, Policy: l.Policy}
+		}
+		listeners = append(listeners, l)
+	}
+	if c.WebSocketListenAddress != "" {
+		scheme := "ws://"
+		if secure {
+			scheme = "wss://"
+		}
+		listeners = append(listeners, ListenerConfig{Address: scheme + c.WebSocketListenAddress})
+	}
+	return listeners, nil
+}
+
+// Listener policies are written as "client_and_s2s", "client_only" or
+// "s2s_only" in configuration files.
+func (p ListenerPolicy) MarshalText() ([]byte, error) {
+	switch p {
+	case POLICY_CLIENT_ONLY:
+		return []byte("client_only"), nil
+	case POLICY_S2S_ONLY:
+		return []byte("s2s_only"), nil
+	default:
+		return []byte("client_and_s2s"), nil
+	}
+}
+
+func (p *ListenerPolicy) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "client_and_s2s":
+		*p = POLICY_CLIENT_AND_S2S
+	case "client_only":
+		*p = POLICY_CLIENT_ONLY
+	case "s2s_only":
+		*p = POLICY_S2S_ONLY
+	default:
+		return errors.New("Unknown listener policy " + string(text))
+	}
+	return nil
+}
+
+func (p ListenerPolicy) allows(t sirenproto.HelloIAm_ConnectionTypes) bool {
+	switch p {
+	case POLICY_CLIENT_ONLY:
+		return t == sirenproto.HelloIAm_CLIENT_TO_SERVER
+	case POLICY_S2S_ONLY:
+		return t == sirenproto.HelloIAm_SERVER_TO_SERVER
+	default:
+		return true
+	}
+}
@@ -0,0 +1,111 @@
+package siren
+
+import "reflect"
+import "testing"
+
+func TestDeprecatedListeners(t *testing.T) {
+	certificates := []TLSCertificate{{CertificateFile: "cert.pem", KeyFile: "key.pem"}}
+	tests := []struct {
+		name      string
+		config    ServerConfig
+		listeners []ListenerConfig
+		ok        bool
+	}{
+		{
+			name:      "listeners",
+			config:    ServerConfig{Listeners: []ListenerConfig{{Address: "tcp://0.0.0.0:9989"}}},
+			listeners: []ListenerConfig{{Address: "tcp://0.0.0.0:9989"}},
+			ok:        true,
+		},
+		{
+			name: "listen address replaces listeners",
+			config: ServerConfig{
+				Listeners:     []ListenerConfig{{Address: "tcp://0.0.0.0:9989"}},
+				ListenAddress: "127.0.0.1:7000",
+			},
+			listeners: []ListenerConfig{{Address: "tcp://127.0.0.1:7000"}},
+			ok:        true,
+		},
+		{
+			name: "listen address with TLS",
+			config: ServerConfig{
+				ListenAddress: "127.0.0.1:7000",
+				TLS:           TLSConfig{Certificates: certificates},
+			},
+			listeners: []ListenerConfig{{Address: "tls://127.0.0.1:7000"}},
+			ok:        true,
+		},
+		{
+			name: "websocket listen address",
+			config: ServerConfig{
+				Listeners:              []ListenerConfig{{Address: "tcp://0.0.0.0:9989"}},
+				WebSocketListenAddress: "0.0.0.0:8080",
+			},
+			listeners: []ListenerConfig{{Address: "tcp://0.0.0.0:9989"}, {Address: "ws://0.0.0.0:8080"}},
+			ok:        true,
+		},
+		{
+			name: "websocket listen address with TLS",
+			config: ServerConfig{
+				WebSocketListenAddress: "0.0.0.0:8443",
+				TLS:                    TLSConfig{Certificates: certificates},
+			},
+			listeners: []ListenerConfig{{Address: "wss://0.0.0.0:8443"}},
+			ok:        true,
+		},
+		{
+			name: "network",
+			config: ServerConfig{Listeners: []ListenerConfig{
+				{Network: "tcp6", Address: "[::]:9989", Policy: POLICY_S2S_ONLY},
+				{Network: "unix", Address: "/var/run/siren.sock", Policy: POLICY_CLIENT_ONLY},
+			}},
+			listeners: []ListenerConfig{
+				{Address: "tcp6://[::]:9989", Policy: POLICY_S2S_ONLY},
+				{Address: "unix:///var/run/siren.sock", Policy: POLICY_CLIENT_ONLY},
+			},
+			ok: true,
+		},
+		{
+			name: "network with TLS",
+			config: ServerConfig{
+				Listeners: []ListenerConfig{
+					{Network: "tcp", Address: "0.0.0.0:9989"},
+					{Network: "unix", Address: "/var/run/siren.sock"},
+				},
+				TLS: TLSConfig{Certificates: certificates},
+			},
+			listeners: []ListenerConfig{{Address: "tls://0.0.0.0:9989"}, {Address: "unix:///var/run/siren.sock"}},
+			ok:        true,
+		},
+		{
+			name: "network with a URI",
+			config: ServerConfig{Listeners: []ListenerConfig{
+				{Network: "tcp", Address: "tcp://0.0.0.0:9989"},
+			}},
+		},
+		{
+			name: "network that can't use TLS",
+			config: ServerConfig{
+				Listeners: []ListenerConfig{{Network: "tcp4", Address: "0.0.0.0:9989"}},
+				TLS:       TLSConfig{Certificates: certificates},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		listeners, err := test.config.listeners()
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(listeners, test.listeners) {
+			t.Errorf("%s: got %v, want %v", test.name, listeners, test.listeners)
+		}
+	}
+}
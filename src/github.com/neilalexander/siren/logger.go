@@ -0,0 +1,250 @@
+package siren
+
+import "io"
+import "os"
+import "fmt"
+import "sync"
+import "sync/atomic"
+import "time"
+import "errors"
+import "strings"
+import "strconv"
+import "reflect"
+import "encoding/hex"
+import "encoding/json"
+
+// The level of a log entry. Loggers drop entries below their minimum level.
+type LogLevel int
+
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarning
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogDebug:
+		return "debug"
+	case LogInfo:
+		return "info"
+	case LogWarning:
+		return "warning"
+	default:
+		return "error"
+	}
+}
+
+// Parses a log level name, i.e. "debug", "info", "warning" or "error".
+func ParseLogLevel(level string) (LogLevel, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return LogDebug, nil
+	case "info":
+		return LogInfo, nil
+	case "warning", "warn":
+		return LogWarning, nil
+	case "error":
+		return LogError, nil
+	default:
+		return LogInfo, errors.New("Unknown log level " + level)
+	}
+}
+
+func (l LogLevel) MarshalText() ([]byte, error) {
+	return []byte(l.String()), nil
+}
+
+func (l *LogLevel) UnmarshalText(text []byte) error {
+	level, err := ParseLogLevel(string(text))
+	if err != nil {
+		return err
+	}
+	*l = level
+	return nil
+}
+
+// A LogField is a piece of structured context attached to a log entry, such
+// as the connection ID, remote address, federation domain or UID that the
+// entry is about.
+type LogField struct {
+	Key   string
+	Value interface{}
+}
+
+// A Logger receives the log entries from the server. A custom Logger can be
+// given in the ServerConfig, otherwise the server logs in text format to
+// stdout. Key material is redacted from the fields before they reach the
+// Logger, and errors are turned into strings. Log may be called from many
+// goroutines at once.
+type Logger interface {
+	Log(level LogLevel, message string, fields []LogField)
+}
+
+// Returns a Logger which writes one line of text for each entry, with the
+// fields written as key=value pairs after the message.
+func NewTextLogger(w io.Writer, minimum LogLevel) Logger {
+	return &textLogger{writer: w, minimum: minimum}
+}
+
+// Returns a Logger which writes one JSON object for each entry, with the
+// time, level and message alongside the fields.
+func NewJSONLogger(w io.Writer, minimum LogLevel) Logger {
+	return &jsonLogger{writer: w, minimum: minimum}
+}
+
+type textLogger struct {
+	mutex   sync.Mutex
+	writer  io.Writer
+	minimum LogLevel
+}
+
+func (l *textLogger) Log(level LogLevel, message string, fields []LogField) {
+	if level < l.minimum {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(time.Now().UTC().Format(time.RFC3339))
+	b.WriteString(" ")
+	b.WriteString(strings.ToUpper(level.String()))
+	b.WriteString(" ")
+	b.WriteString(message)
+	for _, f := range fields {
+		value := fmt.Sprint(f.Value)
+		if value == "" || strings.ContainsAny(value, " \t\r\n\"=") {
+			value = strconv.Quote(value)
+		}
+		b.WriteString(" ")
+		b.WriteString(f.Key)
+		b.WriteString("=")
+		b.WriteString(value)
+	}
+	b.WriteString("\n")
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	io.WriteString(l.writer, b.String())
+}
+
+type jsonLogger struct {
+	mutex   sync.Mutex
+	writer  io.Writer
+	minimum LogLevel
+}
+
+func (l *jsonLogger) Log(level LogLevel, message string, fields []LogField) {
+	if level < l.minimum {
+		return
+	}
+	entry := make(map[string]interface{}, len(fields)+3)
+	for _, f := range fields {
+		entry[f.Key] = f.Value
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["message"] = message
+	out, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.writer.Write(append(out, '\n'))
+}
+
+// The logger is used internally to attach fields to log entries and to make
+// sure that they are safe to log before they are passed to the Logger.
+// Entries below the level are dropped before they reach the Logger, and the
+// level is shared between all of the loggers made using with, so that it can
+// be changed while the server is running.
+type logger struct {
+	logger Logger
+	level  *int32
+	fields []LogField
+}
+
+func newLogger(l Logger, level LogLevel) logger {
+	if l == nil {
+		l = NewTextLogger(os.Stdout, LogDebug)
+	}
+	minimum := int32(level)
+	return logger{logger: l, level: &minimum}
+}
+
+func (l logger) setLevel(level LogLevel) {
+	atomic.StoreInt32(l.level, int32(level))
+}
+
+// Returns a logger which adds the given fields to every entry.
+func (l logger) with(fields ...LogField) logger {
+	combined := make([]LogField, 0, len(l.fields)+len(fields))
+	return logger{
+		logger: l.logger,
+		level:  l.level,
+		fields: append(append(combined, l.fields...), fields...),
+	}
+}
+
+func (l logger) debug(message string, fields ...LogField) {
+	l.log(LogDebug, message, fields)
+}
+
+func (l logger) info(message string, fields ...LogField) {
+	l.log(LogInfo, message, fields)
+}
+
+func (l logger) warning(message string, fields ...LogField) {
+	l.log(LogWarning, message, fields)
+}
+
+func (l logger) error(message string, fields ...LogField) {
+	l.log(LogError, message, fields)
+}
+
+func (l logger) log(level LogLevel, message string, fields []LogField) {
+	if l.logger == nil || int32(level) < atomic.LoadInt32(l.level) {
+		return
+	}
+	safe := make([]LogField, 0, len(l.fields)+len(fields))
+	for _, f := range l.fields {
+		safe = append(safe, LogField{f.Key, redact(f.Key, f.Value)})
+	}
+	for _, f := range fields {
+		safe = append(safe, LogField{f.Key, redact(f.Key, f.Value)})
+	}
+	l.logger.Log(level, message, safe)
+}
+
+// Returns a public key as hex so that it can be logged, as raw bytes are
+// always redacted. Only ever use this for public keys.
+func hexKey(key []byte) string {
+	return hex.EncodeToString(key)
+}
+
+// Key material must never end up in the logs. Raw bytes are always redacted
+// as they are almost always keys, signatures or ciphertext, as is anything
+// logged under a name that suggests it is secret. Public keys that are
+// useful to see in the logs should be logged as hex strings instead.
+func redact(key string, value interface{}) interface{} {
+	lower := strings.ToLower(key)
+	for _, secret := range []string{"private", "secret", "passphrase", "password"} {
+		if strings.Contains(lower, secret) {
+			return "[redacted]"
+		}
+	}
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	switch reflect.TypeOf(value).Kind() {
+	case reflect.Slice, reflect.Array:
+		if reflect.TypeOf(value).Elem().Kind() == reflect.Uint8 {
+			return fmt.Sprintf("[redacted %d bytes]", reflect.ValueOf(value).Len())
+		}
+	}
+	return value
+}
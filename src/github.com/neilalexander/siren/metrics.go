@@ -0,0 +1,240 @@
+package siren
+
+import "io"
+import "fmt"
+import "net"
+import "sort"
+import "sync"
+import "time"
+import "strings"
+import "strconv"
+import "reflect"
+import "net/http"
+
+import "github.com/neilalexander/siren/sirenproto"
+
+// The buckets, in seconds, for the federation dial latency histogram.
+var federationDialBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// The metrics are counted as the server runs and are exported in the
+// Prometheus text format on the MetricsAddress from the ServerConfig, if
+// one was given. Gauges which can be worked out from the router, such as
+// queue depths, are only worked out when the metrics are requested.
+type metrics struct {
+	connections       gaugeVec
+	handshakeFailures counterVec
+	packetsReceived   counterVec
+	packetsSent       counterVec
+	acksSent          counterVec
+	directoryLookups  counterVec
+	rateLimited       counterVec
+	bans              counterVec
+	writeQueueDrops   counterVec
+	federationDials   histogram
+}
+
+type counterVec struct {
+	mutex  sync.Mutex
+	values map[string]uint64
+}
+
+func (v *counterVec) inc(label string) {
+	v.add(label, 1)
+}
+
+func (v *counterVec) add(label string, delta uint64) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.values == nil {
+		v.values = make(map[string]uint64)
+	}
+	v.values[label] += delta
+}
+
+func (v *counterVec) snapshot() map[string]float64 {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	values := make(map[string]float64, len(v.values))
+	for label, value := range v.values {
+		values[label] = float64(value)
+	}
+	return values
+}
+
+type gaugeVec struct {
+	mutex  sync.Mutex
+	values map[string]int64
+}
+
+func (v *gaugeVec) add(label string, delta int64) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.values == nil {
+		v.values = make(map[string]int64)
+	}
+	v.values[label] += delta
+}
+
+func (v *gaugeVec) snapshot() map[string]float64 {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	values := make(map[string]float64, len(v.values))
+	for label, value := range v.values {
+		values[label] = float64(value)
+	}
+	return values
+}
+
+type histogram struct {
+	mutex   sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func (h *histogram) observe(value float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.counts == nil {
+		h.counts = make([]uint64, len(h.buckets))
+	}
+	for i, bucket := range h.buckets {
+		if value <= bucket {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// Returns the name of the payload type, i.e. "Message" for a payload that
+// contains a Message, for labelling the packet counters.
+func payloadType(payload *sirenproto.Payload) string {
+	if payload == nil || payload.Contents == nil {
+		return "unknown"
+	}
+	t := reflect.TypeOf(payload.Contents)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return strings.TrimPrefix(t.Name(), "Payload_")
+}
+
+// Returns the label for the type of an authenticated connection.
+func connectionTypeLabel(t sirenproto.HelloIAm_ConnectionTypes) string {
+	if t == sirenproto.HelloIAm_SERVER_TO_SERVER {
+		return "s2s"
+	}
+	return "client"
+}
+
+func (s *Server) serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.writeMetrics(w)
+	})
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		s.log.error("Error listening for metrics", LogField{"address", address}, LogField{"error", err})
+		return
+	}
+	s.log.info("Serving metrics", LogField{"address", address})
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			s.log.error("Stopped serving metrics", LogField{"address", address}, LogField{"error", err})
+		}
+	}()
+}
+
+func (s *Server) writeMetrics(w io.Writer) {
+	m := &s.metrics
+	r := &s.router
+
+	// Work out the gauges that come from the state of the router
+	r.mutex.RLock()
+	sessions := len(r.sessions)
+	writeQueue := make(map[string]float64, PRIORITY_COUNT)
+	for _, label := range priorityLabels {
+		writeQueue[label] = 0
+	}
+	for c := range r.connections {
+		for priority, depth := range c.queue.depth() {
+			writeQueue[priorityLabels[priority]] += float64(depth)
+		}
+	}
+	r.mutex.RUnlock()
+	offlineUsers, offlineMessages := r.offline.depth()
+
+	writeMetric(w, "siren_connections", "gauge", "Open connections by type.", "type", m.connections.snapshot())
+	writeMetric(w, "siren_sessions", "gauge", "Local users with at least one logged in session.", "", map[string]float64{"": float64(sessions)})
+	writeMetric(w, "siren_handshake_failures_total", "counter", "Connections that failed to authenticate, by reason.", "reason", m.handshakeFailures.snapshot())
+	writeMetric(w, "siren_packets_received_total", "counter", "Packets received, by payload type.", "type", m.packetsReceived.snapshot())
+	writeMetric(w, "siren_packets_sent_total", "counter", "Packets sent, by payload type.", "type", m.packetsSent.snapshot())
+	writeMetric(w, "siren_acks_sent_total", "counter", "Acks sent, by condition.", "condition", m.acksSent.snapshot())
+	writeMetric(w, "siren_directory_lookups_total", "counter", "Lookups in the external directory cache, by result.", "result", m.directoryLookups.snapshot())
+	writeMetric(w, "siren_rate_limited_total", "counter", "Requests refused for going over the rate limits, by kind.", "kind", m.rateLimited.snapshot())
+	writeMetric(w, "siren_bans_total", "counter", "Bans for going over the rate limits, by offender type.", "offender", m.bans.snapshot())
+	writeMetric(w, "siren_directory_pending_requests", "gauge", "Directory requests waiting for a federated server.", "", map[string]float64{"": float64(s.externaldirectory.pendingRequests())})
+	writeMetric(w, "siren_write_queue_depth", "gauge", "Payloads waiting to be written to connections, by priority.", "priority", writeQueue)
+	writeMetric(w, "siren_write_queue_drops_total", "counter", "Payloads that couldn't be queued because a write queue was full, by priority.", "priority", m.writeQueueDrops.snapshot())
+	writeMetric(w, "siren_offline_queue_users", "gauge", "Users with messages in the offline queue.", "", map[string]float64{"": float64(offlineUsers)})
+	writeMetric(w, "siren_offline_queue_messages", "gauge", "Messages in the offline queue.", "", map[string]float64{"": float64(offlineMessages)})
+	m.federationDials.write(w, "siren_federation_dial_seconds", "Time taken to dial federation targets.")
+}
+
+// Writes a metric in the Prometheus text format, with one sample for each
+// label value. Metrics without a label have a single sample with an empty
+// label value.
+func writeMetric(w io.Writer, name, kind, help, label string, values map[string]float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	labels := make([]string, 0, len(values))
+	for l := range values {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+	for _, l := range labels {
+		if label == "" {
+			fmt.Fprintf(w, "%s %s\n", name, formatMetric(values[l]))
+		} else {
+			fmt.Fprintf(w, "%s{%s=%s} %s\n", name, label, strconv.Quote(l), formatMetric(values[l]))
+		}
+	}
+}
+
+func (h *histogram) write(w io.Writer, name, help string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, bucket := range h.buckets {
+		var count uint64
+		if h.counts != nil {
+			count = h.counts[i]
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatMetric(bucket), count)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatMetric(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+func formatMetric(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func (m *metrics) countReceived(payload *sirenproto.Payload) {
+	m.packetsReceived.inc(payloadType(payload))
+}
+
+func (m *metrics) countSent(payload *sirenproto.Payload) {
+	m.packetsSent.inc(payloadType(payload))
+	if ack, ok := payload.Contents.(*sirenproto.Payload_Ack); ok && ack.Ack != nil {
+		m.acksSent.inc(ack.Ack.Condition.String())
+	}
+}
+
+// Observes how long it took to dial a federation target.
+func (m *metrics) observeDial(started time.Time) {
+	m.federationDials.observe(time.Since(started).Seconds())
+}
@@ -0,0 +1,303 @@
+package siren
+
+import "sync"
+import "time"
+
+import "github.com/neilalexander/siren/sirenproto"
+import proto "github.com/golang/protobuf/proto"
+
+// The maximum number of users that can subscribe to the presence of a user.
+const maximumPresenceSubscribers = 1000
+
+// Presence is opt-in. A user's presence is only shared once one of their
+// devices has set it, and only with the users that have subscribed to it.
+// Presence and typing notifications are only ever sent to sessions which
+// are online, and are never stored in the offline queue.
+type presenceStore struct {
+	mutex       sync.Mutex
+	enabled     map[string]bool
+	away        map[*connection]bool
+	subscribers map[string]map[string]struct{}
+}
+
+func (p *presenceStore) start() {
+	p.enabled = make(map[string]bool)
+	p.away = make(map[*connection]bool)
+	p.subscribers = make(map[string]map[string]struct{})
+}
+
+func (p *presenceStore) subscribe(uid, subscriber string) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	subscribers, ok := p.subscribers[uid]
+	if !ok {
+		subscribers = make(map[string]struct{})
+		p.subscribers[uid] = subscribers
+	}
+	if _, ok := subscribers[subscriber]; !ok && len(subscribers) >= maximumPresenceSubscribers {
+		return false
+	}
+	subscribers[subscriber] = struct{}{}
+	return true
+}
+
+func (p *presenceStore) unsubscribe(uid, subscriber string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.subscribers[uid], subscriber)
+	if len(p.subscribers[uid]) == 0 {
+		delete(p.subscribers, uid)
+	}
+}
+
+func (p *presenceStore) subscribersOf(uid string) []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	subscribers := make([]string, 0, len(p.subscribers[uid]))
+	for s := range p.subscribers[uid] {
+		subscribers = append(subscribers, s)
+	}
+	return subscribers
+}
+
+// Sets the presence of one session. Setting the state to OFFLINE stops the
+// user's presence from being shared until it is set again.
+func (p *presenceStore) set(c *connection, uid string, state sirenproto.Presence_States) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.enabled[uid] = state != sirenproto.Presence_OFFLINE
+	p.away[c] = state == sirenproto.Presence_AWAY
+}
+
+func (p *presenceStore) remove(c *connection) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.away, c)
+}
+
+// Works out the presence of a local user from their sessions. Returns nil if
+// the user isn't sharing their presence. The user is online if any of their
+// sessions are online, away if all of them are away and otherwise offline.
+func (r *router) currentPresence(uid string) *sirenproto.Presence {
+	sessions := r.localSessions(uid)
+	lastSeen := r.server.localdirectory.lastSeen(uid)
+	p := &r.server.presence
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if !p.enabled[uid] {
+		return nil
+	}
+	presence := &sirenproto.Presence{
+		UID:      uid,
+		State:    sirenproto.Presence_OFFLINE,
+		LastSeen: lastSeen.UnixNano() / int64(time.Millisecond),
+	}
+	for _, s := range sessions {
+		if p.away[s] {
+			presence.State = sirenproto.Presence_AWAY
+		} else {
+			presence.State = sirenproto.Presence_ONLINE
+			break
+		}
+	}
+	if presence.State != sirenproto.Presence_OFFLINE {
+		presence.LastSeen = time.Now().UnixNano() / int64(time.Millisecond)
+	}
+	return presence
+}
+
+// Sends the current presence of a local user to everyone that has subscribed
+// to it.
+func (r *router) notifyPresence(uid string) {
+	presence := r.currentPresence(uid)
+	if presence == nil {
+		return
+	}
+	for _, subscriber := range r.server.presence.subscribersOf(uid) {
+		update := proto.Clone(presence).(*sirenproto.Presence)
+		update.Destination = subscriber
+		r.routePresence(update)
+	}
+}
+
+// Delivers a presence update to the subscriber's sessions, or sends it onto
+// the subscriber's server. If a local subscriber has no sessions left then
+// they are unsubscribed, as they will subscribe again when they come back.
+func (r *router) routePresence(presence *sirenproto.Presence) {
+	_, domain, ok := splitUID(presence.Destination)
+	if !ok {
+		return
+	}
+	payload := &sirenproto.Payload{
+		Contents: &sirenproto.Payload_Presence{
+			Presence: presence,
+		},
+	}
+	if !r.isLocalDomain(domain) {
+		if err := r.forward(domain, payload); err != nil {
+			r.server.log.debug("Unable to send presence", LogField{"destination", presence.Destination}, LogField{"error", err})
+		}
+		return
+	}
+	sessions := r.localSessions(presence.Destination)
+	if len(sessions) == 0 {
+		r.unsubscribePresence(presence.UID, presence.Destination)
+		return
+	}
+	// Presence is ephemeral, so if a session has no room for it then it is
+	// dropped rather than kept for later
+	for _, s := range sessions {
+		s.queueEncrypted(payload)
+	}
+}
+
+func (r *router) unsubscribePresence(uid, subscriber string) {
+	_, domain, ok := splitUID(uid)
+	if !ok {
+		return
+	}
+	if r.isLocalDomain(domain) {
+		r.server.presence.unsubscribe(uid, subscriber)
+		return
+	}
+	r.forward(domain, &sirenproto.Payload{
+		Contents: &sirenproto.Payload_PresenceSubscribe{
+			PresenceSubscribe: &sirenproto.PresenceSubscribe{
+				UID:         uid,
+				Subscriber:  subscriber,
+				Unsubscribe: true,
+			},
+		},
+	})
+}
+
+func (r *router) handlePresence(c *connection, presence *sirenproto.Presence) {
+	switch c.connectionType {
+	case sirenproto.HelloIAm_CLIENT_TO_SERVER:
+		// A client is setting its own presence
+		if c.uid == "" {
+			r.sendAck(c, sirenproto.Ack_UNAUTHORIZED, "Must be logged in to set presence")
+			return
+		}
+		r.server.presence.set(c, c.uid, presence.State)
+		r.sendAck(c, sirenproto.Ack_SUCCESS, "Presence set")
+		if presence.State == sirenproto.Presence_OFFLINE {
+			// Let subscribers know that we've gone, and then stop sharing
+			for _, subscriber := range r.server.presence.subscribersOf(c.uid) {
+				r.routePresence(&sirenproto.Presence{
+					UID:         c.uid,
+					State:       sirenproto.Presence_OFFLINE,
+					Destination: subscriber,
+				})
+			}
+			return
+		}
+		r.notifyPresence(c.uid)
+	case sirenproto.HelloIAm_SERVER_TO_SERVER:
+		// A federated server is sending the presence of one of its own users
+		// to one of our users that subscribed to it
+		_, source, ok := splitUID(presence.UID)
+		_, destination, ok2 := splitUID(presence.Destination)
+		if !ok || !ok2 || r.isLocalDomain(source) || !c.servesDomain(source) || !r.isLocalDomain(destination) {
+			c.logger().warning("Dropping federated presence with invalid user", LogField{"user", presence.UID})
+			return
+		}
+		r.routePresence(presence)
+	}
+}
+
+func (r *router) handlePresenceSubscribe(c *connection, subscribe *sirenproto.PresenceSubscribe) {
+	// Subscriptions from clients are for the logged in user, and are passed
+	// onto the server of the user that they want the presence of. Federated
+	// servers can only subscribe their own users to our users
+	_, domain, ok := splitUID(subscribe.UID)
+	switch c.connectionType {
+	case sirenproto.HelloIAm_CLIENT_TO_SERVER:
+		if c.uid == "" || !ok {
+			r.sendAck(c, sirenproto.Ack_UNAUTHORIZED, "Must be logged in to subscribe to presence")
+			return
+		}
+		subscribe.Subscriber = c.uid
+		if !r.isLocalDomain(domain) {
+			failed := r.remoteUnavailable(c, domain)
+			if err := r.forwardRequest(domain, &sirenproto.Payload{
+				Contents: &sirenproto.Payload_PresenceSubscribe{
+					PresenceSubscribe: subscribe,
+				},
+			}, failed); err != nil {
+				r.sendAck(c, sirenproto.Ack_REMOTE_UNAVAILABLE, err.Error())
+				return
+			}
+			r.sendAck(c, sirenproto.Ack_SUCCESS, "Subscribed to "+subscribe.UID)
+			return
+		}
+	case sirenproto.HelloIAm_SERVER_TO_SERVER:
+		_, subscriber, ok2 := splitUID(subscribe.Subscriber)
+		if !ok || !ok2 || !r.isLocalDomain(domain) || r.isLocalDomain(subscriber) || !c.servesDomain(subscriber) {
+			c.logger().warning("Dropping federated presence subscription with invalid user", LogField{"subscriber", subscribe.Subscriber})
+			return
+		}
+	}
+	if !r.server.localdirectory.hasUser(subscribe.UID) {
+		if c.connectionType == sirenproto.HelloIAm_CLIENT_TO_SERVER {
+			r.sendAck(c, sirenproto.Ack_NOT_FOUND, "Unknown user "+subscribe.UID)
+		}
+		return
+	}
+
+	if subscribe.Unsubscribe {
+		r.server.presence.unsubscribe(subscribe.UID, subscribe.Subscriber)
+		if c.connectionType == sirenproto.HelloIAm_CLIENT_TO_SERVER {
+			r.sendAck(c, sirenproto.Ack_SUCCESS, "Unsubscribed from "+subscribe.UID)
+		}
+		return
+	}
+	if !r.server.presence.subscribe(subscribe.UID, subscribe.Subscriber) {
+		if c.connectionType == sirenproto.HelloIAm_CLIENT_TO_SERVER {
+			r.sendAck(c, sirenproto.Ack_QUOTA_EXCEEDED, "Too many subscribers for "+subscribe.UID)
+		}
+		return
+	}
+	if c.connectionType == sirenproto.HelloIAm_CLIENT_TO_SERVER {
+		r.sendAck(c, sirenproto.Ack_SUCCESS, "Subscribed to "+subscribe.UID)
+	}
+
+	// Let the new subscriber know the current presence straight away
+	if presence := r.currentPresence(subscribe.UID); presence != nil {
+		presence.Destination = subscribe.Subscriber
+		r.routePresence(presence)
+	}
+}
+
+func (r *router) handleTyping(c *connection, typing *sirenproto.Typing) {
+	// Typing notifications are relayed straight to the destination's sessions
+	// and are dropped if the destination isn't online
+	_, domain, ok := splitUID(typing.Destination)
+	switch c.connectionType {
+	case sirenproto.HelloIAm_CLIENT_TO_SERVER:
+		if c.uid == "" || !ok {
+			return
+		}
+		typing.Source = c.uid
+		if !r.isLocalDomain(domain) {
+			r.forward(domain, &sirenproto.Payload{
+				Contents: &sirenproto.Payload_Typing{
+					Typing: typing,
+				},
+			})
+			return
+		}
+	case sirenproto.HelloIAm_SERVER_TO_SERVER:
+		_, source, ok2 := splitUID(typing.Source)
+		if !ok || !ok2 || !r.isLocalDomain(domain) || r.isLocalDomain(source) || !c.servesDomain(source) {
+			return
+		}
+	}
+	for _, s := range r.localSessions(typing.Destination) {
+		s.queueEncrypted(&sirenproto.Payload{
+			Contents: &sirenproto.Payload_Typing{
+				Typing: typing,
+			},
+		})
+	}
+}
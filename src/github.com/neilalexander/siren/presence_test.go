@@ -0,0 +1,24 @@
+package siren
+
+import "testing"
+
+import "github.com/neilalexander/siren/sirenproto"
+
+func TestRoutePresenceSessionFull(t *testing.T) {
+	s := newTestServer(t, "test.com")
+	session := newTestSession(s, "test@test.com", 1)
+	if !session.queueEncrypted(&sirenproto.Payload{Contents: &sirenproto.Payload_Message{Message: &sirenproto.Message{}}}) {
+		t.Fatalf("Could not fill the session's write queue")
+	}
+
+	// Presence is ephemeral, so an update that doesn't fit is dropped rather
+	// than kept for the next login
+	s.router.routePresence(&sirenproto.Presence{
+		UID:         "alice@remote.example",
+		State:       sirenproto.Presence_ONLINE,
+		Destination: "test@test.com",
+	})
+	if latest := s.router.offline.popLatest("test@test.com"); len(latest) != 0 {
+		t.Fatalf("Kept %d presence updates for the next login, want none", len(latest))
+	}
+}
@@ -0,0 +1,297 @@
+package siren
+
+import "net"
+import "sync"
+import "time"
+import "strings"
+
+import "github.com/neilalexander/siren/sirenproto"
+
+// How long violations of the rate limits are counted for before the count
+// starts again, and how often idle buckets are thrown away.
+const rateLimitViolationWindow = time.Minute
+const rateLimitPruneInterval = time.Minute
+
+// A RateLimit is a token bucket which refills at Rate tokens per second, up
+// to Burst tokens. Each request takes one token, and requests are refused
+// when the bucket is empty. A Rate of zero means no limit.
+type RateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+// The RateLimits from the ServerConfig. Messages and directory lookups are
+// limited for each connection, for each logged in user and for each
+// federated domain. Handshakes are limited for each remote address that
+// connects to us, and for each domain that we try to connect to, so that
+// directory lookups can't be used to make us dial other servers over and
+// over. Anyone that goes over a limit more than BanThreshold times within a
+// minute is banned for BanSeconds: clients by their user, or by their
+// address if they haven't logged in, and federated servers by their domain.
+type RateLimits struct {
+	ConnectionMessages RateLimit
+	UserMessages       RateLimit
+	DomainMessages     RateLimit
+	ConnectionLookups  RateLimit
+	UserLookups        RateLimit
+	DomainLookups      RateLimit
+	AddressHandshakes  RateLimit
+	DomainHandshakes   RateLimit
+	BanThreshold       int
+	BanSeconds         int
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func (b *tokenBucket) take(limit RateLimit, now time.Time) bool {
+	if limit.Rate <= 0 {
+		return true
+	}
+	burst := limit.Burst
+	if burst < 1 {
+		burst = 1
+	}
+	if b.updated.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.updated).Seconds() * limit.Rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.updated = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+type rateViolations struct {
+	count int
+	since time.Time
+}
+
+// The rateLimiter holds the buckets which are shared between connections,
+// i.e. for users and domains, along with the violations and bans. Buckets
+// for a single connection are kept on the connection instead. The clock is a
+// field so that tests can control it.
+type rateLimiter struct {
+	mutex      sync.Mutex
+	now        func() time.Time
+	buckets    map[string]*tokenBucket
+	violations map[string]*rateViolations
+	bans       map[string]time.Time
+}
+
+func (l *rateLimiter) start() {
+	l.now = time.Now
+	l.buckets = make(map[string]*tokenBucket)
+	l.violations = make(map[string]*rateViolations)
+	l.bans = make(map[string]time.Time)
+	go func() {
+		for range time.Tick(rateLimitPruneInterval) {
+			l.prune()
+		}
+	}()
+}
+
+func (l *rateLimiter) allow(key string, limit RateLimit) bool {
+	if limit.Rate <= 0 {
+		return true
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{}
+		l.buckets[key] = bucket
+	}
+	return bucket.take(limit, l.now())
+}
+
+// Counts a violation of the rate limits, and bans the offender if they have
+// gone over the limits too many times. Returns true if they were banned.
+func (l *rateLimiter) violation(offender string, limits RateLimits) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	v, ok := l.violations[offender]
+	if !ok || now.Sub(v.since) > rateLimitViolationWindow {
+		v = &rateViolations{since: now}
+		l.violations[offender] = v
+	}
+	v.count++
+	if limits.BanThreshold <= 0 || limits.BanSeconds <= 0 || v.count < limits.BanThreshold {
+		return false
+	}
+	delete(l.violations, offender)
+	l.bans[offender] = now.Add(time.Duration(limits.BanSeconds) * time.Second)
+	return true
+}
+
+func (l *rateLimiter) banned(offender string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	until, ok := l.bans[offender]
+	if ok && l.now().After(until) {
+		delete(l.bans, offender)
+		return false
+	}
+	return ok
+}
+
+// Throws away buckets which have been idle for long enough to have filled
+// up again, along with old violations and expired bans.
+func (l *rateLimiter) prune() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.updated) > rateLimitPruneInterval {
+			delete(l.buckets, key)
+		}
+	}
+	for offender, v := range l.violations {
+		if now.Sub(v.since) > rateLimitViolationWindow {
+			delete(l.violations, offender)
+		}
+	}
+	for offender, until := range l.bans {
+		if now.After(until) {
+			delete(l.bans, offender)
+		}
+	}
+}
+
+// Returns the host part of a remote address, so that handshakes are limited
+// for each remote host rather than each remote port.
+func addressHost(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Returns who is responsible for the traffic on a connection, for counting
+// violations and bans. A federation connection is only blamed on a domain
+// once the remote server has been verified to serve it, so that a server
+// can't get another domain banned by claiming to be it.
+func (c *connection) offender() string {
+	switch {
+	case c.connectionType == sirenproto.HelloIAm_SERVER_TO_SERVER && len(c.remoteDomains()) > 0:
+		return "domain:" + c.remoteDomains()[0]
+	case c.uid != "":
+		return "uid:" + c.uid
+	default:
+		return "address:" + addressHost(c.connection.remoteAddr())
+	}
+}
+
+// Checks the rate limits for messages and directory lookups from a
+// connection. If the payload is over the limits then it is refused with a
+// RATE_LIMITED Ack, and the connection is closed if the offender has been
+// banned. Returns true if the payload can be processed.
+func (r *router) allowPayload(c *connection, payload *sirenproto.Payload) bool {
+	limits := r.server.config().RateLimits
+	var kind string
+	var connectionLimit, userLimit, domainLimit RateLimit
+	switch payload.Contents.(type) {
+	case *sirenproto.Payload_Message:
+		kind = "messages"
+		connectionLimit, userLimit, domainLimit = limits.ConnectionMessages, limits.UserMessages, limits.DomainMessages
+	case *sirenproto.Payload_DirectoryRequest:
+		kind = "lookups"
+		connectionLimit, userLimit, domainLimit = limits.ConnectionLookups, limits.UserLookups, limits.DomainLookups
+	default:
+		return true
+	}
+
+	if c.buckets == nil {
+		c.buckets = make(map[string]*tokenBucket)
+	}
+	bucket, ok := c.buckets[kind]
+	if !ok {
+		bucket = &tokenBucket{}
+		c.buckets[kind] = bucket
+	}
+	allowed := bucket.take(connectionLimit, r.limiter.now())
+	if allowed && c.uid != "" {
+		allowed = r.limiter.allow("uid:"+c.uid+":"+kind, userLimit)
+	}
+	if allowed && c.connectionType == sirenproto.HelloIAm_SERVER_TO_SERVER {
+		for _, domain := range c.remoteDomains() {
+			if !r.limiter.allow("domain:"+domain+":"+kind, domainLimit) {
+				allowed = false
+				break
+			}
+		}
+	}
+	if allowed {
+		return true
+	}
+
+	r.server.metrics.rateLimited.inc(kind)
+	offender := c.offender()
+	if r.limiter.violation(offender, limits) {
+		r.banConnection(c, offender)
+		return false
+	}
+	c.logger().debug("Rate limited", LogField{"kind", kind})
+	r.sendAck(c, sirenproto.Ack_RATE_LIMITED, "Too many "+kind+", slow down")
+	return false
+}
+
+// Closes a connection whose offender has just been banned, along with any
+// other connections from the same offender.
+func (r *router) banConnection(c *connection, offender string) {
+	c.logger().warning("Banned for going over the rate limits",
+		LogField{"offender", offender}, LogField{"seconds", r.server.config().RateLimits.BanSeconds})
+	r.server.metrics.bans.inc(strings.SplitN(offender, ":", 2)[0])
+	r.mutex.RLock()
+	var closing []*connection
+	for other := range r.connections {
+		if other != c && other.offender() == offender {
+			closing = append(closing, other)
+		}
+	}
+	r.mutex.RUnlock()
+	c.queueEncrypted(&sirenproto.Payload{
+		Contents: &sirenproto.Payload_Ack{
+			Ack: &sirenproto.Ack{
+				Condition: sirenproto.Ack_TERMINATE,
+				Text:      "Banned for going over the rate limits",
+			},
+		},
+	})
+	c.connection.close()
+	for _, other := range closing {
+		other.connection.close()
+	}
+}
+
+// Checks whether a new connection from a remote address can go ahead.
+func (r *router) allowHandshake(conn packetConn) bool {
+	host := addressHost(conn.remoteAddr())
+	if r.limiter.banned("address:" + host) {
+		r.server.metrics.handshakeFailures.inc("banned")
+		return false
+	}
+	if !r.limiter.allow("address:"+host+":handshakes", r.server.config().RateLimits.AddressHandshakes) {
+		r.server.metrics.handshakeFailures.inc("rate_limited")
+		r.server.metrics.rateLimited.inc("handshakes")
+		if r.limiter.violation("address:"+host, r.server.config().RateLimits) {
+			r.server.log.warning("Banned for going over the rate limits", LogField{"offender", "address:" + host})
+			r.server.metrics.bans.inc("address")
+		}
+		return false
+	}
+	return true
+}
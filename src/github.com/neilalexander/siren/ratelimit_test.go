@@ -0,0 +1,195 @@
+package siren
+
+import "testing"
+import "time"
+
+import "github.com/neilalexander/siren/sirenproto"
+
+// Returns a rateLimiter whose clock only moves when the test moves it, and
+// which doesn't prune in the background.
+func newTestRateLimiter(clock *time.Time) *rateLimiter {
+	return &rateLimiter{
+		now:        func() time.Time { return *clock },
+		buckets:    make(map[string]*tokenBucket),
+		violations: make(map[string]*rateViolations),
+		bans:       make(map[string]time.Time),
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	type take struct {
+		at      time.Duration
+		allowed bool
+	}
+	tests := []struct {
+		name  string
+		limit RateLimit
+		takes []take
+	}{
+		{"no limit", RateLimit{}, []take{
+			{0, true}, {0, true}, {0, true}, {0, true},
+		}},
+		{"burst", RateLimit{Rate: 1, Burst: 3}, []take{
+			{0, true}, {0, true}, {0, true}, {0, false},
+			{time.Second, true}, {time.Second, false},
+		}},
+		{"refills up to the burst", RateLimit{Rate: 1, Burst: 2}, []take{
+			{0, true}, {0, true}, {0, false},
+			{time.Minute, true}, {time.Minute, true}, {time.Minute, false},
+		}},
+		{"burst of at least one", RateLimit{Rate: 2}, []take{
+			{0, true}, {0, false},
+			{500 * time.Millisecond, true}, {500 * time.Millisecond, false},
+		}},
+		{"partial tokens", RateLimit{Rate: 0.5, Burst: 1}, []take{
+			{0, true}, {time.Second, false}, {2 * time.Second, true},
+		}},
+	}
+	start := time.Now()
+	for _, test := range tests {
+		var bucket tokenBucket
+		for i, take := range test.takes {
+			if allowed := bucket.take(test.limit, start.Add(take.at)); allowed != take.allowed {
+				t.Errorf("%s: take %d at %v got %v, want %v", test.name, i, take.at, allowed, take.allowed)
+			}
+		}
+	}
+}
+
+func TestRateLimiterBans(t *testing.T) {
+	// Each event is either a violation, which reports whether it caused a
+	// ban, or a check of whether the offender is banned
+	type event struct {
+		at        time.Duration
+		violation bool
+		want      bool
+	}
+	tests := []struct {
+		name   string
+		limits RateLimits
+		events []event
+	}{
+		{"banned at the threshold", RateLimits{BanThreshold: 3, BanSeconds: 10}, []event{
+			{0, true, false}, {time.Second, true, false},
+			{2 * time.Second, false, false},
+			{2 * time.Second, true, true},
+			{2 * time.Second, false, true},
+			{11 * time.Second, false, true},
+			{13 * time.Second, false, false},
+		}},
+		{"violations outside the window", RateLimits{BanThreshold: 3, BanSeconds: 10}, []event{
+			{0, true, false}, {30 * time.Second, true, false},
+			{61 * time.Second, true, false}, {62 * time.Second, true, false},
+			{62 * time.Second, false, false},
+			{63 * time.Second, true, true},
+		}},
+		{"count starts again after a ban", RateLimits{BanThreshold: 2, BanSeconds: 1}, []event{
+			{0, true, false}, {0, true, true},
+			{2 * time.Second, false, false},
+			{2 * time.Second, true, false}, {2 * time.Second, true, true},
+		}},
+		{"no threshold", RateLimits{BanSeconds: 10}, []event{
+			{0, true, false}, {0, true, false}, {0, true, false},
+			{0, false, false},
+		}},
+		{"no ban length", RateLimits{BanThreshold: 1}, []event{
+			{0, true, false}, {0, false, false},
+		}},
+	}
+	start := time.Now()
+	for _, test := range tests {
+		clock := start
+		l := newTestRateLimiter(&clock)
+		for i, event := range test.events {
+			clock = start.Add(event.at)
+			var got bool
+			if event.violation {
+				got = l.violation("uid:test@test.com", test.limits)
+			} else {
+				got = l.banned("uid:test@test.com")
+			}
+			if got != event.want {
+				t.Errorf("%s: event %d at %v got %v, want %v", test.name, i, event.at, got, event.want)
+			}
+			if l.banned("uid:other@test.com") {
+				t.Fatalf("%s: someone else was banned", test.name)
+			}
+		}
+	}
+}
+
+func TestAllowPayloadKeys(t *testing.T) {
+	message := &sirenproto.Payload{Contents: &sirenproto.Payload_Message{Message: &sirenproto.Message{}}}
+	lookup := &sirenproto.Payload{Contents: &sirenproto.Payload_DirectoryRequest{DirectoryRequest: &sirenproto.DirectoryRequest{}}}
+	type source struct {
+		uid     string
+		domains []string
+	}
+	type send struct {
+		source  int
+		payload *sirenproto.Payload
+		allowed bool
+	}
+	tests := []struct {
+		name    string
+		limits  RateLimits
+		sources []source
+		sends   []send
+	}{
+		{
+			"per connection",
+			RateLimits{ConnectionMessages: RateLimit{Rate: 1, Burst: 1}},
+			[]source{{uid: "test@test.com"}, {uid: "test@test.com"}},
+			[]send{{0, message, true}, {0, message, false}, {1, message, true}, {0, lookup, true}},
+		},
+		{
+			"per user",
+			RateLimits{UserMessages: RateLimit{Rate: 1, Burst: 2}},
+			[]source{{uid: "test@test.com"}, {uid: "test@test.com"}, {uid: "other@test.com"}},
+			[]send{{0, message, true}, {1, message, true}, {0, message, false}, {1, message, false}, {2, message, true}},
+		},
+		{
+			"per domain",
+			RateLimits{DomainLookups: RateLimit{Rate: 1, Burst: 1}},
+			[]source{{domains: []string{"remote.example"}}, {domains: []string{"remote.example"}}, {domains: []string{"other.example"}}},
+			[]send{{0, lookup, true}, {1, lookup, false}, {2, lookup, true}, {0, message, true}},
+		},
+		{
+			"clients aren't limited by domain",
+			RateLimits{DomainMessages: RateLimit{Rate: 1, Burst: 1}},
+			[]source{{uid: "test@test.com"}},
+			[]send{{0, message, true}, {0, message, true}},
+		},
+	}
+	for _, test := range tests {
+		s := newTestServer(t, "test.com")
+		config := *s.config()
+		config.RateLimits = test.limits
+		s.current.Store(&config)
+		clock := time.Now()
+		s.router.limiter.mutex.Lock()
+		s.router.limiter.now = func() time.Time { return clock }
+		s.router.limiter.mutex.Unlock()
+
+		var connections []*connection
+		for _, source := range test.sources {
+			c := &connection{
+				log:     s.log,
+				queue:   newWriteQueue(0, 0),
+				metrics: &s.metrics,
+				state:   STATE_AUTHENTICATED,
+				uid:     source.uid,
+			}
+			if source.domains != nil {
+				c.connectionType = sirenproto.HelloIAm_SERVER_TO_SERVER
+				c.domains.Store(source.domains)
+			}
+			connections = append(connections, c)
+		}
+		for i, send := range test.sends {
+			if allowed := s.router.allowPayload(connections[send.source], send.payload); allowed != send.allowed {
+				t.Errorf("%s: send %d got allowed %v, want %v", test.name, i, allowed, send.allowed)
+			}
+		}
+	}
+}
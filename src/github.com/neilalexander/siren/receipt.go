@@ -0,0 +1,108 @@
+package siren
+
+import "time"
+import "crypto/rand"
+import "encoding/hex"
+
+import "github.com/neilalexander/siren/sirenproto"
+
+// Generates a new random ID for a message. Clients use these for the
+// messages and requests that they send, and the server uses them for
+// messages from clients that didn't give one.
+func NewMessageID() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// Receipts are only generated for messages with content, and not for read
+// receipts or other receipts, or for copies of messages that the sender is
+// sending to their own devices.
+func wantsReceipts(message *sirenproto.Message) bool {
+	return message.MessageID != "" &&
+		message.Type == sirenproto.Message_CONTENT &&
+		message.Source != message.Destination
+}
+
+// Lets a client know that we have accepted its message and will try to
+// deliver it. For group messages the receipt is for the group as a whole.
+func (r *router) sendAcceptedReceipt(c *connection, message *sirenproto.Message) {
+	if message.MessageID == "" || message.Type != sirenproto.Message_CONTENT {
+		return
+	}
+	uid := message.Destination
+	if message.GroupID != "" {
+		uid = message.GroupID
+	}
+	c.queueEncrypted(&sirenproto.Payload{
+		Contents: &sirenproto.Payload_Receipt{
+			Receipt: &sirenproto.Receipt{
+				MessageID:   message.MessageID,
+				Type:        sirenproto.Receipt_ACCEPTED,
+				UID:         uid,
+				Destination: message.Source,
+				Timestamp:   time.Now().UnixNano() / int64(time.Millisecond),
+			},
+		},
+	})
+}
+
+// Lets the sender of a message know that it has been written to one of the
+// recipient's devices. This is called by the write thread once the message
+// has actually been written, rather than when it was queued, as a queued
+// message is lost if the connection closes before it is written.
+func (r *router) sendDeliveredReceipt(message *sirenproto.Message, deviceKey []byte) {
+	if !wantsReceipts(message) {
+		return
+	}
+	r.routeReceipt(&sirenproto.Receipt{
+		MessageID:   message.MessageID,
+		Type:        sirenproto.Receipt_DELIVERED,
+		UID:         message.Destination,
+		DeviceKey:   deviceKey,
+		Destination: message.Source,
+		Timestamp:   time.Now().UnixNano() / int64(time.Millisecond),
+	})
+}
+
+// Receipts are delivered to the sender's devices that are online, or sent
+// onto the sender's server. They aren't queued for devices that are offline.
+func (r *router) routeReceipt(receipt *sirenproto.Receipt) {
+	_, domain, ok := splitUID(receipt.Destination)
+	if !ok {
+		return
+	}
+	payload := &sirenproto.Payload{
+		Contents: &sirenproto.Payload_Receipt{
+			Receipt: receipt,
+		},
+	}
+	if !r.isLocalDomain(domain) {
+		if err := r.forward(domain, payload); err != nil {
+			r.server.log.debug("Unable to send receipt", LogField{"destination", receipt.Destination}, LogField{"error", err})
+		}
+		return
+	}
+	for _, s := range r.localSessions(receipt.Destination) {
+		s.queueEncrypted(payload)
+	}
+}
+
+func (r *router) handleReceipt(c *connection, receipt *sirenproto.Receipt) {
+	// Receipts only arrive over federation, for messages that one of our
+	// users sent to a user on the remote server, so the receipt must be for
+	// one of that server's own users
+	if c.connectionType != sirenproto.HelloIAm_SERVER_TO_SERVER {
+		r.sendAck(c, sirenproto.Ack_UNAUTHORIZED, "Clients cannot send receipts")
+		return
+	}
+	_, source, ok := splitUID(receipt.UID)
+	_, destination, ok2 := splitUID(receipt.Destination)
+	if !ok || !ok2 || r.isLocalDomain(source) || !c.servesDomain(source) || !r.isLocalDomain(destination) {
+		c.logger().warning("Dropping federated receipt with invalid user", LogField{"user", receipt.UID})
+		return
+	}
+	r.routeReceipt(receipt)
+}
@@ -0,0 +1,105 @@
+package siren
+
+import "net"
+import "sync"
+import "context"
+import "errors"
+import "strings"
+
+// A Resolver is used by the router to discover the address of the Siren
+// server responsible for a federation domain. The router looks up the
+// _siren._tcp SRV record for the domain through the Resolver specified in
+// the ServerConfig, or through the system resolver if none is given.
+type Resolver interface {
+	LookupSRV(service, proto, name string) (string, []*net.SRV, error)
+}
+
+// Returns a Resolver which uses the system DNS resolver. This is the
+// default if no Resolver is specified in the ServerConfig.
+func NewSystemResolver() Resolver {
+	return &systemResolver{}
+}
+
+type systemResolver struct{}
+
+func (r *systemResolver) LookupSRV(service, proto, name string) (string, []*net.SRV, error) {
+	return net.LookupSRV(service, proto, name)
+}
+
+// Returns a Resolver which sends all DNS queries to the given DNS server
+// address (i.e. "127.0.0.1:53") instead of the servers configured in the
+// operating system.
+func NewDNSResolver(address string) Resolver {
+	return &dnsResolver{
+		resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, address)
+			},
+		},
+	}
+}
+
+type dnsResolver struct {
+	resolver *net.Resolver
+}
+
+func (r *dnsResolver) LookupSRV(service, proto, name string) (string, []*net.SRV, error) {
+	return r.resolver.LookupSRV(context.Background(), service, proto, name)
+}
+
+// The StaticResolver answers SRV lookups from an in-memory map rather than
+// from DNS. It is mostly useful for running several Server instances on the
+// same machine (i.e. on loopback) and federating them with each other.
+type StaticResolver struct {
+	mutex   sync.RWMutex
+	records map[string][]*net.SRV
+}
+
+// Returns a new StaticResolver with no records.
+func NewStaticResolver() *StaticResolver {
+	return &StaticResolver{
+		records: make(map[string][]*net.SRV),
+	}
+}
+
+// Adds a _siren._tcp SRV record for the given domain which points to the
+// given target and port. Records are returned in the order they were added.
+func (r *StaticResolver) Add(domain string, target string, port uint16) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	key := staticResolverKey("siren", "tcp", domain)
+	r.records[key] = append(r.records[key], &net.SRV{
+		Target: target,
+		Port:   port,
+	})
+}
+
+// Removes all records for the given domain.
+func (r *StaticResolver) Remove(domain string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.records, staticResolverKey("siren", "tcp", domain))
+}
+
+func (r *StaticResolver) LookupSRV(service, proto, name string) (string, []*net.SRV, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	key := staticResolverKey(service, proto, name)
+	addrs, ok := r.records[key]
+	if !ok || len(addrs) == 0 {
+		return "", nil, errors.New("No SRV records found for " + key)
+	}
+	// Return a copy so that the caller can't modify our records
+	result := make([]*net.SRV, len(addrs))
+	for i, a := range addrs {
+		srv := *a
+		result[i] = &srv
+	}
+	return key, result, nil
+}
+
+func staticResolverKey(service, proto, name string) string {
+	return "_" + service + "._" + proto + "." + strings.TrimSuffix(strings.ToLower(name), ".") + "."
+}
@@ -1,111 +1,438 @@
 package siren
 
-import "fmt"
+import "crypto/tls"
 import "net"
 import "os"
 import "errors"
+import "sync"
+import "time"
+import "strconv"
+import "sync/atomic"
 
 import "github.com/neilalexander/siren/sirenproto"
 
 type router struct {
 	server      *Server
-	listener    net.Listener
-	connections []connection
-	federations map[string]connection
+	listeners   []packetListener
+	mutex       sync.RWMutex
+	connections map[*connection]struct{}
+	federations map[string]*connection
+	sessions    map[string][]*connection
+	linking     map[string][]*connection
+	offline     offlineQueue
+	resolver    Resolver
+	tlsServer   *tls.Config
+	tlsClient   *tls.Config
 	in          chan *sirenproto.Payload
+	nextID      uint64
+	lists       federationLists
+	limiter     rateLimiter
+}
+
+// The federation whitelist and blacklist start off as the ones in the
+// ServerConfig, but can be replaced while the server is running. If the
+// whitelist isn't empty then we only federate with the domains in it, and
+// we never federate with the domains in the blacklist.
+type federationLists struct {
+	mutex     sync.RWMutex
+	whitelist map[string]struct{}
+	blacklist map[string]struct{}
+}
+
+func (l *federationLists) set(whitelist, blacklist []string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.whitelist = make(map[string]struct{}, len(whitelist))
+	for _, d := range whitelist {
+		l.whitelist[d] = struct{}{}
+	}
+	l.blacklist = make(map[string]struct{}, len(blacklist))
+	for _, d := range blacklist {
+		l.blacklist[d] = struct{}{}
+	}
+}
+
+func (l *federationLists) allows(domain string) bool {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	if _, ok := l.blacklist[domain]; ok {
+		return false
+	}
+	if _, ok := l.whitelist[domain]; !ok && len(l.whitelist) > 0 {
+		return false
+	}
+	return true
 }
 
 func (r *router) start(s *Server) {
-	fmt.Println("Starting router")
+	s.log.debug("Starting router")
 
 	r.server = s
-	r.connections = make([]connection, r.server.config.MaximumS2SConnections)
-	r.federations = make(map[string]connection)
+	r.connections = make(map[*connection]struct{})
+	r.federations = make(map[string]*connection)
+	r.sessions = make(map[string][]*connection)
+	r.linking = make(map[string][]*connection)
+	r.offline.start(r.server.config().MaximumOfflineMessages)
 	r.in = make(chan *sirenproto.Payload)
+	r.lists.set(r.server.config().FederationWhitelist, r.server.config().FederationBlacklist)
+	r.limiter.start()
 
-	go r.listenForConnections()
-}
+	// Use the resolver from the server config if one was given, otherwise
+	// fall back to the system DNS resolver
+	r.resolver = r.server.config().Resolver
+	if r.resolver == nil {
+		r.resolver = NewSystemResolver()
+	}
 
-func (r *router) listenForConnections() {
-	// Start listening for connections
+	// If TLS certificates were given then load them now, so that we fail
+	// early if they are missing or invalid
 	var err error
-	r.listener, err = net.Listen("tcp", r.server.config.ListenAddress)
+	if len(r.server.config().TLS.Certificates) > 0 {
+		if r.tlsServer, err = r.server.config().TLS.serverConfig(); err != nil {
+			r.server.log.error("Error configuring TLS", LogField{"error", err})
+			os.Exit(1)
+		}
+	}
+	if r.server.config().TLS.Enabled || len(r.server.config().TLS.Certificates) > 0 {
+		if r.tlsClient, err = r.server.config().TLS.clientConfig(); err != nil {
+			r.server.log.error("Error configuring TLS", LogField{"error", err})
+			os.Exit(1)
+		}
+	}
+
+	listeners, err := r.server.config().listeners()
+	if err != nil {
+		r.server.log.error("Error configuring listeners", LogField{"error", err})
+		os.Exit(1)
+	}
+	if r.server.config().ListenAddress != "" || r.server.config().WebSocketListenAddress != "" {
+		r.server.log.warning("ListenAddress and WebSocketListenAddress are deprecated, use Listeners instead")
+	}
+	for _, l := range r.server.config().Listeners {
+		if l.Network != "" {
+			r.server.log.warning("The Network of a listener is deprecated, use a URI in the Address instead", LogField{"address", l.Address})
+		}
+	}
+	for _, l := range listeners {
+		r.listenForConnections(l)
+	}
+}
+
+func (r *router) listenForConnections(l ListenerConfig) {
+	// Start listening for connections using the transport for the scheme
+	// given in the listener address
+	listener, err := r.listen(l.Address)
 	if err != nil {
-		fmt.Println("Error listening on", r.server.config.ListenAddress, err.Error())
+		r.server.log.error("Error listening", LogField{"address", l.Address}, LogField{"error", err})
 		os.Exit(1)
 	}
+	r.listeners = append(r.listeners, listener)
+	r.server.log.info("Listening", LogField{"address", l.Address})
+
+	go func() {
+		// At this point the connection has been successfully opened so
+		// defer our closure until later
+		defer listener.close()
+
+		for {
+			// Wait for a new connection to come in
+			conn, err := listener.accept()
+			if err != nil {
+				r.server.log.error("Error accepting", LogField{"address", l.Address}, LogField{"error", err})
+				os.Exit(1)
+			}
+			// Drop the connection straight away if the remote address is
+			// connecting too often or has been banned
+			if !r.allowHandshake(conn) {
+				conn.close()
+				continue
+			}
+			r.newConnection(conn, l.Policy, "")
+		}
+	}()
+}
+
+func (r *router) newConnection(conn packetConn, policy ListenerPolicy, federationDomain string) *connection {
+	// We've got a new connection - we need to create a new connection
+	// object with the appropriate channels so that the read and write
+	// threads know where the socket connection is. If we know the
+	// federation domain then we were the initiator of the connection
+	initiator := federationDomain != ""
+	connection := &connection{
+		id:               atomic.AddUint64(&r.nextID, 1),
+		connection:       conn,
+		queue:            newWriteQueue(r.server.config().MaximumControlQueue, r.server.config().MaximumMessageQueue),
+		metrics:          &r.server.metrics,
+		challenge:        newChallenge(),
+		terminateWrite:   make(chan bool),
+		writeFinished:    make(chan struct{}),
+		federationDomain: federationDomain,
+		policy:           policy,
+		opened:           time.Now(),
+	}
+	r.server.metrics.connections.add("unauthenticated", 1)
+	connection.log = r.server.log.with(
+		LogField{"connection", connection.id},
+		LogField{"remote", conn.remoteAddr()},
+	)
+	// Store the connection in the connections table
+	r.mutex.Lock()
+	r.connections[connection] = struct{}{}
+	if initiator {
+		r.federations[federationDomain] = connection
+	}
+	r.mutex.Unlock()
+	// Start the read and write threads
+	go connection.writeThread(r, initiator)
+	go connection.readThread(r, initiator)
+	return connection
+}
+
+func (r *router) removeConnection(c *connection) {
+	// Remove the connection from the connections table, and from the
+	// federations, sessions and linking tables if it appears in them
+	r.mutex.Lock()
+	delete(r.connections, c)
+	if c.federationDomain != "" && r.federations[c.federationDomain] == c {
+		delete(r.federations, c.federationDomain)
+	}
+	for key, waiting := range r.linking {
+		linking := waiting[:0]
+		for _, l := range waiting {
+			if l != c {
+				linking = append(linking, l)
+			}
+		}
+		if len(linking) > 0 {
+			r.linking[key] = linking
+		} else {
+			delete(r.linking, key)
+		}
+	}
+	if c.uid != "" {
+		sessions := r.sessions[c.uid][:0]
+		for _, s := range r.sessions[c.uid] {
+			if s != c {
+				sessions = append(sessions, s)
+			}
+		}
+		if len(sessions) > 0 {
+			r.sessions[c.uid] = sessions
+		} else {
+			delete(r.sessions, c.uid)
+		}
+	}
+	uid := c.uid
+	r.mutex.Unlock()
+
+	if c.closeState() < STATE_AUTHENTICATED {
+		r.server.metrics.connections.add("unauthenticated", -1)
+	} else {
+		r.server.metrics.connections.add(connectionTypeLabel(c.connectionType), -1)
+	}
 
-	// At this point the connection has been successfully opened so
-	// defer our closure until later
-	defer r.listener.Close()
-	fmt.Println("Listening on", r.server.config.ListenAddress)
+	// If this was a logged in session then the user's presence may have
+	// changed, and they were last seen now
+	if uid != "" {
+		r.server.presence.remove(c)
+		r.server.localdirectory.touch(uid)
+		r.notifyPresence(uid)
+	}
+}
+
+// Returns true if we can federate with a server that serves all of the
+// given domains.
+func (r *router) federationAllowed(domains []string) bool {
+	if len(domains) == 0 {
+		domains = []string{""}
+	}
+	for _, domain := range domains {
+		if !r.lists.allows(domain) || r.limiter.banned("domain:"+domain) {
+			return false
+		}
+	}
+	return true
+}
 
+// How long to spend checking the domains that the remote server on an
+// incoming federation connection claims to serve.
+const domainVerificationTimeout = 10 * time.Second
+
+// Checks that the remote server on an incoming federation connection really
+// serves the domains that it claimed in its HelloIAm, by connecting to each
+// of them through the resolver and making sure that we reach the same public
+// key. The connection is dropped if any of them can't be verified.
+func (r *router) verifyDomains(c *connection) {
+	defer close(c.domainsVerified)
+	deadline := time.Now().Add(domainVerificationTimeout)
+	for _, domain := range c.claimedDomains {
+		if err := r.verifyDomain(c, domain, deadline); err != nil {
+			c.logger().warning("Could not verify federation domain", LogField{"domain", domain}, LogField{"error", err})
+			r.server.metrics.handshakeFailures.inc("domain_unverified")
+			c.queueEncrypted(&sirenproto.Payload{
+				Contents: &sirenproto.Payload_Ack{
+					Ack: &sirenproto.Ack{
+						Condition: sirenproto.Ack_TERMINATE,
+						Text:      "Could not verify that you serve " + domain,
+					},
+				},
+			})
+			c.connection.close()
+			return
+		}
+	}
+	c.domains.Store(c.claimedDomains)
+}
+
+func (r *router) verifyDomain(c *connection, domain string, deadline time.Time) error {
+	if r.isLocalDomain(domain) {
+		return errors.New("Domain is served by this server")
+	}
 	for {
-		// Wait for a new connection to come in
-		conn, err := r.listener.Accept()
-		if err != nil {
-			fmt.Println("Error accepting: ", err.Error())
-			os.Exit(1)
+		// The public key of a connection is set before it moves out of the
+		// initial state, so it is safe to read once it is authenticated
+		if f, ok := r.federation(domain); ok && f.getState() == STATE_AUTHENTICATED {
+			if f.remotePublicKey != c.remotePublicKey {
+				return errors.New("Domain is served by a different public key")
+			}
+			return nil
+		}
+		if err := r.initiateOutgoingConnection(domain); err != nil {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return errors.New("Timed out connecting to domain")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Replaces the federation whitelist and blacklist, and closes any federation
+// connections to domains that are no longer allowed.
+func (r *router) setFederationLists(whitelist, blacklist []string) {
+	r.lists.set(whitelist, blacklist)
+	r.closeDisallowedFederations()
+}
+
+// Closes any federation connections that are no longer allowed, either
+// because of the federation lists or because federation has been disabled.
+func (r *router) closeDisallowedFederations() {
+	enabled := r.server.config().FederationEnabled
+	r.mutex.RLock()
+	var closing []*connection
+	for c := range r.connections {
+		if c.connectionType != sirenproto.HelloIAm_SERVER_TO_SERVER || c.getState() != STATE_AUTHENTICATED {
+			continue
 		}
-		// We've received a new connection - we need to create a new
-		// connection object with the appropriate channels so that the
-		// read and write threads know where the socket connection is
-		connection := &connection{
-			connection:       conn,
-			writeEncrypted:   make(chan *sirenproto.Payload, 10),
-			writeUnencrypted: make(chan *sirenproto.Payload, 10),
+		if !enabled || !r.federationAllowed(c.remoteDomains()) {
+			closing = append(closing, c)
 		}
-		// Store the connection in the connections table
-		r.connections = append(r.connections, *connection)
-		// Start the read and write threads
-		go connection.writeThread(r, false)
-		go connection.readThread(r, false)
 	}
+	r.mutex.RUnlock()
+	for _, c := range closing {
+		c.logger().info("Closing federation that is no longer allowed")
+		c.connection.close()
+	}
+}
+
+func (r *router) isLocalDomain(domain string) bool {
+	for _, d := range r.server.config().LocalDomains {
+		if d == domain {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *router) federation(domain string) (*connection, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	c, ok := r.federations[domain]
+	return c, ok
+}
+
+// Returns true if another federation connection would go over the
+// MaximumS2SConnections from the ServerConfig. Connections that we made
+// count from the start, and connections that other servers made count once
+// they have said that they are federation connections. A limit of zero
+// means no limit.
+func (r *router) federationsFull() bool {
+	maximum := int(r.server.config().MaximumS2SConnections)
+	if maximum <= 0 {
+		return false
+	}
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	count := 0
+	for c := range r.connections {
+		state := c.getState()
+		if state == STATE_CLOSED {
+			continue
+		}
+		if c.federationDomain != "" || (state != STATE_INITIAL && c.connectionType == sirenproto.HelloIAm_SERVER_TO_SERVER) {
+			count++
+		}
+	}
+	return count >= maximum
 }
 
 func (r *router) initiateOutgoingConnection(domain string) error {
 	// Let's see if we already have a federation connection open
 	// for this domain - if we do then we don't need to open
 	// another one
-	if _, ok := r.federations[domain]; ok {
+	if _, ok := r.federation(domain); ok {
 		return nil
 	}
+	if !r.lists.allows(domain) {
+		return errors.New("Federation with " + domain + " is not allowed")
+	}
+	if r.limiter.banned("domain:" + domain) {
+		return errors.New("Federation with " + domain + " is temporarily banned")
+	}
+	if r.federationsFull() {
+		return errors.New("Too many federation connections")
+	}
+	if !r.limiter.allow("domain:"+domain+":handshakes", r.server.config().RateLimits.DomainHandshakes) {
+		r.server.metrics.rateLimited.inc("handshakes")
+		return errors.New("Too many connection attempts to " + domain)
+	}
 
 	// Look up the _siren._tcp.hostname.com DNS SRV record - this
 	// will tell us where we can find the remote server
-	_, addr, err := net.LookupSRV("siren", "tcp", domain)
+	_, addr, err := r.resolver.LookupSRV("siren", "tcp", domain)
 	if err != nil {
 		return errors.New("Unable to look up DNS SRV record")
 	}
 
+	// If TLS is enabled then federation connections are made using TLS,
+	// otherwise they are made using plain TCP
+	scheme := "tcp://"
+	if r.server.config().TLS.Enabled {
+		scheme = "tls://"
+	}
+
 	// For each record that was returned, try to connect to it
 	for _, a := range addr {
-		conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", a.Target, a.Port))
+		started := time.Now()
+		conn, err := r.dial(scheme+net.JoinHostPort(a.Target, strconv.Itoa(int(a.Port))), domain)
+		r.server.metrics.observeDial(started)
 		if err != nil {
 			// If this target failed then try the next one
+			r.server.log.warning("Failed to connect to federation target",
+				LogField{"domain", domain}, LogField{"target", a.Target}, LogField{"error", err})
 			continue
-		} else {
-			fmt.Println("Connected to federation target", a.Target)
-
-			// We've successfully connected to the remote side - create a new
-			// connection object and add it to the connections table
-			connection := &connection{
-				connection:       conn,
-				writeEncrypted:   make(chan *sirenproto.Payload, 10),
-				writeUnencrypted: make(chan *sirenproto.Payload, 10),
-				federationDomain: domain,
-			}
-			r.connections = append(r.connections, *connection)
-			r.federations[domain] = *connection
+		}
+		r.server.log.info("Connected to federation target",
+			LogField{"domain", domain}, LogField{"target", a.Target})
 
-			// Start the read and write threads for the new connection
-			go connection.writeThread(r, true)
-			go connection.readThread(r, true)
+		// We've successfully connected to the remote side - create a new
+		// connection object and add it to the connections table, then start
+		// the read and write threads for the new connection
+		r.newConnection(conn, POLICY_S2S_ONLY, domain)
 
-			// At this point we've been successful in finding a server to
-			// connect to, so we can stop trying
-			return nil
-		}
+		// At this point we've been successful in finding a server to
+		// connect to, so we can stop trying
+		return nil
 	}
 
 	// If we reach this point then we haven't successfully connected
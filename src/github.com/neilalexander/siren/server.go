@@ -1,30 +1,62 @@
 package siren
 
-import "fmt"
+import "sync"
+import "sync/atomic"
+import "encoding/hex"
 
 // The desired server configuration, which should be passed to Start.
 // This controls the behaviour, listening port, private and public keys
-// and other behavioural options for the server.
+// and other behavioural options for the server. The configuration can also
+// be loaded from a JSON file with LoadServerConfig, apart from the keys and
+// the fields which hold Go values.
 type ServerConfig struct {
-	ListenAddress         string
-	LocalDomains          []string
-	FederationEnabled     bool
-	FederationWhitelist   []string
-	FederationBlacklist   []string
-	MaximumMessageSize    int32
-	MaximumS2SConnections int32
-	PrivateKey            [cryptoPrivateKeyLen]byte
-	PublicKey             [cryptoPublicKeyLen]byte
+	Listeners              []ListenerConfig
+	LocalDomains           []string
+	FederationEnabled      bool
+	FederationWhitelist    []string
+	FederationBlacklist    []string
+	RegistrationEnabled    bool
+	MaximumMessageSize     int32
+	MaximumS2SConnections  int32
+	MaximumOfflineMessages int32
+	MaximumControlQueue    int
+	MaximumMessageQueue    int
+	RateLimits             RateLimits
+	PrivateKey             [cryptoPrivateKeyLen]byte `json:"-"`
+	PublicKey              [cryptoPublicKeyLen]byte  `json:"-"`
+	Resolver               Resolver                  `json:"-"`
+	Logger                 Logger                    `json:"-"`
+	LogLevel               LogLevel
+	MetricsAddress         string
+	AdminAddress           string
+	TLS                    TLSConfig
+	// Called to load the configuration again when a reload is requested,
+	// i.e. by Reload or through the admin API. If nil then the server can't
+	// be reloaded
+	ConfigLoader func() (ServerConfig, error) `json:"-"`
+	// Deprecated: use Listeners instead. If set, this replaces Listeners
+	// with a single listener on the given host and port, using TLS if any
+	// TLS certificates are given
+	ListenAddress string `json:",omitempty"`
+	// Deprecated: use a "ws://" or "wss://" address in Listeners instead. If
+	// set, a WebSocket listener is added on the given host and port, using
+	// TLS if any TLS certificates are given
+	WebSocketListenAddress string `json:",omitempty"`
 }
 
 // The Server instance, which contains a number of internal structures
 // including the configuration and references to the router and
 // directories.
 type Server struct {
-	config            ServerConfig
+	current           atomic.Value
+	reloadMutex       sync.Mutex
 	router            router
 	externaldirectory directory
 	localdirectory    directory
+	groups            groupStore
+	presence          presenceStore
+	log               logger
+	metrics           metrics
 }
 
 // Generates a "default" ServerConfig which can either be used as a
@@ -34,29 +66,59 @@ type Server struct {
 func DefaultServerConfig() ServerConfig {
 	publicKey, privateKey := NewCryptoKeys()
 	return ServerConfig{
-		ListenAddress:         "0.0.0.0:9989",
-		MaximumMessageSize:    4096, // 1048576,
-		MaximumS2SConnections: 4096,
-		FederationEnabled:     true,
-		LocalDomains:          []string{"test.com", "test.net"},
-		PublicKey:             *publicKey,
-		PrivateKey:            *privateKey,
+		Listeners: []ListenerConfig{
+			{Address: "tcp://0.0.0.0:9989"},
+		},
+		MaximumMessageSize:     4096, // 1048576,
+		MaximumS2SConnections:  4096,
+		MaximumOfflineMessages: 100,
+		MaximumControlQueue:    256,
+		MaximumMessageQueue:    1024,
+		FederationEnabled:      true,
+		RegistrationEnabled:    true,
+		LocalDomains:           []string{"test.com", "test.net"},
+		LogLevel:               LogInfo,
+		RateLimits: RateLimits{
+			ConnectionMessages: RateLimit{Rate: 20, Burst: 50},
+			UserMessages:       RateLimit{Rate: 30, Burst: 100},
+			DomainMessages:     RateLimit{Rate: 200, Burst: 500},
+			ConnectionLookups:  RateLimit{Rate: 10, Burst: 30},
+			UserLookups:        RateLimit{Rate: 20, Burst: 50},
+			DomainLookups:      RateLimit{Rate: 100, Burst: 200},
+			AddressHandshakes:  RateLimit{Rate: 2, Burst: 20},
+			DomainHandshakes:   RateLimit{Rate: 1, Burst: 5},
+			BanThreshold:       20,
+			BanSeconds:         600,
+		},
+		PublicKey:  *publicKey,
+		PrivateKey: *privateKey,
 	}
 }
 
 // Starts the server task using the provided ServerConfig. The Start
 // function will run (and block) indefinitely.
 func (s *Server) Start(c ServerConfig) {
-	fmt.Println("Starting server")
-	fmt.Println("Public key:", c.PublicKey)
-	fmt.Println("Private key:", c.PrivateKey)
+	s.current.Store(&c)
+	s.log = newLogger(c.Logger, c.LogLevel)
+	s.log.info("Starting server", LogField{"public_key", hex.EncodeToString(c.PublicKey[:])})
+	s.metrics.federationDials.buckets = federationDialBuckets
 
-	s.config = c
+	s.groups.start()
+	s.presence.start()
 	s.router.start(s)
 
 	s.externaldirectory.start(s)
-	s.localdirectory.start(s, s.config.LocalDomains...)
+	s.localdirectory.start(s, s.config().LocalDomains...)
 
-	for {
+	// Export metrics over HTTP if an address was given for them
+	if s.config().MetricsAddress != "" {
+		s.serveMetrics(s.config().MetricsAddress)
 	}
+
+	// Serve the admin API if an address was given for it
+	if s.config().AdminAddress != "" {
+		s.serveAdmin(s.config().AdminAddress)
+	}
+
+	select {}
 }
@@ -0,0 +1,124 @@
+package siren
+
+import "errors"
+import "sync/atomic"
+import "crypto/rand"
+
+import "github.com/neilalexander/siren/sirenproto"
+
+// The states of a connection. Every connection starts in STATE_INITIAL,
+// waiting for the remote side to send its HelloIAm. Once the HelloIAm has
+// been accepted the remote public key is known and the connection moves to
+// STATE_AUTHENTICATING, where both sides prove that they hold the private
+// key for the public key they gave by sending back the other side's
+// challenge, encrypted. When the remote side's proof has been checked the
+// connection moves to STATE_AUTHENTICATED and can carry any payload, until
+// it moves to STATE_CLOSED.
+const (
+	STATE_INITIAL        = iota
+	STATE_AUTHENTICATING = iota
+	STATE_AUTHENTICATED  = iota
+	STATE_CLOSED         = iota
+)
+
+// The length of the random challenge in each HelloIAm.
+const challengeLen = 32
+
+// The events which move a connection between states, worked out from the
+// payloads received from the remote side.
+const (
+	EVENT_HELLO     = iota // an unencrypted HelloIAm
+	EVENT_PROOF     = iota // an encrypted HelloProof
+	EVENT_KEEPALIVE = iota // an encrypted Ping or Pong
+	EVENT_PAYLOAD   = iota // any other encrypted payload
+)
+
+var stateNames = map[int32]string{
+	STATE_INITIAL:        "initial",
+	STATE_AUTHENTICATING: "authenticating",
+	STATE_AUTHENTICATED:  "authenticated",
+	STATE_CLOSED:         "closed",
+}
+
+var eventNames = map[int]string{
+	EVENT_HELLO:     "hello",
+	EVENT_PROOF:     "proof",
+	EVENT_KEEPALIVE: "keepalive",
+	EVENT_PAYLOAD:   "payload",
+}
+
+// The transitions that are allowed from each state, and the state that
+// each event moves the connection to. Any event that isn't listed for the
+// current state is illegal, i.e. a second HelloIAm, or an encrypted payload
+// before the remote side has proved its key. A connection can be closed in
+// any state, which is done with closeState.
+var connectionTransitions = map[int32]map[int]int32{
+	STATE_INITIAL: {
+		EVENT_HELLO: STATE_AUTHENTICATING,
+	},
+	STATE_AUTHENTICATING: {
+		EVENT_PROOF:     STATE_AUTHENTICATED,
+		EVENT_KEEPALIVE: STATE_AUTHENTICATING,
+	},
+	STATE_AUTHENTICATED: {
+		EVENT_KEEPALIVE: STATE_AUTHENTICATED,
+		EVENT_PAYLOAD:   STATE_AUTHENTICATED,
+	},
+	STATE_CLOSED: {},
+}
+
+// Returns the event for a payload received from the remote side. Returns
+// false for unencrypted payloads other than HelloIAm, which are never
+// processed in any state.
+func payloadEvent(payload *sirenproto.Payload, encrypted bool) (int, bool) {
+	if !encrypted {
+		_, ok := payload.Contents.(*sirenproto.Payload_HelloIAm)
+		return EVENT_HELLO, ok
+	}
+	switch payload.Contents.(type) {
+	case *sirenproto.Payload_HelloProof:
+		return EVENT_PROOF, true
+	case *sirenproto.Payload_Ping, *sirenproto.Payload_Pong:
+		return EVENT_KEEPALIVE, true
+	default:
+		return EVENT_PAYLOAD, true
+	}
+}
+
+// Returns the state that the connection would move to for the given event,
+// or an error if the event isn't allowed in the current state. The state
+// isn't changed until setState is called, so that the event can be checked
+// before it is processed.
+func (c *connection) nextState(event int) (int32, error) {
+	state := c.getState()
+	next, ok := connectionTransitions[state][event]
+	if !ok {
+		return state, errors.New("Unexpected " + eventNames[event] + " while " + stateNames[state])
+	}
+	return next, nil
+}
+
+// Generates a new random challenge for a connection.
+func newChallenge() [challengeLen]byte {
+	var challenge [challengeLen]byte
+	if _, err := rand.Read(challenge[:]); err != nil {
+		panic(err)
+	}
+	return challenge
+}
+
+func (c *connection) getState() int32 {
+	return atomic.LoadInt32(&c.state)
+}
+
+// Only the read thread changes the state, apart from closing, so there is
+// no need to compare and swap.
+func (c *connection) setState(state int32) {
+	atomic.StoreInt32(&c.state, state)
+}
+
+// Moves the connection to STATE_CLOSED, returning the state that it was in
+// beforehand.
+func (c *connection) closeState() int32 {
+	return atomic.SwapInt32(&c.state, STATE_CLOSED)
+}
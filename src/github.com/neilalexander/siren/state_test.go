@@ -0,0 +1,124 @@
+package siren
+
+import "testing"
+
+import "github.com/neilalexander/siren/sirenproto"
+
+func TestConnectionTransitions(t *testing.T) {
+	tests := []struct {
+		state int32
+		event int
+		next  int32
+		ok    bool
+	}{
+		{STATE_INITIAL, EVENT_HELLO, STATE_AUTHENTICATING, true},
+		{STATE_INITIAL, EVENT_PROOF, STATE_INITIAL, false},
+		{STATE_INITIAL, EVENT_KEEPALIVE, STATE_INITIAL, false},
+		{STATE_INITIAL, EVENT_PAYLOAD, STATE_INITIAL, false},
+
+		{STATE_AUTHENTICATING, EVENT_HELLO, STATE_AUTHENTICATING, false},
+		{STATE_AUTHENTICATING, EVENT_PROOF, STATE_AUTHENTICATED, true},
+		{STATE_AUTHENTICATING, EVENT_KEEPALIVE, STATE_AUTHENTICATING, true},
+		{STATE_AUTHENTICATING, EVENT_PAYLOAD, STATE_AUTHENTICATING, false},
+
+		{STATE_AUTHENTICATED, EVENT_HELLO, STATE_AUTHENTICATED, false},
+		{STATE_AUTHENTICATED, EVENT_PROOF, STATE_AUTHENTICATED, false},
+		{STATE_AUTHENTICATED, EVENT_KEEPALIVE, STATE_AUTHENTICATED, true},
+		{STATE_AUTHENTICATED, EVENT_PAYLOAD, STATE_AUTHENTICATED, true},
+
+		{STATE_CLOSED, EVENT_HELLO, STATE_CLOSED, false},
+		{STATE_CLOSED, EVENT_PROOF, STATE_CLOSED, false},
+		{STATE_CLOSED, EVENT_KEEPALIVE, STATE_CLOSED, false},
+		{STATE_CLOSED, EVENT_PAYLOAD, STATE_CLOSED, false},
+	}
+
+	// Every transition in the table must be tested, so that adding one
+	// without a test here fails
+	allowed := 0
+	for _, test := range tests {
+		if test.ok {
+			allowed++
+		}
+	}
+	total := 0
+	for _, events := range connectionTransitions {
+		total += len(events)
+	}
+	if allowed != total {
+		t.Fatalf("%d transitions are tested but connectionTransitions has %d", allowed, total)
+	}
+
+	for _, test := range tests {
+		name := stateNames[test.state] + "/" + eventNames[test.event]
+		c := &connection{state: test.state}
+		next, err := c.nextState(test.event)
+		if test.ok && err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+		if next != test.next {
+			t.Errorf("%s: got state %s, want %s", name, stateNames[next], stateNames[test.next])
+		}
+		if c.getState() != test.state {
+			t.Errorf("%s: nextState changed the state to %s", name, stateNames[c.getState()])
+		}
+	}
+}
+
+func TestPayloadEvent(t *testing.T) {
+	tests := []struct {
+		name      string
+		payload   *sirenproto.Payload
+		encrypted bool
+		event     int
+		ok        bool
+	}{
+		// Only a HelloIAm may be sent unencrypted, everything else is
+		// rejected whatever state the connection is in
+		{"HelloIAm", &sirenproto.Payload{Contents: &sirenproto.Payload_HelloIAm{HelloIAm: &sirenproto.HelloIAm{}}}, false, EVENT_HELLO, true},
+		{"HelloProof", &sirenproto.Payload{Contents: &sirenproto.Payload_HelloProof{HelloProof: &sirenproto.HelloProof{}}}, false, EVENT_HELLO, false},
+		{"Ping", &sirenproto.Payload{Contents: &sirenproto.Payload_Ping{Ping: &sirenproto.Ping{}}}, false, EVENT_HELLO, false},
+		{"Pong", &sirenproto.Payload{Contents: &sirenproto.Payload_Pong{Pong: &sirenproto.Pong{}}}, false, EVENT_HELLO, false},
+		{"Ack", &sirenproto.Payload{Contents: &sirenproto.Payload_Ack{Ack: &sirenproto.Ack{}}}, false, EVENT_HELLO, false},
+		{"Message", &sirenproto.Payload{Contents: &sirenproto.Payload_Message{Message: &sirenproto.Message{}}}, false, EVENT_HELLO, false},
+		{"Login", &sirenproto.Payload{Contents: &sirenproto.Payload_Login{Login: &sirenproto.Login{}}}, false, EVENT_HELLO, false},
+		{"PublishPreKeys", &sirenproto.Payload{Contents: &sirenproto.Payload_PublishPreKeys{PublishPreKeys: &sirenproto.PublishPreKeys{}}}, false, EVENT_HELLO, false},
+		{"GroupUpdate", &sirenproto.Payload{Contents: &sirenproto.Payload_GroupUpdate{GroupUpdate: &sirenproto.GroupUpdate{}}}, false, EVENT_HELLO, false},
+		{"GroupRequest", &sirenproto.Payload{Contents: &sirenproto.Payload_GroupRequest{GroupRequest: &sirenproto.GroupRequest{}}}, false, EVENT_HELLO, false},
+		{"GroupState", &sirenproto.Payload{Contents: &sirenproto.Payload_GroupState{GroupState: &sirenproto.GroupState{}}}, false, EVENT_HELLO, false},
+		{"Register", &sirenproto.Payload{Contents: &sirenproto.Payload_Register{Register: &sirenproto.Register{}}}, false, EVENT_HELLO, false},
+		{"DeviceUpdate", &sirenproto.Payload{Contents: &sirenproto.Payload_DeviceUpdate{DeviceUpdate: &sirenproto.DeviceUpdate{}}}, false, EVENT_HELLO, false},
+		{"DeviceLink", &sirenproto.Payload{Contents: &sirenproto.Payload_DeviceLink{DeviceLink: &sirenproto.DeviceLink{}}}, false, EVENT_HELLO, false},
+		{"DirectoryRequest", &sirenproto.Payload{Contents: &sirenproto.Payload_DirectoryRequest{DirectoryRequest: &sirenproto.DirectoryRequest{}}}, false, EVENT_HELLO, false},
+		{"DirectoryResponse", &sirenproto.Payload{Contents: &sirenproto.Payload_DirectoryResponse{DirectoryResponse: &sirenproto.DirectoryResponse{}}}, false, EVENT_HELLO, false},
+		{"DeviceNotification", &sirenproto.Payload{Contents: &sirenproto.Payload_DeviceNotification{DeviceNotification: &sirenproto.DeviceNotification{}}}, false, EVENT_HELLO, false},
+		{"Receipt", &sirenproto.Payload{Contents: &sirenproto.Payload_Receipt{Receipt: &sirenproto.Receipt{}}}, false, EVENT_HELLO, false},
+		{"Presence", &sirenproto.Payload{Contents: &sirenproto.Payload_Presence{Presence: &sirenproto.Presence{}}}, false, EVENT_HELLO, false},
+		{"PresenceSubscribe", &sirenproto.Payload{Contents: &sirenproto.Payload_PresenceSubscribe{PresenceSubscribe: &sirenproto.PresenceSubscribe{}}}, false, EVENT_HELLO, false},
+		{"Typing", &sirenproto.Payload{Contents: &sirenproto.Payload_Typing{Typing: &sirenproto.Typing{}}}, false, EVENT_HELLO, false},
+		{"Empty", &sirenproto.Payload{}, false, EVENT_HELLO, false},
+
+		// Encrypted payloads always map to an event, and it's up to the
+		// state machine whether they are allowed
+		{"HelloProof", &sirenproto.Payload{Contents: &sirenproto.Payload_HelloProof{HelloProof: &sirenproto.HelloProof{}}}, true, EVENT_PROOF, true},
+		{"Ping", &sirenproto.Payload{Contents: &sirenproto.Payload_Ping{Ping: &sirenproto.Ping{}}}, true, EVENT_KEEPALIVE, true},
+		{"Pong", &sirenproto.Payload{Contents: &sirenproto.Payload_Pong{Pong: &sirenproto.Pong{}}}, true, EVENT_KEEPALIVE, true},
+		{"HelloIAm", &sirenproto.Payload{Contents: &sirenproto.Payload_HelloIAm{HelloIAm: &sirenproto.HelloIAm{}}}, true, EVENT_PAYLOAD, true},
+		{"Message", &sirenproto.Payload{Contents: &sirenproto.Payload_Message{Message: &sirenproto.Message{}}}, true, EVENT_PAYLOAD, true},
+		{"Login", &sirenproto.Payload{Contents: &sirenproto.Payload_Login{Login: &sirenproto.Login{}}}, true, EVENT_PAYLOAD, true},
+	}
+
+	for _, test := range tests {
+		event, ok := payloadEvent(test.payload, test.encrypted)
+		if ok != test.ok {
+			t.Errorf("%s (encrypted %v): got ok %v, want %v", test.name, test.encrypted, ok, test.ok)
+			continue
+		}
+		if ok && event != test.event {
+			t.Errorf("%s (encrypted %v): got event %s, want %s", test.name, test.encrypted,
+				eventNames[event], eventNames[test.event])
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package siren
+
+import "crypto/tls"
+import "crypto/x509"
+import "io/ioutil"
+import "errors"
+
+// The TLS configuration for the server. The certificates are used by any
+// listeners with a "tls://" or "wss://" address. When enabled, outgoing
+// federation connections will also be made using TLS. The Siren packet
+// protocol itself is unchanged - TLS simply wraps the existing connection,
+// so that the HelloIAm handshake and packet metadata are no longer visible
+// to observers.
+type TLSConfig struct {
+	Enabled bool
+	// One or more certificates to present to the remote side. When more than
+	// one is given (i.e. one for each of the LocalDomains), the certificate is
+	// selected using the server name (SNI) requested by the remote side
+	Certificates []TLSCertificate
+	// The CA certificates used to verify the certificates of remote servers
+	// when making outgoing federation connections. If empty then the system
+	// roots are used
+	RootCAFile string
+	// The CA certificates used to verify client certificates presented by
+	// remote servers on incoming federation connections. If empty then the
+	// system roots are used
+	ClientCAFile string
+	// If true then incoming server-to-server connections must present a valid
+	// client certificate, otherwise they will be terminated. Client-to-server
+	// connections are never required to present a client certificate
+	RequireS2SClientCertificate bool
+}
+
+// A certificate and private key pair, in PEM format, loaded from files.
+type TLSCertificate struct {
+	CertificateFile string
+	KeyFile         string
+}
+
+func (t *TLSConfig) serverConfig() (*tls.Config, error) {
+	certificates, err := t.loadCertificates()
+	if err != nil {
+		return nil, err
+	}
+	if len(certificates) == 0 {
+		return nil, errors.New("TLS is enabled but no certificates were given")
+	}
+	config := &tls.Config{
+		Certificates: certificates,
+		MinVersion:   tls.VersionTLS12,
+		// Clients won't present a certificate, so we can only ask for one. We
+		// check if the certificate is required once we know the connection type
+		ClientAuth: tls.VerifyClientCertIfGiven,
+	}
+	if t.ClientCAFile != "" {
+		if config.ClientCAs, err = loadCertificatePool(t.ClientCAFile); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+func (t *TLSConfig) clientConfig() (*tls.Config, error) {
+	certificates, err := t.loadCertificates()
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: certificates,
+		MinVersion:   tls.VersionTLS12,
+	}
+	if t.RootCAFile != "" {
+		if config.RootCAs, err = loadCertificatePool(t.RootCAFile); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+func (t *TLSConfig) loadCertificates() ([]tls.Certificate, error) {
+	var certificates []tls.Certificate
+	for _, c := range t.Certificates {
+		certificate, err := tls.LoadX509KeyPair(c.CertificateFile, c.KeyFile)
+		if err != nil {
+			return nil, errors.New("Unable to load certificate " + c.CertificateFile + ": " + err.Error())
+		}
+		certificates = append(certificates, certificate)
+	}
+	return certificates, nil
+}
+
+func loadCertificatePool(file string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.New("Unable to read CA file " + file + ": " + err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("No valid certificates found in CA file " + file)
+	}
+	return pool, nil
+}
+
+func hasVerifiedPeerCertificate(conn packetConn) bool {
+	// Only TLS connections can have peer certificates. The handshake has
+	// already completed by the time that we have read anything from the
+	// connection, so the connection state is complete
+	tlsconn, ok := conn.netConn().(*tls.Conn)
+	if !ok {
+		return false
+	}
+	return len(tlsconn.ConnectionState().VerifiedChains) > 0
+}
+
+// Checks that the verified certificate presented by the remote side is valid
+// for all of the given domains.
+func verifyPeerDomains(conn packetConn, domains []string) error {
+	tlsconn, ok := conn.netConn().(*tls.Conn)
+	if !ok {
+		return errors.New("No TLS certificate was presented")
+	}
+	chains := tlsconn.ConnectionState().VerifiedChains
+	if len(chains) == 0 {
+		return errors.New("No TLS certificate was presented")
+	}
+	for _, domain := range domains {
+		if err := chains[0][0].VerifyHostname(domain); err != nil {
+			return errors.New("TLS certificate isn't valid for " + domain)
+		}
+	}
+	return nil
+}
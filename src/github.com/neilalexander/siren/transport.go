@@ -0,0 +1,162 @@
+package siren
+
+import "io"
+import "net"
+import "sync"
+import "time"
+import "errors"
+import "strings"
+import "encoding/binary"
+
+// A transport knows how to dial and listen for connections using a given
+// URI scheme, i.e. "tcp://" or "ws://". Transports produce packetConns,
+// which carry whole sirenproto.Packets, so that the read and write threads
+// don't need to know anything about the underlying connection.
+type transport interface {
+	dial(r *router, address string, serverName string) (packetConn, error)
+	listen(r *router, address string) (packetListener, error)
+}
+
+// A packetListener accepts incoming packetConns from a transport.
+type packetListener interface {
+	accept() (packetConn, error)
+	close() error
+}
+
+// A packetConn is a connection which sends and receives whole packets. Each
+// call to readPacket returns exactly one packet and each call to writePacket
+// sends exactly one packet.
+type packetConn interface {
+	readPacket() ([]byte, error)
+	writePacket(packet []byte) error
+	close() error
+	remoteAddr() net.Addr
+	// Returns the underlying net.Conn, i.e. so that the TLS state can be
+	// inspected
+	netConn() net.Conn
+}
+
+// The largest packet that can be sent or received on any connection. Clients
+// are held to the MaximumMessageSize from the ServerConfig, which is checked
+// by the read thread, but packets built by servers, i.e. directory responses
+// carrying prekey bundles, can be much larger.
+const maximumPacketSize = 1048576
+
+var errPacketTooLarge = errors.New("Packet exceeds maximum packet size")
+
+// How long to wait when dialing a connection, including any TLS or WebSocket
+// handshake. Federation connections are dialed on behalf of whoever caused
+// them, so a remote server that never finishes the handshake mustn't be able
+// to hold them up for good. This is a variable so that tests can shorten it.
+var dialTimeout = 10 * time.Second
+
+var transportsMutex sync.RWMutex
+var transports = make(map[string]transport)
+
+// Registers a transport for the given URI scheme. Transports normally call
+// this from an init function.
+func registerTransport(scheme string, t transport) {
+	transportsMutex.Lock()
+	defer transportsMutex.Unlock()
+	transports[scheme] = t
+}
+
+// Splits a URI like "tcp://0.0.0.0:9989" into the transport that handles
+// the scheme and the remaining address.
+func lookupTransport(uri string) (transport, string, error) {
+	parts := strings.SplitN(uri, "://", 2)
+	if len(parts) != 2 {
+		return nil, "", errors.New("Invalid transport URI " + uri)
+	}
+	transportsMutex.RLock()
+	defer transportsMutex.RUnlock()
+	t, ok := transports[parts[0]]
+	if !ok {
+		return nil, "", errors.New("Unknown transport scheme " + parts[0])
+	}
+	return t, parts[1], nil
+}
+
+func (r *router) dial(uri string, serverName string) (packetConn, error) {
+	t, address, err := lookupTransport(uri)
+	if err != nil {
+		return nil, err
+	}
+	return t.dial(r, address, serverName)
+}
+
+func (r *router) listen(uri string) (packetListener, error) {
+	t, address, err := lookupTransport(uri)
+	if err != nil {
+		return nil, err
+	}
+	return t.listen(r, address)
+}
+
+// The streamConn carries packets over a stream-oriented net.Conn, such as
+// TCP, TLS or a Unix domain socket. A stream has no packet boundaries of its
+// own, so each packet is prefixed with its length as a 32-bit big-endian
+// integer.
+type streamConn struct {
+	conn net.Conn
+}
+
+func (s *streamConn) readPacket() ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(s.conn, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:])
+	if length > maximumPacketSize {
+		return nil, errPacketTooLarge
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(s.conn, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (s *streamConn) writePacket(packet []byte) error {
+	if len(packet) > maximumPacketSize {
+		return errPacketTooLarge
+	}
+	// Write the length and the packet in a single call so that they can't be
+	// split up by another writer
+	buf := make([]byte, 4+len(packet))
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(packet)))
+	copy(buf[4:], packet)
+	_, err := s.conn.Write(buf)
+	return err
+}
+
+func (s *streamConn) close() error {
+	return s.conn.Close()
+}
+
+func (s *streamConn) remoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *streamConn) netConn() net.Conn {
+	return s.conn
+}
+
+// The streamListener accepts streamConns from a net.Listener.
+type streamListener struct {
+	listener net.Listener
+}
+
+func (s *streamListener) accept() (packetConn, error) {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &streamConn{
+		conn: conn,
+	}, nil
+}
+
+func (s *streamListener) close() error {
+	return s.listener.Close()
+}
@@ -0,0 +1,82 @@
+package siren
+
+import "net"
+import "sync"
+import "errors"
+
+func init() {
+	registerTransport("pipe", &pipeTransport{
+		listeners: make(map[string]*pipeListener),
+	})
+}
+
+// The pipeTransport connects Server instances within the same process using
+// in-memory pipes rather than sockets, which is mostly useful for tests. A
+// server listening on "pipe://a" can be reached by dialling "pipe://a".
+type pipeTransport struct {
+	mutex     sync.Mutex
+	listeners map[string]*pipeListener
+}
+
+func (t *pipeTransport) dial(r *router, address string, serverName string) (packetConn, error) {
+	t.mutex.Lock()
+	listener, ok := t.listeners[address]
+	t.mutex.Unlock()
+	if !ok {
+		return nil, errors.New("Nothing is listening on pipe " + address)
+	}
+	local, remote := net.Pipe()
+	select {
+	case listener.incoming <- remote:
+	case <-listener.closed:
+		return nil, errors.New("Nothing is listening on pipe " + address)
+	}
+	return &streamConn{
+		conn: local,
+	}, nil
+}
+
+func (t *pipeTransport) listen(r *router, address string) (packetListener, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, ok := t.listeners[address]; ok {
+		return nil, errors.New("Something is already listening on pipe " + address)
+	}
+	listener := &pipeListener{
+		transport: t,
+		address:   address,
+		incoming:  make(chan net.Conn),
+		closed:    make(chan struct{}),
+	}
+	t.listeners[address] = listener
+	return listener, nil
+}
+
+type pipeListener struct {
+	transport *pipeTransport
+	address   string
+	incoming  chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (p *pipeListener) accept() (packetConn, error) {
+	select {
+	case conn := <-p.incoming:
+		return &streamConn{
+			conn: conn,
+		}, nil
+	case <-p.closed:
+		return nil, errors.New("Pipe listener closed")
+	}
+}
+
+func (p *pipeListener) close() error {
+	p.closeOnce.Do(func() {
+		p.transport.mutex.Lock()
+		delete(p.transport.listeners, p.address)
+		p.transport.mutex.Unlock()
+		close(p.closed)
+	})
+	return nil
+}
@@ -0,0 +1,80 @@
+package siren
+
+import "os"
+import "net"
+import "time"
+import "crypto/tls"
+import "errors"
+
+func init() {
+	registerTransport("tcp", &netTransport{network: "tcp"})
+	registerTransport("tcp4", &netTransport{network: "tcp4"})
+	registerTransport("tcp6", &netTransport{network: "tcp6"})
+	registerTransport("unix", &netTransport{network: "unix"})
+	registerTransport("tls", &netTransport{network: "tcp", tls: true})
+}
+
+// The netTransport carries packets over a stream socket from the net
+// package, optionally wrapped in TLS using the certificates from the
+// TLSConfig.
+type netTransport struct {
+	network string
+	tls     bool
+}
+
+func (t *netTransport) dial(r *router, address string, serverName string) (packetConn, error) {
+	dialer := net.Dialer{Timeout: dialTimeout}
+	conn, err := dialer.Dial(t.network, address)
+	if err != nil {
+		return nil, err
+	}
+	// If this is a TLS transport then perform the TLS handshake now. We
+	// expect the remote side to present a certificate for the server name,
+	// i.e. the federation domain rather than the SRV target
+	if t.tls {
+		if r.tlsClient == nil {
+			conn.Close()
+			return nil, errors.New("TLS is not configured")
+		}
+		config := r.tlsClient.Clone()
+		config.ServerName = serverName
+		tlsconn := tls.Client(conn, config)
+		conn.SetDeadline(time.Now().Add(dialTimeout))
+		if err := tlsconn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		conn = tlsconn
+	}
+	return &streamConn{
+		conn: conn,
+	}, nil
+}
+
+func (t *netTransport) listen(r *router, address string) (packetListener, error) {
+	if t.network == "unix" {
+		// If the socket file was left behind by a previous run then remove
+		// it, otherwise we won't be able to listen on it again. We only do
+		// this if the file is actually a socket
+		if info, err := os.Lstat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+	listener, err := net.Listen(t.network, address)
+	if err != nil {
+		return nil, err
+	}
+	// If this is a TLS transport then wrap the listener so that all incoming
+	// connections must complete a TLS handshake
+	if t.tls {
+		if r.tlsServer == nil {
+			listener.Close()
+			return nil, errors.New("TLS is not configured")
+		}
+		listener = tls.NewListener(listener, r.tlsServer)
+	}
+	return &streamListener{
+		listener: listener,
+	}, nil
+}
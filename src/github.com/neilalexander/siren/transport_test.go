@@ -0,0 +1,56 @@
+package siren
+
+import "net"
+import "time"
+import "testing"
+import "crypto/tls"
+
+func TestDialHandshakeTimeout(t *testing.T) {
+	timeout := dialTimeout
+	dialTimeout = 200 * time.Millisecond
+	defer func() { dialTimeout = timeout }()
+
+	// Accept connections but never say anything, so that the TLS handshake
+	// never finishes
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	transportsMutex.RLock()
+	transport := transports["tls"]
+	transportsMutex.RUnlock()
+	r := &router{tlsClient: &tls.Config{}}
+	done := make(chan error, 1)
+	go func() {
+		conn, err := transport.dial(r, listener.Addr().String(), "siren.example")
+		if conn != nil {
+			conn.close()
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatalf("Handshake succeeded with a server that never answered")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Dial didn't give up on a handshake that never finished")
+	}
+}
@@ -0,0 +1,167 @@
+package siren
+
+import "net"
+import "sync"
+import "errors"
+import "strings"
+import "net/http"
+
+import "github.com/gorilla/websocket"
+
+func init() {
+	registerTransport("ws", &webSocketTransport{})
+	registerTransport("wss", &webSocketTransport{tls: true})
+}
+
+// The webSocketTransport carries packets over WebSockets, so that browser
+// based clients can connect. Each sirenproto.Packet is carried in a single
+// binary frame. Addresses take the form "host:port/path", where the path is
+// optional and defaults to "/".
+type webSocketTransport struct {
+	tls bool
+}
+
+func splitWebSocketAddress(address string) (string, string) {
+	if i := strings.Index(address, "/"); i >= 0 {
+		return address[:i], address[i:]
+	}
+	return address, "/"
+}
+
+func (t *webSocketTransport) dial(r *router, address string, serverName string) (packetConn, error) {
+	dialer := websocket.Dialer{HandshakeTimeout: dialTimeout}
+	scheme := "ws://"
+	if t.tls {
+		if r.tlsClient == nil {
+			return nil, errors.New("TLS is not configured")
+		}
+		dialer.TLSClientConfig = r.tlsClient.Clone()
+		dialer.TLSClientConfig.ServerName = serverName
+		scheme = "wss://"
+	}
+	conn, _, err := dialer.Dial(scheme+address, nil)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadLimit(maximumPacketSize)
+	return &webSocketConn{conn: conn}, nil
+}
+
+func (t *webSocketTransport) listen(r *router, address string) (packetListener, error) {
+	hostport, path := splitWebSocketAddress(address)
+	if t.tls && r.tlsServer == nil {
+		return nil, errors.New("TLS is not configured")
+	}
+
+	listener, err := net.Listen("tcp", hostport)
+	if err != nil {
+		return nil, err
+	}
+
+	wsl := &webSocketListener{
+		incoming: make(chan *webSocketConn),
+		closed:   make(chan struct{}),
+	}
+
+	upgrader := websocket.Upgrader{
+		// Browser clients may be served from anywhere, and all of the
+		// security happens inside the packet protocol, so accept any origin
+		CheckOrigin: func(*http.Request) bool { return true },
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(w, req, nil)
+		if err != nil {
+			r.server.log.debug("Error upgrading WebSocket connection", LogField{"remote", req.RemoteAddr}, LogField{"error", err})
+			return
+		}
+		conn.SetReadLimit(maximumPacketSize)
+		select {
+		case wsl.incoming <- &webSocketConn{conn: conn}:
+		case <-wsl.closed:
+			conn.Close()
+		}
+	})
+
+	// If this is a secure WebSocket transport then serve over TLS
+	wsl.server = &http.Server{Handler: mux}
+	go func() {
+		var err error
+		if t.tls {
+			wsl.server.TLSConfig = r.tlsServer
+			err = wsl.server.ServeTLS(listener, "", "")
+		} else {
+			err = wsl.server.Serve(listener)
+		}
+		if err != http.ErrServerClosed {
+			r.server.log.error("Stopped listening for WebSockets", LogField{"address", address}, LogField{"error", err})
+		}
+		wsl.close()
+	}()
+
+	return wsl, nil
+}
+
+type webSocketListener struct {
+	server    *http.Server
+	incoming  chan *webSocketConn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (w *webSocketListener) accept() (packetConn, error) {
+	select {
+	case conn := <-w.incoming:
+		return conn, nil
+	case <-w.closed:
+		return nil, errors.New("WebSocket listener closed")
+	}
+}
+
+func (w *webSocketListener) close() error {
+	var err error
+	w.closeOnce.Do(func() {
+		close(w.closed)
+		err = w.server.Close()
+	})
+	return err
+}
+
+// The webSocketConn carries each packet in a single binary frame.
+type webSocketConn struct {
+	conn       *websocket.Conn
+	writeMutex sync.Mutex
+}
+
+func (w *webSocketConn) readPacket() ([]byte, error) {
+	messageType, packet, err := w.conn.ReadMessage()
+	if err == websocket.ErrReadLimit {
+		return nil, errPacketTooLarge
+	}
+	if err != nil {
+		return nil, err
+	}
+	if messageType != websocket.BinaryMessage {
+		return nil, errors.New("Unexpected non-binary WebSocket frame")
+	}
+	return packet, nil
+}
+
+func (w *webSocketConn) writePacket(packet []byte) error {
+	w.writeMutex.Lock()
+	defer w.writeMutex.Unlock()
+	return w.conn.WriteMessage(websocket.BinaryMessage, packet)
+}
+
+func (w *webSocketConn) close() error {
+	return w.conn.Close()
+}
+
+func (w *webSocketConn) remoteAddr() net.Addr {
+	return w.conn.RemoteAddr()
+}
+
+func (w *webSocketConn) netConn() net.Conn {
+	return w.conn.UnderlyingConn()
+}
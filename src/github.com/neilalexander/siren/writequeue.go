@@ -0,0 +1,171 @@
+package siren
+
+import "sync"
+import "errors"
+
+import "github.com/neilalexander/siren/sirenproto"
+
+// Payloads waiting to be written to a connection are queued with one of
+// these priorities. Control traffic, such as handshakes, pings, acks and
+// directory responses, is always written before message traffic, so that a
+// busy connection still answers pings and requests promptly.
+const (
+	PRIORITY_CONTROL = iota
+	PRIORITY_MESSAGE = iota
+	PRIORITY_COUNT   = iota
+)
+
+var errQueueFull = errors.New("Write queue is full")
+var errQueueClosed = errors.New("Connection is closed")
+
+var priorityLabels = [PRIORITY_COUNT]string{"control", "message"}
+
+// Returns the priority that a payload should be queued with.
+func payloadPriority(payload *sirenproto.Payload) int {
+	switch payload.Contents.(type) {
+	case *sirenproto.Payload_Message, *sirenproto.Payload_Receipt,
+		*sirenproto.Payload_Presence, *sirenproto.Payload_Typing:
+		return PRIORITY_MESSAGE
+	default:
+		return PRIORITY_CONTROL
+	}
+}
+
+// A payload waiting to be written. If failed is set then it is called if
+// the payload can't be sent because the connection didn't authenticate in
+// time, so that whoever asked for it can be told.
+type queuedPayload struct {
+	payload   *sirenproto.Payload
+	encrypted bool
+	failed    func()
+}
+
+// The writeQueue holds the payloads waiting to be written to a connection
+// by its write thread. Queueing never blocks: if a queue is full then the
+// payload is refused instead, so that a slow remote side can't hold up the
+// read thread or any other connection's threads. The ready channel is
+// signalled whenever something is queued, to wake up the write thread.
+type writeQueue struct {
+	mutex  sync.Mutex
+	queues [PRIORITY_COUNT][]queuedPayload
+	limits [PRIORITY_COUNT]int
+	ready  chan struct{}
+	closed bool
+}
+
+func newWriteQueue(control, message int) *writeQueue {
+	q := &writeQueue{
+		ready: make(chan struct{}, 1),
+	}
+	q.limits[PRIORITY_CONTROL] = control
+	q.limits[PRIORITY_MESSAGE] = message
+	return q
+}
+
+// Queues a payload with the given priority. Returns an error if the payload
+// wasn't queued, either because the queue for that priority is full or
+// because the connection has closed.
+func (q *writeQueue) push(priority int, p queuedPayload) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return errQueueClosed
+	}
+	if q.limits[priority] > 0 && len(q.queues[priority]) >= q.limits[priority] {
+		return errQueueFull
+	}
+	q.queues[priority] = append(q.queues[priority], p)
+	q.wake()
+	return nil
+}
+
+// Takes the next payload to be written, highest priority first.
+func (q *writeQueue) pop() (queuedPayload, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for priority := range q.queues {
+		if len(q.queues[priority]) > 0 {
+			p := q.queues[priority][0]
+			q.queues[priority][0] = queuedPayload{}
+			q.queues[priority] = q.queues[priority][1:]
+			return p, true
+		}
+	}
+	return queuedPayload{}, false
+}
+
+// Refuses anything queued later, once the connection has closed. Message
+// traffic that is still queued is thrown away, but the control traffic is
+// returned so that it can still be sent, as it usually includes the Ack
+// telling the remote side why the connection is being closed.
+func (q *writeQueue) close() []queuedPayload {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.closed = true
+	control := q.queues[PRIORITY_CONTROL]
+	for priority := range q.queues {
+		q.queues[priority] = nil
+	}
+	return control
+}
+
+// Wakes up the write thread even if nothing new has been queued, i.e. so
+// that it sends the payloads it was holding once the connection has been
+// authenticated.
+func (q *writeQueue) wake() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Returns how many payloads are waiting with each priority.
+func (q *writeQueue) depth() [PRIORITY_COUNT]int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	var depth [PRIORITY_COUNT]int
+	for priority := range q.queues {
+		depth[priority] = len(q.queues[priority])
+	}
+	return depth
+}
+
+// Queues a payload to be encrypted and sent to the remote side. If the
+// queue is full then the overflow policy applies: message traffic is
+// dropped and false is returned so that the caller can deal with it, but
+// if control traffic can't be queued then the remote side has stopped
+// reading altogether, so the connection is closed.
+func (c *connection) queueEncrypted(payload *sirenproto.Payload) bool {
+	return c.queuePayload(queuedPayload{payload: payload, encrypted: true})
+}
+
+// Queues a payload to be encrypted and sent to the remote side, like
+// queueEncrypted, but calls failed if the connection doesn't authenticate
+// in time for the payload to be sent.
+func (c *connection) queueRequest(payload *sirenproto.Payload, failed func()) bool {
+	return c.queuePayload(queuedPayload{payload: payload, encrypted: true, failed: failed})
+}
+
+// Queues a payload to be sent to the remote side without encryption, with
+// the same overflow policy as queueEncrypted.
+func (c *connection) queueUnencrypted(payload *sirenproto.Payload) bool {
+	return c.queuePayload(queuedPayload{payload: payload})
+}
+
+func (c *connection) queuePayload(p queuedPayload) bool {
+	priority := payloadPriority(p.payload)
+	switch c.queue.push(priority, p) {
+	case nil:
+		return true
+	case errQueueClosed:
+		return false
+	}
+	c.metrics.writeQueueDrops.inc(priorityLabels[priority])
+	if priority == PRIORITY_CONTROL {
+		c.logger().warning("Write queue is full, closing connection", LogField{"type", payloadType(p.payload)})
+		c.connection.close()
+	} else {
+		c.logger().debug("Write queue is full, dropping payload", LogField{"type", payloadType(p.payload)})
+	}
+	return false
+}
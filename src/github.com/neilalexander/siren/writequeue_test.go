@@ -0,0 +1,131 @@
+package siren
+
+import "net"
+import "testing"
+
+import "github.com/neilalexander/siren/sirenproto"
+
+// A packetConn that only records whether it has been closed.
+type closeRecorder struct {
+	closed int
+}
+
+func (c *closeRecorder) readPacket() ([]byte, error)     { return nil, errQueueClosed }
+func (c *closeRecorder) writePacket(packet []byte) error { return nil }
+func (c *closeRecorder) close() error                    { c.closed++; return nil }
+func (c *closeRecorder) remoteAddr() net.Addr            { return nil }
+func (c *closeRecorder) netConn() net.Conn               { return nil }
+
+func newTestQueueConnection(s *Server, control, message int) (*connection, *closeRecorder) {
+	conn := &closeRecorder{}
+	return &connection{
+		log:        s.log,
+		queue:      newWriteQueue(control, message),
+		metrics:    &s.metrics,
+		connection: conn,
+	}, conn
+}
+
+func testMessage(id string) *sirenproto.Payload {
+	return &sirenproto.Payload{Contents: &sirenproto.Payload_Message{Message: &sirenproto.Message{MessageID: id}}}
+}
+
+func testAck(text string) *sirenproto.Payload {
+	return &sirenproto.Payload{Contents: &sirenproto.Payload_Ack{Ack: &sirenproto.Ack{Text: text}}}
+}
+
+func TestWriteQueuePriority(t *testing.T) {
+	s := newTestServer(t, "test.com")
+	c, _ := newTestQueueConnection(s, 0, 0)
+	for _, payload := range []*sirenproto.Payload{
+		testMessage("first"), testAck("first"), testMessage("second"), testAck("second"),
+	} {
+		if !c.queueEncrypted(payload) {
+			t.Fatalf("Could not queue %v", payload)
+		}
+	}
+
+	// Control traffic comes out first, and each priority stays in order
+	want := []*sirenproto.Payload{testAck("first"), testAck("second"), testMessage("first"), testMessage("second")}
+	for i, w := range want {
+		p, ok := c.queue.pop()
+		if !ok {
+			t.Fatalf("Queue ran out after %d payloads, want %d", i, len(want))
+		}
+		if p.payload.String() != w.String() {
+			t.Errorf("Payload %d was %v, want %v", i, p.payload, w)
+		}
+	}
+	if _, ok := c.queue.pop(); ok {
+		t.Errorf("Queue has more payloads than were queued")
+	}
+}
+
+func TestWriteQueueOverflow(t *testing.T) {
+	tests := []struct {
+		name    string
+		control int
+		message int
+		payload *sirenproto.Payload
+		closed  bool
+	}{
+		{"message queue full", 0, 2, testMessage("overflow"), false},
+		{"control queue full", 2, 0, testAck("overflow"), true},
+	}
+	for _, test := range tests {
+		s := newTestServer(t, "test.com")
+		c, conn := newTestQueueConnection(s, test.control, test.message)
+		for i := 0; i < 2; i++ {
+			if !c.queueEncrypted(test.payload) {
+				t.Fatalf("%s: could not queue payload %d before the queue was full", test.name, i)
+			}
+		}
+		if c.queueEncrypted(test.payload) {
+			t.Errorf("%s: queued a payload when the queue was full", test.name)
+		}
+		if closed := conn.closed > 0; closed != test.closed {
+			t.Errorf("%s: got connection closed %v, want %v", test.name, closed, test.closed)
+		}
+		if depth := c.queue.depth(); depth[payloadPriority(test.payload)] != 2 {
+			t.Errorf("%s: queue depth is %v after overflowing", test.name, depth)
+		}
+	}
+
+	// A full message queue doesn't hold up control traffic
+	s := newTestServer(t, "test.com")
+	c, conn := newTestQueueConnection(s, 0, 1)
+	c.queueEncrypted(testMessage("first"))
+	c.queueEncrypted(testMessage("dropped"))
+	if !c.queueEncrypted(testAck("control")) {
+		t.Errorf("Control traffic was refused because the message queue was full")
+	}
+	if conn.closed > 0 {
+		t.Errorf("Connection was closed because the message queue was full")
+	}
+}
+
+func TestWriteQueueClose(t *testing.T) {
+	s := newTestServer(t, "test.com")
+	c, conn := newTestQueueConnection(s, 0, 0)
+	c.queueEncrypted(testMessage("message"))
+	c.queueEncrypted(testAck("goodbye"))
+
+	// Control traffic is kept so that the reason for closing can still be
+	// sent, but messages are thrown away
+	remaining := c.queue.close()
+	if len(remaining) != 1 || remaining[0].payload.String() != testAck("goodbye").String() {
+		t.Fatalf("Closing the queue returned %v, want only the control traffic", remaining)
+	}
+	if depth := c.queue.depth(); depth != [PRIORITY_COUNT]int{} {
+		t.Errorf("Queue depth is %v after closing", depth)
+	}
+
+	// Anything queued afterwards is refused without closing the connection
+	// again
+	if c.queueEncrypted(testMessage("late")) || c.queueEncrypted(testAck("late")) {
+		t.Errorf("Queued a payload after the queue was closed")
+	}
+	if conn.closed > 0 {
+		t.Errorf("Connection was closed because the queue was closed")
+	}
+}